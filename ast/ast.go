@@ -15,6 +15,11 @@ type Node struct {
 	Children   []Node // TODO: Should this be a slice of pointers of Nodes?
 	TokenStart token.Token
 	Symbols    *SymTable // Only blocks get a symbol table.
+	ValueType  string    // Full type name of an expression, filled in by the type checker.
+	TypeName   string    // Like ValueType, but with the ? of types that can be nil, for tools that show types.
+	// Names of the annotations like @unused written before a declaration or statement.
+	Annotations []string
+	Doc         string // Text of the /// comments before a function, class, member or constant, one per line.
 }
 
 // Predefined AST node types.
@@ -32,7 +37,7 @@ const (
 	CAST    = "CAST"    // Twp children.
 	VARDECL = "VARDECL" // Variable children. Name and type for each variable, then expression.
 	// TODO: Consider making the third child a VARASSIGN.
-	VARTYPE   = "VARTYPE"   // Variable children. Name and optionally a child for each inner type.
+	VARTYPE   = "VARTYPE"   // Variable children. Name and optionally a child for each inner type. Nullable types are named "?".
 	VARASSIGN = "VARASSIGN" // Variable children children. One or more Varref and one expression.
 	FUNCDECL  = "FUNCDECL"  // Four children. Name, paramlist for params, returnlist for return, block.
 	PARAMLIST = "PARAMLIST" // Variable children.
@@ -51,13 +56,58 @@ const (
 	INT      = "INT"      // Leaf.
 	FLOAT    = "FLOAT"    // Leaf.
 	STRING   = "STRING"   // Leaf.
+	CHAR     = "CHAR"     // Leaf. The literal is the character.
 	BOOL     = "BOOL"     // Leaf.
 	NIL      = "NIL"      // Leaf.
 	SELF     = "SELF"     // Leaf.
 	VOID     = "VOID"     // Leaf.
 	IDENT    = "IDENT"    // Leaf.
+
+	// Variable children. STRING segments alternating with expressions, starting and ending with a segment.
+	INTERPOLATION = "INTERPOLATION"
 )
 
+// HasAnnotation reports whether a declaration or statement is marked with @name.
+func (node *Node) HasAnnotation(name string) bool {
+	for _, annotation := range node.Annotations {
+		if annotation == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDiscard reports whether an assignment target is _, which throws the value away.
+func IsDiscard(node *Node) bool {
+	for node.Type == EXPRESSION {
+		node = &node.Children[0]
+	}
+	return node.Type == VARREF && node.Children[0].TokenStart.Literal == "_"
+}
+
+// IsCompound reports whether an assignment is like x += y or x++, whose expression is x + y or x + 1 with the
+// target as its left operand.
+func IsCompound(node *Node) bool {
+	t := node.TokenStart.Type
+	return node.Type == VARASSIGN && (t == token.OPASSIGN || t == token.INC || t == token.DEC)
+}
+
+// Lines returns the first and last source lines of the tokens under a node. Operators and wrappers have no
+// line of their own, so a node without tokens gives zeros.
+func Lines(node *Node) (int, int) {
+	first, last := node.TokenStart.Line, node.TokenStart.Line
+	for i := range node.Children {
+		childFirst, childLast := Lines(&node.Children[i])
+		if childFirst != 0 && (first == 0 || childFirst < first) {
+			first = childFirst
+		}
+		if childLast > last {
+			last = childLast
+		}
+	}
+	return first, last
+}
+
 // Print AST.
 func Print(node Node) {
 	printUtil(node, 0)
@@ -80,3 +130,19 @@ func printUtil(node Node, depth int) {
 		printUtil(c, depth+1)
 	}
 }
+
+// SplitTemplate splits a format template at each % placeholder, replacing %% with a percent sign.
+func SplitTemplate(template string) []string {
+	segments := []string{""}
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			segments[len(segments)-1] += template[i : i+1]
+		} else if i+1 < len(template) && template[i+1] == '%' {
+			segments[len(segments)-1] += "%"
+			i++
+		} else {
+			segments = append(segments, "")
+		}
+	}
+	return segments
+}
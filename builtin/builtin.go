@@ -13,6 +13,7 @@ import (
 func Init(node *ast.Node) *ast.Node {
 
 	node = createBuiltin("list", node)
+	node = createBuiltin("string", node)
 	node = createBuiltin("stl", node)
 
 	return node
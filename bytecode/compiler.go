@@ -0,0 +1,253 @@
+package bytecode
+
+import (
+	"fmt"
+	"knox/ir"
+	"strings"
+)
+
+type loop struct {
+	breaks    []int // Operand offsets to patch with the loop end.
+	continues []int // Operand offsets to patch with the continue target.
+}
+
+type compiler struct {
+	prog      *Program
+	functions map[*ir.Func]int
+	classes   map[*ir.Class]int
+	fn        *Function
+	slots     map[*ir.Var]int
+	loops     []*loop
+	line      int
+}
+
+// Compile translates a program in IR form into bytecode.
+func Compile(p *ir.Program) *Program {
+	c := &compiler{
+		prog:      &Program{},
+		functions: make(map[*ir.Func]int),
+		classes:   make(map[*ir.Class]int),
+	}
+	for i, f := range p.Funcs {
+		c.functions[f] = i
+		c.prog.Functions = append(c.prog.Functions, Function{Name: f.Name, Params: len(f.Params), Locals: len(f.Params) + len(f.Locals)})
+	}
+	for i, class := range p.Classes {
+		c.classes[class] = i
+		compiled := Class{Name: class.Name, Init: c.functions[class.Init], Methods: make(map[string]int)}
+		for _, field := range class.Fields {
+			compiled.Fields = append(compiled.Fields, field.Name)
+		}
+		for name, method := range class.Methods {
+			compiled.Methods[name] = c.functions[method]
+		}
+		c.prog.Classes = append(c.prog.Classes, compiled)
+	}
+	c.prog.Main = c.functions[p.Main]
+	for _, f := range p.Funcs {
+		c.function(f)
+	}
+	return c.prog
+}
+
+func abortMsg(line int, msg string) {
+	fmt.Printf("Bytecode error: %v. Line %v.\n", msg, line)
+	panic("Aborted.\n")
+}
+
+func (c *compiler) function(f *ir.Func) {
+	c.fn = &c.prog.Functions[c.functions[f]]
+	c.slots = make(map[*ir.Var]int)
+	for i, v := range append(append([]*ir.Var(nil), f.Params...), f.Locals...) {
+		c.slots[v] = i
+	}
+	c.loops = nil
+	c.line = f.Line
+	c.stmts(f.Body)
+	c.emit(RETURN, 0) // Implicit return for void functions.
+}
+
+func (c *compiler) stmts(stmts []ir.Stmt) {
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *ir.Instr:
+			c.instr(s)
+		case *ir.If:
+			c.value(s.Cond)
+			next := c.emitJump(JUMPIFFALSE)
+			c.stmts(s.Then)
+			if len(s.Else) > 0 {
+				end := c.emitJump(JUMP)
+				c.patch(next)
+				c.stmts(s.Else)
+				c.patch(end)
+			} else {
+				c.patch(next)
+			}
+		case *ir.Loop:
+			c.loops = append(c.loops, &loop{})
+			top := len(c.fn.Code)
+			c.stmts(s.Body)
+			post := len(c.fn.Code)
+			c.stmts(s.Post)
+			c.emit(JUMP, top)
+			l := c.loops[len(c.loops)-1]
+			for _, offset := range l.breaks {
+				c.patch(offset)
+			}
+			for _, offset := range l.continues {
+				c.patchTo(offset, post)
+			}
+			c.loops = c.loops[:len(c.loops)-1]
+		case *ir.Break:
+			l := c.loops[len(c.loops)-1]
+			l.breaks = append(l.breaks, c.emitJump(JUMP))
+		case *ir.Continue:
+			l := c.loops[len(c.loops)-1]
+			l.continues = append(l.continues, c.emitJump(JUMP))
+		case *ir.Return:
+			c.line = s.Line
+			for _, v := range s.Values {
+				c.value(v)
+			}
+			c.emit(RETURN, len(s.Values))
+		}
+	}
+}
+
+var opcodes = map[ir.Op]Opcode{
+	ir.Add: ADD, ir.Sub: SUB, ir.Mul: MUL, ir.Div: DIV, ir.Rem: MOD, ir.Concat: CONCAT,
+	ir.And: AND, ir.Or: OR, ir.Xor: XOR,
+	ir.Eq: EQ, ir.Ne: NOTEQ, ir.Lt: LT, ir.Le: LTEQ, ir.Gt: GT, ir.Ge: GTEQ,
+	ir.Neg: NEG, ir.Not: NOT, ir.Index: INDEX, ir.SetIndex: SETINDEX, ir.Iter: ITER,
+}
+
+// Operations whose operand is the type of their arguments, which they calculate in.
+var typed = map[ir.Op]bool{
+	ir.Add: true, ir.Sub: true, ir.Mul: true, ir.Div: true, ir.Rem: true, ir.Neg: true,
+	ir.Lt: true, ir.Le: true, ir.Gt: true, ir.Ge: true,
+}
+
+func (c *compiler) instr(in *ir.Instr) {
+	if in.Line != 0 {
+		c.line = in.Line
+	}
+	for _, arg := range in.Args {
+		c.value(arg)
+	}
+	switch in.Op {
+	case ir.Copy:
+	case ir.Convert:
+		c.emit(CAST, c.constant(in.Dst[0].Typ))
+	case ir.Shl:
+		c.emit(SHL, c.constant(in.Dst[0].Typ))
+	case ir.Shr:
+		c.emit(SHR, c.constant(in.Dst[0].Typ))
+	case ir.Compl:
+		c.emit(COMPL, c.constant(in.Dst[0].Typ))
+	case ir.Call:
+		c.emit(CALL, c.functions[in.Func])
+	case ir.Builtin:
+		dot := strings.Index(in.Name, ".")
+		if pkg := in.Name[:dot]; pkg == "list" || pkg == "map" || pkg == "string" {
+			c.emit(INVOKE, c.constant(in.Name[dot+1:]), len(in.Args)-1)
+		} else {
+			c.emit(BUILTIN, c.constant(in.Name), len(in.Args))
+		}
+	case ir.New:
+		c.emit(NEW, c.classes[in.Class])
+	case ir.GetField:
+		c.emit(GETFIELD, c.constant(in.Class.Fields[in.Field].Name))
+	case ir.SetField:
+		c.emit(SETFIELD, c.constant(in.Class.Fields[in.Field].Name))
+	case ir.NewList:
+		c.emit(LIST, len(in.Args))
+	case ir.NewMap:
+		c.emit(MAP)
+	case ir.Concat: // Joins the top two strings, so n parts take n-1.
+		for range in.Args[1:] {
+			c.emit(CONCAT)
+		}
+	default:
+		op, ok := opcodes[in.Op]
+		if !ok {
+			abortMsg(in.Line, "Unsupported instruction "+in.Op.String())
+		}
+		if typed[in.Op] {
+			c.emit(op, c.constant(in.Args[0].Type()))
+		} else {
+			c.emit(op)
+		}
+	}
+	// Results are on the stack in order, so store them in reverse.
+	for i := len(in.Dst) - 1; i >= 0; i-- {
+		c.emit(STORE, c.slots[in.Dst[i]])
+	}
+}
+
+// Push an operand.
+func (c *compiler) value(v ir.Value) {
+	switch v := v.(type) {
+	case *ir.Var:
+		c.emit(LOAD, c.slots[v])
+	case *ir.Const:
+		switch value := v.Value.(type) {
+		case nil:
+			c.emit(NIL)
+		case bool:
+			if value {
+				c.emit(TRUE)
+			} else {
+				c.emit(FALSE)
+			}
+		default:
+			c.emit(CONST, c.constant(value))
+		}
+	}
+}
+
+func (c *compiler) constant(value interface{}) int {
+	for i, existing := range c.prog.Constants {
+		if existing == value {
+			return i
+		}
+	}
+	c.prog.Constants = append(c.prog.Constants, value)
+	return len(c.prog.Constants) - 1
+}
+
+func (c *compiler) emit(op Opcode, operands ...int) int {
+	offset := len(c.fn.Code)
+	if len(c.fn.Lines) == 0 || c.fn.Lines[len(c.fn.Lines)-1].Line != c.line {
+		c.fn.Lines = append(c.fn.Lines, LineInfo{Offset: offset, Line: c.line})
+	}
+	c.fn.Code = append(c.fn.Code, byte(op))
+	for _, operand := range operands {
+		c.checkOperand(operand)
+		c.fn.Code = append(c.fn.Code, byte(operand>>8), byte(operand))
+	}
+	return offset
+}
+
+// Operands are 16 bits, which limits the constants, locals and code size of a function.
+func (c *compiler) checkOperand(operand int) {
+	if operand > 0xffff {
+		abortMsg(c.line, fmt.Sprintf("%v is too large for bytecode: %v doesn't fit in a 16-bit operand", c.fn.Name, operand))
+	}
+}
+
+// Emit a jump with a placeholder target and return the operand offset.
+func (c *compiler) emitJump(op Opcode) int {
+	return c.emit(op, 0xffff) + 1
+}
+
+// Point a jump at the next instruction.
+func (c *compiler) patch(offset int) {
+	c.patchTo(offset, len(c.fn.Code))
+}
+
+func (c *compiler) patchTo(offset int, target int) {
+	c.checkOperand(target)
+	c.fn.Code[offset] = byte(target >> 8)
+	c.fn.Code[offset+1] = byte(target)
+}
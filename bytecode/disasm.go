@@ -0,0 +1,78 @@
+package bytecode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Disassemble returns a human readable listing of a program.
+func Disassemble(p *Program) string {
+	var sb strings.Builder
+	for i, class := range p.Classes {
+		fmt.Fprintf(&sb, "class %d %s (fields %s, init %d)\n", i, class.Name, strings.Join(class.Fields, ", "), class.Init)
+	}
+	if len(p.Classes) > 0 {
+		sb.WriteString("\n")
+	}
+	for i := range p.Functions {
+		fn := &p.Functions[i]
+		fmt.Fprintf(&sb, "func %d %s (params %d, locals %d)", i, fn.Name, fn.Params, fn.Locals)
+		if i == p.Main {
+			sb.WriteString(" main")
+		}
+		sb.WriteString("\n")
+		sb.WriteString(DisassembleFunction(p, fn))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// DisassembleFunction lists the instructions of one function with their source lines.
+func DisassembleFunction(p *Program, fn *Function) string {
+	var sb strings.Builder
+	lastLine := -1
+	for offset := 0; offset < len(fn.Code); offset += Width(Opcode(fn.Code[offset])) {
+		fmt.Fprintf(&sb, "%04d ", offset)
+		if line := fn.LineAt(offset); line != lastLine {
+			fmt.Fprintf(&sb, "%4d ", line)
+			lastLine = line
+		} else {
+			sb.WriteString("   | ")
+		}
+		sb.WriteString(instruction(p, fn.Code, offset))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func instruction(p *Program, code []byte, offset int) string {
+	op := Opcode(code[offset])
+	var operands []int
+	for i := 0; i < definitions[op].operands; i++ {
+		operands = append(operands, ReadOperand(code, offset+1+2*i))
+	}
+
+	switch op {
+	case CONST, GETFIELD, SETFIELD, CAST, SHL, SHR, COMPL, ADD, SUB, MUL, DIV, MOD, NEG, LT, LTEQ, GT, GTEQ:
+		return fmt.Sprintf("%-12s %4d (%s)", op, operands[0], constantString(p.Constants[operands[0]]))
+	case INVOKE, BUILTIN:
+		return fmt.Sprintf("%-12s %4d (%s) %d", op, operands[0], p.Constants[operands[0]], operands[1])
+	case CALL:
+		return fmt.Sprintf("%-12s %4d (%s)", op, operands[0], p.Functions[operands[0]].Name)
+	case NEW:
+		return fmt.Sprintf("%-12s %4d (%s)", op, operands[0], p.Classes[operands[0]].Name)
+	case JUMP, JUMPIFFALSE:
+		return fmt.Sprintf("%-12s %04d", op, operands[0])
+	}
+	if len(operands) == 1 {
+		return fmt.Sprintf("%-12s %4d", op, operands[0])
+	}
+	return op.String()
+}
+
+func constantString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,296 @@
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Header of a serialized program.
+const (
+	magic   = "KNXB"
+	version = 2 // Arithmetic and comparisons take their type.
+)
+
+// Tags for serialized constants.
+const (
+	tagInt = iota
+	tagFloat
+	tagString
+	tagBool
+)
+
+// Encode serializes a program to the on-disk format.
+func (p *Program) Encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(version)
+
+	writeUint(&buf, len(p.Constants))
+	for _, constant := range p.Constants {
+		switch value := constant.(type) {
+		case int64:
+			buf.WriteByte(tagInt)
+			var tmp [binary.MaxVarintLen64]byte
+			buf.Write(tmp[:binary.PutVarint(tmp[:], value)])
+		case float64:
+			buf.WriteByte(tagFloat)
+			var tmp [8]byte
+			binary.BigEndian.PutUint64(tmp[:], math.Float64bits(value))
+			buf.Write(tmp[:])
+		case string:
+			buf.WriteByte(tagString)
+			writeString(&buf, value)
+		case bool:
+			buf.WriteByte(tagBool)
+			if value {
+				buf.WriteByte(1)
+			} else {
+				buf.WriteByte(0)
+			}
+		}
+	}
+
+	writeUint(&buf, len(p.Classes))
+	for _, class := range p.Classes {
+		writeString(&buf, class.Name)
+		writeUint(&buf, len(class.Fields))
+		for _, field := range class.Fields {
+			writeString(&buf, field)
+		}
+		writeUint(&buf, class.Init)
+		// Sort methods so that the output is deterministic.
+		var names []string
+		for name := range class.Methods {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeUint(&buf, len(names))
+		for _, name := range names {
+			writeString(&buf, name)
+			writeUint(&buf, class.Methods[name])
+		}
+	}
+
+	writeUint(&buf, len(p.Functions))
+	for _, fn := range p.Functions {
+		writeString(&buf, fn.Name)
+		writeUint(&buf, fn.Params)
+		writeUint(&buf, fn.Locals)
+		writeUint(&buf, len(fn.Code))
+		buf.Write(fn.Code)
+		writeUint(&buf, len(fn.Lines))
+		for _, info := range fn.Lines {
+			writeUint(&buf, info.Offset)
+			writeUint(&buf, info.Line)
+		}
+	}
+
+	writeUint(&buf, p.Main)
+	return buf.Bytes()
+}
+
+// Decode reads a program serialized by Encode.
+func Decode(data []byte) (*Program, error) {
+	r := &reader{data: data}
+	if string(r.bytes(len(magic))) != magic {
+		return nil, errors.New("not a Knox bytecode file")
+	}
+	if r.byte() != version {
+		return nil, errors.New("unsupported bytecode version")
+	}
+
+	p := &Program{}
+	count := r.uint()
+	for i := 0; i < count && r.err == nil; i++ {
+		switch r.byte() {
+		case tagInt:
+			value, n := binary.Varint(r.data[r.pos:])
+			if n <= 0 {
+				r.fail()
+				break
+			}
+			r.pos += n
+			p.Constants = append(p.Constants, value)
+		case tagFloat:
+			p.Constants = append(p.Constants, math.Float64frombits(binary.BigEndian.Uint64(r.bytes(8))))
+		case tagString:
+			p.Constants = append(p.Constants, r.string())
+		case tagBool:
+			p.Constants = append(p.Constants, r.byte() == 1)
+		default:
+			r.fail()
+		}
+	}
+
+	count = r.uint()
+	for i := 0; i < count && r.err == nil; i++ {
+		class := Class{Name: r.string(), Methods: make(map[string]int)}
+		fields := r.uint()
+		for j := 0; j < fields && r.err == nil; j++ {
+			class.Fields = append(class.Fields, r.string())
+		}
+		class.Init = r.uint()
+		methods := r.uint()
+		for j := 0; j < methods && r.err == nil; j++ {
+			name := r.string()
+			class.Methods[name] = r.uint()
+		}
+		p.Classes = append(p.Classes, class)
+	}
+
+	count = r.uint()
+	for i := 0; i < count && r.err == nil; i++ {
+		fn := Function{Name: r.string(), Params: r.uint(), Locals: r.uint()}
+		fn.Code = append([]byte(nil), r.bytes(r.uint())...)
+		lines := r.uint()
+		for j := 0; j < lines && r.err == nil; j++ {
+			fn.Lines = append(fn.Lines, LineInfo{Offset: r.uint(), Line: r.uint()})
+		}
+		p.Functions = append(p.Functions, fn)
+	}
+
+	p.Main = r.uint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if p.Main >= len(p.Functions) {
+		return nil, errors.New("invalid main function")
+	}
+	if err := p.verify(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Check that every operand is in range, that the constants named by an operand are strings, and that jumps land
+// on instructions of code that doesn't run off its end, so that a corrupt file is rejected rather than indexing
+// past the end of a table. The stack isn't checked, so code that pops more than it pushed or passes the wrong
+// values to a builtin is only caught by the VM when it runs.
+func (p *Program) verify() error {
+	for _, class := range p.Classes {
+		if class.Init >= len(p.Functions) {
+			return errors.New("invalid class constructor")
+		}
+		for _, index := range class.Methods {
+			if index >= len(p.Functions) {
+				return errors.New("invalid method")
+			}
+		}
+	}
+	for _, fn := range p.Functions {
+		if fn.Params > fn.Locals {
+			return errors.New("invalid function " + fn.Name)
+		}
+		starts := make([]bool, len(fn.Code))
+		var jumps []int
+		last := NIL
+		for offset := 0; offset < len(fn.Code); {
+			op := Opcode(fn.Code[offset])
+			starts[offset], last = true, op
+			def, ok := definitions[op]
+			if !ok || offset+Width(op) > len(fn.Code) {
+				return errors.New("invalid instruction in " + fn.Name)
+			}
+			var operand int
+			if def.operands > 0 {
+				operand = ReadOperand(fn.Code, offset+1)
+			}
+			var limit int
+			named := false
+			switch op {
+			case CONST:
+				limit = len(p.Constants)
+			case GETFIELD, SETFIELD, INVOKE, BUILTIN, CAST, SHL, SHR, COMPL, ADD, SUB, MUL, DIV, MOD, NEG, LT, LTEQ, GT, GTEQ:
+				limit = len(p.Constants)
+				named = true // Names of members, methods, builtins and types.
+			case LOAD, STORE:
+				limit = fn.Locals
+			case JUMP, JUMPIFFALSE:
+				limit = len(fn.Code)
+				jumps = append(jumps, operand)
+			case CALL:
+				limit = len(p.Functions)
+			case NEW:
+				limit = len(p.Classes)
+			default:
+				limit = operand + 1
+			}
+			if operand >= limit {
+				return errors.New("invalid operand in " + fn.Name)
+			}
+			if named {
+				if _, ok := p.Constants[operand].(string); !ok {
+					return errors.New("invalid operand in " + fn.Name)
+				}
+			}
+			offset += Width(op)
+		}
+		if last != RETURN && last != JUMP {
+			return errors.New("missing return at the end of " + fn.Name)
+		}
+		for _, target := range jumps {
+			if !starts[target] {
+				return errors.New("invalid jump in " + fn.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func writeUint(buf *bytes.Buffer, n int) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(n))])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUint(buf, len(s))
+	buf.WriteString(s)
+}
+
+// Bounds checked reader. The first error sticks and all later reads return zero values.
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = errors.New("truncated or corrupt bytecode file")
+	}
+	r.pos = len(r.data)
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.pos+n > len(r.data) {
+		r.fail()
+		if n > 8 {
+			n = 8 // Enough zeros for any fixed size read.
+		}
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) byte() byte {
+	return r.bytes(1)[0]
+}
+
+func (r *reader) uint() int {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 || value > math.MaxInt32 {
+		r.fail()
+		return 0
+	}
+	r.pos += n
+	return int(value)
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(r.uint()))
+}
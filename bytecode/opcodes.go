@@ -0,0 +1,117 @@
+package bytecode
+
+// Opcode is a single VM instruction.
+type Opcode byte
+
+// Instruction set. Operands are 16-bit big endian and follow the opcode.
+const (
+	CONST    Opcode = iota // Push constant. Operand: constant index.
+	NIL                    // Push nil.
+	TRUE                   // Push true.
+	FALSE                  // Push false.
+	POP                    // Discard top of stack.
+	LOAD                   // Push local. Operand: slot.
+	STORE                  // Pop into local. Operand: slot.
+	GETFIELD               // Pop object, push member. Operand: constant index of member name.
+	SETFIELD               // Pop value and object, set member. Operand: constant index of member name.
+	INDEX                  // Pop index and container, push element.
+	SETINDEX               // Pop value, index and container, set element.
+	ADD                    // Operand: constant index of the type, whose bits wrap the result.
+	SUB                    // Operand: constant index of the type.
+	MUL                    // Operand: constant index of the type.
+	DIV                    // Operand: constant index of the type, which decides if the division is unsigned.
+	MOD                    // Operand: constant index of the type.
+	AND
+	OR
+	XOR
+	SHL   // Operand: constant index of the integer type, whose bits wrap the result.
+	SHR   // Operand: constant index of the integer type, which decides if the shift keeps the sign.
+	COMPL // Operand: constant index of the integer type.
+	NEG   // Operand: constant index of the type.
+	NOT
+	CONCAT
+	EQ
+	NOTEQ
+	LT          // Operand: constant index of the type of the operands, which decides if they compare as unsigned.
+	LTEQ        // Operand: constant index of the type of the operands.
+	GT          // Operand: constant index of the type of the operands.
+	GTEQ        // Operand: constant index of the type of the operands.
+	JUMP        // Operand: absolute offset.
+	JUMPIFFALSE // Pop condition. Operand: absolute offset.
+	CALL        // Operand: function index.
+	INVOKE      // Call method on receiver below the arguments. Operands: constant index of method name, argument count.
+	BUILTIN     // Call native function. Operands: constant index of builtin name, argument count.
+	RETURN      // Operand: number of return values.
+	NEW         // Push new object. Operand: class index.
+	LIST        // Pop items and push a list. Operand: item count.
+	MAP         // Push empty map.
+	CAST        // Convert top of stack. Operand: constant index of type name.
+	ITER        // Replace a list or map with a snapshot list of its elements or keys.
+)
+
+type definition struct {
+	name     string
+	operands int // Number of 16-bit operands.
+}
+
+var definitions = map[Opcode]definition{
+	CONST:       {"CONST", 1},
+	NIL:         {"NIL", 0},
+	TRUE:        {"TRUE", 0},
+	FALSE:       {"FALSE", 0},
+	POP:         {"POP", 0},
+	LOAD:        {"LOAD", 1},
+	STORE:       {"STORE", 1},
+	GETFIELD:    {"GETFIELD", 1},
+	SETFIELD:    {"SETFIELD", 1},
+	INDEX:       {"INDEX", 0},
+	SETINDEX:    {"SETINDEX", 0},
+	ADD:         {"ADD", 1},
+	SUB:         {"SUB", 1},
+	MUL:         {"MUL", 1},
+	DIV:         {"DIV", 1},
+	MOD:         {"MOD", 1},
+	AND:         {"AND", 0},
+	OR:          {"OR", 0},
+	XOR:         {"XOR", 0},
+	SHL:         {"SHL", 1},
+	SHR:         {"SHR", 1},
+	COMPL:       {"COMPL", 1},
+	NEG:         {"NEG", 1},
+	NOT:         {"NOT", 0},
+	CONCAT:      {"CONCAT", 0},
+	EQ:          {"EQ", 0},
+	NOTEQ:       {"NOTEQ", 0},
+	LT:          {"LT", 1},
+	LTEQ:        {"LTEQ", 1},
+	GT:          {"GT", 1},
+	GTEQ:        {"GTEQ", 1},
+	JUMP:        {"JUMP", 1},
+	JUMPIFFALSE: {"JUMPIFFALSE", 1},
+	CALL:        {"CALL", 1},
+	INVOKE:      {"INVOKE", 2},
+	BUILTIN:     {"BUILTIN", 2},
+	RETURN:      {"RETURN", 1},
+	NEW:         {"NEW", 1},
+	LIST:        {"LIST", 1},
+	MAP:         {"MAP", 0},
+	CAST:        {"CAST", 1},
+	ITER:        {"ITER", 0},
+}
+
+// Width returns the size in bytes of an instruction including its operands.
+func Width(op Opcode) int {
+	return 1 + 2*definitions[op].operands
+}
+
+// ReadOperand reads the 16-bit operand starting at offset.
+func ReadOperand(code []byte, offset int) int {
+	return int(code[offset])<<8 | int(code[offset+1])
+}
+
+func (op Opcode) String() string {
+	if def, ok := definitions[op]; ok {
+		return def.name
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,54 @@
+package bytecode
+
+// Program is a compiled Knox program.
+type Program struct {
+	Constants []interface{} // int64, float64, bool or string.
+	Classes   []Class
+	Functions []Function
+	Main      int // Index of the main function.
+}
+
+// Class describes the layout of a heap object.
+type Class struct {
+	Name    string
+	Fields  []string
+	Init    int            // Function that runs the member initializers on self.
+	Methods map[string]int // Method name to function index.
+}
+
+// Function is a compiled function or method.
+type Function struct {
+	Name   string
+	Params int // Includes self for methods.
+	Locals int // Includes params.
+	Code   []byte
+	Lines  []LineInfo
+}
+
+// LineInfo maps the instruction at Offset onwards to a Knox source line.
+type LineInfo struct {
+	Offset int
+	Line   int
+}
+
+// LineAt returns the Knox source line of the instruction at offset.
+func (f *Function) LineAt(offset int) int {
+	line := 0
+	for _, info := range f.Lines {
+		if info.Offset > offset {
+			break
+		}
+		line = info.Line
+	}
+	return line
+}
+
+// FieldIndex returns the slot of a member, or -1.
+func (c *Class) FieldIndex(name string) int {
+	for i, field := range c.Fields {
+		if field == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,98 @@
+package cfa
+
+import (
+	"fmt"
+	"knox/ast"
+)
+
+// Analyze builds a control flow graph for every function. Functions with results that can fall off the end,
+// break or continue outside of a loop, and variables used before they are declared or initialized are errors.
+// Unreachable statements are warnings.
+// Returns the number of warnings.
+func Analyze(node *ast.Node) int {
+	warnings = 0
+	analyze(node)
+	return warnings
+}
+
+var warnings int
+
+func analyze(node *ast.Node) {
+	for i := range node.Children {
+		child := &node.Children[i]
+		switch child.Type {
+		case ast.FUNCDECL:
+			analyzeFunc(child)
+		case ast.CLASS:
+			checkMembers(child)
+			analyze(child)
+		case ast.BLOCK:
+			analyze(child)
+		}
+	}
+}
+
+func analyzeFunc(fn *ast.Node) {
+	g := Build(fn)
+	reachable := map[*Block]bool{}
+	visit(g.Entry, reachable)
+
+	// Warn once at the start of each unreachable region.
+	tainted := map[*Block]bool{}
+	for _, block := range g.Blocks {
+		if reachable[block] {
+			continue
+		}
+		for _, pred := range block.Preds {
+			if tainted[pred] {
+				tainted[block] = true
+			}
+		}
+		if !tainted[block] && len(block.Nodes) > 0 {
+			warningMsg(block.Nodes[0], "Unreachable code")
+			tainted[block] = true
+		}
+	}
+
+	checkInit(g, reachable)
+
+	// Like C, main returns 0 when it falls off the end.
+	name := fn.Children[0].TokenStart.Literal
+	results := &fn.Children[2]
+	if reachable[g.End] && name != "main" && results.Children[0].Children[0].TokenStart.Literal != "void" {
+		abortMsg(&fn.Children[0], "Function "+name+" can end without returning a value")
+	}
+}
+
+func visit(block *Block, reachable map[*Block]bool) {
+	if reachable[block] {
+		return
+	}
+	reachable[block] = true
+	for _, succ := range block.Succs {
+		visit(succ, reachable)
+	}
+}
+
+func abortMsg(node *ast.Node, msg string) {
+	fmt.Printf("Control flow error: %v. Line %v.\n", msg, line(node))
+	panic("Aborted.\n")
+}
+
+func warningMsg(node *ast.Node, msg string) {
+	fmt.Printf("Control flow warning: %v. Line %v.\n", msg, line(node))
+	warnings++
+}
+
+// Statements like assignments have no token of their own, so use the first one inside.
+func line(node *ast.Node) int {
+	if node.TokenStart.Line != 0 {
+		return node.TokenStart.Line
+	}
+	for i := range node.Children {
+		if l := line(&node.Children[i]); l != 0 {
+			return l
+		}
+	}
+	return 0
+}
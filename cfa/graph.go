@@ -0,0 +1,143 @@
+package cfa
+
+import (
+	"knox/ast"
+)
+
+// Graph is the control flow graph of a function.
+type Graph struct {
+	Entry  *Block
+	Exit   *Block // Reached by every return and by falling off the end.
+	End    *Block // Block that falls off the end of the function body.
+	Blocks []*Block
+}
+
+// Block is a basic block. Nodes holds statements along with the conditions of branches and loops.
+type Block struct {
+	Nodes []*ast.Node
+	Succs []*Block
+	Preds []*Block
+}
+
+type loop struct {
+	breakTo    *Block
+	continueTo *Block
+}
+
+type builder struct {
+	g     *Graph
+	cur   *Block
+	loops []loop
+}
+
+// Build the control flow graph of a FUNCDECL.
+func Build(fn *ast.Node) *Graph {
+	b := &builder{g: &Graph{}}
+	b.g.Entry = b.newBlock()
+	b.g.Exit = b.newBlock()
+	b.cur = b.g.Entry
+	b.block(&fn.Children[3])
+	b.g.End = b.cur
+	b.edge(b.cur, b.g.Exit)
+	return b.g
+}
+
+func (b *builder) newBlock() *Block {
+	block := &Block{}
+	b.g.Blocks = append(b.g.Blocks, block)
+	return block
+}
+
+func (b *builder) edge(from *Block, to *Block) {
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+func (b *builder) block(node *ast.Node) {
+	for i := range node.Children {
+		b.statement(&node.Children[i])
+	}
+}
+
+func (b *builder) statement(node *ast.Node) {
+	switch node.Type {
+	case ast.IFSTATEMENT:
+		b.ifStatement(node, 0)
+	case ast.WHILESTATEMENT:
+		header := b.newBlock()
+		b.edge(b.cur, header)
+		header.Nodes = append(header.Nodes, &node.Children[0])
+		after := b.newBlock()
+		if !isTrue(&node.Children[0]) {
+			b.edge(header, after)
+		}
+		b.loop(header, after, &node.Children[1])
+	case ast.FORSTATEMENT:
+		b.cur.Nodes = append(b.cur.Nodes, &node.Children[1]) // The container is evaluated once.
+		header := b.newBlock()
+		b.edge(b.cur, header)
+		header.Nodes = append(header.Nodes, &node.Children[0]) // The element is declared each iteration.
+		after := b.newBlock()
+		b.edge(header, after)
+		b.loop(header, after, &node.Children[2])
+	case ast.JUMPSTATEMENT:
+		b.cur.Nodes = append(b.cur.Nodes, node)
+		switch node.TokenStart.Literal {
+		case "return":
+			b.edge(b.cur, b.g.Exit)
+		case "break", "continue":
+			if len(b.loops) == 0 {
+				abortMsg(node, "Use of "+node.TokenStart.Literal+" outside of a loop")
+			}
+			target := b.loops[len(b.loops)-1].breakTo
+			if node.TokenStart.Literal == "continue" {
+				target = b.loops[len(b.loops)-1].continueTo
+			}
+			b.edge(b.cur, target)
+		}
+		b.cur = b.newBlock() // Anything that follows is unreachable.
+	default:
+		b.cur.Nodes = append(b.cur.Nodes, node)
+	}
+}
+
+// Condition and block at i, followed by else if and else branches.
+func (b *builder) ifStatement(node *ast.Node, i int) {
+	b.cur.Nodes = append(b.cur.Nodes, &node.Children[i])
+	header := b.cur
+	after := b.newBlock()
+
+	b.cur = b.newBlock()
+	b.edge(header, b.cur)
+	b.block(&node.Children[i+1])
+	b.edge(b.cur, after)
+
+	b.cur = b.newBlock()
+	b.edge(header, b.cur)
+	if i+3 < len(node.Children) { // Else if
+		b.ifStatement(node, i+2)
+	} else if i+2 < len(node.Children) { // Else
+		b.block(&node.Children[i+2])
+	}
+	b.edge(b.cur, after)
+	b.cur = after
+}
+
+// Body of a loop that starts at header and leaves to after.
+func (b *builder) loop(header *Block, after *Block, body *ast.Node) {
+	b.loops = append(b.loops, loop{breakTo: after, continueTo: header})
+	b.cur = b.newBlock()
+	b.edge(header, b.cur)
+	b.block(body)
+	b.edge(b.cur, header)
+	b.loops = b.loops[:len(b.loops)-1]
+	b.cur = after
+}
+
+// Whether a condition is the literal true, which makes a loop infinite.
+func isTrue(node *ast.Node) bool {
+	if node.Type == ast.EXPRESSION {
+		return isTrue(&node.Children[0])
+	}
+	return node.Type == ast.BOOL && node.TokenStart.Literal == "true"
+}
@@ -0,0 +1,174 @@
+package cfa
+
+import (
+	"knox/ast"
+)
+
+// Symbol tables hold every declaration of a block from the start, so check that each local variable is
+// declared on every path that reaches a use of it. Variables are always initialized by their declaration.
+func checkInit(g *Graph, reachable map[*Block]bool) {
+	locals := map[*ast.Node]bool{}
+	for _, block := range g.Blocks {
+		for _, node := range block.Nodes {
+			if node.Type == ast.VARDECL {
+				for _, entry := range declared(node) {
+					locals[entry] = true
+				}
+			}
+		}
+	}
+
+	// Forward data flow of the declarations that reach the start of each block.
+	in := map[*Block]map[*ast.Node]bool{g.Entry: {}}
+	for changed := true; changed; {
+		changed = false
+		for _, block := range g.Blocks {
+			if !reachable[block] || block == g.Entry {
+				continue
+			}
+			var set map[*ast.Node]bool
+			for _, pred := range block.Preds {
+				if out := outSet(pred, in[pred]); out != nil {
+					set = intersect(set, out)
+				}
+			}
+			if set != nil && (in[block] == nil || len(set) != len(in[block])) { // Sets only shrink.
+				in[block] = set
+				changed = true
+			}
+		}
+	}
+
+	for _, block := range g.Blocks {
+		if !reachable[block] {
+			continue
+		}
+		set := copySet(in[block])
+		for _, node := range block.Nodes {
+			if node.Type != ast.VARDECL {
+				checkUses(node, locals, set, nil)
+				continue
+			}
+			entries := declared(node)
+			if len(node.Children)%2 == 1 {
+				self := map[*ast.Node]bool{}
+				for _, entry := range entries {
+					self[entry] = true
+				}
+				checkUses(&node.Children[len(node.Children)-1], locals, set, self)
+			}
+			for _, entry := range entries {
+				set[entry] = true
+			}
+		}
+	}
+}
+
+// Symbol table entries of the variables a VARDECL declares.
+func declared(node *ast.Node) []*ast.Node {
+	var entries []*ast.Node
+	for i := 0; i+1 < len(node.Children); i += 2 {
+		entries = append(entries, node.Symbols.Entries[node.Children[i].TokenStart.Literal])
+	}
+	return entries
+}
+
+// Declarations after a block runs, or nil if nothing reaches it yet.
+func outSet(block *Block, in map[*ast.Node]bool) map[*ast.Node]bool {
+	if in == nil {
+		return nil
+	}
+	out := copySet(in)
+	for _, node := range block.Nodes {
+		if node.Type == ast.VARDECL {
+			for _, entry := range declared(node) {
+				out[entry] = true
+			}
+		}
+	}
+	return out
+}
+
+func intersect(a map[*ast.Node]bool, b map[*ast.Node]bool) map[*ast.Node]bool {
+	if a == nil {
+		return b
+	}
+	result := map[*ast.Node]bool{}
+	for entry := range a {
+		if b[entry] {
+			result[entry] = true
+		}
+	}
+	return result
+}
+
+func copySet(set map[*ast.Node]bool) map[*ast.Node]bool {
+	result := map[*ast.Node]bool{}
+	for entry := range set {
+		result[entry] = true
+	}
+	return result
+}
+
+// Abort on a variable reference that isn't declared yet. self holds the variables of the declaration
+// whose initializer is being checked.
+func checkUses(node *ast.Node, locals map[*ast.Node]bool, set map[*ast.Node]bool, self map[*ast.Node]bool) {
+	if node.Type == ast.VARREF && node.Symbols != nil {
+		name := node.Children[0].TokenStart.Literal
+		entry := node.Symbols.LookupSymbol(name)
+		if self[entry] {
+			abortMsg(node, "Variable "+name+" is used in its own initializer")
+		} else if locals[entry] && !set[entry] {
+			abortMsg(node, "Variable "+name+" is used before its declaration")
+		}
+	}
+	for i := range node.Children {
+		checkUses(&node.Children[i], locals, set, self)
+	}
+}
+
+// Members are initialized in order when an object is created, so an initializer may only read the
+// members declared before it, and may only call methods once every member is initialized.
+func checkMembers(class *ast.Node) {
+	block := &class.Children[1]
+	assigned := map[*ast.Node]bool{}
+	remaining := 0
+	for i := range block.Children {
+		if block.Children[i].Type == ast.VARDECL {
+			remaining++
+		}
+	}
+	for i := range block.Children {
+		member := &block.Children[i]
+		if member.Type != ast.VARDECL {
+			continue
+		}
+		remaining--
+		checkMemberUses(&member.Children[len(member.Children)-1], block.Symbols, assigned, remaining > 0)
+		for _, entry := range declared(member) {
+			assigned[entry] = true
+		}
+	}
+}
+
+func checkMemberUses(node *ast.Node, members *ast.SymTable, assigned map[*ast.Node]bool, partial bool) {
+	var name string
+	switch node.Type {
+	case ast.VARREF:
+		name = node.Children[0].TokenStart.Literal
+	case ast.DOTOP:
+		if node.Children[0].Type == ast.SELF {
+			name = node.Children[1].TokenStart.Literal
+		}
+	}
+	if entry, ok := members.Entries[name]; ok {
+		if entry.Type == ast.VARDECL && !assigned[entry] {
+			abortMsg(node, "Member "+name+" is read before the constructor assigns it")
+		} else if entry.Type == ast.FUNCDECL && partial {
+			abortMsg(node, "Method "+name+" is called before the constructor assigns every member")
+		}
+	}
+	for i := range node.Children {
+		checkMemberUses(&node.Children[i], members, assigned, partial)
+	}
+}
@@ -0,0 +1,224 @@
+package doc
+
+import (
+	"html"
+	"knox/ast"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TODO: List interfaces and contracts once Knox has them.
+
+// Page documents the declarations of one Knox file, in the order they're declared.
+type Page struct {
+	Name      string // File name without the extension, which names the output files.
+	File      string
+	Constants []*Decl
+	Classes   []*Class
+	Functions []*Decl
+}
+
+// Class is a class with its members and methods.
+type Class struct {
+	Decl
+	Members []*Decl
+	Methods []*Decl
+}
+
+// Decl is a documented declaration.
+type Decl struct {
+	Name      string
+	Anchor    string // Unique within the page. Members and methods are qualified with their class.
+	Doc       string
+	Signature []Fragment
+}
+
+// Fragment is a piece of a signature. Fragments that name a class of the module link to it.
+type Fragment struct {
+	Text  string
+	Class string
+}
+
+// Module is the set of pages documented together, so that types link across files.
+type Module struct {
+	Pages   []*Page
+	classes map[string]*Page
+}
+
+// NewModule documents the parsed programs of a set of files.
+func NewModule(files []string, programs []*ast.Node) *Module {
+	m := &Module{classes: map[string]*Page{}}
+	for i, prog := range programs {
+		page := Extract(files[i], prog)
+		for _, c := range page.Classes {
+			m.classes[c.Name] = page
+		}
+		m.Pages = append(m.Pages, page)
+	}
+	sort.Slice(m.Pages, func(i, j int) bool { return m.Pages[i].Name < m.Pages[j].Name })
+	return m
+}
+
+// Extract collects the constants, classes and functions of a parsed file.
+func Extract(file string, prog *ast.Node) *Page {
+	page := &Page{Name: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)), File: file}
+	for i := range prog.Children {
+		decl := &prog.Children[i]
+		switch decl.Type {
+		case ast.VARDECL:
+			page.Constants = append(page.Constants, variable(decl, ""))
+		case ast.FUNCDECL:
+			page.Functions = append(page.Functions, function(decl, ""))
+		case ast.CLASS:
+			page.Classes = append(page.Classes, class(decl))
+		}
+	}
+	return page
+}
+
+// Describe gives the signature of a function, class, member or variable declaration as plain text.
+func Describe(node *ast.Node) string {
+	var d *Decl
+	switch node.Type {
+	case ast.FUNCDECL:
+		d = function(node, "")
+	case ast.CLASS:
+		d = &class(node).Decl
+	default:
+		d = variable(node, "") // Parameters and loop variables are written without a keyword.
+	}
+	text := ""
+	for _, f := range d.Signature {
+		text += f.Text
+	}
+	return strings.TrimSpace(text)
+}
+
+func class(node *ast.Node) *Class {
+	name := node.Children[0].TokenStart.Literal
+	c := &Class{Decl: Decl{Name: name, Anchor: name, Doc: node.Doc, Signature: []Fragment{{Text: "class " + name}}}}
+	for i := range node.Children[1].Children {
+		member := &node.Children[1].Children[i]
+		if member.Type == ast.FUNCDECL {
+			c.Methods = append(c.Methods, function(member, name))
+		} else {
+			c.Members = append(c.Members, variable(member, name))
+		}
+	}
+	return c
+}
+
+// func name(a : T, const b : U) R
+func function(node *ast.Node, class string) *Decl {
+	d := declared(node, class)
+	d.Signature = []Fragment{{Text: "func " + d.Name + "("}}
+	for i, param := range node.Children[1].Children {
+		if i > 0 {
+			d.Signature = append(d.Signature, Fragment{Text: ", "})
+		}
+		if param.TokenStart.Literal == "const" {
+			d.Signature = append(d.Signature, Fragment{Text: "const "})
+		}
+		d.Signature = append(d.Signature, Fragment{Text: param.Children[0].TokenStart.Literal + " : "})
+		d.Signature = append(d.Signature, typeName(&param.Children[1])...)
+	}
+	d.Signature = append(d.Signature, Fragment{Text: ") "})
+	results := node.Children[2].Children
+	if len(results) > 1 {
+		d.Signature = append(d.Signature, Fragment{Text: "("})
+	}
+	for i := range results {
+		if i > 0 {
+			d.Signature = append(d.Signature, Fragment{Text: ", "})
+		}
+		d.Signature = append(d.Signature, typeName(&results[i])...)
+	}
+	if len(results) > 1 {
+		d.Signature = append(d.Signature, Fragment{Text: ")"})
+	}
+	return d
+}
+
+// var x : T, let x : T or const x : T. Several variables declared together share the doc comment.
+func variable(node *ast.Node, class string) *Decl {
+	d := declared(node, class)
+	d.Signature = []Fragment{{Text: node.TokenStart.Literal + " "}}
+	for i := 0; i+1 < len(node.Children); i += 2 {
+		if i > 0 {
+			d.Signature = append(d.Signature, Fragment{Text: ", "})
+		}
+		d.Signature = append(d.Signature, Fragment{Text: node.Children[i].TokenStart.Literal + " : "})
+		d.Signature = append(d.Signature, typeName(&node.Children[i+1])...)
+	}
+	return d
+}
+
+func declared(node *ast.Node, class string) *Decl {
+	name := node.Children[0].TokenStart.Literal
+	anchor := name
+	if class != "" {
+		anchor = class + "." + name
+	}
+	return &Decl{Name: name, Anchor: anchor, Doc: node.Doc}
+}
+
+// Type of a VARTYPE node, with the class names as their own fragments.
+func typeName(node *ast.Node) []Fragment {
+	name := node.Children[0].TokenStart.Literal
+	switch {
+	case name == "?":
+		return append(typeName(&node.Children[1]), Fragment{Text: "?"})
+	case name == "[":
+		return append(append([]Fragment{{Text: "["}}, typeName(&node.Children[1])...), Fragment{Text: "]"})
+	case len(node.Children) > 1:
+		fragments := []Fragment{{Text: name + "["}}
+		for i := 1; i < len(node.Children); i++ {
+			if i > 1 {
+				fragments = append(fragments, Fragment{Text: ", "})
+			}
+			fragments = append(fragments, typeName(&node.Children[i])...)
+		}
+		return append(fragments, Fragment{Text: "]"})
+	}
+	return []Fragment{{Text: name, Class: name}}
+}
+
+// Link target of a class for a page, or "" for primitives and classes outside of the module. A class of the
+// page itself is preferred over one of the same name in another file. ext is the extension of the output files.
+func (m *Module) link(from *Page, class string, ext string) string {
+	for _, c := range from.Classes {
+		if c.Name == class {
+			return "#" + class
+		}
+	}
+	if page, ok := m.classes[class]; ok {
+		return page.Name + ext + "#" + class
+	}
+	return ""
+}
+
+// Signature as HTML, with links on the classes of the module. Markdown allows the same HTML inline.
+func (m *Module) signature(page *Page, d *Decl, ext string) string {
+	var b strings.Builder
+	for _, f := range d.Signature {
+		text := html.EscapeString(f.Text)
+		if target := m.link(page, f.Class, ext); target != "" {
+			b.WriteString("<a href=\"" + target + "\">" + text + "</a>")
+		} else {
+			b.WriteString(text)
+		}
+	}
+	return b.String()
+}
+
+// Paragraphs of a doc comment, which are separated by empty lines.
+func paragraphs(doc string) []string {
+	var result []string
+	for _, p := range strings.Split(doc, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package doc
+
+import (
+	"html"
+	"strings"
+)
+
+const style = `body { font-family: sans-serif; max-width: 50em; margin: 2em auto; line-height: 1.4; }
+pre { background: #f4f4f4; padding: 0.5em; }
+a { color: #2a5db0; text-decoration: none; }
+.member { margin-left: 2em; }`
+
+// HTML renders a page as a standalone document.
+func (m *Module) HTML(page *Page) string {
+	var b strings.Builder
+	header(&b, page.Name)
+	b.WriteString("<p><code>" + html.EscapeString(page.File) + "</code></p>\n")
+	if len(page.Constants) > 0 {
+		b.WriteString("<h2>Constants</h2>\n")
+		for _, d := range page.Constants {
+			m.htmlDecl(&b, page, d, "h3", "")
+		}
+	}
+	if len(page.Classes) > 0 {
+		b.WriteString("<h2>Classes</h2>\n")
+		for _, c := range page.Classes {
+			m.htmlDecl(&b, page, &c.Decl, "h3", "")
+			for _, d := range c.Members {
+				m.htmlDecl(&b, page, d, "h4", "member")
+			}
+			for _, d := range c.Methods {
+				m.htmlDecl(&b, page, d, "h4", "member")
+			}
+		}
+	}
+	if len(page.Functions) > 0 {
+		b.WriteString("<h2>Functions</h2>\n")
+		for _, d := range page.Functions {
+			m.htmlDecl(&b, page, d, "h3", "")
+		}
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+func (m *Module) htmlDecl(b *strings.Builder, page *Page, d *Decl, heading string, class string) {
+	if class != "" {
+		b.WriteString("<div class=\"" + class + "\">\n")
+	}
+	b.WriteString("<" + heading + " id=\"" + html.EscapeString(d.Anchor) + "\">" + html.EscapeString(d.Anchor) + "</" + heading + ">\n")
+	b.WriteString("<pre><code>" + m.signature(page, d, ".html") + "</code></pre>\n")
+	for _, p := range paragraphs(d.Doc) {
+		b.WriteString("<p>" + html.EscapeString(p) + "</p>\n")
+	}
+	if class != "" {
+		b.WriteString("</div>\n")
+	}
+}
+
+// HTMLIndex lists the pages of a module.
+func (m *Module) HTMLIndex(title string) string {
+	var b strings.Builder
+	header(&b, title)
+	b.WriteString("<ul>\n")
+	for _, page := range m.Pages {
+		b.WriteString("<li><a href=\"" + page.Name + ".html\">" + html.EscapeString(page.Name) + "</a>")
+		for i, c := range page.Classes {
+			if i == 0 {
+				b.WriteString(": ")
+			} else {
+				b.WriteString(", ")
+			}
+			b.WriteString("<a href=\"" + page.Name + ".html#" + c.Anchor + "\">" + html.EscapeString(c.Name) + "</a>")
+		}
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+	return b.String()
+}
+
+func header(b *strings.Builder, title string) {
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	b.WriteString("<title>" + html.EscapeString(title) + "</title>\n")
+	b.WriteString("<style>\n" + style + "\n</style>\n</head>\n<body>\n")
+	b.WriteString("<h1>" + html.EscapeString(title) + "</h1>\n")
+}
@@ -0,0 +1,68 @@
+package doc
+
+import (
+	"strings"
+)
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "_", `\_`, "*", `\*`, "`", "\\`", "<", "&lt;")
+
+// Markdown renders a page. Signatures are written as inline HTML so that their types can link, since
+// links don't work inside code spans.
+func (m *Module) Markdown(page *Page) string {
+	var b strings.Builder
+	b.WriteString("# " + markdownEscaper.Replace(page.Name) + "\n\n")
+	b.WriteString("`" + page.File + "`\n")
+	if len(page.Constants) > 0 {
+		b.WriteString("\n## Constants\n")
+		for _, d := range page.Constants {
+			m.markdownDecl(&b, page, d, "###")
+		}
+	}
+	if len(page.Classes) > 0 {
+		b.WriteString("\n## Classes\n")
+		for _, c := range page.Classes {
+			m.markdownDecl(&b, page, &c.Decl, "###")
+			for _, d := range c.Members {
+				m.markdownDecl(&b, page, d, "####")
+			}
+			for _, d := range c.Methods {
+				m.markdownDecl(&b, page, d, "####")
+			}
+		}
+	}
+	if len(page.Functions) > 0 {
+		b.WriteString("\n## Functions\n")
+		for _, d := range page.Functions {
+			m.markdownDecl(&b, page, d, "###")
+		}
+	}
+	return b.String()
+}
+
+func (m *Module) markdownDecl(b *strings.Builder, page *Page, d *Decl, heading string) {
+	b.WriteString("\n<a id=\"" + d.Anchor + "\"></a>\n")
+	b.WriteString(heading + " " + markdownEscaper.Replace(d.Anchor) + "\n\n")
+	b.WriteString("<pre><code>" + m.signature(page, d, ".md") + "</code></pre>\n")
+	for _, p := range paragraphs(d.Doc) {
+		b.WriteString("\n" + markdownEscaper.Replace(p) + "\n")
+	}
+}
+
+// MarkdownIndex lists the pages of a module.
+func (m *Module) MarkdownIndex(title string) string {
+	var b strings.Builder
+	b.WriteString("# " + markdownEscaper.Replace(title) + "\n\n")
+	for _, page := range m.Pages {
+		b.WriteString("- [" + markdownEscaper.Replace(page.Name) + "](" + page.Name + ".md)")
+		for i, c := range page.Classes {
+			if i == 0 {
+				b.WriteString(": ")
+			} else {
+				b.WriteString(", ")
+			}
+			b.WriteString("[" + markdownEscaper.Replace(c.Name) + "](" + page.Name + ".md#" + c.Anchor + ")")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
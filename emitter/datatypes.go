@@ -15,6 +15,8 @@ func initDataTypes() map[string]string {
 		"u64":    "uint64_t",
 		"f32":    "float",
 		"f64":    "double",
-		"string": "const char *"}
+		"rune":   "int32_t",
+		"byte":   "uint8_t",
+		"string": "struct knox_string *"}
 	return m
 }
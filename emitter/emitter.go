@@ -2,409 +2,545 @@ package emitter
 
 import (
 	"fmt"
-	"knox/ast"
+	"knox/ir"
+	"math"
+	"strconv"
 	"strings"
 )
 
-var level = 0
-var currentName string          // Current var declaration name.
-var nextLine string             // Placeholder to add next line once current line completes.
-var prototypes []string         // Keep track of function prototypes so that order doesn't matter.
-var structPrototypes []string   // Keep track of struct prototypes so that order doesn't matter.
-var currentMethods []string     // Keep track of methods in current class
-var currentMembers []string     // Keep track of members in current class
-var currentClass string         // Name of current class
-var datatypes map[string]string // Mapping of Knox primitives to C primitives.
-
-func indent() string {
-	return strings.Repeat("\t", level)
-}
+var datatypes = initDataTypes() // Mapping of Knox primitives to C primitives.
 
-// Generate outputs code given an AST.
-func Generate(node *ast.Node) string {
-	datatypes = initDataTypes()
-	return program(node)
-}
+type emitter struct {
+	main    *ir.Func
+	fn      *ir.Func
+	level   int
+	labels  int
+	loops   []string // Label that continue jumps to, empty for a plain continue.
+	checked bool     // Trap on integer overflow and division by zero.
+	debug   bool     // Trap on nil dereferences.
+	file    string   // C string of the Knox file name for runtime errors.
 
-func header() string {
-	code := ""
-	code += "#include <stdlib.h>\n#include <stdio.h>\n#include <string.h>\n#include <stdint.h>\n#include <stdbool.h>\n#include <stddef.h>\n#include \"knoxutil.h\"\n\n" // TODO: #130 Only include what is needed.
-	// TODO: Main should set seed.
-	return code
+	strings   map[string]string // Static string constants by value.
+	constants string            // Definitions of the string constants.
 }
 
-func program(node *ast.Node) string {
-	head := header()
+// Generate outputs C code for a program in IR form. In checked builds integer arithmetic and conversions abort
+// with the Knox file and line when they overflow or divide by zero, except for code marked @wrapping. Debug
+// builds abort on nil dereferences that the type checker can't rule out, like members narrowed by != nil.
+func Generate(p *ir.Program, checked bool, debug bool) string {
+	e := &emitter{main: p.Main, checked: checked, debug: debug, file: cString(p.File), strings: make(map[string]string)}
+	code := header()
 
-	var code string
-	for _, child := range node.Children {
-		if child.Type == ast.FUNCDECL {
-			code += funcDecl(&child)
-		} else if child.Type == ast.CLASS {
-			code += classDecl(&child)
-
-			// Fake constructor.
-			constructor := "void _" + currentClass + "(struct " + currentClass + "* self)"
-			prototypes = append(prototypes, constructor+";")
-			code += constructor + " {\n"
-			for _, member := range currentMembers {
-				code += "\tself->" + member
-			}
-			code += "}\n\n"
+	// Struct prototypes so that order doesn't matter.
+	for _, c := range p.Classes {
+		code += "struct " + c.Name + ";\n"
+	}
+	if len(p.Classes) > 0 {
+		code += "\n"
+	}
+	for _, c := range p.Classes {
+		code += "struct " + c.Name + " {\n"
+		for _, field := range c.Fields {
+			code += "\t" + declaration(field) + ";\n"
+		}
+		code += "};\n\n"
+	}
 
-			// All other methods.
-			for _, method := range currentMethods {
-				code += method
+	// Multiple return values are returned in a struct.
+	for _, f := range p.Funcs {
+		if len(f.Results) > 1 {
+			code += "struct " + mangle(f.Name) + "_results {\n"
+			for i, t := range f.Results {
+				code += fmt.Sprintf("\t%s r%d;\n", cType(t), i)
 			}
-
-			currentClass = ""
+			code += "};\n\n"
 		}
 	}
 
-	//Generate struct prototypes.
-	for _, prototype := range structPrototypes {
-		head += prototype + "\n"
+	// Function prototypes since C requires functions to be declared before use.
+	for _, f := range p.Funcs {
+		code += e.signature(f) + ";\n"
 	}
-	// Generate function prototypes since C requires functions to be declared before use.
-	for _, prototype := range prototypes {
-		head += prototype + "\n"
-	}
-	head += "\n"
+	code += "\n"
 
-	return head + code
+	var functions string
+	for _, f := range p.Funcs {
+		functions += e.function(f)
+	}
+	if e.constants != "" {
+		code += e.constants + "\n"
+	}
+	return code + functions
 }
 
-func classDecl(node *ast.Node) string {
-	currentMethods = nil
-	currentMembers = nil
-	currentClass = node.Children[0].TokenStart.Literal
-	code := "struct " + node.Children[0].TokenStart.Literal + " " + classBlock(&node.Children[1])
-	structPrototypes = append(structPrototypes, "struct "+node.Children[0].TokenStart.Literal+";")
+func header() string {
+	code := ""
+	code += "#include <stdlib.h>\n#include <stdio.h>\n#include <string.h>\n#include <stdint.h>\n#include <stdbool.h>\n#include <stddef.h>\n#include <math.h>\n#include \"knoxutil.h\"\n\n" // TODO: #130 Only include what is needed.
+	// TODO: Main should set seed.
 	return code
 }
 
-func classBlock(node *ast.Node) string {
-	var code string
-	//level++
-	code += "{\n"
-	for _, child := range node.Children {
-		if child.Type == ast.VARDECL {
-			//code += "\t" + varDecl(&child)
-			rawMethod := "\t" + varDecl(&child)
-			code += strings.Split(rawMethod, " =")[0] + ";\n"
-		} else if child.Type == ast.FUNCDECL {
-			method := funcDecl(&child)
-			currentMethods = append(currentMethods, method)
-		} else {
-			// Should not happen.
-			fmt.Println(child.Type)
-		}
-	}
-	//level--
-	code += "};\n\n"
-	return code
+func abortMsg(line int, msg string) {
+	fmt.Printf("C error: %v. Line %v.\n", msg, line)
+	panic("Aborted.\n")
 }
 
-func funcDecl(node *ast.Node) string {
-	code := ""
+func indent(level int) string {
+	return strings.Repeat("\t", level)
+}
 
-	// Return types.
-	// TODO: Create a struct for multiple return values.
-	if len(node.Children[2].Children) > 1 {
-		code += "("
-		for index, item := range node.Children[2].Children {
-			code += item.Children[0].TokenStart.Literal
-			if index < len(node.Children[2].Children)-1 {
-				code += ", "
-			}
-		}
-		code += ") "
-	} else if len(node.Children[2].Children) == 1 {
-		returnType := node.Children[2].Children[0].Children[0].TokenStart.Literal
-		// Knox allows main to be void or int but C requires int.
-		if node.Children[0].TokenStart.Literal == "main" {
-			returnType = "int"
-		}
-		code += returnType + " "
-	}
+// C identifier of a function. Methods are named Class_method.
+func mangle(name string) string {
+	return strings.Replace(name, ".", "_", 1)
+}
 
-	// Function name.
-	code += node.Children[0].TokenStart.Literal + "("
+// C type of a Knox type. Reference types are pointers.
+func cType(t string) string {
+	if val, ok := datatypes[t]; ok {
+		return val
+	}
+	switch {
+	case ir.IsList(t):
+		return "struct knox_list *"
+	case ir.IsMap(t):
+		abortMsg(0, "The C backend doesn't support maps")
+	case t == "nil":
+		return "void *"
+	}
+	return "struct " + t + " *"
+}
 
-	// Parameters.
-	if currentClass != "" {
-		code += "struct " + currentClass + "* self"
-		if len(node.Children[1].Children) > 0 {
-			code += ", "
-		}
+func declaration(v *ir.Var) string {
+	t := cType(v.Typ)
+	if strings.HasSuffix(t, "*") {
+		return t + v.Name
 	}
-	for i := 0; i < len(node.Children[1].Children); i++ {
-		paramName := node.Children[1].Children[i].Children[0].TokenStart.Literal
-		paramType := node.Children[1].Children[i].Children[1].Children[0].TokenStart.Literal
-		if paramType == "string" {
-			paramType = "char *"
-		}
-		code += paramType + " " + paramName
+	return t + " " + v.Name
+}
 
-		if i+1 < len(node.Children[1].Children) {
-			code += ", "
-		}
+func (e *emitter) returnType(f *ir.Func) string {
+	switch {
+	case len(f.Results) > 1:
+		return "struct " + mangle(f.Name) + "_results"
+	case len(f.Results) == 1:
+		return cType(f.Results[0])
+	case f == e.main: // Knox allows main to be void but C requires int.
+		return "int"
 	}
-	code += ")"
+	return "void"
+}
 
-	// Save this as the prototype.
-	prototypes = append(prototypes, code+";")
+func (e *emitter) signature(f *ir.Func) string {
+	var params []string
+	for _, param := range f.Params {
+		params = append(params, declaration(param))
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+	return e.returnType(f) + " " + mangle(f.Name) + "(" + strings.Join(params, ", ") + ")"
+}
 
-	// Body.
-	code += " " + block(&node.Children[3])
+func (e *emitter) function(f *ir.Func) string {
+	e.fn = f
+	e.level = 1
+	e.labels = 0
+	e.loops = nil
 
-	return code
+	code := e.signature(f) + " {\n"
+	for _, local := range f.Locals {
+		code += "\t" + declaration(local) + ";\n"
+	}
+	code += e.stmts(f.Body)
+	return code + "}\n\n"
 }
 
-func block(node *ast.Node) string {
+////
+// Statements.
+////
+
+func (e *emitter) stmts(stmts []ir.Stmt) string {
 	var code string
-	level++
-	code += "{\n"
-	for _, s := range node.Children {
-		code += indent() + statement(&s)
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *ir.Instr:
+			code += e.instr(s)
+		case *ir.If:
+			code += indent(e.level) + "if (" + e.value(s.Cond) + ") " + e.block(s.Then)
+			if len(s.Else) > 0 {
+				code += " else " + e.block(s.Else)
+			}
+			code += "\n"
+		case *ir.Loop:
+			// Continue jumps over the body to the post statements.
+			label := ""
+			if len(s.Post) > 0 {
+				e.labels++
+				label = fmt.Sprintf("continue_%d", e.labels)
+			}
+			e.loops = append(e.loops, label)
+			e.level++
+			body := e.stmts(s.Body)
+			e.loops = e.loops[:len(e.loops)-1]
+			if label != "" {
+				body += indent(e.level-1) + label + ":;\n" + e.stmts(s.Post)
+			}
+			e.level--
+			code += indent(e.level) + "while (1) {\n" + body + indent(e.level) + "}\n"
+		case *ir.Break:
+			code += indent(e.level) + "break;\n"
+		case *ir.Continue:
+			if label := e.loops[len(e.loops)-1]; label != "" {
+				code += indent(e.level) + "goto " + label + ";\n"
+			} else {
+				code += indent(e.level) + "continue;\n"
+			}
+		case *ir.Return:
+			code += indent(e.level) + e.ret(s.Values) + "\n"
+		}
 	}
-	level--
-	code += indent() + "}\n\n"
 	return code
 }
 
-// Block without newline.
-func blockIf(node *ast.Node) string {
-	var code string
-	level++
-	code += "{\n"
-	for _, s := range node.Children {
-		code += indent() + statement(&s)
+// Statements in braces, without a trailing newline.
+func (e *emitter) block(stmts []ir.Stmt) string {
+	e.level++
+	code := "{\n" + e.stmts(stmts)
+	e.level--
+	return code + indent(e.level) + "}"
+}
+
+func (e *emitter) ret(values []ir.Value) string {
+	switch {
+	case len(values) > 1:
+		var fields []string
+		for _, v := range values {
+			fields = append(fields, e.value(v))
+		}
+		return "return (" + e.returnType(e.fn) + "){" + strings.Join(fields, ", ") + "};"
+	case len(values) == 1:
+		return "return " + e.value(values[0]) + ";"
+	case e.fn == e.main:
+		return "return 0;"
 	}
-	level--
-	code += indent() + "}"
-	return code
+	return "return;"
 }
 
-func statement(node *ast.Node) string {
-	currentName = ""
+////
+// Instructions.
+////
+
+var operators = map[ir.Op]string{
+	ir.Add: "+", ir.Sub: "-", ir.Mul: "*", ir.Div: "/", ir.Rem: "%",
+	ir.And: "&", ir.Or: "|", ir.Xor: "^", ir.Shl: "<<", ir.Shr: ">>",
+	ir.Eq: "==", ir.Ne: "!=", ir.Lt: "<", ir.Le: "<=", ir.Gt: ">", ir.Ge: ">=",
+}
+
+func (e *emitter) instr(in *ir.Instr) string {
+	args := make([]string, len(in.Args))
+	for i, arg := range in.Args {
+		args[i] = e.value(arg)
+	}
 
 	var code string
-	switch node.Type {
-	case ast.VARDECL:
-		code = varDecl(node)
-	case ast.VARASSIGN:
-		code = varAssign(node)
-	case ast.IFSTATEMENT:
-		code = ifStatement(node)
-	case ast.WHILESTATEMENT:
-		code = whileStatement(node)
-	case ast.FORSTATEMENT:
-		code = forStatement(node)
-	case ast.JUMPSTATEMENT:
-		code = jumpStatement(node)
-	case ast.LEFTEXPR:
-		code = expr(&node.Children[0]) + ";\n"
-	case ast.FUNCCALL:
-		code = funcCall(node) + "\n"
-	}
-
-	if nextLine != "" {
-		code += nextLine + "\n"
-		nextLine = ""
+	if e.debug && dereferences(in) && len(in.Args) > 0 {
+		self := e.fn.Class != nil && in.Args[0] == e.fn.Params[0] // Callers check self.
+		if !self {
+			code = e.trap(args[0]+" == NULL", "nil "+in.Args[0].Type()+" dereferenced", in.Line)
+		}
 	}
-	return code
+	return code + e.plainInstr(in, args)
 }
 
-// TODO: This needs to be rewritten to recursively handle dotop.
-func funcCall(node *ast.Node) string {
+func (e *emitter) plainInstr(in *ir.Instr, args []string) string {
+	if e.checked && len(in.Dst) == 1 && ir.IsInt(in.Dst[0].Typ) {
+		if code, ok := e.checkedInstr(in); ok {
+			return code
+		}
+	}
 
-	// Normal function calls.
-	if node.Children[0].Type != ast.DOTOP {
-		funcName := node.Children[0].TokenStart.Literal
-		var argList string
-		for index, child := range node.Children {
-			if index == 0 {
-				continue
+	var rhs string
+	switch in.Op {
+	case ir.Copy:
+		rhs = args[0]
+	case ir.Add, ir.Sub, ir.Mul, ir.Div, ir.Rem, ir.Eq, ir.Ne, ir.Lt, ir.Le, ir.Gt, ir.Ge:
+		if in.Op == ir.Rem && ir.IsFloat(in.Args[0].Type()) {
+			abortMsg(in.Line, "The C backend doesn't support % on "+in.Args[0].Type())
+		}
+		if in.Args[0].Type() == "string" { // Strings compare by value.
+			rhs = "knox_string_compare(" + args[0] + ", " + args[1] + ") " + operators[in.Op] + " 0"
+		} else {
+			rhs = args[0] + " " + operators[in.Op] + " " + args[1]
+		}
+	case ir.And, ir.Or, ir.Xor:
+		rhs = args[0] + " " + operators[in.Op] + " " + args[1]
+	case ir.Shl, ir.Shr:
+		// The count is masked since shifting by the width or more is undefined, and so is shifting a negative
+		// number left, so signed values are shifted as unsigned.
+		t := in.Dst[0].Typ
+		count := fmt.Sprintf("(%s & %d)", args[1], ir.Bits(t)-1)
+		if in.Op == ir.Shl && !ir.IsUnsigned(t) {
+			rhs = fmt.Sprintf("(%s)((uint%d_t)%s << %s)", cType(t), ir.Bits(t), args[0], count)
+		} else {
+			rhs = args[0] + " " + operators[in.Op] + " " + count
+		}
+	case ir.Concat:
+		rhs = fmt.Sprintf("knox_string_concat(%d, %s)", len(args), strings.Join(args, ", "))
+	case ir.Neg:
+		rhs = "-" + args[0]
+	case ir.Not:
+		rhs = "!" + args[0]
+	case ir.Compl:
+		rhs = "~" + args[0]
+	case ir.Convert:
+		from, to := in.Args[0].Type(), in.Dst[0].Typ
+		if to == "string" {
+			switch {
+			case ir.IsInt(from):
+				rhs = "knox_int_to_string(" + args[0] + ")"
+			case ir.IsFloat(from):
+				rhs = fmt.Sprintf("knox_float_to_string(%s, %d)", args[0], ir.Bits(from))
+			case from == "bool":
+				rhs = "knox_bool_to_string(" + args[0] + ")"
+			default:
+				abortMsg(in.Line, "The C backend can't cast "+from+" to string")
 			}
-			argList += expr(&child.Children[0])
-			if index < len(node.Children)-1 {
-				argList += ", "
+		} else if from == "string" {
+			abortMsg(in.Line, "The C backend can't cast string to "+to)
+		} else {
+			rhs = "(" + cType(to) + ")" + args[0]
+		}
+	case ir.Call:
+		call := mangle(in.Func.Name) + "(" + strings.Join(args, ", ") + ")"
+		if len(in.Dst) > 1 {
+			code := indent(e.level) + "{\n"
+			code += indent(e.level+1) + e.returnType(in.Func) + " knox_results = " + call + ";\n"
+			for i, dst := range in.Dst {
+				code += fmt.Sprintf("%s%s = knox_results.r%d;\n", indent(e.level+1), dst.Name, i)
 			}
+			return code + indent(e.level) + "}\n"
 		}
-		return funcName + "(" + argList + ")"
-	}
-
-	// Either a package or a method.
-	// TODO: Handle builtin functions in a better way.
-	if node.Children[0].Children[0].TokenStart.Literal == "stl" {
-		switch node.Children[0].Children[1].TokenStart.Literal {
-		case "print":
-			var funcName string
-			var argList string
-			funcName = "printf"
-			argList = expr(&node.Children[1])
-			return funcName + "(\"%s\", " + argList + ");"
-
-		// Bitwise.
-		case "and":
-			return "(" + expr(&node.Children[1]) + " & " + expr(&node.Children[2]) + ")"
-		case "or":
-			return "(" + expr(&node.Children[1]) + " | " + expr(&node.Children[2]) + ")"
-		case "not":
-			return "(~" + expr(&node.Children[1]) + ")"
-		case "left":
-			return "(" + expr(&node.Children[1]) + " << " + expr(&node.Children[2]) + ")"
-		case "right":
-			return "(" + expr(&node.Children[1]) + " >> " + expr(&node.Children[2]) + ")"
-		case "xor":
-			return "(" + expr(&node.Children[1]) + " ^ " + expr(&node.Children[2]) + ")"
-
-		// Math.
-		case "random":
-			return "random(" + expr(&node.Children[1]) + ", " + expr(&node.Children[2]) + ")"
-		case "randomf":
-			return "randomf(" + expr(&node.Children[1]) + ", " + expr(&node.Children[2]) + ")"
+		rhs = call
+	case ir.Builtin:
+		rhs = e.builtin(in, args)
+	case ir.New:
+		rhs = "malloc(sizeof(struct " + in.Class.Name + "))"
+	case ir.GetField:
+		rhs = args[0] + "->" + in.Class.Fields[in.Field].Name
+	case ir.SetField:
+		return indent(e.level) + args[0] + "->" + in.Class.Fields[in.Field].Name + " = " + args[1] + ";\n"
+	case ir.NewList:
+		code := indent(e.level) + in.Dst[0].Name + " = knox_list_new();\n"
+		for i, item := range in.Args {
+			code += indent(e.level) + "knox_list_append(" + in.Dst[0].Name + ", " + toSlot(args[i], item.Type()) + ");\n"
 		}
+		return code
+	case ir.Index:
+		list(in)
+		rhs = fromSlot(fmt.Sprintf("knox_list_get(%s, %s, %d)", args[0], args[1], in.Line), in.Dst[0].Typ)
+	case ir.SetIndex:
+		list(in)
+		return fmt.Sprintf("%sknox_list_set(%s, %s, %s, %d);\n", indent(e.level), args[0], args[1], toSlot(args[2], in.Args[2].Type()), in.Line)
+	case ir.Iter:
+		list(in)
+		rhs = "knox_list_copy(" + args[0] + ")"
+	default:
+		abortMsg(in.Line, "The C backend doesn't support "+in.Op.String())
+	}
+	if len(in.Dst) == 0 {
+		return indent(e.level) + rhs + ";\n"
+	}
+	return indent(e.level) + in.Dst[0].Name + " = " + rhs + ";\n"
+}
 
+// Whether an instruction uses the object or list in its first operand.
+func dereferences(in *ir.Instr) bool {
+	switch in.Op {
+	case ir.GetField, ir.SetField, ir.Index, ir.SetIndex, ir.Iter:
+		return true
+	case ir.Call:
+		return in.Func.Class != nil && in.Func != in.Func.Class.Init
+	case ir.Builtin:
+		return strings.HasPrefix(in.Name, "list.") || strings.HasPrefix(in.Name, "map.")
 	}
+	return false
+}
 
-	// If a method.
-	// myobj.foo(a, b)  ->  foo(myobj, a, b)
-	if node.Children[0].Type == ast.DOTOP {
-		funcName := node.Children[0].Children[1].TokenStart.Literal
-		var argList string
-		//argList += node.Children[0].Children[0].TokenStart.Literal
-		argList += expr(&node.Children[0].Children[0])
-		if len(node.Children) > 1 {
-			argList += ", "
-			for index, child := range node.Children[1].Children {
-				argList += expr(&child)
-				if index < len(node.Children[1].Children)-1 {
-					argList += ", "
-				}
+// Integer arithmetic and conversions with runtime checks. The overflow builtins compute the exact result and
+// report whether it fits in the destination. Division by zero traps in @wrapping code too.
+func (e *emitter) checkedInstr(in *ir.Instr) (string, bool) {
+	if in.Wrapping && in.Op != ir.Div && in.Op != ir.Rem {
+		return "", false
+	}
+	dst := in.Dst[0].Name
+	args := make([]string, len(in.Args))
+	for i, arg := range in.Args {
+		args[i] = e.value(arg)
+		if _, ok := arg.(*ir.Const); ok { // Unsigned constants are stored as negative numbers when large.
+			args[i] = "(" + cType(arg.Type()) + ")" + args[i]
+		}
+	}
+	overflow := "integer overflow in " + operators[in.Op]
+	switch in.Op {
+	case ir.Add, ir.Sub, ir.Mul:
+		builtin := map[ir.Op]string{ir.Add: "add", ir.Sub: "sub", ir.Mul: "mul"}[in.Op]
+		return e.trap(fmt.Sprintf("__builtin_%s_overflow(%s, %s, &%s)", builtin, args[0], args[1], dst), overflow, in.Line), true
+	case ir.Div, ir.Rem:
+		code := e.trap(args[1]+" == 0", "division by zero", in.Line)
+		if !ir.IsUnsigned(in.Dst[0].Typ) && !in.Wrapping { // The minimum value divided by -1 doesn't fit.
+			code += e.trap(fmt.Sprintf("%s == -1 && __builtin_sub_overflow(0, %s, &%s)", args[1], args[0], dst), overflow, in.Line)
+		}
+		return code + indent(e.level) + dst + " = " + args[0] + " " + operators[in.Op] + " " + args[1] + ";\n", true
+	case ir.Neg:
+		return e.trap(fmt.Sprintf("__builtin_sub_overflow(0, %s, &%s)", args[0], dst), "integer overflow in negation", in.Line), true
+	case ir.Convert:
+		from, to := in.Args[0].Type(), in.Dst[0].Typ
+		msg := "integer overflow in conversion to " + to
+		if ir.IsInt(from) {
+			return e.trap(fmt.Sprintf("__builtin_add_overflow(%s, 0, &%s)", args[0], dst), msg, in.Line), true
+		} else if ir.IsFloat(from) {
+			bits := ir.Bits(to)
+			min, max := 0.0, math.Ldexp(1, bits)
+			if !ir.IsUnsigned(to) {
+				min, max = -math.Ldexp(1, bits-1), math.Ldexp(1, bits-1)
 			}
+			cond := fmt.Sprintf("!(trunc(%s) >= %s && trunc(%s) < %s)", args[0], floatConstant(min, "f64"), args[0], floatConstant(max, "f64"))
+			code := e.trap(cond, msg, in.Line)
+			return code + indent(e.level) + dst + " = (" + cType(to) + ")" + args[0] + ";\n", true
 		}
-		return funcName + "(" + argList + ")"
 	}
-
-	return ""
+	return "", false
 }
 
-func ifStatement(node *ast.Node) string {
-	code := "if("
-	code += expr(&node.Children[0]) + ") " + blockIf(&node.Children[1]) // Condition and block
-
-	for i := 2; i < len(node.Children); i += 2 {
-		if i+1 != len(node.Children) { // Else if
-			code += " else if(" + expr(&node.Children[i]) + ") " + blockIf(&node.Children[i+1])
+func (e *emitter) trap(cond string, msg string, line int) string {
+	return fmt.Sprintf("%sif (%s) knox_trap(%s, %s, %d);\n", indent(e.level), cond, cString(msg), e.file, line)
+}
 
-		} else { // Else
-			code += " else " + blockIf(&node.Children[i])
+func (e *emitter) builtin(in *ir.Instr, args []string) string {
+	switch in.Name {
+	case "stl.print", "stl.println", "stl.eprint":
+		return "knox_" + in.Name[len("stl."):] + "(" + args[0] + ")"
+	case "rune.toString":
+		return "knox_rune_to_string(" + args[0] + ")"
+	case "stl.random":
+		return "knox_random(" + args[0] + ", " + args[1] + ")"
+	case "stl.range":
+		return "knox_range(" + strings.Join(args, ", ") + ")"
+	case "list.append":
+		return "knox_list_append(" + args[0] + ", " + toSlot(args[1], in.Args[1].Type()) + ")"
+	case "list.length":
+		return "knox_list_length(" + args[0] + ")"
+	}
+	if strings.HasPrefix(in.Name, "string.") { // Runtime functions named after the methods.
+		if in.Name == "string.at" || in.Name == "string.slice" {
+			args = append(args, strconv.Itoa(in.Line))
 		}
+		return "knox_" + mangle(in.Name) + "(" + strings.Join(args, ", ") + ")"
 	}
-
-	return code + "\n"
+	abortMsg(in.Line, "The C backend doesn't support "+in.Name)
+	return ""
 }
 
-func whileStatement(node *ast.Node) string {
-	return "while(" + expr(&node.Children[0]) + ") " + blockIf(&node.Children[1]) + "\n"
+// Check that the container operand is a list. Maps aren't supported yet.
+func list(in *ir.Instr) {
+	if !ir.IsList(in.Args[0].Type()) {
+		abortMsg(in.Line, "Only lists are supported by the C backend")
+	}
 }
 
-func forStatement(node *ast.Node) string {
-	return ""
-	// TODO
+// List items are stored in 64-bit slots.
+func toSlot(value string, t string) string {
+	switch {
+	case ir.IsFloat(t):
+		return "knox_slot_from_double(" + value + ")"
+	case ir.IsPrimitive(t):
+		return "(int64_t)" + value
+	}
+	return "(int64_t)(intptr_t)" + value
 }
 
-func jumpStatement(node *ast.Node) string {
-	code := node.TokenStart.Literal + " "
-	for index, child := range node.Children {
-		code += expr(&child.Children[0])
-		if index < len(node.Children)-1 {
-			code += ", "
-		}
+func fromSlot(slot string, t string) string {
+	switch {
+	case ir.IsFloat(t):
+		return "(" + cType(t) + ")knox_slot_to_double(" + slot + ")"
+	case ir.IsPrimitive(t):
+		return "(" + cType(t) + ")" + slot
 	}
-	return code + ";\n"
+	return "(" + cType(t) + ")(intptr_t)" + slot
 }
 
-func varAssign(node *ast.Node) string {
-	code := ""
-	// TODO: Fix multiple assignment.
-	for i := 0; i < len(node.Children)-1; i++ {
-		code += node.Children[i].Children[0].TokenStart.Literal
-		//currentName = node.Children[i].Children[0].TokenStart.Literal
-		currentName = expr(&node.Children[i])
-		if i+1 < len(node.Children)-1 {
-			code += ", "
+// C expression for an operand.
+func (e *emitter) value(v ir.Value) string {
+	switch v := v.(type) {
+	case *ir.Var:
+		return v.Name
+	case *ir.Const:
+		switch value := v.Value.(type) {
+		case int64:
+			switch {
+			case ir.IsUnsigned(v.Typ) && value < 0: // u64 values above the int64 range.
+				return strconv.FormatUint(uint64(value), 10) + "ULL"
+			case value == math.MinInt64: // C has no negative literals, and 9223372036854775808 doesn't fit.
+				return "(-9223372036854775807LL - 1)"
+			case value < 0: // Keep negative numbers apart from other operators.
+				return "(" + strconv.FormatInt(value, 10) + ")"
+			}
+			return strconv.FormatInt(value, 10)
+		case float64:
+			if value < 0 {
+				return "(" + floatConstant(value, v.Typ) + ")"
+			}
+			return floatConstant(value, v.Typ)
+		case string:
+			return e.stringConstant(value)
+		case bool:
+			return strconv.FormatBool(value)
 		}
 	}
-	if node.Children[0].Children[0].Type == ast.DOTOP {
-		code = expr(&node.Children[0].Children[0])
-	}
-	return code + " = " + expr(&node.Children[len(node.Children)-1].Children[0]) + ";\n"
+	return "NULL"
 }
 
-func varDecl(node *ast.Node) string {
-	code := ""
-	member := ""
-	// TODO: Fix multiple declarations.
-	for i := 0; i < len(node.Children)-1; i += 2 {
-		varName := node.Children[i].TokenStart.Literal
-		currentName = expr(&node.Children[i])
-
-		varType := node.Children[i+1].Children[0].TokenStart.Literal
-		if val, ok := datatypes[varType]; ok {
-			varType = val
-		} else {
-			varType = "struct " + varType + " *"
-		}
-
-		code += varType + " " + varName
-		member += varName
-		if i+2 < len(node.Children)-1 {
-			code += ", "
-		}
+// Pointer to a static string with the bytes of a constant.
+func (e *emitter) stringConstant(value string) string {
+	name, ok := e.strings[value]
+	if !ok {
+		name = fmt.Sprintf("knox_string_%d", len(e.strings))
+		e.strings[value] = name
+		e.constants += fmt.Sprintf("static struct knox_string %s = {%d, %s};\n", name, len(value), cString(value))
 	}
+	return "&" + name
+}
 
-	varExpr := expr(&node.Children[len(node.Children)-1].Children[0])
-	member += " = " + varExpr + ";\n"
-	if currentClass != "" {
-		currentMembers = append(currentMembers, member)
+func floatConstant(value float64, t string) string {
+	switch {
+	case math.IsNaN(value):
+		return "NAN"
+	case math.IsInf(value, 1):
+		return "INFINITY"
+	case math.IsInf(value, -1):
+		return "-INFINITY"
 	}
-	return code + " = " + varExpr + ";\n"
+	s := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".en") {
+		s += ".0"
+	}
+	if cType(t) == "float" {
+		s += "f"
+	}
+	return s
 }
 
-func expr(node *ast.Node) string {
-	if node.Type == ast.BINARYOP {
-		// If concatenating strings.
-		if node.TokenStart.Literal == "concat" { // Type checker will convert + for strings to concat.
-			return "concat(" + expr(&node.Children[0]) + ", " + expr(&node.Children[1]) + ")"
-		}
-		// Else any other binary op.
-		return "(" + expr(&node.Children[0]) + node.TokenStart.Literal + expr(&node.Children[1]) + ")"
-	} else if node.Type == ast.UNARYOP {
-		return "(" + node.TokenStart.Literal + expr(&node.Children[0]) + ")"
-	} else if node.Type == ast.FUNCCALL {
-		return funcCall(node)
-	} else if node.Type == ast.DOTOP {
-		return "(" + expr(&node.Children[0]) + "->" + expr(&node.Children[1]) + ")"
-	} else if node.Type == ast.EXPRESSION {
-		return expr(&node.Children[0])
-	} else if node.Type == ast.CAST {
-		return "((" + datatypes[expr(&node.Children[1])] + ")" + expr(&node.Children[0]) + ")"
-	} else if node.Type == ast.NEW {
-		nextLine = "\t_" + node.Children[0].Children[0].TokenStart.Literal + "(" + currentName + ");"
-		return "malloc(sizeof(struct " + node.Children[0].Children[0].TokenStart.Literal + "))"
-	} else { // Primary.
-		if node.Type == ast.STRING {
-			return "\"" + node.TokenStart.Literal + "\""
-		}
-		if node.Type == ast.NIL {
-			return "NULL"
-		}
-		if node.Type == ast.INT || node.Type == ast.FLOAT {
-			return strings.ReplaceAll(node.TokenStart.Literal, "_", "") // Remove the underscore separators.
+// Quote a string as a C literal, escaping everything outside printable ASCII.
+func cString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, b := range []byte(s) {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			fmt.Fprintf(&sb, "\\%03o", b)
+		} else {
+			sb.WriteByte(b)
 		}
-		return node.TokenStart.Literal
 	}
+	sb.WriteByte('"')
+	return sb.String()
 }
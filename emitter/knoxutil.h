@@ -3,37 +3,452 @@
 #include <string.h>
 #include <stdint.h>
 #include <stdbool.h>
+#include <stdarg.h>
+#include <math.h>
 
-// Concatensate two strings.
-char* concat(const char *s1, const char *s2)
+// Strings are immutable UTF-8 bytes and their length. Literals are static and slices share the bytes of the
+// string they come from, so the bytes aren't followed by a zero.
+struct knox_string {
+    int64_t length;
+    const char *data;
+};
+
+// New string holding a copy of the bytes.
+static struct knox_string* knox_string_new(const char *data, int64_t length)
 {
-    const size_t len1 = strlen(s1);
-    const size_t len2 = strlen(s2);
-    char *result = malloc(len1 + len2 + 1); 
+    struct knox_string *s = malloc(sizeof(struct knox_string) + length);
     // TODO: Check for malloc errors.
-    memcpy(result, s1, len1);
-    memcpy(result + len1, s2, len2 + 1);
-    return result;
+    char *bytes = (char *)(s + 1);
+    memcpy(bytes, data, length);
+    s->length = length;
+    s->data = bytes;
+    return s;
 }
 
-// Copy the contents of one string to a new string.
-char* copy(const char *s)
+// New string sharing the bytes of another.
+static struct knox_string* knox_string_view(const char *data, int64_t length)
 {
-    const size_t len = strlen(s);
-    char *result = malloc(len + 1); 
-    // TODO: Check for malloc errors.
-    memcpy(result, s, len + 1);
+    struct knox_string *s = malloc(sizeof(struct knox_string));
+    s->length = length;
+    s->data = data;
+    return s;
+}
+
+static bool knox_rune_start(char c)
+{
+    return ((unsigned char)c & 0xC0) != 0x80;
+}
+
+// Number of runes in the first n bytes.
+static int64_t knox_runes(const char *data, int64_t n)
+{
+    int64_t runes = 0;
+    for (int64_t i = 0; i < n; i++) {
+        runes += knox_rune_start(data[i]);
+    }
+    return runes;
+}
+
+// Byte offset of the rune at an index, the length for the index just past the end, or -1 outside the string.
+static int64_t knox_string_offset(struct knox_string *s, int64_t index)
+{
+    if (index < 0) {
+        return -1;
+    }
+    int64_t runes = 0;
+    for (int64_t i = 0; i < s->length; i++) {
+        if (knox_rune_start(s->data[i]) && runes++ == index) {
+            return i;
+        }
+    }
+    return runes == index ? s->length : -1;
+}
+
+// Join count strings into a new one with a single allocation.
+struct knox_string* knox_string_concat(int count, ...)
+{
+    va_list parts;
+    int64_t length = 0;
+    va_start(parts, count);
+    for (int i = 0; i < count; i++) {
+        length += va_arg(parts, struct knox_string *)->length;
+    }
+    va_end(parts);
+
+    struct knox_string *s = malloc(sizeof(struct knox_string) + length);
+    char *bytes = (char *)(s + 1);
+    s->length = length;
+    s->data = bytes;
+    va_start(parts, count);
+    for (int i = 0; i < count; i++) {
+        struct knox_string *part = va_arg(parts, struct knox_string *);
+        memcpy(bytes, part->data, part->length);
+        bytes += part->length;
+    }
+    va_end(parts);
+    return s;
+}
+
+// Negative, zero or positive as a sorts before, the same as or after b, comparing bytes.
+int knox_string_compare(struct knox_string *a, struct knox_string *b)
+{
+    int cmp = memcmp(a->data, b->data, a->length < b->length ? a->length : b->length);
+    if (cmp != 0) {
+        return cmp;
+    }
+    return (a->length > b->length) - (a->length < b->length);
+}
+
+void knox_print(struct knox_string *s)
+{
+    fwrite(s->data, 1, s->length, stdout);
+}
+
+void knox_println(struct knox_string *s)
+{
+    fwrite(s->data, 1, s->length, stdout);
+    putchar('\n');
+}
+
+void knox_eprint(struct knox_string *s)
+{
+    fwrite(s->data, 1, s->length, stderr);
+}
+
+// Decimal representation of an integer, for casts to string.
+struct knox_string* knox_int_to_string(int64_t n)
+{
+    char buffer[24];
+    int length = snprintf(buffer, sizeof(buffer), "%lld", (long long)n);
+    return knox_string_new(buffer, length);
+}
+
+struct knox_string* knox_bool_to_string(bool b)
+{
+    return b ? knox_string_view("true", 4) : knox_string_view("false", 5);
+}
+
+// Shortest decimal representation that reads back as the same float of the given bits, in the same form as the vm's.
+struct knox_string* knox_float_to_string(double f, int bits)
+{
+    if (isnan(f)) {
+        return knox_string_view("NaN", 3);
+    } else if (isinf(f)) {
+        return f > 0 ? knox_string_view("+Inf", 4) : knox_string_view("-Inf", 4);
+    }
+    char buffer[32];
+    int digits;
+    for (digits = 1; digits <= 17; digits++) {
+        snprintf(buffer, sizeof(buffer), "%.*e", digits - 1, f);
+        double read = strtod(buffer, NULL);
+        if (bits == 32 ? (float)read == (float)f : read == f) {
+            break;
+        }
+    }
+    int exponent = atoi(strchr(buffer, 'e') + 1);
+    int length = strlen(buffer);
+    if (exponent >= -4 && exponent < 6) { // Large and small numbers keep the exponent.
+        int decimals = digits - 1 - exponent;
+        length = snprintf(buffer, sizeof(buffer), "%.*f", decimals > 0 ? decimals : 0, f);
+    }
+    return knox_string_new(buffer, length);
+}
+
+int64_t knox_string_length(struct knox_string *s)
+{
+    return knox_runes(s->data, s->length);
+}
+
+// The rune at an index, as a string.
+struct knox_string* knox_string_at(struct knox_string *s, int64_t index, int line)
+{
+    int64_t start = knox_string_offset(s, index);
+    if (start < 0 || start == s->length) {
+        fprintf(stderr, "Runtime error: index %lld out of range for string of length %lld. Line %d.\n", (long long)index, (long long)knox_string_length(s), line);
+        exit(1);
+    }
+    int64_t end = start + 1;
+    while (end < s->length && !knox_rune_start(s->data[end])) {
+        end++;
+    }
+    return knox_string_view(s->data + start, end - start);
+}
+
+struct knox_string* knox_string_slice(struct knox_string *s, int64_t start, int64_t end, int line)
+{
+    int64_t from = knox_string_offset(s, start);
+    int64_t to = knox_string_offset(s, end);
+    if (from < 0 || to < 0 || start > end) {
+        fprintf(stderr, "Runtime error: slice %lld:%lld out of range for string of length %lld. Line %d.\n", (long long)start, (long long)end, (long long)knox_string_length(s), line);
+        exit(1);
+    }
+    return knox_string_view(s->data + from, to - from);
+}
+
+// Byte offset of the first occurrence of sub at or after a byte offset, or -1.
+static int64_t knox_string_search(struct knox_string *s, struct knox_string *sub, int64_t from)
+{
+    for (int64_t i = from; i + sub->length <= s->length; i++) {
+        if (memcmp(s->data + i, sub->data, sub->length) == 0) {
+            return i;
+        }
+    }
+    return -1;
+}
+
+int64_t knox_string_find(struct knox_string *s, struct knox_string *sub)
+{
+    int64_t i = knox_string_search(s, sub, 0);
+    return i < 0 ? -1 : knox_runes(s->data, i);
+}
+
+// Whitespace is trimmed from both ends.
+struct knox_string* knox_string_trim(struct knox_string *s)
+{
+    int64_t start = 0, end = s->length;
+    while (start < end && strchr(" \t\n\r", s->data[start]) != NULL) {
+        start++;
+    }
+    while (end > start && strchr(" \t\n\r", s->data[end - 1]) != NULL) {
+        end--;
+    }
+    return knox_string_view(s->data + start, end - start);
+}
+
+// Replace every occurrence of old. An empty old string leaves the string as it is.
+struct knox_string* knox_string_replace(struct knox_string *s, struct knox_string *old, struct knox_string *replacement)
+{
+    if (old->length == 0) {
+        return s;
+    }
+    struct knox_string *result = knox_string_new("", 0);
+    int64_t start = 0;
+    for (int64_t i; (i = knox_string_search(s, old, start)) >= 0; start = i + old->length) {
+        result = knox_string_concat(3, result, knox_string_view(s->data + start, i - start), replacement);
+    }
+    return knox_string_concat(2, result, knox_string_view(s->data + start, s->length - start));
+}
+
+// Shift the ASCII letters from first to last, leaving other characters alone.
+static struct knox_string* knox_string_map_ascii(struct knox_string *s, char first, char last, int shift)
+{
+    struct knox_string *result = knox_string_new(s->data, s->length);
+    char *bytes = (char *)result->data;
+    for (int64_t i = 0; i < s->length; i++) {
+        if (bytes[i] >= first && bytes[i] <= last) {
+            bytes[i] += shift;
+        }
+    }
     return result;
 }
 
-int random(int min, int max) {
+struct knox_string* knox_string_toUpper(struct knox_string *s)
+{
+    return knox_string_map_ascii(s, 'a', 'z', 'A' - 'a');
+}
+
+struct knox_string* knox_string_toLower(struct knox_string *s)
+{
+    return knox_string_map_ascii(s, 'A', 'Z', 'a' - 'A');
+}
+
+// UTF-8 encoding of a code point. Invalid code points become U+FFFD, like in Go.
+struct knox_string* knox_rune_to_string(int32_t r)
+{
+    char bytes[4];
+    int n;
+    if (r < 0 || r > 0x10FFFF || (r >= 0xD800 && r <= 0xDFFF)) {
+        r = 0xFFFD;
+    }
+    if (r < 0x80) {
+        bytes[0] = r;
+        n = 1;
+    } else if (r < 0x800) {
+        bytes[0] = 0xC0 | (r >> 6);
+        bytes[1] = 0x80 | (r & 0x3F);
+        n = 2;
+    } else if (r < 0x10000) {
+        bytes[0] = 0xE0 | (r >> 12);
+        bytes[1] = 0x80 | ((r >> 6) & 0x3F);
+        bytes[2] = 0x80 | (r & 0x3F);
+        n = 3;
+    } else {
+        bytes[0] = 0xF0 | (r >> 18);
+        bytes[1] = 0x80 | ((r >> 12) & 0x3F);
+        bytes[2] = 0x80 | ((r >> 6) & 0x3F);
+        bytes[3] = 0x80 | (r & 0x3F);
+        n = 4;
+    }
+    return knox_string_new(bytes, n);
+}
+
+// The string as a Knox literal. Braces are escaped so that they don't start an interpolation.
+struct knox_string* knox_string_quote(struct knox_string *s)
+{
+    char *bytes = malloc(2 + 6 * s->length); // Control characters take at most 6 bytes, as \u{1f}.
+    int64_t n = 0;
+    bytes[n++] = '"';
+    for (int64_t i = 0; i < s->length; i++) {
+        char c = s->data[i];
+        switch (c) {
+        case '"': case '\\': case '{': case '}':
+            bytes[n++] = '\\';
+            bytes[n++] = c;
+            break;
+        case '\n':
+            n += sprintf(bytes + n, "\\n");
+            break;
+        case '\t':
+            n += sprintf(bytes + n, "\\t");
+            break;
+        case '\r':
+            n += sprintf(bytes + n, "\\r");
+            break;
+        case 0:
+            n += sprintf(bytes + n, "\\0");
+            break;
+        default:
+            if ((unsigned char)c < 0x20 || c == 0x7f) {
+                n += sprintf(bytes + n, "\\u{%x}", c);
+            } else {
+                bytes[n++] = c;
+            }
+        }
+    }
+    bytes[n++] = '"';
+    return knox_string_view(bytes, n);
+}
+
+// Abort on a failed runtime check of a checked build.
+void knox_trap(const char *msg, const char *file, int line)
+{
+    fprintf(stderr, "Runtime error: %s. %s, line %d.\n", msg, file, line);
+    exit(1);
+}
+
+int knox_random(int min, int max) {
     return (rand() % (max - min + 1)) + min; 
 }
 
-float randomf(float min, float max) {
+float knox_randomf(float min, float max) {
     return min + ((float)rand() / RAND_MAX) * (max - min);
 }
 
-double randomd(double min, double max) {
+double knox_randomd(double min, double max) {
     return min + ((double)rand() / RAND_MAX) * (max - min);
-}
\ No newline at end of file
+}
+
+// Growable list. Items are stored in 64-bit slots regardless of element type.
+struct knox_list {
+    int64_t length;
+    int64_t capacity;
+    int64_t *items;
+};
+
+// Floating point items keep their bits in the slot.
+int64_t knox_slot_from_double(double value)
+{
+    int64_t slot;
+    memcpy(&slot, &value, sizeof(slot));
+    return slot;
+}
+
+double knox_slot_to_double(int64_t slot)
+{
+    double value;
+    memcpy(&value, &slot, sizeof(value));
+    return value;
+}
+
+struct knox_list* knox_list_new(void)
+{
+    struct knox_list *list = calloc(1, sizeof(struct knox_list));
+    // TODO: Check for malloc errors.
+    return list;
+}
+
+void knox_list_append(struct knox_list *list, int64_t item)
+{
+    if (list->length == list->capacity) {
+        list->capacity = list->capacity == 0 ? 8 : list->capacity * 2;
+        list->items = realloc(list->items, list->capacity * sizeof(int64_t));
+    }
+    list->items[list->length++] = item;
+}
+
+// Snapshot of a list for iteration, so that the loop isn't affected by changes to the list.
+struct knox_list* knox_list_copy(struct knox_list *list)
+{
+    struct knox_list *copy = knox_list_new();
+    for (int64_t i = 0; i < list->length; i++) {
+        knox_list_append(copy, list->items[i]);
+    }
+    return copy;
+}
+
+int64_t knox_list_length(struct knox_list *list)
+{
+    return list->length;
+}
+
+// Parts between each separator. An empty separator splits the string into runes.
+struct knox_list* knox_string_split(struct knox_string *s, struct knox_string *sep)
+{
+    struct knox_list *parts = knox_list_new();
+    if (sep->length == 0) {
+        for (int64_t start = 0, end; start < s->length; start = end) {
+            for (end = start + 1; end < s->length && !knox_rune_start(s->data[end]); end++) {
+            }
+            knox_list_append(parts, (int64_t)(intptr_t)knox_string_view(s->data + start, end - start));
+        }
+        return parts;
+    }
+    int64_t start = 0;
+    for (int64_t i; (i = knox_string_search(s, sep, start)) >= 0; start = i + sep->length) {
+        knox_list_append(parts, (int64_t)(intptr_t)knox_string_view(s->data + start, i - start));
+    }
+    knox_list_append(parts, (int64_t)(intptr_t)knox_string_view(s->data + start, s->length - start));
+    return parts;
+}
+
+// The strings in a list with a separator between each.
+struct knox_string* knox_string_join(struct knox_string *sep, struct knox_list *parts)
+{
+    struct knox_string *result = knox_string_new("", 0);
+    for (int64_t i = 0; i < parts->length; i++) {
+        if (i > 0) {
+            result = knox_string_concat(2, result, sep);
+        }
+        result = knox_string_concat(2, result, (struct knox_string *)(intptr_t)parts->items[i]);
+    }
+    return result;
+}
+
+static void knox_list_check(struct knox_list *list, int64_t index, int line)
+{
+    if (index < 0 || index >= list->length) {
+        fprintf(stderr, "Runtime error: index %lld out of range for list of length %lld. Line %d.\n", (long long)index, (long long)list->length, line);
+        exit(1);
+    }
+}
+
+int64_t knox_list_get(struct knox_list *list, int64_t index, int line)
+{
+    knox_list_check(list, index, line);
+    return list->items[index];
+}
+
+void knox_list_set(struct knox_list *list, int64_t index, int64_t item, int line)
+{
+    knox_list_check(list, index, line);
+    list->items[index] = item;
+}
+
+struct knox_list* knox_range(int64_t start, int64_t end, int64_t step)
+{
+    struct knox_list *list = knox_list_new();
+    for (int64_t i = start; (step > 0 && i < end) || (step < 0 && i > end); i += step) {
+        knox_list_append(list, i);
+    }
+    return list;
+}
@@ -0,0 +1,33 @@
+package format
+
+import (
+	"knox/ast"
+	"knox/lexer"
+	"strings"
+)
+
+// Whether two programs have the same tree, apart from the lines of their tokens.
+func same(a *ast.Node, b *ast.Node) bool {
+	if a.Type != b.Type || a.TokenStart.Type != b.TokenStart.Type || a.TokenStart.Literal != b.TokenStart.Literal ||
+		a.Doc != b.Doc || strings.Join(a.Annotations, " ") != strings.Join(b.Annotations, " ") || len(a.Children) != len(b.Children) {
+		return false
+	}
+	for i := range a.Children {
+		if !same(&a.Children[i], &b.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameComments(a []lexer.Comment, b []lexer.Comment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Text != b[i].Text {
+			return false
+		}
+	}
+	return true
+}
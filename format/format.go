@@ -0,0 +1,413 @@
+package format
+
+import (
+	"fmt"
+	"knox/ast"
+	"knox/lexer"
+	"knox/parser"
+	"strings"
+)
+
+// Source formats Knox code. Comments stay next to the declarations and statements they were written with,
+// and runs of blank lines become one. The result is checked to parse to the same program with the same
+// comments, and to format to itself.
+func Source(code string) string {
+	output, prog, comments := render(code)
+	again, formatted, formattedComments := render(output)
+	if !same(&prog, &formatted) || !sameComments(comments, formattedComments) || again != output {
+		fmt.Println("Formatting changed the program. This is a bug in knox fmt.")
+		panic("Aborted.")
+	}
+	return output
+}
+
+func render(code string) (string, ast.Node, []lexer.Comment) {
+	l := lexer.New(code + "\n")
+	prog := parser.New(l).Program()
+	p := &printer{lines: strings.Split(code, "\n"), comments: l.Comments, braces: l.Braces, annotations: l.Annotations,
+		quotes: l.Quotes, open: true}
+	for i := range prog.Children {
+		p.declaration(&prog.Children[i])
+	}
+	p.commentsBefore(len(p.lines) + 1)
+	return p.b.String(), prog, l.Comments
+}
+
+type printer struct {
+	b           strings.Builder
+	depth       int
+	lines       []string        // Source lines, to find the blank ones.
+	comments    []lexer.Comment // Comments that haven't been printed.
+	braces      []int           // Lines of the closing braces of the blocks that haven't been printed.
+	opened      int             // Number of blocks started.
+	closed      int             // Number of closing braces printed.
+	annotations []int           // Lines of the annotations that haven't been printed.
+	quotes      []string        // Source text of the quoted literals that haven't been printed.
+	last        int             // Last source line printed.
+	open        bool            // Whether nothing has been printed yet in the file or block, so blank lines are dropped.
+}
+
+func (p *printer) write(text string) {
+	p.b.WriteString(text)
+}
+
+func (p *printer) indent() {
+	p.write(strings.Repeat("    ", p.depth))
+}
+
+// Start a line for a declaration, statement or comment that begins at a source line, after a blank line if the
+// source has one.
+func (p *printer) start(line int) {
+	if !p.open && p.blankBefore(line) {
+		p.write("\n")
+	}
+	p.open = false
+	p.indent()
+}
+
+// Whether the source has a blank line before a line, skipping the lines of annotations.
+func (p *printer) blankBefore(line int) bool {
+	for line--; line > p.last && line <= len(p.lines); line-- {
+		text := strings.TrimSpace(p.lines[line-1])
+		if text == "" {
+			return true
+		} else if !strings.HasPrefix(text, "@") {
+			return false
+		}
+	}
+	return false
+}
+
+// End a line of code that ends at a source line, with the comments written on or before that line. A // comment
+// ends the line, so the ones after it are left for their own lines.
+func (p *printer) end(line int) {
+	for len(p.comments) > 0 && p.comments[0].Line <= line {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.write(" " + c.Text)
+		p.seen(c.EndLine)
+		if strings.HasPrefix(c.Text, "//") {
+			break
+		}
+	}
+	p.write("\n")
+	p.seen(line)
+}
+
+func (p *printer) seen(line int) {
+	if line > p.last {
+		p.last = line
+	}
+}
+
+// Print the comments before a source line on their own lines.
+func (p *printer) commentsBefore(line int) {
+	for len(p.comments) > 0 && p.comments[0].Line < line {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.start(c.Line)
+		p.write(c.Text + "\n")
+		p.seen(c.EndLine)
+	}
+}
+
+// Print a block after its header, which ends at a source line, and return the line of its closing brace. An empty
+// block stays on one line if it was written on one, with the /* */ comments written in it. The braces are in the
+// order the blocks close, so a block takes the next one once its inner blocks have taken theirs.
+func (p *printer) block(node *ast.Node, header int, item func(*ast.Node)) int {
+	opening := p.opened
+	p.opened++
+	if len(node.Children) == 0 && p.braces[0] <= header {
+		text := " {"
+		var outside []lexer.Comment // Comments in the header, which stay for the end of the line.
+		for len(p.comments) > 0 && p.comments[0].Closed <= p.closed {
+			if c := p.comments[0]; c.Opened > opening {
+				text += " " + c.Text
+			} else {
+				outside = append(outside, c)
+			}
+			p.comments = p.comments[1:]
+		}
+		p.comments = append(outside, p.comments...)
+		if text != " {" {
+			text += " "
+		}
+		p.write(text + "}")
+		return p.closeBrace()
+	}
+	p.write(" {")
+	p.end(header)
+	p.depth++
+	p.open = true
+	for i := range node.Children {
+		item(&node.Children[i])
+	}
+	closing := p.closeBrace()
+	p.commentsBefore(closing)
+	p.depth--
+	p.open = false
+	p.indent()
+	p.write("}")
+	return closing
+}
+
+func (p *printer) closeBrace() int {
+	line := p.braces[0]
+	p.braces = p.braces[1:]
+	p.closed++
+	return line
+}
+
+// Line of the next annotation of a declaration. The ones of statements and parameters before it are skipped,
+// since they are printed on the line they annotate.
+func (p *printer) annotation() int {
+	for p.annotations[0] <= p.last {
+		p.annotations = p.annotations[1:]
+	}
+	line := p.annotations[0]
+	p.annotations = p.annotations[1:]
+	return line
+}
+
+// Functions, classes and constants, and the members and methods of classes. Annotations go on their own lines,
+// with the comments written between them and the declaration.
+func (p *printer) declaration(node *ast.Node) {
+	line := firstLine(node)
+	for _, annotation := range node.Annotations {
+		at := p.annotation()
+		p.commentsBefore(at)
+		p.start(at)
+		p.write("@" + annotation)
+		p.end(at)
+		p.open = true // The declaration follows its annotations without a blank line.
+	}
+	p.commentsBefore(line)
+	p.start(line)
+	switch node.Type {
+	case ast.FUNCDECL:
+		p.write("func " + node.Children[0].TokenStart.Literal + "(")
+		for i := range node.Children[1].Children {
+			if i > 0 {
+				p.write(", ")
+			}
+			param := &node.Children[1].Children[i]
+			p.write(annotations(param))
+			if param.TokenStart.Literal == "const" {
+				p.write("const ")
+			}
+			p.write(param.Children[0].TokenStart.Literal + " : " + typeName(&param.Children[1]))
+		}
+		p.write(") ")
+		results := node.Children[2].Children
+		if len(results) > 1 {
+			p.write("(")
+		}
+		for i := range results {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.write(typeName(&results[i]))
+		}
+		if len(results) > 1 {
+			p.write(")")
+		}
+		header := lastLine(&node.Children[2])
+		if params := lastLine(&node.Children[1]); params > header {
+			header = params
+		}
+		p.end(p.block(&node.Children[3], header, p.statement))
+	case ast.CLASS:
+		p.write("class " + node.Children[0].TokenStart.Literal)
+		p.end(p.block(&node.Children[1], node.Children[0].TokenStart.Line, p.declaration))
+	case ast.VARDECL:
+		p.write(p.varDecl(node) + ";")
+		p.end(lastLine(node))
+	}
+}
+
+// Statements, with their annotations before them on the same line.
+func (p *printer) statement(node *ast.Node) {
+	line := firstLine(node)
+	p.commentsBefore(line)
+	p.start(line)
+	p.write(annotations(node))
+	switch node.Type {
+	case ast.VARDECL:
+		p.write(p.varDecl(node) + ";")
+		p.end(lastLine(node))
+	case ast.VARASSIGN:
+		p.write(p.assignment(node) + ";")
+		p.end(lastLine(node))
+	case ast.LEFTEXPR:
+		p.write(p.expr(&node.Children[0]) + ";")
+		p.end(lastLine(node))
+	case ast.JUMPSTATEMENT:
+		p.write(node.TokenStart.Literal)
+		if len(node.Children) > 0 {
+			p.write(" " + p.exprs(node.Children))
+		}
+		p.write(";")
+		p.end(lastLine(node))
+	case ast.IFSTATEMENT:
+		var closing int
+		for i := 0; i+1 < len(node.Children); i += 2 {
+			if i > 0 {
+				p.write(" else ")
+			}
+			p.write("if " + p.expr(&node.Children[i]))
+			closing = p.block(&node.Children[i+1], lastLine(&node.Children[i]), p.statement)
+		}
+		if len(node.Children)%2 == 1 {
+			p.write(" else")
+			closing = p.block(&node.Children[len(node.Children)-1], closing, p.statement)
+		}
+		p.end(closing)
+	case ast.FORSTATEMENT:
+		p.write("for " + p.variables(&node.Children[0]) + " in " + p.expr(&node.Children[1]))
+		p.end(p.block(&node.Children[2], lastLine(&node.Children[1]), p.statement))
+	case ast.WHILESTATEMENT:
+		p.write("while " + p.expr(&node.Children[0]))
+		p.end(p.block(&node.Children[1], lastLine(&node.Children[0]), p.statement))
+	default:
+		fmt.Printf("Can't format a %s statement. Line %v.\n", node.Type, line)
+		panic("Aborted.")
+	}
+}
+
+// var x : T, y : U = e
+func (p *printer) varDecl(node *ast.Node) string {
+	return node.TokenStart.Literal + " " + p.variables(node) + " = " + p.expr(&node.Children[len(node.Children)-1])
+}
+
+// The names and types of a declaration.
+func (p *printer) variables(node *ast.Node) string {
+	var pairs []string
+	for i := 0; i+1 < len(node.Children); i += 2 {
+		pairs = append(pairs, node.Children[i].TokenStart.Literal+" : "+typeName(&node.Children[i+1]))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// x, y = e, or x += e and x++, whose expression is x + e with the target as its left operand.
+func (p *printer) assignment(node *ast.Node) string {
+	target := p.expr(&node.Children[0])
+	if ast.IsCompound(node) {
+		op := node.TokenStart.Literal
+		if op == "++" || op == "--" {
+			return target + op
+		}
+		return target + " " + op + " " + p.expr(&node.Children[1].Children[1])
+	}
+	last := len(node.Children) - 1
+	return p.exprs(node.Children[:last]) + " = " + p.expr(&node.Children[last])
+}
+
+func (p *printer) exprs(nodes []ast.Node) string {
+	var texts []string
+	for i := range nodes {
+		texts = append(texts, p.expr(&nodes[i]))
+	}
+	return strings.Join(texts, ", ")
+}
+
+// An expression where one is expected. Other EXPRESSION nodes were written in parentheses.
+func (p *printer) expr(node *ast.Node) string {
+	if node.Type == ast.EXPRESSION {
+		return p.operand(&node.Children[0])
+	}
+	return p.operand(node)
+}
+
+// An expression as the operand of another. The tree keeps the parentheses that were written, so printing the
+// tokens in order parses back to the same tree.
+func (p *printer) operand(node *ast.Node) string {
+	switch node.Type {
+	case ast.EXPRESSION:
+		return "(" + p.expr(node) + ")"
+	case ast.BINARYOP:
+		return p.operand(&node.Children[0]) + " " + node.TokenStart.Literal + " " + p.operand(&node.Children[1])
+	case ast.UNARYOP:
+		op, text := node.TokenStart.Literal, p.operand(&node.Children[0])
+		if (op == "-" || op == "+") && strings.HasPrefix(text, op) { // -(-x) without the space would be --x.
+			return op + " " + text
+		}
+		return op + text
+	case ast.INDEXOP:
+		return p.operand(&node.Children[0]) + "[" + p.expr(&node.Children[1]) + "]"
+	case ast.DOTOP:
+		return p.operand(&node.Children[0]) + "." + node.Children[1].TokenStart.Literal
+	case ast.FUNCCALL:
+		return p.operand(&node.Children[0]) + "(" + p.exprs(node.Children[1:]) + ")"
+	case ast.CAST:
+		return p.operand(&node.Children[0]) + " as " + node.Children[1].TokenStart.Literal
+	case ast.VARREF:
+		text := node.Children[0].TokenStart.Literal
+		for i := 1; i < len(node.Children); i++ {
+			text += "[" + p.expr(&node.Children[i]) + "]"
+		}
+		return text
+	case ast.NEW:
+		return "new " + typeName(&node.Children[0])
+	case ast.LIST:
+		return "[" + p.exprs(node.Children) + "]"
+	case ast.STRING:
+		return `"` + p.quoted() + `"`
+	case ast.CHAR:
+		return "'" + p.quoted() + "'"
+	case ast.INTERPOLATION:
+		text := `"`
+		for i := range node.Children {
+			if i%2 == 0 {
+				text += p.quoted()
+			} else {
+				text += "{" + p.expr(&node.Children[i]) + "}"
+			}
+		}
+		return text + `"`
+	}
+	return node.TokenStart.Literal // Numbers keep the text they were written with.
+}
+
+// Text of the next string or character literal between its quotes, with escapes as they were written. The
+// literals are printed in source order.
+func (p *printer) quoted() string {
+	text := p.quotes[0]
+	p.quotes = p.quotes[1:]
+	return text
+}
+
+// Type of a VARTYPE node, like int?, [T] or map[K, V].
+func typeName(node *ast.Node) string {
+	name := node.Children[0].TokenStart.Literal
+	switch {
+	case name == "?":
+		return typeName(&node.Children[1]) + "?"
+	case name == "[":
+		return "[" + typeName(&node.Children[1]) + "]"
+	case len(node.Children) > 1:
+		var inner []string
+		for i := 1; i < len(node.Children); i++ {
+			inner = append(inner, typeName(&node.Children[i]))
+		}
+		return name + "[" + strings.Join(inner, ", ") + "]"
+	}
+	return name
+}
+
+func annotations(node *ast.Node) string {
+	text := ""
+	for _, annotation := range node.Annotations {
+		text += "@" + annotation + " "
+	}
+	return text
+}
+
+func firstLine(node *ast.Node) int {
+	first, _ := ast.Lines(node)
+	return first
+}
+
+func lastLine(node *ast.Node) int {
+	_, last := ast.Lines(node)
+	return last
+}
@@ -0,0 +1,194 @@
+package ir
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Program is the lowered form of a type checked Knox program that every backend consumes.
+// Expressions are flattened into three-address instructions over typed variables and temporaries,
+// while control flow stays structured so that it maps directly onto C, WebAssembly and bytecode.
+type Program struct {
+	File    string // Knox source file, for runtime errors.
+	Classes []*Class
+	Funcs   []*Func // Functions, methods and class initializers.
+	Main    *Func
+}
+
+// Class is a user defined class. Builtin classes are lowered to Builtin instructions instead.
+type Class struct {
+	Name    string
+	Fields  []*Var
+	Init    *Func // Runs the member initializers. Takes self and returns nothing.
+	Methods map[string]*Func
+}
+
+// FieldIndex returns the index of a field, or -1 if there is none.
+func (c *Class) FieldIndex(name string) int {
+	for i, field := range c.Fields {
+		if field.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Func is a function. Methods and initializers take self as their first parameter.
+type Func struct {
+	Name    string // Qualified with the class name for methods.
+	Class   *Class // Class of a method or initializer, nil for global functions.
+	Params  []*Var
+	Results []string // Knox types. Empty for void functions.
+	Locals  []*Var   // Variables and temporaries, not including params.
+	Body    []Stmt
+	Line    int
+}
+
+// Value is an operand of an instruction.
+type Value interface {
+	Type() string
+	String() string
+}
+
+// Var is a named local variable or a compiler generated temporary.
+type Var struct {
+	Name string // Unique within the function.
+	Typ  string
+	Temp bool
+}
+
+// Type of the variable.
+func (v *Var) Type() string {
+	return v.Typ
+}
+
+func (v *Var) String() string {
+	return "%" + v.Name
+}
+
+// Const is a literal with a concrete type. Value is an int64, float64, string, bool or nil.
+type Const struct {
+	Typ   string
+	Value interface{}
+}
+
+// Type of the constant.
+func (c *Const) Type() string {
+	return c.Typ
+}
+
+func (c *Const) String() string {
+	switch v := c.Value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case nil:
+		return "nil"
+	}
+	return fmt.Sprintf("%v:%s", c.Value, c.Typ)
+}
+
+// Stmt is an instruction or a structured control flow statement.
+type Stmt interface {
+	stmt()
+}
+
+// Op is an instruction opcode.
+type Op int
+
+// Instruction opcodes. Binary and unary operators have operands of the same concrete type.
+const (
+	Copy     Op = iota // dst = a
+	Add                // dst = a + b
+	Sub                // dst = a - b
+	Mul                // dst = a * b
+	Div                // dst = a / b
+	Rem                // dst = a % b
+	And                // dst = a & b
+	Or                 // dst = a | b
+	Xor                // dst = a ^ b
+	Shl                // dst = a << b, with b taken modulo the bits of the type
+	Shr                // dst = a >> b, keeping the sign of signed types
+	Eq                 // dst = a == b
+	Ne                 // dst = a != b
+	Lt                 // dst = a < b
+	Le                 // dst = a <= b
+	Gt                 // dst = a > b
+	Ge                 // dst = a >= b
+	Concat             // dst = args... joined, for strings
+	Neg                // dst = -a
+	Not                // dst = !a
+	Compl              // dst = ~a
+	Convert            // dst = a as the type of dst
+	Call               // dst... = Func(args...)
+	Builtin            // dst... = Name(args...), with the receiver first for list and map methods
+	New                // dst = allocation of Class, not yet initialized
+	GetField           // dst = a.Class.Fields[Field]
+	SetField           // a.Class.Fields[Field] = b
+	NewList            // dst = [args...]
+	NewMap             // dst = empty map
+	Index              // dst = a[b]
+	SetIndex           // a[b] = c
+	Iter               // dst = snapshot of the items of list a or the keys of map a
+)
+
+var opNames = [...]string{
+	Copy: "copy", Add: "add", Sub: "sub", Mul: "mul", Div: "div", Rem: "rem",
+	And: "and", Or: "or", Xor: "xor", Shl: "shl", Shr: "shr",
+	Eq: "eq", Ne: "ne", Lt: "lt", Le: "le", Gt: "gt", Ge: "ge",
+	Concat: "concat", Neg: "neg", Not: "not", Compl: "compl", Convert: "convert",
+	Call: "call", Builtin: "builtin", New: "new", GetField: "getfield", SetField: "setfield",
+	NewList: "newlist", NewMap: "newmap", Index: "index", SetIndex: "setindex", Iter: "iter",
+}
+
+func (op Op) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("op(%d)", int(op))
+}
+
+// Instr is a three-address instruction.
+type Instr struct {
+	Op    Op
+	Dst   []*Var // Results. Only calls can have more than one.
+	Args  []Value
+	Func  *Func  // Callee of Call.
+	Name  string // Name of a Builtin.
+	Class *Class // Class of New, GetField and SetField.
+	Field int    // Field index of GetField and SetField.
+	Line  int    // Source line for runtime errors.
+
+	Wrapping bool // Integer overflow wraps around even in checked builds.
+}
+
+// If runs Then when Cond is true, otherwise Else.
+type If struct {
+	Cond Value
+	Then []Stmt
+	Else []Stmt
+}
+
+// Loop runs Body forever. Continue jumps to Post, which runs before the next iteration, and Break leaves the loop.
+type Loop struct {
+	Body []Stmt
+	Post []Stmt
+}
+
+// Break leaves the innermost loop.
+type Break struct{}
+
+// Continue starts the next iteration of the innermost loop.
+type Continue struct{}
+
+// Return leaves the function with a value for each result.
+type Return struct {
+	Values []Value
+	Line   int
+}
+
+func (*Instr) stmt()    {}
+func (*If) stmt()       {}
+func (*Loop) stmt()     {}
+func (*Break) stmt()    {}
+func (*Continue) stmt() {}
+func (*Return) stmt()   {}
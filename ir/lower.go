@@ -0,0 +1,1173 @@
+package ir
+
+import (
+	"fmt"
+	"knox/ast"
+	"knox/lexer"
+	"knox/token"
+	"strings"
+)
+
+type lowerer struct {
+	prog      *Program
+	functions map[string]*Func
+	classes   map[string]*Class
+	decls     map[*Func]*ast.Node
+	builtins  map[string]map[string]*ast.Node // Builtin class to method declarations.
+
+	// State of the function being lowered.
+	fn       *Func
+	body     []Stmt
+	scopes   []map[string]*Var
+	names    map[string]bool
+	temps    int
+	loops    int
+	line     int
+	wrapping bool // Inside a declaration or statement marked @wrapping.
+}
+
+// Result types of the natively implemented list and map methods. "elem", "key" and "list" stand for
+// the element type, key type and the list's own type.
+var listMethods = map[string][]string{
+	"append": {"void", "elem"}, "insert": {"void", "int", "elem"}, "length": {"int"}, "sort": {"void"},
+	"reverse": {"void"}, "remove": {"bool", "int"}, "contains": {"bool", "elem"}, "range": {"list", "int", "int"},
+}
+
+var mapMethods = map[string][]string{
+	"length": {"int"}, "contains": {"bool", "key"}, "remove": {"bool", "key"},
+}
+
+// Lower translates a type checked AST into the IR.
+func Lower(node *ast.Node) *Program {
+	l := &lowerer{
+		prog:      &Program{},
+		functions: make(map[string]*Func),
+		classes:   make(map[string]*Class),
+		decls:     make(map[*Func]*ast.Node),
+		builtins:  make(map[string]map[string]*ast.Node),
+	}
+	l.declareAll(node)
+	for _, f := range l.prog.Funcs {
+		if f.Class != nil && f == f.Class.Init {
+			l.lowerInit(f)
+		} else {
+			l.lowerFunc(f)
+		}
+	}
+	l.prog.Main = l.functions["main"]
+	if l.prog.Main == nil {
+		abortMsg(node, "Missing main function")
+	}
+	return l.prog
+}
+
+func abortMsg(node *ast.Node, msg string) {
+	fmt.Printf("IR error: %v. Line %v.\n", msg, node.TokenStart.Line)
+	panic("Aborted.\n")
+}
+
+// Abort at the line of the last lowered node.
+func (l *lowerer) abort(msg string) {
+	fmt.Printf("IR error: %v. Line %v.\n", msg, l.line)
+	panic("Aborted.\n")
+}
+
+// Create every function, class and method first so that order doesn't matter.
+func (l *lowerer) declareAll(node *ast.Node) {
+	for i := range node.Children {
+		child := &node.Children[i]
+		switch child.Type {
+		case ast.PROGRAM: // Builtins are implemented by each backend's runtime.
+			for j := range child.Children {
+				decl := &child.Children[j]
+				if decl.Type != ast.CLASS {
+					continue
+				}
+				methods := make(map[string]*ast.Node)
+				for k := range decl.Children[1].Children {
+					member := &decl.Children[1].Children[k]
+					if member.Type == ast.FUNCDECL {
+						methods[member.Children[0].TokenStart.Literal] = member
+					}
+				}
+				l.builtins[decl.Children[0].TokenStart.Literal] = methods
+			}
+		case ast.FUNCDECL:
+			f := l.newFunc(child, nil)
+			l.functions[f.Name] = f
+		case ast.CLASS:
+			c := &Class{Name: child.Children[0].TokenStart.Literal, Methods: make(map[string]*Func)}
+			l.classes[c.Name] = c
+			l.prog.Classes = append(l.prog.Classes, c)
+			c.Init = &Func{Name: "_" + c.Name, Class: c, Params: []*Var{{Name: "self", Typ: c.Name}}, Line: child.Children[0].TokenStart.Line}
+			l.decls[c.Init] = child
+			l.prog.Funcs = append(l.prog.Funcs, c.Init)
+			for j := range child.Children[1].Children {
+				member := &child.Children[1].Children[j]
+				if member.Type == ast.VARDECL {
+					for k := 0; k < len(member.Children)-1; k += 2 {
+						c.Fields = append(c.Fields, &Var{Name: member.Children[k].TokenStart.Literal, Typ: TypeName(&member.Children[k+1])})
+					}
+				} else if member.Type == ast.FUNCDECL {
+					f := l.newFunc(member, c)
+					c.Methods[member.Children[0].TokenStart.Literal] = f
+				}
+			}
+		}
+	}
+}
+
+func (l *lowerer) newFunc(node *ast.Node, c *Class) *Func {
+	f := &Func{Name: node.Children[0].TokenStart.Literal, Class: c, Line: node.Children[0].TokenStart.Line}
+	if c != nil {
+		f.Name = c.Name + "." + f.Name
+		f.Params = append(f.Params, &Var{Name: "self", Typ: c.Name})
+	}
+	for _, param := range node.Children[1].Children {
+		f.Params = append(f.Params, &Var{Name: param.Children[0].TokenStart.Literal, Typ: TypeName(&param.Children[1])})
+	}
+	for i := range node.Children[2].Children {
+		if t := TypeName(&node.Children[2].Children[i]); t != "void" {
+			f.Results = append(f.Results, t)
+		}
+	}
+	l.decls[f] = node
+	l.prog.Funcs = append(l.prog.Funcs, f)
+	return f
+}
+
+func (l *lowerer) begin(f *Func) {
+	l.fn = f
+	l.body = nil
+	l.scopes = []map[string]*Var{{}}
+	l.names = make(map[string]bool)
+	l.temps = 0
+	l.loops = 0
+	l.line = f.Line
+	l.wrapping = l.decls[f].HasAnnotation("wrapping")
+	if f.Class != nil && f != f.Class.Init {
+		l.wrapping = l.wrapping || l.decls[f.Class.Init].HasAnnotation("wrapping")
+	}
+	for _, param := range f.Params {
+		l.names[param.Name] = true
+		if param.Name != "self" || f.Class == nil {
+			l.scopes[0][param.Name] = param
+		}
+	}
+}
+
+func (l *lowerer) lowerFunc(f *Func) {
+	l.begin(f)
+	f.Body = l.block(&l.decls[f].Children[3])
+}
+
+// The initializer runs the member initializers in order.
+func (l *lowerer) lowerInit(f *Func) {
+	l.begin(f)
+	self := f.Params[0]
+	field := 0
+	class := l.decls[f]
+	for _, member := range class.Children[1].Children {
+		if member.Type != ast.VARDECL {
+			continue
+		}
+		l.wrapping = class.HasAnnotation("wrapping") || member.HasAnnotation("wrapping")
+		names := (len(member.Children) - 1) / 2
+		var values []Value
+		if names == 1 {
+			values = []Value{l.expr(&member.Children[2], f.Class.Fields[field].Typ)}
+		} else {
+			values = l.multi(&member.Children[len(member.Children)-1], names)
+		}
+		for _, value := range values {
+			l.emit(&Instr{Op: SetField, Args: []Value{self, l.coerce(value, f.Class.Fields[field].Typ)}, Class: f.Class, Field: field})
+			field++
+		}
+	}
+	f.Body = l.body
+}
+
+////
+// Statements.
+////
+
+// Lower a block into its own statement list.
+func (l *lowerer) block(node *ast.Node) []Stmt {
+	return l.capture(func() {
+		for i := range node.Children {
+			l.statement(&node.Children[i])
+		}
+	})
+}
+
+// Collect the statements emitted by fn in a new scope.
+func (l *lowerer) capture(fn func()) []Stmt {
+	saved := l.body
+	l.body = nil
+	l.scopes = append(l.scopes, make(map[string]*Var))
+	fn()
+	l.scopes = l.scopes[:len(l.scopes)-1]
+	stmts := l.body
+	l.body = saved
+	return stmts
+}
+
+func (l *lowerer) statement(node *ast.Node) {
+	l.mark(node)
+	if node.HasAnnotation("wrapping") {
+		defer func(saved bool) { l.wrapping = saved }(l.wrapping)
+		l.wrapping = true
+	}
+	switch node.Type {
+	case ast.VARDECL:
+		l.varDecl(node)
+	case ast.VARASSIGN:
+		l.varAssign(node)
+	case ast.IFSTATEMENT:
+		l.emit(l.ifStatement(node, 0))
+	case ast.WHILESTATEMENT:
+		l.whileStatement(node)
+	case ast.FORSTATEMENT:
+		l.forStatement(node)
+	case ast.JUMPSTATEMENT:
+		l.jumpStatement(node)
+	case ast.LEFTEXPR:
+		l.expr(&node.Children[0], "void")
+	default:
+		abortMsg(node, "Unexpected statement "+string(node.Type))
+	}
+}
+
+func (l *lowerer) varDecl(node *ast.Node) {
+	if node.TokenStart.Type == token.CONST { // Constants are inlined where they're used.
+		return
+	}
+	names := (len(node.Children) - 1) / 2
+	if names == 1 {
+		t := TypeName(&node.Children[1])
+		value := l.coerce(l.expr(&node.Children[2], t), t)
+		l.assign(l.declare(node.Children[0].TokenStart.Literal, t), value)
+		return
+	}
+
+	// The initializer must be a call with a result for each name.
+	values := l.multi(&node.Children[len(node.Children)-1], names)
+	for k := 0; k < names; k++ {
+		t := TypeName(&node.Children[2*k+1])
+		l.assign(l.declare(node.Children[2*k].TokenStart.Literal, t), l.coerce(values[k], t))
+	}
+}
+
+func (l *lowerer) varAssign(node *ast.Node) {
+	right := &node.Children[len(node.Children)-1]
+	if len(node.Children) > 2 { // Multiple assignment from the results of a call.
+		values := l.multi(right, len(node.Children)-1)
+		for i, value := range values {
+			if !ast.IsDiscard(&node.Children[i]) {
+				l.store(&node.Children[i], func(string, func() Value) Value { return value })
+			}
+		}
+		return
+	}
+	if ast.IsDiscard(&node.Children[0]) {
+		l.expr(right, "")
+		return
+	}
+	if ast.IsCompound(node) { // The operator reads the target through the object and index it already evaluated.
+		l.store(&node.Children[0], func(t string, current func() Value) Value {
+			return l.operate(unwrap(right), t, func(string) Value { return current() })
+		})
+		return
+	}
+	l.store(&node.Children[0], func(t string, current func() Value) Value { return l.expr(right, t) })
+}
+
+// Store into an assignment target. The value is produced once the target's type is known, after
+// anything the target itself evaluates, and can read the target's current value.
+func (l *lowerer) store(target *ast.Node, value func(t string, current func() Value) Value) {
+	left := unwrap(target)
+	l.mark(left)
+	switch left.Type {
+	case ast.VARREF:
+		name := left.Children[0].TokenStart.Literal
+		if v := l.lookup(name); v != nil {
+			l.assign(v, l.coerce(value(v.Typ, func() Value { return v }), v.Typ))
+			return
+		}
+		self, field := l.selfField(left, name)
+		t := l.fn.Class.Fields[field].Typ
+		current := func() Value { return l.getField(self, l.fn.Class, field) }
+		l.emit(&Instr{Op: SetField, Args: []Value{self, l.coerce(value(t, current), t)}, Class: l.fn.Class, Field: field, Line: l.line})
+	case ast.DOTOP:
+		obj := l.expr(&left.Children[0], "")
+		c, field := l.field(left, obj)
+		t := c.Fields[field].Typ
+		current := func() Value { return l.getField(obj, c, field) }
+		l.emit(&Instr{Op: SetField, Args: []Value{obj, l.coerce(value(t, current), t)}, Class: c, Field: field, Line: left.TokenStart.Line})
+	case ast.INDEXOP:
+		container := l.expr(&left.Children[0], "")
+		keyType, valueType := l.indexTypes(left, container.Type())
+		key := l.coerce(l.expr(&left.Children[1], keyType), keyType)
+		current := func() Value {
+			dst := l.temp(valueType)
+			l.emit(&Instr{Op: Index, Dst: []*Var{dst}, Args: []Value{container, key}, Line: left.TokenStart.Line})
+			return dst
+		}
+		l.emit(&Instr{Op: SetIndex, Args: []Value{container, key, l.coerce(value(valueType, current), valueType)}, Line: left.TokenStart.Line})
+	default:
+		abortMsg(target, "Invalid assignment target")
+	}
+}
+
+// Chains of else ifs become nested ifs.
+func (l *lowerer) ifStatement(node *ast.Node, i int) *If {
+	s := &If{Cond: l.coerce(l.expr(&node.Children[i], "bool"), "bool")}
+	s.Then = l.block(&node.Children[i+1])
+	if i+3 < len(node.Children) { // Else if
+		s.Else = l.capture(func() {
+			l.emit(l.ifStatement(node, i+2))
+		})
+	} else if i+2 < len(node.Children) { // Else
+		s.Else = l.block(&node.Children[i+2])
+	}
+	return s
+}
+
+func (l *lowerer) whileStatement(node *ast.Node) {
+	l.loops++
+	body := l.capture(func() {
+		l.breakUnless(l.expr(&node.Children[0], "bool"))
+		l.body = append(l.body, l.block(&node.Children[1])...)
+	})
+	l.loops--
+	l.emit(&Loop{Body: body})
+}
+
+// for item : T in list { ... } walks a snapshot of the list, or of a map's keys, with a hidden index.
+func (l *lowerer) forStatement(node *ast.Node) {
+	container := l.expr(&node.Children[1], "")
+	listType := container.Type()
+	if IsMap(listType) {
+		key, _ := MapTypes(listType)
+		listType = "[" + key + "]"
+	} else if !IsList(listType) {
+		abortMsg(node, "Cannot iterate over "+listType)
+	}
+	items := l.temp(listType)
+	l.emit(&Instr{Op: Iter, Dst: []*Var{items}, Args: []Value{container}, Line: node.TokenStart.Line})
+	index := l.temp("int")
+	l.assign(index, &Const{Typ: "int", Value: int64(0)})
+
+	l.loops++
+	body := l.capture(func() {
+		length := l.temp("int")
+		l.emit(&Instr{Op: Builtin, Name: "list.length", Dst: []*Var{length}, Args: []Value{items}})
+		more := l.temp("bool")
+		l.emit(&Instr{Op: Lt, Dst: []*Var{more}, Args: []Value{index, length}})
+		l.breakUnless(more)
+		itemType := TypeName(&node.Children[0].Children[1])
+		item := l.declare(node.Children[0].Children[0].TokenStart.Literal, itemType)
+		if itemType == Elem(listType) {
+			l.emit(&Instr{Op: Index, Dst: []*Var{item}, Args: []Value{items, index}, Line: node.TokenStart.Line})
+		} else {
+			value := l.temp(Elem(listType))
+			l.emit(&Instr{Op: Index, Dst: []*Var{value}, Args: []Value{items, index}, Line: node.TokenStart.Line})
+			l.assign(item, l.coerce(value, itemType))
+		}
+		l.body = append(l.body, l.block(&node.Children[2])...)
+	})
+	l.loops--
+	post := l.capture(func() {
+		l.emit(&Instr{Op: Add, Dst: []*Var{index}, Args: []Value{index, &Const{Typ: "int", Value: int64(1)}}})
+	})
+	l.emit(&Loop{Body: body, Post: post})
+}
+
+// Leave the loop when cond is false.
+func (l *lowerer) breakUnless(cond Value) {
+	done := l.temp("bool")
+	l.emit(&Instr{Op: Not, Dst: []*Var{done}, Args: []Value{l.coerce(cond, "bool")}})
+	l.emit(&If{Cond: done, Then: []Stmt{&Break{}}})
+}
+
+func (l *lowerer) jumpStatement(node *ast.Node) {
+	switch node.TokenStart.Literal {
+	case "return":
+		if len(node.Children) != len(l.fn.Results) {
+			abortMsg(node, fmt.Sprintf("Returning %d values from %s, which has %d results", len(node.Children), l.fn.Name, len(l.fn.Results)))
+		}
+		s := &Return{Line: node.TokenStart.Line}
+		for i := range node.Children {
+			s.Values = append(s.Values, l.coerce(l.expr(&node.Children[i], l.fn.Results[i]), l.fn.Results[i]))
+		}
+		l.emit(s)
+	case "break", "continue":
+		if l.loops == 0 {
+			abortMsg(node, strings.Title(node.TokenStart.Literal)+" outside of loop")
+		}
+		if node.TokenStart.Literal == "break" {
+			l.emit(&Break{})
+		} else {
+			l.emit(&Continue{})
+		}
+	}
+}
+
+////
+// Expressions.
+////
+
+// Lower an expression and return its value, or nil for a void call.
+func (l *lowerer) expr(node *ast.Node, hint string) Value {
+	node = unwrap(node)
+	l.mark(node)
+
+	switch node.Type {
+	case ast.INT, ast.FLOAT:
+		digits, suffix := lexer.NumberSuffix(node.TokenStart.Literal)
+		value, ok := lexer.NumberValue(digits)
+		if !ok {
+			abortMsg(node, "Invalid number literal")
+		}
+		t := suffix
+		if t == "" && node.Type == ast.INT {
+			t = Concrete("INT_LITERAL", hint)
+		} else if t == "" {
+			t = Concrete("FLOAT_LITERAL", hint)
+		}
+		if IsFloat(t) {
+			f, _ := value.Float64()
+			return &Const{Typ: t, Value: f}
+		}
+		if n := value.Num(); n.IsUint64() { // u64 values above the int64 range keep their bits.
+			return &Const{Typ: t, Value: int64(n.Uint64())}
+		}
+		return &Const{Typ: t, Value: value.Num().Int64()}
+	case ast.STRING: // The lexer has already replaced the escapes.
+		return &Const{Typ: "string", Value: node.TokenStart.Literal}
+	case ast.CHAR:
+		return &Const{Typ: "rune", Value: int64([]rune(node.TokenStart.Literal)[0])}
+	case ast.INTERPOLATION:
+		var parts []Value
+		for i := range node.Children {
+			if i%2 == 0 {
+				parts = append(parts, l.expr(&node.Children[i], ""))
+			} else {
+				parts = append(parts, l.toString(l.expr(&node.Children[i], ""), false, node.TokenStart.Line))
+			}
+		}
+		return l.concat(parts, node.TokenStart.Line)
+	case ast.BOOL:
+		return &Const{Typ: "bool", Value: node.TokenStart.Literal == "true"}
+	case ast.NIL:
+		return &Const{Typ: "nil"}
+	case ast.SELF:
+		if l.fn.Class == nil {
+			abortMsg(node, "Self outside of a class")
+		}
+		return l.fn.Params[0]
+	case ast.VARREF:
+		name := node.Children[0].TokenStart.Literal
+		if decl := node.Symbols.LookupSymbol(name); decl != nil && decl.TokenStart.Type == token.CONST && len(decl.Children) == 3 {
+			t := TypeName(&decl.Children[1])
+			return l.coerce(l.expr(&decl.Children[2], t), t)
+		}
+		if v := l.lookup(name); v != nil {
+			return v
+		}
+		self, field := l.selfField(node, name)
+		return l.getField(self, l.fn.Class, field)
+	case ast.DOTOP:
+		obj := l.expr(&node.Children[0], "")
+		c, field := l.field(node, obj)
+		return l.getField(obj, c, field)
+	case ast.INDEXOP:
+		container := l.expr(&node.Children[0], "")
+		if container.Type() == "string" { // The rune at an index.
+			index := l.coerce(l.expr(&node.Children[1], "int"), "int")
+			dst := l.temp("string")
+			l.emit(&Instr{Op: Builtin, Name: "string.at", Dst: []*Var{dst}, Args: []Value{container, index}, Line: node.TokenStart.Line})
+			return dst
+		}
+		keyType, valueType := l.indexTypes(node, container.Type())
+		key := l.coerce(l.expr(&node.Children[1], keyType), keyType)
+		dst := l.temp(valueType)
+		l.emit(&Instr{Op: Index, Dst: []*Var{dst}, Args: []Value{container, key}, Line: node.TokenStart.Line})
+		return dst
+	case ast.BINARYOP:
+		return l.binaryOp(node, hint)
+	case ast.UNARYOP:
+		switch node.TokenStart.Literal {
+		case "-":
+			value := l.expr(&node.Children[0], hint)
+			if literal := unwrap(&node.Children[0]); literal.Type == ast.INT || literal.Type == ast.FLOAT {
+				// A negative literal is one constant, since -128i8 and -9223372036854775808 only fit negated.
+				switch v := value.(*Const).Value.(type) {
+				case int64:
+					return &Const{Typ: value.Type(), Value: -v}
+				case float64:
+					return &Const{Typ: value.Type(), Value: -v}
+				}
+			}
+			dst := l.temp(value.Type())
+			l.emit(&Instr{Op: Neg, Dst: []*Var{dst}, Args: []Value{value}, Line: node.TokenStart.Line})
+			return dst
+		case "~":
+			value := l.expr(&node.Children[0], hint)
+			dst := l.temp(value.Type())
+			l.emit(&Instr{Op: Compl, Dst: []*Var{dst}, Args: []Value{value}})
+			return dst
+		case "!":
+			value := l.coerce(l.expr(&node.Children[0], "bool"), "bool")
+			dst := l.temp("bool")
+			l.emit(&Instr{Op: Not, Dst: []*Var{dst}, Args: []Value{value}})
+			return dst
+		}
+		return l.expr(&node.Children[0], hint)
+	case ast.CAST:
+		to := node.Children[1].TokenStart.Literal
+		value := l.expr(&node.Children[0], to)
+		if value.Type() == to {
+			return value
+		} else if to == "string" {
+			return l.toString(value, false, node.TokenStart.Line)
+		}
+		dst := l.temp(to)
+		l.emit(&Instr{Op: Convert, Dst: []*Var{dst}, Args: []Value{value}, Line: node.TokenStart.Line})
+		return dst
+	case ast.FUNCCALL:
+		results := l.call(node)
+		if len(results) == 0 {
+			return nil
+		}
+		return results[0]
+	case ast.NEW:
+		return l.newExpr(node)
+	case ast.LIST:
+		t := node.ValueType
+		if IsList(hint) {
+			t = hint
+		} else if !IsList(t) {
+			abortMsg(node, "Unknown list type")
+		}
+		t = Concrete(t, "")
+		var items []Value
+		for i := range node.Children {
+			items = append(items, l.coerce(l.expr(&node.Children[i], Elem(t)), Elem(t)))
+		}
+		dst := l.temp(t)
+		l.emit(&Instr{Op: NewList, Dst: []*Var{dst}, Args: items})
+		return dst
+	}
+	abortMsg(node, "Unexpected expression "+string(node.Type))
+	return nil
+}
+
+var binaryOps = map[string]Op{
+	"+": Add, "-": Sub, "*": Mul, "/": Div, "%": Rem, "concat": Concat,
+	"&": And, "|": Or, "^": Xor, "<<": Shl, ">>": Shr,
+	"==": Eq, "!=": Ne, "<": Lt, "<=": Le, ">": Gt, ">=": Ge,
+}
+
+func (l *lowerer) binaryOp(node *ast.Node, hint string) Value {
+	op := node.TokenStart.Literal
+	if op == "&&" || op == "||" {
+		return l.logical(node)
+	}
+	return l.operate(node, hint, func(t string) Value { return l.expr(&node.Children[0], t) })
+}
+
+// Lower an operator whose left operand is produced by first once the operand type is known, so that a compound
+// assignment can use the value of its target.
+func (l *lowerer) operate(node *ast.Node, hint string, first func(t string) Value) Value {
+	op := node.TokenStart.Literal
+	code, ok := binaryOps[op]
+	if !ok {
+		abortMsg(node, "Unsupported operator "+op)
+	}
+
+	// Pick the operand type, letting a literal take the type of the other side.
+	left := unwrap(&node.Children[0]).ValueType
+	right := unwrap(&node.Children[1]).ValueType
+	operand := left
+	if HasLiteral(left) || left == "nil" || left == "" {
+		operand = right
+	}
+	if IsLiteral(operand) {
+		if IsNumber(hint) && !IsLiteral(hint) {
+			operand = Concrete(operand, hint)
+		} else if left == "FLOAT_LITERAL" || right == "FLOAT_LITERAL" {
+			operand = Concrete("FLOAT_LITERAL", "")
+		} else {
+			operand = Concrete(operand, "")
+		}
+	} else if HasLiteral(operand) {
+		operand = Concrete(operand, "") // A list literal compared with another.
+	}
+
+	a := first(operand)
+	if operand == "" || operand == "nil" {
+		operand = a.Type()
+	}
+	b := l.expr(&node.Children[1], operand)
+	if operand == "nil" {
+		operand = b.Type()
+	}
+	a, b = l.coerce(a, operand), l.coerce(b, operand)
+
+	if code == Eq || code == Ne {
+		equal := l.equal(a, b, node.TokenStart.Line)
+		if code == Eq {
+			return equal
+		}
+		dst := l.temp("bool")
+		l.emit(&Instr{Op: Not, Dst: []*Var{dst}, Args: []Value{equal}})
+		return dst
+	}
+
+	t := operand
+	if code >= Eq && code <= Ge {
+		t = "bool"
+	} else if code == Concat {
+		t = "string"
+	}
+	dst := l.temp(t)
+	l.emit(&Instr{Op: code, Dst: []*Var{dst}, Args: []Value{a, b}, Line: node.TokenStart.Line})
+	return dst
+}
+
+// Compare two values of the same type. Lists are equal when their items are, and objects are identical unless
+// their class has an equals method. Both of those are equal when they're the same reference, and never to nil.
+func (l *lowerer) equal(a Value, b Value, line int) Value {
+	t := a.Type()
+	if t == "nil" {
+		t = b.Type()
+	}
+	dst := l.temp("bool")
+	l.emit(&Instr{Op: Eq, Dst: []*Var{dst}, Args: []Value{a, b}, Line: line})
+	c := l.classes[t]
+	if isNil(a) || isNil(b) || !IsList(t) && (c == nil || c.Methods["equals"] == nil) {
+		return dst
+	}
+
+	different := l.capture(func() {
+		l.unlessNil(a, func() {
+			l.unlessNil(b, func() {
+				if !IsList(t) {
+					l.emit(&Instr{Op: Call, Func: c.Methods["equals"], Dst: []*Var{dst}, Args: []Value{a, b}, Line: line})
+					return
+				}
+				length := l.temp("int")
+				l.emit(&Instr{Op: Builtin, Name: "list.length", Dst: []*Var{length}, Args: []Value{a}})
+				other := l.temp("int")
+				l.emit(&Instr{Op: Builtin, Name: "list.length", Dst: []*Var{other}, Args: []Value{b}})
+				l.emit(&Instr{Op: Eq, Dst: []*Var{dst}, Args: []Value{length, other}})
+				index := l.temp("int")
+				l.assign(index, &Const{Typ: "int", Value: int64(0)})
+				body := l.capture(func() {
+					l.breakUnless(dst)
+					more := l.temp("bool")
+					l.emit(&Instr{Op: Lt, Dst: []*Var{more}, Args: []Value{index, length}})
+					l.breakUnless(more)
+					x, y := l.temp(Elem(t)), l.temp(Elem(t))
+					l.emit(&Instr{Op: Index, Dst: []*Var{x}, Args: []Value{a, index}, Line: line})
+					l.emit(&Instr{Op: Index, Dst: []*Var{y}, Args: []Value{b, index}, Line: line})
+					l.assign(dst, l.equal(x, y, line))
+				})
+				post := l.capture(func() {
+					l.emit(&Instr{Op: Add, Dst: []*Var{index}, Args: []Value{index, &Const{Typ: "int", Value: int64(1)}}})
+				})
+				l.emit(&Loop{Body: body, Post: post})
+			})
+		})
+	})
+	l.emit(&If{Cond: dst, Else: different})
+	return dst
+}
+
+func isNil(v Value) bool {
+	c, ok := v.(*Const)
+	return ok && c.Typ == "nil"
+}
+
+// Run fn when a reference isn't nil.
+func (l *lowerer) unlessNil(v Value, fn func()) {
+	set := l.temp("bool")
+	l.emit(&Instr{Op: Ne, Dst: []*Var{set}, Args: []Value{v, &Const{Typ: "nil"}}})
+	l.emit(&If{Cond: set, Then: l.capture(fn)})
+}
+
+// Short circuit && and || with an if that assigns the result.
+func (l *lowerer) logical(node *ast.Node) Value {
+	dst := l.temp("bool")
+	l.assign(dst, l.coerce(l.expr(&node.Children[0], "bool"), "bool"))
+	right := l.capture(func() {
+		l.assign(dst, l.coerce(l.expr(&node.Children[1], "bool"), "bool"))
+	})
+	if node.TokenStart.Literal == "&&" {
+		l.emit(&If{Cond: dst, Then: right})
+	} else {
+		l.emit(&If{Cond: dst, Else: right})
+	}
+	return dst
+}
+
+func (l *lowerer) newExpr(node *ast.Node) Value {
+	t := TypeName(&node.Children[0])
+	dst := l.temp(t)
+	switch {
+	case IsList(t):
+		l.emit(&Instr{Op: NewList, Dst: []*Var{dst}})
+	case IsMap(t):
+		l.emit(&Instr{Op: NewMap, Dst: []*Var{dst}})
+	default:
+		c, ok := l.classes[t]
+		if !ok {
+			abortMsg(node, "Cannot create "+t)
+		}
+		l.emit(&Instr{Op: New, Dst: []*Var{dst}, Class: c, Line: node.TokenStart.Line})
+		l.emit(&Instr{Op: Call, Func: c.Init, Args: []Value{dst}, Line: node.TokenStart.Line})
+	}
+	return dst
+}
+
+////
+// Calls.
+////
+
+// Lower a call and return its results.
+func (l *lowerer) call(node *ast.Node) []*Var {
+	callee := unwrap(&node.Children[0])
+	args := node.Children[1:]
+	line := node.TokenStart.Line
+
+	if callee.Type == ast.VARREF {
+		name := callee.Children[0].TokenStart.Literal
+		if f, ok := l.functions[name]; ok {
+			return l.callFunc(f, nil, args, line)
+		}
+		if c := l.fn.Class; c != nil {
+			if f, ok := c.Methods[name]; ok { // Implicit method of self.
+				return l.callFunc(f, l.fn.Params[0], args, line)
+			}
+		}
+		abortMsg(node, "Calling undeclared function "+name)
+	}
+	if callee.Type != ast.DOTOP {
+		abortMsg(node, "Invalid function call")
+	}
+
+	method := callee.Children[1].TokenStart.Literal
+	receiver := unwrap(&callee.Children[0])
+	if receiver.Type == ast.VARREF {
+		pkg := receiver.Children[0].TokenStart.Literal
+		if _, ok := l.builtins[pkg]; ok && l.lookup(pkg) == nil { // Builtin package such as stl.
+			return l.declaredBuiltin(node, pkg, method, nil, args)
+		}
+	}
+
+	obj := l.expr(&callee.Children[0], "")
+	t := obj.Type()
+	if t == "string" {
+		return l.declaredBuiltin(node, "string", method, obj, args)
+	}
+	if IsList(t) || IsMap(t) {
+		signature, ok := listMethods[method]
+		pkg := "list"
+		if IsMap(t) {
+			signature, ok = mapMethods[method]
+			pkg = "map"
+		}
+		if !ok {
+			abortMsg(node, "Unknown method "+pkg+"."+method)
+		}
+		var types []string
+		for _, s := range signature {
+			switch s {
+			case "elem":
+				s = Elem(t)
+			case "key":
+				s, _ = MapTypes(t)
+			case "list":
+				s = t
+			}
+			types = append(types, s)
+		}
+		var results []string
+		if types[0] != "void" {
+			results = types[:1]
+		}
+		return l.builtin(node, pkg+"."+method, obj, types[1:], results, args)
+	}
+
+	c, ok := l.classes[t]
+	if !ok {
+		abortMsg(node, "Cannot call a method on "+t)
+	}
+	f, ok := c.Methods[method]
+	if !ok {
+		abortMsg(node, "Unknown method "+t+"."+method)
+	}
+	return l.callFunc(f, obj, args, line)
+}
+
+func (l *lowerer) callFunc(f *Func, self Value, args []ast.Node, line int) []*Var {
+	in := &Instr{Op: Call, Func: f, Line: line}
+	params := f.Params
+	if f.Class != nil {
+		in.Args = append(in.Args, self)
+		params = params[1:]
+	}
+	in.Args = append(in.Args, l.args(args, params)...)
+	for _, t := range f.Results {
+		in.Dst = append(in.Dst, l.temp(t))
+	}
+	l.emit(in)
+	return in.Dst
+}
+
+// Call a builtin declared in a builtin/*.knox file, taking its signature from the declaration.
+func (l *lowerer) declaredBuiltin(node *ast.Node, pkg string, method string, self Value, args []ast.Node) []*Var {
+	decl, ok := l.builtins[pkg][method]
+	if !ok {
+		abortMsg(node, "Unknown builtin "+pkg+"."+method)
+	}
+	params := decl.Children[1].Children
+	if len(params) > 0 && params[0].HasAnnotation("template") {
+		dst := l.temp("string")
+		l.assign(dst, l.format(node, args))
+		return []*Var{dst}
+	}
+	var types []string
+	for _, param := range params {
+		types = append(types, TypeName(&param.Children[1]))
+	}
+	var results []string
+	for i := range decl.Children[2].Children {
+		if t := TypeName(&decl.Children[2].Children[i]); t != "void" {
+			results = append(results, t)
+		}
+	}
+	return l.builtin(node, pkg+"."+method, self, types, results, args)
+}
+
+func (l *lowerer) builtin(node *ast.Node, name string, self Value, types []string, results []string, args []ast.Node) []*Var {
+	if len(args) != len(types) {
+		abortMsg(node, fmt.Sprintf("%s takes %d arguments", name, len(types)))
+	}
+	in := &Instr{Op: Builtin, Name: name, Line: node.TokenStart.Line}
+	if self != nil {
+		in.Args = append(in.Args, self)
+	}
+	for i := range args {
+		if types[i] == "printable" {
+			in.Args = append(in.Args, l.toString(l.expr(&args[i], ""), false, node.TokenStart.Line))
+		} else {
+			in.Args = append(in.Args, l.coerce(l.expr(&args[i], types[i]), types[i]))
+		}
+	}
+	for _, t := range results {
+		in.Dst = append(in.Dst, l.temp(t))
+	}
+	l.emit(in)
+	return in.Dst
+}
+
+// Replace each placeholder of a builtin's template with the string form of the next value.
+func (l *lowerer) format(node *ast.Node, args []ast.Node) Value {
+	var parts []Value
+	for i, segment := range ast.SplitTemplate(unwrap(&args[0]).TokenStart.Literal) {
+		if i > 0 {
+			parts = append(parts, l.toString(l.expr(&args[i], ""), false, node.TokenStart.Line))
+		}
+		parts = append(parts, &Const{Typ: "string", Value: segment})
+	}
+	return l.concat(parts, node.TokenStart.Line)
+}
+
+// Join strings with one concatenation, leaving out empty constants.
+func (l *lowerer) concat(parts []Value, line int) Value {
+	var nonEmpty []Value
+	for _, part := range parts {
+		if c, ok := part.(*Const); !ok || c.Value != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	switch len(nonEmpty) {
+	case 0:
+		return &Const{Typ: "string", Value: ""}
+	case 1:
+		return nonEmpty[0]
+	}
+	dst := l.temp("string")
+	l.emit(&Instr{Op: Concat, Dst: []*Var{dst}, Args: nonEmpty, Line: line})
+	return dst
+}
+
+// String form of a printable value, as print shows it. Strings inside lists and maps are quoted, nil
+// references are "nil", and objects are converted by their toString method.
+func (l *lowerer) toString(value Value, quote bool, line int) Value {
+	t := value.Type()
+	switch {
+	case t == "string" && quote:
+		dst := l.temp("string")
+		l.emit(&Instr{Op: Builtin, Name: "string.quote", Dst: []*Var{dst}, Args: []Value{value}, Line: line})
+		return dst
+	case t == "string":
+		return value
+	case t == "rune":
+		dst := l.temp("string")
+		l.emit(&Instr{Op: Builtin, Name: "rune.toString", Dst: []*Var{dst}, Args: []Value{value}, Line: line})
+		return dst
+	case IsNumber(t) || t == "bool":
+		dst := l.temp("string")
+		l.emit(&Instr{Op: Convert, Dst: []*Var{dst}, Args: []Value{value}, Line: line})
+		return dst
+	}
+
+	dst := l.temp("string")
+	l.assign(dst, &Const{Typ: "string", Value: "nil"})
+	l.unlessNil(value, func() {
+		switch {
+		case IsList(t):
+			l.assign(dst, l.join("[", l.each(value, line, func(item Value) Value {
+				return l.toString(item, true, line)
+			}), "]", line))
+		case IsMap(t):
+			keyType, valueType := MapTypes(t)
+			keys := l.temp("[" + keyType + "]")
+			l.emit(&Instr{Op: Iter, Dst: []*Var{keys}, Args: []Value{value}, Line: line})
+			l.assign(dst, l.join("{", l.each(keys, line, func(key Value) Value {
+				item := l.temp(valueType)
+				l.emit(&Instr{Op: Index, Dst: []*Var{item}, Args: []Value{value, key}, Line: line})
+				return l.concat([]Value{l.toString(key, true, line), &Const{Typ: "string", Value: ": "}, l.toString(item, true, line)}, line)
+			}), "}", line))
+		default:
+			c, ok := l.classes[t]
+			if !ok || c.Methods["toString"] == nil {
+				l.abort("Cannot print " + t)
+			}
+			l.emit(&Instr{Op: Call, Func: c.Methods["toString"], Dst: []*Var{dst}, Args: []Value{value}, Line: line})
+		}
+	})
+	return dst
+}
+
+// Strings made by fn from each item of a list.
+func (l *lowerer) each(list Value, line int, fn func(item Value) Value) Value {
+	parts := l.temp("[string]")
+	l.emit(&Instr{Op: NewList, Dst: []*Var{parts}})
+	length := l.temp("int")
+	l.emit(&Instr{Op: Builtin, Name: "list.length", Dst: []*Var{length}, Args: []Value{list}})
+	index := l.temp("int")
+	l.assign(index, &Const{Typ: "int", Value: int64(0)})
+	body := l.capture(func() {
+		more := l.temp("bool")
+		l.emit(&Instr{Op: Lt, Dst: []*Var{more}, Args: []Value{index, length}})
+		l.breakUnless(more)
+		item := l.temp(Elem(list.Type()))
+		l.emit(&Instr{Op: Index, Dst: []*Var{item}, Args: []Value{list, index}, Line: line})
+		l.emit(&Instr{Op: Builtin, Name: "list.append", Args: []Value{parts, fn(item)}})
+	})
+	post := l.capture(func() {
+		l.emit(&Instr{Op: Add, Dst: []*Var{index}, Args: []Value{index, &Const{Typ: "int", Value: int64(1)}}})
+	})
+	l.emit(&Loop{Body: body, Post: post})
+	return parts
+}
+
+// Strings separated by commas between an opening and closing bracket.
+func (l *lowerer) join(open string, parts Value, close string, line int) Value {
+	joined := l.temp("string")
+	l.emit(&Instr{Op: Builtin, Name: "string.join", Dst: []*Var{joined}, Args: []Value{&Const{Typ: "string", Value: ", "}, parts}, Line: line})
+	return l.concat([]Value{&Const{Typ: "string", Value: open}, joined, &Const{Typ: "string", Value: close}}, line)
+}
+
+func (l *lowerer) args(args []ast.Node, params []*Var) []Value {
+	if len(args) != len(params) {
+		l.abort("Wrong number of arguments")
+	}
+	var values []Value
+	for i := range args {
+		values = append(values, l.coerce(l.expr(&args[i], params[i].Typ), params[i].Typ))
+	}
+	return values
+}
+
+// Lower a call that must produce n values.
+func (l *lowerer) multi(node *ast.Node, n int) []Value {
+	call := unwrap(node)
+	if call.Type != ast.FUNCCALL {
+		abortMsg(node, "Multiple declaration requires a function call")
+	}
+	results := l.call(call)
+	if len(results) != n {
+		abortMsg(node, fmt.Sprintf("Assigning %d values to %d variables", len(results), n))
+	}
+	var values []Value
+	for _, result := range results {
+		values = append(values, result)
+	}
+	return values
+}
+
+////
+// Helpers.
+////
+
+// Skip over EXPRESSION wrappers.
+func unwrap(node *ast.Node) *ast.Node {
+	for node.Type == ast.EXPRESSION {
+		node = &node.Children[0]
+	}
+	return node
+}
+
+// Record the source line of the next instruction.
+func (l *lowerer) mark(node *ast.Node) {
+	if node.TokenStart.Line != 0 {
+		l.line = node.TokenStart.Line
+	}
+}
+
+func (l *lowerer) emit(s Stmt) {
+	if in, ok := s.(*Instr); ok {
+		if in.Line == 0 {
+			in.Line = l.line
+		}
+		switch in.Op {
+		case Add, Sub, Mul, Div, Rem, Neg, Convert:
+			in.Wrapping = l.wrapping && IsInt(in.Dst[0].Typ)
+		}
+	}
+	l.body = append(l.body, s)
+}
+
+func (l *lowerer) lookup(name string) *Var {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if v, ok := l.scopes[i][name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// Make a function unique name from base.
+func (l *lowerer) unique(base string) string {
+	name := base
+	for i := 1; l.names[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	l.names[name] = true
+	return name
+}
+
+// Declare a variable in the current scope.
+func (l *lowerer) declare(name string, t string) *Var {
+	v := &Var{Name: l.unique(name), Typ: t}
+	l.fn.Locals = append(l.fn.Locals, v)
+	l.scopes[len(l.scopes)-1][name] = v
+	return v
+}
+
+func (l *lowerer) temp(t string) *Var {
+	l.temps++
+	v := &Var{Name: l.unique(fmt.Sprintf("t%d", l.temps)), Typ: t, Temp: true}
+	l.fn.Locals = append(l.fn.Locals, v)
+	return v
+}
+
+// Store value in dst. A temporary that was just computed is replaced by dst instead of being copied.
+func (l *lowerer) assign(dst *Var, value Value) {
+	if v, ok := value.(*Var); ok && v.Temp && len(l.body) > 0 {
+		if in, ok := l.body[len(l.body)-1].(*Instr); ok {
+			for i, d := range in.Dst {
+				if d == v {
+					in.Dst[i] = dst
+					l.removeLocal(v)
+					return
+				}
+			}
+		}
+	}
+	l.emit(&Instr{Op: Copy, Dst: []*Var{dst}, Args: []Value{value}})
+}
+
+func (l *lowerer) removeLocal(v *Var) {
+	for i := len(l.fn.Locals) - 1; i >= 0; i-- {
+		if l.fn.Locals[i] == v {
+			l.fn.Locals = append(l.fn.Locals[:i], l.fn.Locals[i+1:]...)
+			return
+		}
+	}
+}
+
+// Convert a number to type t if it has a different numeric type. Constants are converted in place.
+func (l *lowerer) coerce(value Value, t string) Value {
+	if value == nil {
+		l.abort("Void value used as " + t)
+	}
+	from := value.Type()
+	if from == t || !IsNumber(from) || !IsNumber(t) {
+		return value
+	}
+	if c, ok := value.(*Const); ok {
+		switch v := c.Value.(type) {
+		case int64:
+			if IsFloat(t) {
+				return &Const{Typ: t, Value: float64(v)}
+			}
+			return &Const{Typ: t, Value: v}
+		case float64:
+			if IsFloat(t) {
+				return &Const{Typ: t, Value: v}
+			}
+		}
+	}
+	dst := l.temp(t)
+	l.emit(&Instr{Op: Convert, Dst: []*Var{dst}, Args: []Value{value}})
+	return dst
+}
+
+func (l *lowerer) getField(obj Value, c *Class, field int) Value {
+	dst := l.temp(c.Fields[field].Typ)
+	l.emit(&Instr{Op: GetField, Dst: []*Var{dst}, Args: []Value{obj}, Class: c, Field: field})
+	return dst
+}
+
+// Find a field of the class of obj.
+func (l *lowerer) field(node *ast.Node, obj Value) (*Class, int) {
+	c, ok := l.classes[obj.Type()]
+	if !ok {
+		abortMsg(node, "Unknown class "+obj.Type())
+	}
+	name := node.Children[1].TokenStart.Literal
+	field := c.FieldIndex(name)
+	if field == -1 {
+		abortMsg(node, "Unknown member "+c.Name+"."+name)
+	}
+	return c, field
+}
+
+// Find an implicit member of self.
+func (l *lowerer) selfField(node *ast.Node, name string) (*Var, int) {
+	if c := l.fn.Class; c != nil {
+		if field := c.FieldIndex(name); field != -1 {
+			return l.fn.Params[0], field
+		}
+	}
+	abortMsg(node, "Unknown variable "+name)
+	return nil, 0
+}
+
+// Key and value types of indexing a list or map.
+func (l *lowerer) indexTypes(node *ast.Node, t string) (string, string) {
+	switch {
+	case IsList(t):
+		return "int", Elem(t)
+	case IsMap(t):
+		return MapTypes(t)
+	}
+	abortMsg(node, "Cannot index "+t)
+	return "", ""
+}
@@ -0,0 +1,102 @@
+package ir
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Print formats a program as text for debugging.
+func Print(p *Program) string {
+	var b strings.Builder
+	for _, c := range p.Classes {
+		fmt.Fprintf(&b, "class %s {\n", c.Name)
+		for _, field := range c.Fields {
+			fmt.Fprintf(&b, "\t%s %s\n", field.Name, field.Typ)
+		}
+		b.WriteString("}\n\n")
+	}
+	for _, f := range p.Funcs {
+		var params []string
+		for _, param := range f.Params {
+			params = append(params, param.String()+" "+param.Typ)
+		}
+		fmt.Fprintf(&b, "func %s(%s) (%s) {\n", f.Name, strings.Join(params, ", "), strings.Join(f.Results, ", "))
+		for _, local := range f.Locals {
+			fmt.Fprintf(&b, "\tvar %s %s\n", local, local.Typ)
+		}
+		printStmts(&b, f.Body, 1)
+		b.WriteString("}\n\n")
+	}
+	return b.String()
+}
+
+func printStmts(b *strings.Builder, stmts []Stmt, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *Instr:
+			b.WriteString(indent + s.String() + "\n")
+		case *If:
+			fmt.Fprintf(b, "%sif %s {\n", indent, s.Cond)
+			printStmts(b, s.Then, depth+1)
+			if len(s.Else) > 0 {
+				b.WriteString(indent + "} else {\n")
+				printStmts(b, s.Else, depth+1)
+			}
+			b.WriteString(indent + "}\n")
+		case *Loop:
+			b.WriteString(indent + "loop {\n")
+			printStmts(b, s.Body, depth+1)
+			if len(s.Post) > 0 {
+				b.WriteString(indent + "} post {\n")
+				printStmts(b, s.Post, depth+1)
+			}
+			b.WriteString(indent + "}\n")
+		case *Break:
+			b.WriteString(indent + "break\n")
+		case *Continue:
+			b.WriteString(indent + "continue\n")
+		case *Return:
+			fmt.Fprintf(b, "%sreturn %s\n", indent, joinValues(s.Values))
+		}
+	}
+}
+
+func (in *Instr) String() string {
+	var dst []string
+	for _, d := range in.Dst {
+		dst = append(dst, d.String())
+	}
+	var s string
+	if len(dst) > 0 {
+		s = strings.Join(dst, ", ") + " = "
+	}
+	s += in.Op.String()
+	if in.Wrapping {
+		s += " wrapping"
+	}
+	switch in.Op {
+	case Call:
+		s += " " + in.Func.Name
+	case Builtin:
+		s += " " + in.Name
+	case New:
+		s += " " + in.Class.Name
+	case GetField, SetField:
+		s += " " + in.Class.Name + "." + in.Class.Fields[in.Field].Name
+	case Convert:
+		s += " " + in.Dst[0].Typ
+	}
+	if len(in.Args) > 0 {
+		s += " " + joinValues(in.Args)
+	}
+	return s
+}
+
+func joinValues(values []Value) string {
+	var s []string
+	for _, v := range values {
+		s = append(s, v.String())
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,138 @@
+package ir
+
+import (
+	"knox/ast"
+	"strings"
+)
+
+// TypeName builds the full Knox type name of a VARTYPE node, matching the type checker. Nullable types are
+// represented like the type that they wrap.
+func TypeName(node *ast.Node) string {
+	name := node.Children[0].TokenStart.Literal
+	if len(node.Children) == 1 {
+		return name
+	}
+	if name == "?" {
+		return TypeName(&node.Children[1])
+	}
+	if name == "[" {
+		return "[" + TypeName(&node.Children[1]) + "]"
+	}
+	var inner []string
+	for i := 1; i < len(node.Children); i++ {
+		inner = append(inner, TypeName(&node.Children[i]))
+	}
+	return name + "[" + strings.Join(inner, ",") + "]"
+}
+
+// IsList reports whether t is a list type like [int].
+func IsList(t string) bool {
+	return strings.HasPrefix(t, "[")
+}
+
+// IsMap reports whether t is a map type like map[string,int].
+func IsMap(t string) bool {
+	return strings.HasPrefix(t, "map[")
+}
+
+// Elem is the element type of a list type.
+func Elem(t string) string {
+	return t[1 : len(t)-1]
+}
+
+// MapTypes splits a map type into its key and value types.
+func MapTypes(t string) (string, string) {
+	inner := t[len("map[") : len(t)-1]
+	depth := 0
+	for i, c := range inner {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				return inner[:i], inner[i+1:]
+			}
+		}
+	}
+	return inner, ""
+}
+
+// IsLiteral reports whether t is the type of an untyped number literal.
+func IsLiteral(t string) bool {
+	return t == "INT_LITERAL" || t == "FLOAT_LITERAL"
+}
+
+// IsFloat reports whether t is a floating point type.
+func IsFloat(t string) bool {
+	return t == "float" || t == "f32" || t == "f64" || t == "FLOAT_LITERAL"
+}
+
+// IsInt reports whether t is an integer type. Runes and bytes are stored as integers too, like i32 and u8.
+func IsInt(t string) bool {
+	switch t {
+	case "int", "i8", "i16", "i32", "i64", "u8", "u16", "u32", "u64", "INT_LITERAL", "rune", "byte":
+		return true
+	}
+	return false
+}
+
+// IsNumber reports whether t is an integer or floating point type.
+func IsNumber(t string) bool {
+	return IsInt(t) || IsFloat(t)
+}
+
+// IsUnsigned reports whether t is an unsigned integer type.
+func IsUnsigned(t string) bool {
+	return strings.HasPrefix(t, "u") || t == "byte"
+}
+
+// Bits returns the width of a number type.
+func Bits(t string) int {
+	switch t {
+	case "i8", "u8", "byte":
+		return 8
+	case "i16", "u16":
+		return 16
+	case "int", "i32", "u32", "float", "f32", "rune":
+		return 32
+	}
+	return 64
+}
+
+// IsPrimitive reports whether t is stored by value rather than as a reference.
+func IsPrimitive(t string) bool {
+	return IsNumber(t) || t == "bool"
+}
+
+// HasLiteral reports whether t is a literal type or a list of them, however deeply nested.
+func HasLiteral(t string) bool {
+	if IsList(t) {
+		return HasLiteral(Elem(t))
+	}
+	return IsLiteral(t)
+}
+
+// Concrete replaces a literal type with a concrete one, preferring the type the context expects. The items of
+// lists are replaced at every level, so [[INT_LITERAL]] becomes [[int]].
+func Concrete(t string, hint string) string {
+	if IsList(t) {
+		if IsList(hint) {
+			hint = Elem(hint)
+		} else {
+			hint = ""
+		}
+		return "[" + Concrete(Elem(t), hint) + "]"
+	}
+	if !IsLiteral(t) {
+		return t
+	}
+	if IsNumber(hint) && !IsLiteral(hint) && (IsFloat(hint) || t == "INT_LITERAL") {
+		return hint
+	}
+	if t == "FLOAT_LITERAL" {
+		return "f64" // C treats unsuffixed float literals as double.
+	}
+	return "int"
+}
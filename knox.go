@@ -6,31 +6,88 @@ import (
 	"io/ioutil"
 	"knox/ast"
 	"knox/builtin"
+	"knox/bytecode"
+	"knox/cfa"
+	"knox/doc"
 	"knox/emitter"
+	"knox/format"
+	"knox/ir"
 	"knox/lexer"
+	"knox/lint"
+	"knox/llvm"
+	"knox/lsp"
+	"knox/opt"
 	"knox/parser"
 	"knox/typechecker"
+	"knox/vm"
+	"knox/wasm"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"time"
 )
 
+// Subcommands, which take their own flags after the command name.
+var commands = map[string]func(args []string){
+	"doc": runDoc,
+	"fmt": runFmt,
+	"lsp": runLSP,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	// Flags
 	timeFlag := flag.Bool("time", false, "Print the time taken by each compiler phase.")
 	astFlag := flag.Bool("ast", false, "Print the AST.")
-	codeFlag := flag.Bool("code", false, "Print the C code.")
+	codeFlag := flag.Bool("code", false, "Print the C or WebAssembly text code.")
 	outFlag := flag.String("out", "", "Path for output files.")
 	nameFlag := flag.String("name", "", "Name for output executable.")
 	binaryFlag := flag.Bool("binary", true, "Generates executable.")
+	backendFlag := flag.String("backend", "c", "Code generator to use: c, vm, llvm or wasm.")
+	disasmFlag := flag.Bool("disasm", false, "Print the bytecode disassembly.")
+	emitLLVMFlag := flag.Bool("emit-llvm", false, "Print the LLVM IR.")
+	irFlag := flag.Bool("ir", false, "Print the Knox IR.")
+	werrorFlag := flag.Bool("Werror", false, "Treat warnings as errors.")
+	checkedFlag := flag.Bool("checked", false, "Abort on integer overflow and division by zero. Only the c backend supports it.")
+	debugFlag := flag.Bool("debug", false, "Abort on nil dereferences. Only the c backend supports it, and the vm backend always does.")
 	flag.Parse()
 	args := flag.Args()
 
 	if len(args) == 0 {
 		panic("Specify file to be compiled.")
 	}
+	if *checkedFlag && *backendFlag != "c" {
+		panic("The " + *backendFlag + " backend doesn't support -checked.")
+	}
+	if *debugFlag && (*backendFlag == "llvm" || *backendFlag == "wasm") {
+		panic("The " + *backendFlag + " backend doesn't support -debug.")
+	}
+
+	// Run previously compiled bytecode.
+	if filepath.Ext(args[0]) == ".kbc" {
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			panic(err)
+		}
+		prog, err := bytecode.Decode(data)
+		if err != nil {
+			panic(err)
+		}
+		if *disasmFlag {
+			fmt.Print(bytecode.Disassemble(prog))
+		}
+		runVM(prog)
+		return
+	}
+
 	code, err := ioutil.ReadFile(args[0]) // TODO: Support multiple files.
 	//code, err := ioutil.ReadFile("examples/chain.knox")
 	if err != nil {
@@ -57,25 +114,143 @@ func main() {
 	typechecker.Analyze(&a)
 	elapsedTypeChecking := time.Since(start)
 
-	// Control flow analysis.
-	//cfa.Analyze(&a)
+	// Control flow analysis and warnings.
+	warnings := cfa.Analyze(&a)
+	warnings += lint.Analyze(&a)
+	if *werrorFlag && warnings > 0 {
+		fmt.Printf("Treating %v warnings as errors.\n", warnings)
+		panic("Aborted.\n")
+	}
 
-	// Generate code.
+	// Lower to the IR that every backend consumes.
 	start = time.Now()
-	output := emitter.Generate(&a)
-	elapsedEmitting := time.Since(start)
+	program := ir.Lower(&a)
+	program.File = args[0]
+	elapsedLowering := time.Since(start)
 
-	if *codeFlag {
-		fmt.Println(output)
+	// Fold constants and remove dead code.
+	start = time.Now()
+	simplifications := opt.Optimize(program)
+	elapsedOptimizing := time.Since(start)
+
+	if *irFlag {
+		fmt.Print(ir.Print(program))
 	}
 
-	// Output code.
+	// Output path.
 	ex, err := os.Executable()
 	if err != nil {
 		panic(err)
 	}
 	local := filepath.Dir(ex) // Get current path.
 	outputDir := path.Join(local, *outFlag)
+
+	if *backendFlag == "vm" {
+		start = time.Now()
+		prog := bytecode.Compile(program)
+		elapsedCompiling := time.Since(start)
+
+		if *disasmFlag {
+			fmt.Print(bytecode.Disassemble(prog))
+		}
+		werr := ioutil.WriteFile(path.Join(outputDir, "out.kbc"), prog.Encode(), 0644) // TODO: Bytecode files should use Knox file names.
+		if werr != nil {
+			panic(werr)
+		}
+		if *timeFlag {
+			fmt.Printf("Parsing took: %v\n", elapsedParsing)
+			fmt.Printf("Type checking took: %v\n", elapsedTypeChecking)
+			fmt.Printf("Lowering took: %v\n", elapsedLowering)
+			fmt.Printf("Optimizing took: %v (%v simplifications)\n", elapsedOptimizing, simplifications)
+			fmt.Printf("Compiling bytecode took: %v\n", elapsedCompiling)
+		}
+		if *binaryFlag {
+			runVM(prog)
+		}
+		return
+	} else if *backendFlag == "llvm" {
+		start = time.Now()
+		output := llvm.Generate(program)
+		elapsedEmitting := time.Since(start)
+
+		if *emitLLVMFlag {
+			fmt.Print(output)
+		}
+		irFile := path.Join(outputDir, "out.ll") // TODO: IR files should use Knox file names.
+		werr := ioutil.WriteFile(irFile, []byte(output), 0644)
+		if werr != nil {
+			panic(werr)
+		}
+
+		// The runtime is shared with the C backend, so knoxutil.h is expected next to the output like out.c expects it.
+		if *binaryFlag {
+			binName := *nameFlag
+			if binName == "" {
+				binName = "a.out"
+			}
+			cmd := exec.Command("clang", "-x", "ir", irFile, "-x", "c", path.Join(outputDir, "knoxutil.h"), "-o", path.Join(outputDir, binName))
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cerr := cmd.Run()
+			if cerr != nil {
+				panic(cerr)
+			}
+		}
+
+		if *timeFlag {
+			fmt.Printf("Parsing took: %v\n", elapsedParsing)
+			fmt.Printf("Type checking took: %v\n", elapsedTypeChecking)
+			fmt.Printf("Lowering took: %v\n", elapsedLowering)
+			fmt.Printf("Optimizing took: %v (%v simplifications)\n", elapsedOptimizing, simplifications)
+			fmt.Printf("Generating LLVM IR took: %v\n", elapsedEmitting)
+		}
+		return
+	} else if *backendFlag == "wasm" {
+		start = time.Now()
+		output := wasm.Generate(program)
+		elapsedEmitting := time.Since(start)
+
+		if *codeFlag {
+			fmt.Print(output)
+		}
+
+		// Check the module before writing it, since it may be run by other hosts.
+		module, verr := wasm.Validate(output)
+		if verr != nil {
+			panic(verr)
+		}
+		werr := ioutil.WriteFile(path.Join(outputDir, "out.wat"), []byte(output), 0644) // TODO: WAT files should use Knox file names.
+		if werr != nil {
+			panic(werr)
+		}
+		if *timeFlag {
+			fmt.Printf("Parsing took: %v\n", elapsedParsing)
+			fmt.Printf("Type checking took: %v\n", elapsedTypeChecking)
+			fmt.Printf("Lowering took: %v\n", elapsedLowering)
+			fmt.Printf("Optimizing took: %v (%v simplifications)\n", elapsedOptimizing, simplifications)
+			fmt.Printf("Generating WebAssembly took: %v\n", elapsedEmitting)
+		}
+		if *binaryFlag {
+			if rerr := wasm.Run(module, os.Stdout); rerr != nil {
+				fmt.Println(rerr)
+				os.Exit(1)
+			}
+		}
+		return
+	} else if *backendFlag != "c" {
+		panic("Unknown backend: " + *backendFlag)
+	}
+
+	// Generate code.
+	start = time.Now()
+	output := emitter.Generate(program, *checkedFlag, *debugFlag)
+	elapsedEmitting := time.Since(start)
+
+	if *codeFlag {
+		fmt.Println(output)
+	}
+
+	// Output code.
 	codeFile := path.Join(outputDir, "out.c") // TODO: C files should use Knox file names.
 	binName := *nameFlag
 	if binName == "" {
@@ -101,6 +276,141 @@ func main() {
 	if *timeFlag {
 		fmt.Printf("Parsing took: %v\n", elapsedParsing)
 		fmt.Printf("Parsing took: %v\n", elapsedTypeChecking)
+		fmt.Printf("Lowering took: %v\n", elapsedLowering)
+		fmt.Printf("Optimizing took: %v (%v simplifications)\n", elapsedOptimizing, simplifications)
 		fmt.Printf("Parsing took: %v\n", elapsedEmitting)
 	}
 }
+
+// Execute bytecode, exiting with an error status on a runtime error.
+func runVM(prog *bytecode.Program) {
+	machine := vm.New(prog, os.Stdout)
+	if err := machine.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Write Markdown and HTML documentation for a file, or for every file of a module directory.
+func runDoc(args []string) {
+	flags := flag.NewFlagSet("doc", flag.ExitOnError)
+	outFlag := flags.String("out", "doc", "Path for the documentation.")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		panic("Specify file or module to be documented.")
+	}
+	files := sourceFiles(flags.Args())
+
+	// Only parse, so that documentation can be written for code that doesn't type check yet.
+	var programs []*ast.Node
+	for _, file := range files {
+		code, err := ioutil.ReadFile(file)
+		if err != nil {
+			panic(err)
+		}
+		p := parser.New(lexer.New(string(code) + "\n"))
+		a := p.Program()
+		programs = append(programs, &a)
+	}
+	module := doc.NewModule(files, programs)
+
+	if err := os.MkdirAll(*outFlag, 0755); err != nil {
+		panic(err)
+	}
+	write := func(name string, text string) {
+		if err := ioutil.WriteFile(path.Join(*outFlag, name), []byte(text), 0644); err != nil {
+			panic(err)
+		}
+	}
+	for _, page := range module.Pages {
+		write(page.Name+".md", module.Markdown(page))
+		write(page.Name+".html", module.HTML(page))
+	}
+	if len(module.Pages) > 1 {
+		title := filepath.Base(flags.Arg(0))
+		write("index.md", module.MarkdownIndex(title))
+		write("index.html", module.HTMLIndex(title))
+	}
+}
+
+// Serve editors over the standard input and output, from the directory with the builtins like the compiler.
+func runLSP(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	flags.Parse(args)
+	if !lsp.Serve(os.Stdin, os.Stdout) {
+		os.Exit(1)
+	}
+}
+
+// Print formatted source, or with -w rewrite the files that change and with -d print how they change.
+func runFmt(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	writeFlag := flags.Bool("w", false, "Write the formatted source back to the files.")
+	diffFlag := flags.Bool("d", false, "Print a diff of the changes instead of the formatted source.")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		panic("Specify file or module to be formatted.")
+	}
+
+	for _, file := range sourceFiles(flags.Args()) {
+		code, err := ioutil.ReadFile(file)
+		if err != nil {
+			panic(err)
+		}
+		formatted := format.Source(string(code))
+		if !*writeFlag && !*diffFlag {
+			fmt.Print(formatted)
+		}
+		if formatted == string(code) {
+			continue
+		}
+		if *diffFlag {
+			fmt.Print(diff(file, formatted))
+		}
+		if *writeFlag {
+			if err := ioutil.WriteFile(file, []byte(formatted), 0644); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+// Unified diff from a file to new contents.
+func diff(file string, contents string) string {
+	f, err := ioutil.TempFile("", "knox-fmt")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(contents); err != nil {
+		panic(err)
+	}
+	f.Close()
+	output, err := exec.Command("diff", "-u", "--label", file+".orig", "--label", file, file, f.Name()).Output()
+	if _, differ := err.(*exec.ExitError); err != nil && !differ { // diff exits with 1 when the files differ.
+		panic(err)
+	}
+	return string(output)
+}
+
+// The files named by the arguments, where a directory stands for the .knox files in it.
+func sourceFiles(args []string) []string {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			panic(err)
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(path.Join(arg, "*.knox"))
+		if err != nil {
+			panic(err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files
+}
@@ -5,6 +5,8 @@ package lexer
 import (
 	"fmt"
 	"knox/token"
+	"strings"
+	"unicode"
 )
 
 // Lexer object.
@@ -14,6 +16,25 @@ type Lexer struct {
 	ch           rune   // Current character.
 	characters   []rune // Rune slice of input string.
 	line         int    // Line number of the current token.
+	holes        []int  // Depth of braces in each interpolated string hole being lexed.
+	opened       int    // Number of opening braces read.
+
+	// Comments, the lines of closing braces and annotations and the text of quoted literals, in source order,
+	// which tools that print the source back need.
+	Comments    []Comment
+	Braces      []int
+	Annotations []int
+	Quotes      []string // Source text between the quotes of string and character literals and their pieces.
+}
+
+// Comment is a //, /* */ or /// comment with its markers.
+type Comment struct {
+	Text    string
+	Line    int
+	EndLine int // Last line of a block comment.
+	// Numbers of opening and closing braces before the comment, to tell whether it's inside a block on one line.
+	Opened int
+	Closed int
 }
 
 // New a Lexer instance from string input.
@@ -66,13 +87,44 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.COMMA, l.ch)
 	case rune('+'):
 		tok = newToken(token.PLUS, l.ch)
+		if l.peekChar() == '+' {
+			l.readChar()
+			tok = token.Token{Type: token.INC, Literal: "++"}
+		}
 	case rune('{'):
 		tok = newToken(token.LBRACE, l.ch)
+		l.opened++
+		if len(l.holes) > 0 {
+			l.holes[len(l.holes)-1]++
+		}
 	case rune('}'):
 		tok = newToken(token.RBRACE, l.ch)
+		if len(l.holes) > 0 && l.holes[len(l.holes)-1] == 0 { // End of a hole, so the string continues.
+			literal, open := l.readString()
+			tok = token.Token{Type: token.INTERPMID, Literal: literal}
+			if !open {
+				tok.Type = token.INTERPEND
+				l.holes = l.holes[:len(l.holes)-1]
+			}
+		} else if len(l.holes) > 0 {
+			l.holes[len(l.holes)-1]--
+		}
+		if tok.Type == token.RBRACE {
+			l.Braces = append(l.Braces, l.line)
+		}
 	case rune('-'):
 		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == '-' {
+			l.readChar()
+			tok = token.Token{Type: token.DEC, Literal: "--"}
+		}
 	case rune('/'):
+		if l.isDocComment() {
+			position, line := l.position, l.line
+			tok = token.Token{Type: token.DOC, Literal: l.readDocComment(), Line: line}
+			l.comment(position, line)
+			return tok
+		}
 		tok = newToken(token.SLASH, l.ch)
 	case rune('*'):
 		tok = newToken(token.ASTERISK, l.ch)
@@ -80,11 +132,21 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.PERCENT, l.ch)
 	case rune('^'):
 		tok = newToken(token.CARET, l.ch)
+	case rune('~'):
+		tok = newToken(token.TILDE, l.ch)
 	case rune('.'):
 		tok = newToken(token.DOT, l.ch)
+	case rune('@'):
+		tok = newToken(token.AT, l.ch)
+		l.Annotations = append(l.Annotations, l.line)
+	case rune('?'):
+		tok = newToken(token.QUESTION, l.ch)
 	case rune('<'):
 		tok = newToken(token.LT, l.ch)
-		if l.peekChar() == '=' {
+		if l.peekChar() == '<' {
+			l.readChar()
+			tok = token.Token{Type: token.LSHIFT, Literal: "<<"}
+		} else if l.peekChar() == '=' {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.LTEQ, Literal: string(ch) + string(l.ch)}
@@ -93,7 +155,10 @@ func (l *Lexer) NextToken() token.Token {
 		}
 	case rune('>'):
 		tok = newToken(token.GT, l.ch)
-		if l.peekChar() == '=' {
+		if l.peekChar() == '>' {
+			l.readChar()
+			tok = token.Token{Type: token.RSHIFT, Literal: ">>"}
+		} else if l.peekChar() == '=' {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.GTEQ, Literal: string(ch) + string(l.ch)}
@@ -105,12 +170,16 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.AND, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.AMPERSAND, l.ch)
 		}
 	case rune('|'):
 		if l.peekChar() == '|' {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.OR, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.PIPE, l.ch)
 		}
 	case rune('!'):
 		if l.peekChar() == rune('=') {
@@ -121,8 +190,14 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch)
 		}
 	case rune('"'):
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		literal, open := l.readString()
+		tok = token.Token{Type: token.STRING, Literal: literal}
+		if open {
+			tok.Type = token.INTERPSTART
+			l.holes = append(l.holes, 0)
+		}
+	case rune('\''):
+		tok = token.Token{Type: token.CHAR, Literal: l.readCharacter()}
 	case rune('['):
 		tok = newToken(token.LBRACKET, l.ch)
 	case rune(']'):
@@ -135,26 +210,33 @@ func (l *Lexer) NextToken() token.Token {
 		tok.Literal = ""
 		tok.Type = token.EOF
 	default:
+		line := l.line // Reading past the end of the token can count the newline after it.
 		if isDigit(l.ch) {
-			// If starts with 0x...
-			// If starts with 0b...
-			// If starts with 0o...
-			// Else...
-			tok = l.readDecimal()
-			tok.Line = l.line
+			tok = l.readNumberLiteral()
+			tok.Line = line
 			return tok
 		} else {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdentifier(tok.Literal)
-			tok.Line = l.line
+			tok.Line = line
 			return tok
 		}
 	}
+	if assignable[tok.Type] && l.peekChar() == '=' { // Compound assignment.
+		l.readChar()
+		tok = token.Token{Type: token.OPASSIGN, Literal: tok.Literal + "="}
+	}
 	tok.Line = l.line
 	l.readChar()
 	return tok
 }
 
+// Operators that can be followed by = to assign their result.
+var assignable = map[token.TokenType]bool{
+	token.PLUS: true, token.MINUS: true, token.ASTERISK: true, token.SLASH: true, token.PERCENT: true,
+	token.AMPERSAND: true, token.PIPE: true, token.CARET: true, token.LSHIFT: true, token.RSHIFT: true,
+}
+
 // return new token
 func newToken(tokenType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
@@ -177,22 +259,78 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
+// Skip comments other than doc comments, which are tokens.
 func (l *Lexer) checkComments() {
-	for l.ch == rune('/') && l.peekChar() == '/' {
-		l.skipComment()
+	for l.ch == rune('/') && (l.peekChar() == '/' && !l.isDocComment() || l.peekChar() == '*') {
+		position, line := l.position, l.line
+		if l.peekChar() == '*' {
+			l.skipBlockComment()
+		} else {
+			l.skipComment()
+		}
+		l.comment(position, line)
 		l.skipWhitespace()
 	}
 }
 
+// Record the comment that was just read from position.
+func (l *Lexer) comment(position int, line int) {
+	text := strings.TrimRight(string(l.characters[position:l.position]), " \t\r")
+	l.Comments = append(l.Comments, Comment{Text: text, Line: line, EndLine: line + strings.Count(text, "\n"), Opened: l.opened,
+		Closed: len(l.Braces)})
+}
+
 // Ignore comments.
 func (l *Lexer) skipComment() {
-	for l.ch != rune('\n') {
+	for l.ch != rune('\n') && l.ch != rune(0) {
+		l.readChar()
+	}
+}
+
+// Skip a /* */ comment, which can contain other block comments.
+func (l *Lexer) skipBlockComment() {
+	line := l.line
+	depth := 0
+	for {
+		switch {
+		case l.ch == rune(0):
+			fmt.Printf("End of block comment not found. Line %v.\n", line)
+			panic("Aborted.")
+		case l.ch == '/' && l.peekChar() == '*':
+			depth++
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth--
+			l.readChar()
+		}
+		l.readChar()
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+// Whether a /// doc comment starts here. Comments with more slashes, like separator lines, are plain comments.
+func (l *Lexer) isDocComment() bool {
+	text := l.characters[l.position:]
+	return len(text) >= 3 && string(text[:3]) == "///" && (len(text) == 3 || text[3] != '/')
+}
+
+// Read a doc comment up to the end of its line, dropping the slashes and the space after them.
+func (l *Lexer) readDocComment() string {
+	l.readChar()
+	l.readChar()
+	l.readChar()
+	if l.ch == ' ' {
 		l.readChar()
 	}
+	position := l.position
+	l.skipComment()
+	return strings.TrimRight(string(l.characters[position:l.position]), " \t\r")
 }
 
-// read number
-func (l *Lexer) readNumber() string {
+// Read the digits of a number and the _ separators between them.
+func (l *Lexer) readDigits(isDigit func(rune) bool) string {
 	position := l.position
 	for isDigit(l.ch) || isUnderscore(l.ch) {
 		l.readChar()
@@ -209,40 +347,157 @@ func (l *Lexer) readUntilWhitespace() string {
 	return string(l.characters[position:l.position])
 }
 
-// read decimal
-func (l *Lexer) readDecimal() token.Token {
-	integer := l.readNumber()
-	if l.ch == rune('.') {
+// Read a number literal. Integers are decimal or have a 0x, 0b or 0o prefix, floats have a fraction or an
+// exponent like 1.5e-3, and either can end with a type suffix like u8 or f32. The literal keeps its source
+// text, so use NumberSuffix and NumberValue to read it.
+func (l *Lexer) readNumberLiteral() token.Token {
+	position := l.position
+	tok := token.Token{Type: token.INT}
+	if base, ok := radixes[l.peekChar()]; ok && l.ch == '0' {
 		l.readChar()
-		fraction := l.readNumber()
-		if isEmpty(l.ch) || isWhitespace(l.ch) || IsOperator(l.ch) || isComparison(l.ch) || isCompound(l.ch) || isBracket(l.ch) || isBrace(l.ch) || isParen(l.ch) {
-			return token.Token{Type: token.FLOAT, Literal: integer + "." + fraction}
-		} else {
-			illegalPart := l.readUntilWhitespace()
-			return token.Token{Type: token.ILLEGAL, Literal: integer + "." + fraction + illegalPart}
+		l.readChar()
+		l.readDigits(isIdentifier) // Read past invalid digits to report them.
+		digits, _ := NumberSuffix(string(l.characters[position:l.position]))
+		for _, ch := range digits[2:] {
+			if !isUnderscore(ch) && !strings.ContainsRune(hexDigits[:base], unicode.ToLower(ch)) {
+				l.numberError(position, fmt.Sprintf("Invalid digit %c in the base %d literal", ch, base))
+			}
+		}
+		if strings.Trim(digits[2:], "_") == "" {
+			l.numberError(position, "Missing digits after the prefix of the literal")
 		}
-	} else if isEmpty(l.ch) || isWhitespace(l.ch) || IsOperator(l.ch) || isComparison(l.ch) || isCompound(l.ch) || isBracket(l.ch) || isBrace(l.ch) || isParen(l.ch) {
-		return token.Token{Type: token.INT, Literal: integer}
 	} else {
-		illegalPart := l.readUntilWhitespace()
-		return token.Token{Type: token.ILLEGAL, Literal: integer + illegalPart}
+		l.readDigits(isDigit)
+		if l.ch == '.' {
+			tok.Type = token.FLOAT
+			l.readChar()
+			l.readDigits(isDigit)
+		}
+		if l.ch == 'e' || l.ch == 'E' {
+			tok.Type = token.FLOAT
+			l.readChar()
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			if !isDigit(l.ch) {
+				l.numberError(position, "Missing digits in the exponent of the literal")
+			}
+			l.readDigits(isDigit)
+		}
+		end := l.position
+		for isIdentifier(l.ch) {
+			l.readChar()
+		}
+		if suffix := string(l.characters[end:l.position]); suffix != "" && !isSuffix(suffix) {
+			l.numberError(position, "Unknown type suffix "+suffix+" on the literal")
+		} else if tok.Type == token.FLOAT && suffix != "" && suffix[0] != 'f' {
+			l.numberError(position, "Only f32 and f64 can be the suffix of the float literal")
+		}
 	}
+	tok.Literal = string(l.characters[position:l.position])
+	if isEmpty(l.ch) || isWhitespace(l.ch) || IsOperator(l.ch) || isBitwise(l.ch) || isComparison(l.ch) || isCompound(l.ch) || isBracket(l.ch) || isBrace(l.ch) || isParen(l.ch) {
+		return tok
+	}
+	illegalPart := l.readUntilWhitespace()
+	return token.Token{Type: token.ILLEGAL, Literal: tok.Literal + illegalPart}
 }
 
-// read string
-func (l *Lexer) readString() string {
-	position := l.position + 1
+func (l *Lexer) numberError(position int, msg string) {
+	for isIdentifier(l.ch) || l.ch == '.' {
+		l.readChar()
+	}
+	fmt.Printf("%s %s. Line %v.\n", msg, string(l.characters[position:l.position]), l.line)
+	panic("Aborted.")
+}
+
+// Read a string literal up to its closing quote or the { of a hole, replacing escape sequences with the
+// characters they stand for. Reports whether it stopped at a hole.
+func (l *Lexer) readString() (string, bool) {
+	var value []rune
+	start := l.readPosition
 	for {
 		l.readChar()
-		if l.ch == '"' {
+		if l.ch == '"' || l.ch == '{' {
 			break
 		}
 		if l.ch == rune(0) {
 			fmt.Println("End of string literal not found.")
 			panic("Aborted.")
 		}
+		if l.ch == '\\' {
+			l.readChar()
+			value = append(value, l.escape())
+		} else {
+			value = append(value, l.ch)
+		}
+	}
+	l.Quotes = append(l.Quotes, string(l.characters[start:l.position]))
+	return string(value), l.ch == '{'
+}
+
+// Read a character literal like 'a' or '\n', which holds exactly one code point.
+func (l *Lexer) readCharacter() string {
+	start := l.readPosition
+	l.readChar()
+	ch := l.ch
+	switch ch {
+	case '\\':
+		l.readChar()
+		ch = l.escape()
+	case '\'', '\n', rune(0):
+		fmt.Printf("Empty character literal. Line %v.\n", l.line)
+		panic("Aborted.")
+	}
+	l.readChar()
+	if l.ch != '\'' {
+		fmt.Printf("Character literals hold a single character, and strings use double quotes. Line %v.\n", l.line)
+		panic("Aborted.")
+	}
+	l.Quotes = append(l.Quotes, string(l.characters[start:l.position]))
+	return string(ch)
+}
+
+var escapes = map[rune]rune{'n': '\n', 't': '\t', 'r': '\r', '0': 0, '\\': '\\', '"': '"', '\'': '\'', '{': '{', '}': '}'}
+
+// Character for the escape sequence after a backslash: \n, \t, \r, \0, \\, \", \', \{, \} or \u{hex} for
+// any code point.
+func (l *Lexer) escape() rune {
+	if ch, ok := escapes[l.ch]; ok {
+		return ch
+	}
+	if l.ch == 'u' && l.peekChar() == '{' {
+		l.readChar()
+		var code rune
+		digits := 0
+		for l.readChar(); l.ch != '}'; l.readChar() {
+			digit := hexDigit(l.ch)
+			if digit < 0 || digits == 6 {
+				fmt.Printf("Invalid \\u escape in string literal. Line %v.\n", l.line)
+				panic("Aborted.")
+			}
+			code = code*16 + digit
+			digits++
+		}
+		if digits == 0 || code > 0x10FFFF || (code >= 0xD800 && code <= 0xDFFF) {
+			fmt.Printf("Invalid \\u escape in string literal. Line %v.\n", l.line)
+			panic("Aborted.")
+		}
+		return code
 	}
-	return string(l.characters[position:l.position])
+	fmt.Printf("Unknown escape sequence \\%c in string literal. Line %v.\n", l.ch, l.line)
+	panic("Aborted.")
+}
+
+func hexDigit(ch rune) rune {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0'
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10
+	}
+	return -1
 }
 
 // peek character
@@ -256,7 +511,7 @@ func (l *Lexer) peekChar() rune {
 
 // determinate ch is identifier or not
 func isIdentifier(ch rune) bool {
-	return !isWhitespace(ch) && !isBrace(ch) && !IsOperator(ch) && !isComparison(ch) && !isCompound(ch) && !isBrace(ch) && !isParen(ch) && !isBracket(ch) && !isEmpty(ch) && !isDot(ch)
+	return !isWhitespace(ch) && !isBrace(ch) && !IsOperator(ch) && !isBitwise(ch) && !isComparison(ch) && !isCompound(ch) && !isBrace(ch) && !isParen(ch) && !isBracket(ch) && !isEmpty(ch) && !isDot(ch)
 }
 
 func isDot(ch rune) bool {
@@ -273,6 +528,11 @@ func IsOperator(ch rune) bool {
 	return ch == rune('+') || ch == rune('-') || ch == rune('/') || ch == rune('*') || ch == rune('%') || ch == rune('^')
 }
 
+// The bitwise operators other than ^, which IsOperator includes.
+func isBitwise(ch rune) bool {
+	return ch == rune('&') || ch == rune('|') || ch == rune('~')
+}
+
 // is comparison
 func isComparison(ch rune) bool {
 	return ch == rune('=') || ch == rune('!') || ch == rune('>') || ch == rune('<')
@@ -280,7 +540,7 @@ func isComparison(ch rune) bool {
 
 // is compound
 func isCompound(ch rune) bool {
-	return ch == rune(',') || ch == rune(':') || ch == rune('"') || ch == rune(';')
+	return ch == rune(',') || ch == rune(':') || ch == rune('"') || ch == rune(';') || ch == rune('?')
 }
 
 // is brace
@@ -0,0 +1,62 @@
+package lexer
+
+import (
+	"math/big"
+	"strings"
+)
+
+// Bases of the integer literal prefixes 0x, 0b and 0o.
+var radixes = map[rune]int{'x': 16, 'b': 2, 'o': 8}
+
+const hexDigits = "0123456789abcdef"
+
+// Type suffixes of number literals, like 255u8 or 1.5f32.
+var numberSuffixes = []string{"i8", "i16", "i32", "i64", "u8", "u16", "u32", "u64", "f32", "f64"}
+
+// NumberSuffix splits a number literal into its digits and its type suffix, like 255 and u8 for 255u8. Hex
+// digits can't start a suffix, so 0x1f32 has none.
+func NumberSuffix(literal string) (string, string) {
+	for _, suffix := range numberSuffixes {
+		if strings.HasSuffix(literal, suffix) && !(isRadix(literal) && suffix[0] == 'f') {
+			return literal[:len(literal)-len(suffix)], suffix
+		}
+	}
+	return literal, ""
+}
+
+// NumberValue returns the exact value of a number literal's digits, as split from its suffix by NumberSuffix.
+func NumberValue(digits string) (*big.Rat, bool) {
+	digits = strings.ReplaceAll(digits, "_", "")
+	if isRadix(digits) {
+		i, ok := new(big.Int).SetString(digits[2:], radixes[rune(digits[1])])
+		if !ok {
+			return nil, false
+		}
+		return new(big.Rat).SetInt(i), true
+	}
+	if !strings.ContainsAny(digits, ".eE") { // Leading zeros don't make a decimal integer octal.
+		i, ok := new(big.Int).SetString(digits, 10)
+		if !ok {
+			return nil, false
+		}
+		return new(big.Rat).SetInt(i), true
+	}
+	return new(big.Rat).SetString(digits)
+}
+
+func isRadix(literal string) bool {
+	if len(literal) < 2 || literal[0] != '0' {
+		return false
+	}
+	_, ok := radixes[rune(literal[1])]
+	return ok
+}
+
+func isSuffix(s string) bool {
+	for _, suffix := range numberSuffixes {
+		if s == suffix {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package lint
+
+import (
+	"fmt"
+	"knox/ast"
+	"strings"
+)
+
+// TODO: Warn about unused imports once Knox has modules.
+
+type linter struct {
+	functions map[string]*ast.Node            // Global functions by name.
+	classes   map[string]*ast.Node            // Classes by name.
+	methods   map[string]map[string]*ast.Node // Methods by class and name.
+	called    map[*ast.Node]bool              // Functions and methods reachable from main.
+	created   map[string]bool                 // Classes whose member initializers run.
+	used      map[*ast.Node]bool              // Symbol table entries that are read.
+	warnings  int
+}
+
+// Analyze warns about unused local variables, parameters and members, and about functions and methods
+// that are never called from main. Declarations marked @unused are skipped, as are the builtins. Returns
+// the number of warnings.
+func Analyze(node *ast.Node) int {
+	l := &linter{
+		functions: map[string]*ast.Node{},
+		classes:   map[string]*ast.Node{},
+		methods:   map[string]map[string]*ast.Node{},
+		called:    map[*ast.Node]bool{},
+		created:   map[string]bool{},
+		used:      map[*ast.Node]bool{},
+	}
+	for i := range node.Children {
+		decl := &node.Children[i]
+		switch decl.Type {
+		case ast.FUNCDECL:
+			l.functions[name(decl)] = decl
+		case ast.CLASS:
+			l.classes[name(decl)] = decl
+			l.methods[name(decl)] = map[string]*ast.Node{}
+			for j := range decl.Children[1].Children {
+				if member := &decl.Children[1].Children[j]; member.Type == ast.FUNCDECL {
+					l.methods[name(decl)][name(member)] = member
+				}
+			}
+		}
+	}
+
+	main, hasMain := l.functions["main"]
+	if hasMain {
+		l.call(main, "")
+	}
+	for _, fn := range l.functions {
+		l.walk(&fn.Children[3], "")
+	}
+	for class, decl := range l.classes {
+		l.walk(&decl.Children[1], class)
+	}
+
+	for i := range node.Children {
+		decl := &node.Children[i]
+		switch decl.Type {
+		case ast.FUNCDECL:
+			if hasMain && !l.called[decl] && !decl.HasAnnotation("unused") {
+				l.warningMsg(&decl.Children[0], "Function "+name(decl)+" is never called from main")
+			} else if l.called[decl] {
+				l.checkFunc(decl)
+			}
+		case ast.CLASS:
+			l.checkClass(decl)
+		}
+	}
+	return l.warnings
+}
+
+// Mark a function or method as reachable along with everything it calls.
+func (l *linter) call(fn *ast.Node, class string) {
+	if l.called[fn] {
+		return
+	}
+	l.called[fn] = true
+	l.calls(&fn.Children[3], class)
+}
+
+func (l *linter) calls(node *ast.Node, class string) {
+	switch node.Type {
+	case ast.FUNCCALL:
+		callee := node.Children[0]
+		if callee.Type == ast.EXPRESSION {
+			callee = callee.Children[0]
+		}
+		if callee.Type == ast.VARREF {
+			if method, ok := l.methods[class][name(&callee)]; ok { // Implicit method of self.
+				l.call(method, class)
+			} else if fn, ok := l.functions[name(&callee)]; ok {
+				l.call(fn, "")
+			}
+		} else if callee.Type == ast.DOTOP {
+			receiver := callee.Children[0].ValueType
+			if method, ok := l.methods[receiver][callee.Children[1].TokenStart.Literal]; ok {
+				l.call(method, receiver)
+			} else if stl := unwrap(&callee.Children[0]); stl.Type == ast.VARREF && name(stl) == "stl" {
+				for i := 1; i < len(node.Children); i++ {
+					l.printed(node.Children[i].ValueType)
+				}
+			}
+		}
+	case ast.INTERPOLATION:
+		for i := 1; i < len(node.Children); i += 2 {
+			l.printed(node.Children[i].ValueType)
+		}
+	case ast.BINARYOP: // == and != call equals on objects and the objects in lists.
+		if op := node.TokenStart.Literal; op == "==" || op == "!=" {
+			for i := range node.Children {
+				receiver := strings.Trim(node.Children[i].ValueType, "[]")
+				if method, ok := l.methods[receiver]["equals"]; ok {
+					l.call(method, receiver)
+				}
+			}
+		}
+	case ast.NEW:
+		created := node.Children[0].Children[0].TokenStart.Literal
+		if decl, ok := l.classes[created]; ok && !l.created[created] {
+			l.created[created] = true
+			for i := range decl.Children[1].Children {
+				if member := &decl.Children[1].Children[i]; member.Type == ast.VARDECL {
+					l.calls(member, created)
+				}
+			}
+		}
+	}
+	for i := range node.Children {
+		l.calls(&node.Children[i], class)
+	}
+}
+
+// Printing a value calls toString on the objects in it.
+func (l *linter) printed(t string) {
+	for _, word := range strings.FieldsFunc(t, func(r rune) bool { return strings.ContainsRune("[]?,", r) }) {
+		if method, ok := l.methods[word]["toString"]; ok {
+			l.call(method, word)
+		}
+	}
+}
+
+// Record the variables and members a node reads. Plain assignment targets aren't reads.
+func (l *linter) walk(node *ast.Node, class string) {
+	switch node.Type {
+	case ast.FUNCDECL:
+		l.walk(&node.Children[3], class)
+		return
+	case ast.VARASSIGN:
+		for i := range node.Children {
+			target := unwrap(&node.Children[i])
+			if i == len(node.Children)-1 {
+				l.walk(target, class)
+			} else if target.Type == ast.DOTOP {
+				l.walk(&target.Children[0], class)
+			} else if target.Type != ast.VARREF {
+				l.walk(target, class)
+			}
+		}
+		return
+	case ast.VARREF:
+		if node.Symbols != nil {
+			if entry := node.Symbols.LookupSymbol(name(node)); entry != nil {
+				l.used[entry] = true
+			}
+		}
+	case ast.DOTOP:
+		if decl, ok := l.classes[node.Children[0].ValueType]; ok {
+			if entry, ok := decl.Children[1].Symbols.Entries[node.Children[1].TokenStart.Literal]; ok {
+				l.used[entry] = true
+			}
+		}
+	}
+	for i := range node.Children {
+		l.walk(&node.Children[i], class)
+	}
+}
+
+func (l *linter) checkFunc(fn *ast.Node) {
+	body := &fn.Children[3]
+	for i := range fn.Children[1].Children {
+		param := &fn.Children[1].Children[i]
+		if !l.used[body.Symbols.Entries[name(param)]] && !param.HasAnnotation("unused") {
+			l.warningMsg(&param.Children[0], "Parameter "+name(param)+" of "+name(fn)+" is never used")
+		}
+	}
+	l.checkLocals(body)
+}
+
+// Warn about unused variables declared in a block and the blocks inside it.
+func (l *linter) checkLocals(node *ast.Node) {
+	for i := range node.Children {
+		child := &node.Children[i]
+		switch child.Type {
+		case ast.VARDECL:
+			if child.HasAnnotation("unused") {
+				continue
+			}
+			for j := 0; j+1 < len(child.Children); j += 2 {
+				ident := &child.Children[j]
+				if !l.used[child.Symbols.Entries[ident.TokenStart.Literal]] {
+					l.warningMsg(ident, "Variable "+ident.TokenStart.Literal+" is never used")
+				}
+			}
+		case ast.FORSTATEMENT: // The loop variable is required, so only its body is checked.
+			l.checkLocals(&child.Children[2])
+		case ast.BLOCK, ast.IFSTATEMENT, ast.WHILESTATEMENT:
+			l.checkLocals(child)
+		}
+	}
+}
+
+// Members are private until Knox has modules, so warn about any that the program never uses.
+func (l *linter) checkClass(class *ast.Node) {
+	block := &class.Children[1]
+	for i := range block.Children {
+		member := &block.Children[i]
+		if member.HasAnnotation("unused") {
+			continue
+		}
+		if member.Type == ast.VARDECL {
+			for j := 0; j+1 < len(member.Children); j += 2 {
+				ident := &member.Children[j]
+				if !l.used[block.Symbols.Entries[ident.TokenStart.Literal]] {
+					l.warningMsg(ident, "Member "+name(class)+"."+ident.TokenStart.Literal+" is never used")
+				}
+			}
+		} else if member.Type == ast.FUNCDECL {
+			if !l.called[member] {
+				l.warningMsg(&member.Children[0], "Method "+name(class)+"."+name(member)+" is never called from main")
+			} else {
+				l.checkFunc(member)
+			}
+		}
+	}
+}
+
+// Name of a declaration or reference.
+func name(node *ast.Node) string {
+	return node.Children[0].TokenStart.Literal
+}
+
+// Skip over EXPRESSION wrappers.
+func unwrap(node *ast.Node) *ast.Node {
+	for node.Type == ast.EXPRESSION {
+		node = &node.Children[0]
+	}
+	return node
+}
+
+func (l *linter) warningMsg(node *ast.Node, msg string) {
+	fmt.Printf("Lint warning: %v. Line %v.\n", msg, node.TokenStart.Line)
+	l.warnings++
+}
@@ -0,0 +1,588 @@
+package llvm
+
+import (
+	"fmt"
+	"knox/ir"
+	"strings"
+)
+
+type loop struct {
+	continueLabel string
+	breakLabel    string
+}
+
+type generator struct {
+	main    *ir.Func
+	strings map[string]string // String literal to global name.
+	globals strings.Builder
+	code    strings.Builder
+
+	// State of the function being generated.
+	body       strings.Builder
+	allocas    strings.Builder
+	temps      int
+	labels     int
+	terminated bool
+	fn         *ir.Func
+	loops      []loop
+}
+
+// Runtime functions from knoxutil.h.
+const runtime = `declare ptr @malloc(i64)
+declare void @knox_print(ptr)
+declare void @knox_println(ptr)
+declare void @knox_eprint(ptr)
+declare i32 @knox_string_compare(ptr, ptr)
+declare ptr @knox_string_concat(i32, ...)
+declare ptr @knox_int_to_string(i64)
+declare ptr @knox_float_to_string(double, i32)
+declare ptr @knox_bool_to_string(i1 zeroext)
+declare i64 @knox_string_length(ptr)
+declare ptr @knox_string_at(ptr, i64, i32)
+declare ptr @knox_string_slice(ptr, i64, i64, i32)
+declare i64 @knox_string_find(ptr, ptr)
+declare ptr @knox_string_split(ptr, ptr)
+declare ptr @knox_string_join(ptr, ptr)
+declare ptr @knox_string_trim(ptr)
+declare ptr @knox_string_replace(ptr, ptr, ptr)
+declare ptr @knox_string_toUpper(ptr)
+declare ptr @knox_string_toLower(ptr)
+declare ptr @knox_string_quote(ptr)
+declare ptr @knox_rune_to_string(i32)
+declare i32 @knox_random(i32, i32)
+declare ptr @knox_list_new()
+declare ptr @knox_list_copy(ptr)
+declare void @knox_list_append(ptr, i64)
+declare i64 @knox_list_length(ptr)
+declare i64 @knox_list_get(ptr, i64, i32)
+declare void @knox_list_set(ptr, i64, i64, i32)
+declare ptr @knox_range(i64, i64, i64)
+`
+
+// Generate outputs LLVM IR for a program in IR form.
+func Generate(p *ir.Program) string {
+	g := &generator{main: p.Main, strings: make(map[string]string)}
+
+	var types strings.Builder
+	for _, c := range p.Classes {
+		var fields []string
+		for _, field := range c.Fields {
+			fields = append(fields, llvmType(field.Typ))
+		}
+		fmt.Fprintf(&types, "%%%s = type { %s }\n", ident(c.Name), strings.Join(fields, ", "))
+	}
+	for _, f := range p.Funcs {
+		g.function(f)
+	}
+
+	header := "; Generated by the Knox compiler.\n\n" + types.String()
+	if types.Len() > 0 {
+		header += "\n"
+	}
+	return header + g.globals.String() + "\n" + runtime + "\n" + g.code.String()
+}
+
+func abortMsg(line int, msg string) {
+	fmt.Printf("LLVM error: %v. Line %v.\n", msg, line)
+	panic("Aborted.\n")
+}
+
+////
+// Functions.
+////
+
+// Every variable lives in an alloca, which LLVM promotes to registers.
+func (g *generator) function(f *ir.Func) {
+	g.body.Reset()
+	g.allocas.Reset()
+	g.temps = 0
+	g.labels = 0
+	g.terminated = false
+	g.fn = f
+	g.loops = nil
+
+	var params []string
+	for _, param := range f.Params {
+		reg := "%p." + param.Name
+		params = append(params, llvmType(param.Typ)+" "+reg)
+		g.alloca(param)
+		g.store(param, reg)
+	}
+	for _, local := range f.Locals {
+		g.alloca(local)
+	}
+
+	g.stmts(f.Body)
+	if !g.terminated { // Falling off the end.
+		g.ret(nil)
+	}
+
+	g.code.WriteString(fmt.Sprintf("define %s @%s(%s)", g.returnType(f), ident(f.Name), strings.Join(params, ", ")) + " {\nentry:\n")
+	g.code.WriteString(g.allocas.String())
+	g.code.WriteString(g.body.String())
+	g.code.WriteString("}\n\n")
+}
+
+func (g *generator) returnType(f *ir.Func) string {
+	return llvmReturnType(f.Results, f == g.main)
+}
+
+////
+// Statements.
+////
+
+func (g *generator) stmts(stmts []ir.Stmt) {
+	for _, s := range stmts {
+		if g.terminated { // Code after return, break or continue still needs a block.
+			g.startBlock(g.newLabel("dead"))
+		}
+		switch s := s.(type) {
+		case *ir.Instr:
+			g.instr(s)
+		case *ir.If:
+			then := g.newLabel("if.then")
+			els := g.newLabel("if.else")
+			end := g.newLabel("if.end")
+			g.emit("br i1 %s, label %%%s, label %%%s", g.value(s.Cond), then, els)
+			g.startBlock(then)
+			g.stmts(s.Then)
+			g.branch(end)
+			g.startBlock(els)
+			g.stmts(s.Else)
+			g.branch(end)
+			g.startBlock(end)
+		case *ir.Loop:
+			body := g.newLabel("loop.body")
+			post := g.newLabel("loop.post")
+			end := g.newLabel("loop.end")
+			g.branch(body)
+			g.startBlock(body)
+			g.loops = append(g.loops, loop{continueLabel: post, breakLabel: end})
+			g.stmts(s.Body)
+			g.loops = g.loops[:len(g.loops)-1]
+			g.branch(post)
+			g.startBlock(post)
+			g.stmts(s.Post)
+			g.branch(body)
+			g.startBlock(end)
+		case *ir.Break:
+			g.branch(g.loops[len(g.loops)-1].breakLabel)
+		case *ir.Continue:
+			g.branch(g.loops[len(g.loops)-1].continueLabel)
+		case *ir.Return:
+			var values []string
+			for _, v := range s.Values {
+				values = append(values, g.value(v))
+			}
+			g.ret(values)
+		}
+	}
+}
+
+func (g *generator) ret(values []string) {
+	retType := g.returnType(g.fn)
+	switch {
+	case retType == "void":
+		g.emit("ret void")
+	case len(values) == 0: // Missing return value.
+		g.emit("ret %s %s", retType, zeroValue(retType))
+	case len(values) == 1:
+		g.emit("ret %s %s", retType, values[0])
+	default:
+		agg := "undef"
+		for i, value := range values {
+			agg = g.temp("insertvalue %s %s, %s %s, %d", retType, agg, llvmType(g.fn.Results[i]), value, i)
+		}
+		g.emit("ret %s %s", retType, agg)
+	}
+	g.terminated = true
+}
+
+////
+// Instructions.
+////
+
+func (g *generator) instr(in *ir.Instr) {
+	switch in.Op {
+	case ir.Copy:
+		g.store(in.Dst[0], g.value(in.Args[0]))
+	case ir.Add, ir.Sub, ir.Mul, ir.Div, ir.Rem, ir.Eq, ir.Ne, ir.Lt, ir.Le, ir.Gt, ir.Ge:
+		g.store(in.Dst[0], g.binaryOp(in))
+	case ir.And, ir.Or, ir.Xor, ir.Shl, ir.Shr:
+		g.store(in.Dst[0], g.bitwise(in))
+	case ir.Concat:
+		parts := []string{fmt.Sprintf("i32 %d", len(in.Args))}
+		for _, arg := range in.Args {
+			parts = append(parts, "ptr "+g.value(arg))
+		}
+		g.store(in.Dst[0], g.temp("call ptr (i32, ...) @knox_string_concat(%s)", strings.Join(parts, ", ")))
+	case ir.Neg:
+		t := in.Dst[0].Typ
+		if ir.IsFloat(t) {
+			g.store(in.Dst[0], g.temp("fneg %s %s", llvmType(t), g.value(in.Args[0])))
+		} else {
+			g.store(in.Dst[0], g.temp("sub %s 0, %s", llvmType(t), g.value(in.Args[0])))
+		}
+	case ir.Not:
+		g.store(in.Dst[0], g.temp("xor i1 %s, true", g.value(in.Args[0])))
+	case ir.Compl:
+		g.store(in.Dst[0], g.temp("xor %s %s, -1", llvmType(in.Dst[0].Typ), g.value(in.Args[0])))
+	case ir.Convert:
+		from, to := in.Args[0].Type(), in.Dst[0].Typ
+		if to == "string" && ir.IsInt(from) {
+			g.store(in.Dst[0], g.temp("call ptr @knox_int_to_string(i64 %s)", g.convert(g.value(in.Args[0]), from, "i64")))
+			return
+		} else if to == "string" && ir.IsFloat(from) {
+			g.store(in.Dst[0], g.temp("call ptr @knox_float_to_string(double %s, i32 %d)", g.convertTyped(g.value(in.Args[0]), from, "f64"), ir.Bits(from)))
+			return
+		} else if to == "string" && from == "bool" {
+			g.store(in.Dst[0], g.temp("call ptr @knox_bool_to_string(i1 zeroext %s)", g.value(in.Args[0])))
+			return
+		}
+		if from == "string" || to == "string" {
+			abortMsg(in.Line, "The LLVM backend can't cast "+from+" to "+to)
+		}
+		g.store(in.Dst[0], g.convertTyped(g.value(in.Args[0]), from, to))
+	case ir.Call:
+		g.call(in)
+	case ir.Builtin:
+		g.builtin(in)
+	case ir.New:
+		end := g.temp("getelementptr %%%s, ptr null, i32 1", ident(in.Class.Name))
+		size := g.temp("ptrtoint ptr %s to i64", end)
+		g.store(in.Dst[0], g.temp("call ptr @malloc(i64 %s)", size))
+	case ir.GetField:
+		ptr := g.field(in)
+		g.store(in.Dst[0], g.temp("load %s, ptr %s", llvmType(in.Dst[0].Typ), ptr))
+	case ir.SetField:
+		value := g.value(in.Args[1])
+		ptr := g.field(in)
+		g.emit("store %s %s, ptr %s", llvmType(in.Class.Fields[in.Field].Typ), value, ptr)
+	case ir.NewList:
+		list := g.temp("call ptr @knox_list_new()")
+		for _, item := range in.Args {
+			g.emit("call void @knox_list_append(ptr %s, i64 %s)", list, g.toSlot(g.value(item), item.Type()))
+		}
+		g.store(in.Dst[0], list)
+	case ir.Index:
+		list := g.list(in)
+		index := g.convert(g.value(in.Args[1]), in.Args[1].Type(), "i64")
+		slot := g.temp("call i64 @knox_list_get(ptr %s, i64 %s, i32 %d)", list, index, in.Line)
+		g.store(in.Dst[0], g.fromSlot(slot, in.Dst[0].Typ))
+	case ir.SetIndex:
+		list := g.list(in)
+		index := g.convert(g.value(in.Args[1]), in.Args[1].Type(), "i64")
+		item := g.toSlot(g.value(in.Args[2]), in.Args[2].Type())
+		g.emit("call void @knox_list_set(ptr %s, i64 %s, i64 %s, i32 %d)", list, index, item, in.Line)
+	case ir.Iter:
+		g.store(in.Dst[0], g.temp("call ptr @knox_list_copy(ptr %s)", g.list(in)))
+	default:
+		abortMsg(in.Line, "The LLVM backend doesn't support "+in.Op.String())
+	}
+}
+
+// The list operand of an instruction. Maps aren't supported yet.
+func (g *generator) list(in *ir.Instr) string {
+	if !ir.IsList(in.Args[0].Type()) {
+		abortMsg(in.Line, "Only lists are supported by the LLVM backend")
+	}
+	return g.value(in.Args[0])
+}
+
+func (g *generator) field(in *ir.Instr) string {
+	return g.temp("getelementptr %%%s, ptr %s, i32 0, i32 %d", ident(in.Class.Name), g.value(in.Args[0]), in.Field)
+}
+
+var (
+	intOps   = map[ir.Op]string{ir.Add: "add", ir.Sub: "sub", ir.Mul: "mul"}
+	floatOps = map[ir.Op]string{ir.Add: "fadd", ir.Sub: "fsub", ir.Mul: "fmul", ir.Div: "fdiv", ir.Rem: "frem"}
+	icmps    = map[ir.Op]string{ir.Eq: "eq", ir.Ne: "ne", ir.Lt: "lt", ir.Le: "le", ir.Gt: "gt", ir.Ge: "ge"}
+	fcmps    = map[ir.Op]string{ir.Eq: "oeq", ir.Ne: "une", ir.Lt: "olt", ir.Le: "ole", ir.Gt: "ogt", ir.Ge: "oge"}
+)
+
+func (g *generator) binaryOp(in *ir.Instr) string {
+	operand := in.Args[0].Type()
+	if operand == "nil" {
+		operand = in.Args[1].Type()
+	}
+	t := llvmType(operand)
+	l, r := g.value(in.Args[0]), g.value(in.Args[1])
+
+	if operand == "string" { // Strings compare by value.
+		cmp := g.temp("call i32 @knox_string_compare(ptr %s, ptr %s)", l, r)
+		if in.Op == ir.Eq || in.Op == ir.Ne {
+			return g.temp("icmp %s i32 %s, 0", icmps[in.Op], cmp)
+		}
+		return g.temp("icmp s%s i32 %s, 0", icmps[in.Op], cmp)
+	}
+	if ir.IsFloat(operand) {
+		if inst, ok := floatOps[in.Op]; ok {
+			return g.temp("%s %s %s, %s", inst, t, l, r)
+		}
+		return g.temp("fcmp %s %s %s, %s", fcmps[in.Op], t, l, r)
+	}
+	if inst, ok := intOps[in.Op]; ok {
+		return g.temp("%s %s %s, %s", inst, t, l, r)
+	}
+	sign := "s"
+	if ir.IsUnsigned(operand) {
+		sign = "u"
+	}
+	switch in.Op {
+	case ir.Div:
+		return g.temp("%sdiv %s %s, %s", sign, t, l, r)
+	case ir.Rem:
+		return g.temp("%srem %s %s, %s", sign, t, l, r)
+	case ir.Eq, ir.Ne:
+		return g.temp("icmp %s %s %s, %s", icmps[in.Op], t, l, r)
+	}
+	return g.temp("icmp %s%s %s %s, %s", sign, icmps[in.Op], t, l, r)
+}
+
+var bitwiseOps = map[ir.Op]string{ir.And: "and", ir.Or: "or", ir.Xor: "xor", ir.Shl: "shl", ir.Shr: "ashr"}
+
+// Shifting by the width or more is poison, so the count is masked.
+func (g *generator) bitwise(in *ir.Instr) string {
+	t := in.Dst[0].Typ
+	l, r := g.value(in.Args[0]), g.value(in.Args[1])
+	inst := bitwiseOps[in.Op]
+	if in.Op == ir.Shl || in.Op == ir.Shr {
+		r = g.temp("and %s %s, %d", llvmType(t), r, ir.Bits(t)-1)
+	}
+	if in.Op == ir.Shr && ir.IsUnsigned(t) {
+		inst = "lshr"
+	}
+	return g.temp("%s %s %s, %s", inst, llvmType(t), l, r)
+}
+
+// Convert between Knox primitive types using C's rules.
+func (g *generator) convertTyped(value string, from string, to string) string {
+	ft, tt := llvmType(from), llvmType(to)
+	switch {
+	case to == "bool" && from != "bool":
+		if ir.IsFloat(from) {
+			return g.temp("fcmp une %s %s, 0.0", ft, value)
+		}
+		return g.temp("icmp ne %s %s, 0", ft, value)
+	case ir.IsFloat(from) && ir.IsFloat(to):
+		if ft == tt {
+			return value
+		} else if ft == "float" {
+			return g.temp("fpext float %s to double", value)
+		}
+		return g.temp("fptrunc double %s to float", value)
+	case ir.IsFloat(from):
+		if ir.IsUnsigned(to) {
+			return g.temp("fptoui %s %s to %s", ft, value, tt)
+		}
+		return g.temp("fptosi %s %s to %s", ft, value, tt)
+	case ir.IsFloat(to):
+		if ir.IsUnsigned(from) || from == "bool" {
+			return g.temp("uitofp %s %s to %s", ft, value, tt)
+		}
+		return g.temp("sitofp %s %s to %s", ft, value, tt)
+	}
+	return g.convert(value, from, tt)
+}
+
+// Resize an integer value to an LLVM integer type.
+func (g *generator) convert(value string, from string, to string) string {
+	ft := llvmType(from)
+	switch {
+	case bits(ft) == bits(to):
+		return value
+	case bits(ft) > bits(to):
+		return g.temp("trunc %s %s to %s", ft, value, to)
+	case ir.IsUnsigned(from) || from == "bool":
+		return g.temp("zext %s %s to %s", ft, value, to)
+	}
+	return g.temp("sext %s %s to %s", ft, value, to)
+}
+
+// List items are stored in 64-bit slots.
+func (g *generator) toSlot(value string, t string) string {
+	switch lt := llvmType(t); {
+	case lt == "ptr":
+		return g.temp("ptrtoint ptr %s to i64", value)
+	case lt == "double":
+		return g.temp("bitcast double %s to i64", value)
+	case lt == "float":
+		wide := g.temp("fpext float %s to double", value)
+		return g.temp("bitcast double %s to i64", wide)
+	default:
+		return g.convert(value, t, "i64")
+	}
+}
+
+func (g *generator) fromSlot(slot string, t string) string {
+	switch lt := llvmType(t); {
+	case lt == "ptr":
+		return g.temp("inttoptr i64 %s to ptr", slot)
+	case lt == "double":
+		return g.temp("bitcast i64 %s to double", slot)
+	case lt == "float":
+		wide := g.temp("bitcast i64 %s to double", slot)
+		return g.temp("fptrunc double %s to float", wide)
+	case lt == "i64":
+		return slot
+	default:
+		return g.temp("trunc i64 %s to %s", slot, lt)
+	}
+}
+
+////
+// Calls.
+////
+
+// Multiple results come back in a struct.
+func (g *generator) call(in *ir.Instr) {
+	var args []string
+	for i, arg := range in.Args {
+		args = append(args, llvmType(in.Func.Params[i].Typ)+" "+g.value(arg))
+	}
+	retType := g.returnType(in.Func)
+	call := fmt.Sprintf("call %s @%s(%s)", retType, ident(in.Func.Name), strings.Join(args, ", "))
+	if len(in.Dst) == 0 {
+		g.emit("%s", call)
+		return
+	}
+	result := g.temp("%s", call)
+	if len(in.Dst) == 1 {
+		g.store(in.Dst[0], result)
+		return
+	}
+	for i, dst := range in.Dst {
+		g.store(dst, g.temp("extractvalue %s %s, %d", retType, result, i))
+	}
+}
+
+func (g *generator) builtin(in *ir.Instr) {
+	var args []string
+	for _, arg := range in.Args {
+		args = append(args, g.value(arg))
+	}
+	var result string
+	switch in.Name {
+	case "stl.print", "stl.println", "stl.eprint":
+		g.emit("call void @knox_%s(ptr %s)", in.Name[len("stl."):], args[0])
+		return
+	case "rune.toString":
+		result = g.temp("call ptr @knox_rune_to_string(i32 %s)", args[0])
+	case "stl.range":
+		for i := range args {
+			args[i] = g.convert(args[i], in.Args[i].Type(), "i64")
+		}
+		result = g.temp("call ptr @knox_range(i64 %s, i64 %s, i64 %s)", args[0], args[1], args[2])
+	case "stl.random":
+		result = g.temp("call i32 @knox_random(i32 %s, i32 %s)", args[0], args[1])
+	case "list.append":
+		g.emit("call void @knox_list_append(ptr %s, i64 %s)", args[0], g.toSlot(args[1], in.Args[1].Type()))
+		return
+	case "list.length":
+		length := g.temp("call i64 @knox_list_length(ptr %s)", args[0])
+		result = g.convert(length, "i64", llvmType(in.Dst[0].Typ))
+	default:
+		if strings.HasPrefix(in.Name, "string.") {
+			result = g.stringMethod(in, args)
+			break
+		}
+		abortMsg(in.Line, "The LLVM backend doesn't support "+in.Name)
+	}
+	if len(in.Dst) > 0 {
+		g.store(in.Dst[0], result)
+	}
+}
+
+// Call the runtime function for a string method, which takes and returns i64 for Knox ints.
+func (g *generator) stringMethod(in *ir.Instr, args []string) string {
+	var params []string
+	for i, arg := range args {
+		if t := in.Args[i].Type(); ir.IsInt(t) {
+			params = append(params, "i64 "+g.convert(arg, t, "i64"))
+		} else {
+			params = append(params, "ptr "+arg)
+		}
+	}
+	if in.Name == "string.at" || in.Name == "string.slice" {
+		params = append(params, fmt.Sprintf("i32 %d", in.Line))
+	}
+	call := fmt.Sprintf("@knox_%s(%s)", strings.Replace(in.Name, ".", "_", 1), strings.Join(params, ", "))
+	if t := in.Dst[0].Typ; ir.IsInt(t) {
+		return g.convert(g.temp("call i64 %s", call), "i64", llvmType(t))
+	}
+	return g.temp("call ptr %s", call)
+}
+
+////
+// Helpers.
+////
+
+func (g *generator) alloca(v *ir.Var) {
+	fmt.Fprintf(&g.allocas, "\t%%v.%s = alloca %s\n", v.Name, llvmType(v.Typ))
+}
+
+func (g *generator) store(v *ir.Var, value string) {
+	g.emit("store %s %s, ptr %%v.%s", llvmType(v.Typ), value, v.Name)
+}
+
+// LLVM operand for a value, loading variables.
+func (g *generator) value(v ir.Value) string {
+	switch v := v.(type) {
+	case *ir.Var:
+		return g.temp("load %s, ptr %%v.%s", llvmType(v.Typ), v.Name)
+	case *ir.Const:
+		switch value := v.Value.(type) {
+		case int64:
+			return fmt.Sprint(value)
+		case float64:
+			return floatConstant(value, llvmType(v.Typ))
+		case string:
+			return g.stringConstant(value)
+		case bool:
+			return fmt.Sprint(value)
+		}
+	}
+	return "null"
+}
+
+// Static string with the bytes of a constant, laid out like struct knox_string.
+func (g *generator) stringConstant(value string) string {
+	if name, ok := g.strings[value]; ok {
+		return name
+	}
+	name := fmt.Sprintf("@.str.%d", len(g.strings))
+	g.strings[value] = name
+	fmt.Fprintf(&g.globals, "%s.data = private unnamed_addr constant [%d x i8] %s\n", name, len(value)+1, cString(value))
+	fmt.Fprintf(&g.globals, "%s = private constant { i64, ptr } { i64 %d, ptr %s.data }\n", name, len(value), name)
+	return name
+}
+
+func (g *generator) emit(format string, args ...interface{}) {
+	g.body.WriteString("\t" + fmt.Sprintf(format, args...) + "\n")
+}
+
+// Emit an instruction into a new register.
+func (g *generator) temp(format string, args ...interface{}) string {
+	g.temps++
+	reg := fmt.Sprintf("%%t%d", g.temps)
+	g.emit("%s = %s", reg, fmt.Sprintf(format, args...))
+	return reg
+}
+
+func (g *generator) newLabel(prefix string) string {
+	g.labels++
+	return fmt.Sprintf("%s.%d", prefix, g.labels)
+}
+
+func (g *generator) startBlock(label string) {
+	g.body.WriteString("\n" + label + ":\n")
+	g.terminated = false
+}
+
+// Branch unless the block already ended with a terminator.
+func (g *generator) branch(label string) {
+	if !g.terminated {
+		g.emit("br label %%%s", label)
+	}
+	g.terminated = true
+}
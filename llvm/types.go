@@ -0,0 +1,101 @@
+package llvm
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// LLVM type for a Knox type. All reference types are opaque pointers.
+func llvmType(t string) string {
+	switch t {
+	case "void":
+		return "void"
+	case "bool":
+		return "i1"
+	case "i8", "u8", "byte":
+		return "i8"
+	case "i16", "u16":
+		return "i16"
+	case "int", "i32", "u32", "rune", "INT_LITERAL":
+		return "i32"
+	case "i64", "u64":
+		return "i64"
+	case "float", "f32":
+		return "float"
+	case "f64", "FLOAT_LITERAL":
+		return "double"
+	}
+	return "ptr"
+}
+
+// LLVM type returned by a function, a struct for multiple return values.
+func llvmReturnType(types []string, isMain bool) string {
+	if isMain && len(types) == 0 {
+		return "i32" // Knox allows main to be void but C requires int.
+	}
+	if len(types) == 0 {
+		return "void"
+	}
+	if len(types) == 1 {
+		return llvmType(types[0])
+	}
+	var fields []string
+	for _, t := range types {
+		fields = append(fields, llvmType(t))
+	}
+	return "{ " + strings.Join(fields, ", ") + " }"
+}
+
+// Size in bits of an LLVM integer type.
+func bits(llvm string) int {
+	var n int
+	fmt.Sscanf(llvm, "i%d", &n)
+	return n
+}
+
+func zeroValue(llvm string) string {
+	switch {
+	case llvm == "ptr":
+		return "null"
+	case llvm == "float" || llvm == "double":
+		return "0.0"
+	case strings.HasPrefix(llvm, "{"):
+		return "zeroinitializer"
+	}
+	return "0"
+}
+
+// Float constants are written in hex since LLVM rejects decimals that aren't exact.
+func floatConstant(value float64, llvm string) string {
+	if llvm == "float" {
+		value = float64(float32(value))
+	}
+	return fmt.Sprintf("0x%016X", math.Float64bits(value))
+}
+
+var plainIdent = regexp.MustCompile(`^[-a-zA-Z$._][-a-zA-Z$._0-9]*$`)
+
+// Quote a global or type name if LLVM requires it.
+func ident(name string) string {
+	if plainIdent.MatchString(name) {
+		return name
+	}
+	return "\"" + name + "\""
+}
+
+// Encode a string as an LLVM c"" constant including the terminator.
+func cString(s string) string {
+	var sb strings.Builder
+	sb.WriteString("c\"")
+	for _, b := range []byte(s) {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			fmt.Fprintf(&sb, "\\%02X", b)
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	sb.WriteString("\\00\"")
+	return sb.String()
+}
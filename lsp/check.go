@@ -0,0 +1,120 @@
+package lsp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"knox/ast"
+	"knox/builtin"
+	"knox/cfa"
+	"knox/lexer"
+	"knox/lint"
+	"knox/parser"
+	"knox/typechecker"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Result of checking the text of a document.
+type analysis struct {
+	text        string
+	program     *ast.Node          // Nil if the text doesn't parse. The types are filled in up to the first type error.
+	declared    map[*ast.Node]bool // Declarations of the document, which the builtins' aren't.
+	braces      []int              // Lines of the closing braces, which aren't in the tree.
+	ends        map[*ast.Node]int  // Line of the closing brace of each block, found when first needed.
+	diagnostics []diagnostic
+}
+
+// Messages end with the line they're about, like "Type error: Undeclared type: Foo. Line 3.", and can quote a
+// line break.
+var located = regexp.MustCompile(`(?s)(.*?)\.* Line (\d+)\.\n`)
+
+// Run the compiler up to the warnings, turning what it prints into diagnostics.
+func analyze(text string) *analysis {
+	a := &analysis{text: text, declared: map[*ast.Node]bool{}, diagnostics: []diagnostic{}}
+	var prog ast.Node
+	parsed := false
+	output, failure := capture(func() {
+		l := lexer.New(text + "\n")
+		prog = parser.New(l).Program()
+		parsed = true
+		a.braces = l.Braces
+		declarations(&prog, a.declared)
+		prog = *builtin.Init(&prog)
+		typechecker.Analyze(&prog)
+		cfa.Analyze(&prog)
+		lint.Analyze(&prog)
+	})
+	if parsed {
+		a.program = &prog
+	}
+
+	for _, match := range located.FindAllStringSubmatch(output, -1) {
+		line, _ := strconv.Atoi(match[2])
+		a.report(strings.TrimSpace(match[1]), line-1)
+	}
+	if rest := strings.TrimSpace(located.ReplaceAllString(output, "")); rest != "" {
+		a.report(rest, 0)
+	}
+	if failure != nil && !strings.HasPrefix(fmt.Sprint(failure), "Aborted.") { // A bug, rather than an error in the code.
+		a.report(fmt.Sprintf("Internal error: %v", failure), 0)
+	}
+	return a
+}
+
+// Add a diagnostic that covers a line, from its indentation to its end.
+func (a *analysis) report(msg string, line int) {
+	if line < 0 { // Nodes that the compiler made up have no line.
+		line = 0
+	}
+	severity := severityError
+	if strings.Contains(strings.ToLower(msg), "warning:") {
+		severity = severityWarning
+	}
+	text := lineText(a.text, line)
+	a.diagnostics = append(a.diagnostics, diagnostic{
+		Range:    span{position{line, len(text) - len(strings.TrimLeft(text, " \t"))}, position{line, utf16Length(text)}},
+		Severity: severity,
+		Source:   "knox",
+		Message:  msg,
+	})
+}
+
+// Run f with the standard output, where the compiler prints its errors and warnings, read into a string.
+// Returns what f panicked with, which is "Aborted." after an error in the code.
+func capture(f func()) (output string, failure interface{}) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	read := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		read <- string(data)
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	func() {
+		defer func() { failure = recover() }()
+		f()
+	}()
+	os.Stdout = stdout
+	w.Close()
+	output = <-read
+	r.Close()
+	return output, failure
+}
+
+// Collect the declarations in the symbol tables of a tree.
+func declarations(node *ast.Node, declared map[*ast.Node]bool) {
+	if node.Symbols != nil {
+		for _, decl := range node.Symbols.Entries {
+			declared[decl] = true
+		}
+	}
+	for i := range node.Children {
+		declarations(&node.Children[i], declared)
+	}
+}
@@ -0,0 +1,437 @@
+package lsp
+
+import (
+	"knox/ast"
+	"knox/doc"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// The tree has lines but no columns, so a position is matched to a name by its text: the third x on a line is
+// the third IDENT x of that line, in the order the parser read them.
+
+// A name in the tree and the node that gives it meaning.
+type reference struct {
+	ident  *ast.Node
+	parent *ast.Node
+}
+
+// Length of a string in UTF-16 code units, which is how the protocol counts characters.
+func utf16Length(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// Byte offset in a line of a character counted in UTF-16 code units.
+func byteOffset(line string, character int) int {
+	units := 0
+	for i, r := range line {
+		if units >= character {
+			return i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Word under the cursor, and how many times the same word comes before it on the line.
+func wordAt(line string, character int) (string, int) {
+	offset := byteOffset(line, character)
+	start, end := offset, offset
+	for start > 0 && isIdentRune(rune(line[start-1])) {
+		start--
+	}
+	for end < len(line) && isIdentRune(rune(line[end])) {
+		end++
+	}
+	word := line[start:end]
+	if word == "" {
+		return "", 0
+	}
+	return word, len(occurrences(line[:start], word))
+}
+
+// Byte offsets of a word where it stands on its own in a line.
+func occurrences(line string, word string) []int {
+	var found []int
+	for i := 0; i+len(word) <= len(line); i++ {
+		if line[i:i+len(word)] != word {
+			continue
+		}
+		if (i > 0 && isIdentRune(rune(line[i-1]))) || (i+len(word) < len(line) && isIdentRune(rune(line[i+len(word)]))) {
+			continue
+		}
+		found = append(found, i)
+	}
+	return found
+}
+
+// Collect the names of a line in preorder, which is the order they're written in.
+func references(node *ast.Node, parent *ast.Node, line int, word string, refs *[]reference) {
+	if node.Type == ast.IDENT && node.TokenStart.Line == line && node.TokenStart.Literal == word {
+		*refs = append(*refs, reference{node, parent})
+	}
+	for i := range node.Children {
+		child := &node.Children[i]
+		if child.Type == ast.PROGRAM { // The builtins.
+			continue
+		}
+		if i == 1 && node.Type == ast.VARASSIGN && ast.IsCompound(node) {
+			child = &child.Children[1] // Skip the copy of the target.
+		}
+		references(child, node, line, word, refs)
+	}
+}
+
+// Name under the cursor.
+func referenceAt(check *analysis, pos position, text string) *reference {
+	word, index := wordAt(text, pos.Character)
+	if word == "" {
+		return nil
+	}
+	var refs []reference
+	references(check.program, nil, pos.Line+1, word, &refs)
+	if index >= len(refs) {
+		return nil
+	}
+	return &refs[index]
+}
+
+// Declaration that a name refers to, looked up the way the type checker does.
+func (check *analysis) resolve(ref *reference) *ast.Node {
+	name := ref.ident.TokenStart.Literal
+	parent := ref.parent
+	switch parent.Type {
+	case ast.VARREF, ast.FUNCCALL:
+		if parent.Symbols != nil && ref.ident == &parent.Children[0] {
+			return parent.Symbols.LookupSymbol(name)
+		}
+	case ast.DOTOP:
+		if ref.ident == &parent.Children[1] {
+			return check.member(check.typeOf(&parent.Children[0]), name)
+		}
+	case ast.VARTYPE, ast.CAST:
+		return check.class(name)
+	case ast.CLASS, ast.FUNCDECL:
+		if ref.ident == &parent.Children[0] {
+			return parent
+		}
+	case ast.VARDECL:
+		return parent
+	}
+	return nil
+}
+
+// Class of an expression's type, from the types the type checker filled in.
+func (check *analysis) typeOf(node *ast.Node) *ast.Node {
+	name := node.ValueType
+	if strings.HasPrefix(name, "[") {
+		name = "list"
+	}
+	if name == "" && node.Type == ast.VARREF && len(node.Children) == 1 && node.Symbols != nil { // Not checked on its own.
+		ident := node.Children[0].TokenStart.Literal
+		if decl := node.Symbols.LookupSymbol(ident); decl != nil {
+			return check.typeClass(decl, ident, "")
+		}
+	}
+	return check.class(name)
+}
+
+func (check *analysis) class(name string) *ast.Node {
+	decl := check.program.Symbols.LookupSymbol(name)
+	if decl == nil || decl.Type != ast.CLASS {
+		return nil
+	}
+	return decl
+}
+
+func (check *analysis) member(class *ast.Node, name string) *ast.Node {
+	if class == nil {
+		return nil
+	}
+	return class.Children[1].Symbols.Entries[name]
+}
+
+// Where a name is declared, if it's declared in the document rather than the builtins.
+func definition(check *analysis, uri string, pos position, text string) []location {
+	locations := []location{}
+	ref := referenceAt(check, pos, text)
+	if ref == nil {
+		return locations
+	}
+	decl := check.resolve(ref)
+	if decl == nil || !(check.declared[decl] || decl == ref.parent) {
+		return locations
+	}
+	name := ref.ident.TokenStart.Literal
+	if at := check.nameAt(decl, name); at != nil {
+		locations = append(locations, location{uri, *at})
+	}
+	return locations
+}
+
+// Span of the name in a declaration, which is the first time it's written on the line it's declared on.
+func (check *analysis) nameAt(decl *ast.Node, name string) *span {
+	for i := range decl.Children {
+		ident := &decl.Children[i]
+		if ident.Type != ast.IDENT || ident.TokenStart.Literal != name {
+			continue
+		}
+		line := ident.TokenStart.Line - 1
+		text := lineText(check.text, line)
+		found := occurrences(text, name)
+		if len(found) == 0 {
+			return nil
+		}
+		start := utf16Length(text[:found[0]])
+		return &span{position{line, start}, position{line, start + utf16Length(name)}}
+	}
+	return nil
+}
+
+// Type or signature of the name under the cursor, then its doc comment.
+func hoverAt(check *analysis, pos position, text string) *hover {
+	ref := referenceAt(check, pos, text)
+	if ref == nil {
+		return nil
+	}
+	decl := check.resolve(ref)
+	if decl == nil {
+		return nil
+	}
+	name := ref.ident.TokenStart.Literal
+	signature := doc.Describe(decl)
+	if decl.Type == ast.VARDECL && ref.parent.TypeName != "" { // The type where it's used, which may be narrowed.
+		signature = name + " : " + ref.parent.TypeName
+	}
+	value := "```knox\n" + signature + "\n```"
+	if decl.Doc != "" {
+		value += "\n\n" + decl.Doc
+	}
+	return &hover{markupContent{"markdown", value}}
+}
+
+// Members of the value before the dot at the cursor.
+func completion(check *analysis, pos position, text string) []completionItem {
+	items := []completionItem{}
+	before := strings.TrimRightFunc(text[:byteOffset(text, pos.Character)], isIdentRune)
+	if !strings.HasSuffix(before, ".") {
+		return items
+	}
+	class := check.chain(strings.TrimSuffix(before, "."), pos.Line+1)
+	if class == nil {
+		return items
+	}
+
+	entries := class.Children[1].Symbols.Entries
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		decl := entries[name]
+		kind := completionField
+		if decl.Type == ast.FUNCDECL {
+			kind = completionMethod
+		}
+		items = append(items, completionItem{name, kind, doc.Describe(decl), decl.Doc})
+	}
+	return items
+}
+
+// Class of a chain of names written before a dot, like a.b[0].c(). Indices and arguments are skipped, since
+// only the types of the names matter.
+func (check *analysis) chain(text string, line int) *ast.Node {
+	var parts []string
+	depth, end := 0, len(text)
+	i := len(text) - 1
+	for ; i >= 0; i-- {
+		c := text[i]
+		if c == ')' || c == ']' {
+			depth++
+		} else if c == '(' || c == '[' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		} else if depth == 0 && c == '.' {
+			parts = append([]string{text[i+1 : end]}, parts...)
+			end = i
+		} else if depth == 0 && !isIdentRune(rune(c)) {
+			break
+		}
+	}
+	parts = append([]string{text[i+1 : end]}, parts...)
+
+	var class *ast.Node
+	for n, part := range parts {
+		name := part[:strings.IndexFunc(part+" ", func(r rune) bool { return !isIdentRune(r) })]
+		var decl *ast.Node
+		if n == 0 {
+			if name == "self" {
+				class = check.enclosing(check.program, ast.CLASS, line)
+				continue
+			}
+			decl = check.scope(line).LookupSymbol(name)
+		} else {
+			decl = check.member(class, name)
+		}
+		if decl == nil {
+			return nil
+		}
+		class = check.typeClass(decl, name, part[len(name):])
+	}
+	return class
+}
+
+// Class of a declared name, followed through the calls and indices after it.
+func (check *analysis) typeClass(decl *ast.Node, name string, suffix string) *ast.Node {
+	var vartype *ast.Node
+	switch decl.Type {
+	case ast.CLASS:
+		return decl // Like stl.
+	case ast.FUNCDECL:
+		if !strings.HasPrefix(suffix, "(") || len(decl.Children[2].Children) != 1 {
+			return nil
+		}
+		vartype = &decl.Children[2].Children[0]
+		suffix = suffix[strings.Index(suffix, ")")+1:]
+	case ast.VARDECL:
+		for i := 0; i+1 < len(decl.Children); i += 2 {
+			if decl.Children[i].TokenStart.Literal == name {
+				vartype = &decl.Children[i+1]
+			}
+		}
+	}
+	for vartype != nil && vartype.Children[0].TokenStart.Literal == "?" {
+		vartype = &vartype.Children[1]
+	}
+	for vartype != nil && strings.HasPrefix(suffix, "[") && vartype.Children[0].TokenStart.Literal == "[" {
+		vartype = &vartype.Children[1]
+		suffix = suffix[strings.Index(suffix, "]")+1:]
+	}
+	if vartype == nil || suffix != "" {
+		return nil
+	}
+	if vartype.Children[0].TokenStart.Literal == "[" {
+		return check.class("list")
+	}
+	return check.class(vartype.Children[0].TokenStart.Literal)
+}
+
+// Lines of the closing braces of the blocks. Blocks close in postorder, and each has its own brace.
+func (check *analysis) blockEnds(node *ast.Node) {
+	for i := range node.Children {
+		if node.Children[i].Type != ast.PROGRAM {
+			check.blockEnds(&node.Children[i])
+		}
+	}
+	if node.Type == ast.BLOCK && len(check.braces) > len(check.ends) {
+		check.ends[node] = check.braces[len(check.ends)]
+	}
+}
+
+// First and last lines of a node, up to the closing braces of its blocks.
+func (check *analysis) lines(node *ast.Node) (int, int) {
+	if check.ends == nil {
+		check.ends = map[*ast.Node]int{}
+		check.blockEnds(check.program)
+	}
+	first, last := ast.Lines(node)
+	for i := range node.Children {
+		if end := check.ends[&node.Children[i]]; end > last {
+			last = end
+		}
+	}
+	return first, last
+}
+
+// Symbols of the innermost block around a line.
+func (check *analysis) scope(line int) *ast.SymTable {
+	symbols := check.program.Symbols
+	var visit func(node *ast.Node)
+	visit = func(node *ast.Node) {
+		for i := range node.Children {
+			child := &node.Children[i]
+			if child.Type == ast.PROGRAM {
+				continue
+			}
+			if child.Type == ast.BLOCK {
+				if first, last := check.lines(node); first <= line && line <= last {
+					symbols = child.Symbols
+				}
+			}
+			visit(child)
+		}
+	}
+	visit(check.program)
+	return symbols
+}
+
+// Innermost node of a type around a line.
+func (check *analysis) enclosing(node *ast.Node, nodeType ast.NodeType, line int) *ast.Node {
+	var found *ast.Node
+	for i := range node.Children {
+		child := &node.Children[i]
+		if child.Type == ast.PROGRAM {
+			continue
+		}
+		if first, last := check.lines(child); child.Type == nodeType && first <= line && line <= last {
+			found = child
+		}
+		if inner := check.enclosing(child, nodeType, line); inner != nil {
+			found = inner
+		}
+	}
+	return found
+}
+
+// Outline of the classes, functions and constants of the document.
+func symbols(check *analysis) []documentSymbol {
+	outline := []documentSymbol{}
+	for i := range check.program.Children {
+		if decl := &check.program.Children[i]; decl.Type != ast.PROGRAM {
+			outline = append(outline, check.symbol(decl))
+		}
+	}
+	return outline
+}
+
+func (check *analysis) symbol(decl *ast.Node) documentSymbol {
+	name := decl.Children[0].TokenStart.Literal
+	first, last := check.lines(decl)
+	s := documentSymbol{Name: name, Detail: doc.Describe(decl)}
+	s.Range = span{position{first - 1, 0}, position{last - 1, utf16Length(lineText(check.text, last-1))}}
+	s.SelectionRange = s.Range
+	if at := check.nameAt(decl, name); at != nil {
+		s.SelectionRange = *at
+	}
+
+	switch decl.Type {
+	case ast.CLASS:
+		s.Kind = symbolClass
+		for i := range decl.Children[1].Children {
+			member := &decl.Children[1].Children[i]
+			child := check.symbol(member)
+			child.Kind = symbolField
+			if member.Type == ast.FUNCDECL {
+				child.Kind = symbolMethod
+			}
+			s.Children = append(s.Children, child)
+		}
+	case ast.FUNCDECL:
+		s.Kind = symbolFunction
+	default:
+		s.Kind = symbolVariable
+		if decl.TokenStart.Literal == "const" {
+			s.Kind = symbolConstant
+		}
+	}
+	return s
+}
@@ -0,0 +1,200 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// TODO: Support incremental changes and documents that import other files.
+
+// Server answers requests about the documents that the client has open.
+type Server struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]*document
+	shutdown  bool
+}
+
+type document struct {
+	text  string
+	check *analysis // Latest check of the text that parsed, for finding names and types.
+}
+
+// Serve runs a language server that reads requests from in and writes responses to out until the client exits.
+// Diagnostics are published when a document is opened and saved. Returns whether the client shut the server
+// down before exiting, as the protocol asks.
+func Serve(in io.Reader, out io.Writer) bool {
+	s := &Server{in: bufio.NewReader(in), out: out, documents: map[string]*document{}}
+	for {
+		req, err := s.read()
+		if failure, ok := err.(*responseError); ok { // The client gets an answer, with no ID since it wasn't read.
+			s.write(errorResponse{JSONRPC: "2.0", Error: *failure})
+			continue
+		} else if err != nil { // The end of the input, or it can't be read any more.
+			return false
+		}
+		if req.Method == "exit" {
+			return s.shutdown
+		}
+		result, failure := s.handle(req)
+		if req.ID == nil { // Notification.
+			continue
+		}
+		if failure == nil {
+			s.write(response{JSONRPC: "2.0", ID: req.ID, Result: result})
+		} else {
+			s.write(errorResponse{JSONRPC: "2.0", ID: req.ID, Error: *failure})
+		}
+	}
+}
+
+// Read a message, which has a header with its length, then a blank line, then the JSON content. A message that
+// can't be parsed gives a *responseError, and the next read starts after what was read of it.
+func (s *Server) read() (*request, error) {
+	reader := textproto.NewReader(s.in)
+	header, err := reader.ReadMIMEHeader()
+	if _, ok := err.(textproto.ProtocolError); ok {
+		// Skip the rest of the header, which ends with a blank line, and so does the input when it can't be read.
+		for line, _ := reader.ReadLine(); line != ""; line, _ = reader.ReadLine() {
+		}
+		return nil, &responseError{parseError, "Bad header: " + err.Error()}
+	} else if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || length < 0 {
+		return nil, &responseError{parseError, "Bad Content-Length: " + header.Get("Content-Length")}
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(s.in, content); err != nil {
+		return nil, err
+	}
+	req := &request{}
+	if err := json.Unmarshal(content, req); err != nil {
+		return nil, &responseError{parseError, "Bad JSON: " + err.Error()}
+	}
+	return req, nil
+}
+
+func (s *Server) write(msg interface{}) {
+	content, err := json.Marshal(msg)
+	if err != nil { // The messages are built from types that can always be encoded, but the client still gets one.
+		content, _ = json.Marshal(errorResponse{JSONRPC: "2.0", Error: responseError{internalError, err.Error()}})
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(content), content)
+}
+
+// Answer a request or act on a notification. Gives the error to answer with for methods the server doesn't know
+// and for params that don't fit the method.
+func (s *Server) handle(req *request) (interface{}, *responseError) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       map[string]interface{}{"openClose": true, "change": 1, "save": map[string]bool{"includeText": true}},
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string][]string{"triggerCharacters": {"."}},
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "knox"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didSave", "textDocument/didClose":
+		var params documentParams
+		if failure := decode(req, &params); failure != nil {
+			return nil, failure
+		}
+		s.sync(req.Method, &params)
+		return nil, nil
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion":
+		var params positionParams
+		if failure := decode(req, &params); failure != nil {
+			return nil, failure
+		}
+		doc := s.documents[params.TextDocument.URI]
+		if doc == nil || doc.check == nil {
+			return nil, nil
+		}
+		line := lineText(doc.text, params.Position.Line)
+		switch req.Method {
+		case "textDocument/definition":
+			return definition(doc.check, params.TextDocument.URI, params.Position, line), nil
+		case "textDocument/hover":
+			return hoverAt(doc.check, params.Position, line), nil
+		}
+		return completion(doc.check, params.Position, line), nil
+	case "textDocument/documentSymbol":
+		var params positionParams
+		if failure := decode(req, &params); failure != nil {
+			return nil, failure
+		}
+		if doc := s.documents[params.TextDocument.URI]; doc != nil && doc.check != nil {
+			return symbols(doc.check), nil
+		}
+		return []documentSymbol{}, nil
+	}
+	if req.ID == nil || strings.HasPrefix(req.Method, "$/") { // Notifications can be ignored.
+		return nil, nil
+	}
+	return nil, &responseError{methodNotFound, "Unknown method " + req.Method}
+}
+
+// Read the params of a request into the struct for its method.
+func decode(req *request, params interface{}) *responseError {
+	if err := json.Unmarshal(req.Params, params); err != nil {
+		return &responseError{invalidParams, "Invalid params for " + req.Method + ": " + err.Error()}
+	}
+	return nil
+}
+
+// Keep the text of a document. It's checked again on every change, so that names and types stay current, but
+// the diagnostics only change when it's opened or saved.
+func (s *Server) sync(method string, params *documentParams) {
+	uri := params.TextDocument.URI
+	doc := s.documents[uri]
+	switch method {
+	case "textDocument/didOpen":
+		doc = &document{text: params.TextDocument.Text}
+		s.documents[uri] = doc
+	case "textDocument/didChange":
+		if doc == nil || len(params.ContentChanges) == 0 {
+			return
+		}
+		doc.text = params.ContentChanges[len(params.ContentChanges)-1].Text
+	case "textDocument/didSave":
+		if doc == nil {
+			return
+		} else if params.Text != nil {
+			doc.text = *params.Text
+		}
+	case "textDocument/didClose":
+		delete(s.documents, uri)
+		s.write(notification{"2.0", "textDocument/publishDiagnostics", publishDiagnosticsParams{uri, []diagnostic{}}})
+		return
+	}
+
+	check := analyze(doc.text)
+	if check.program != nil {
+		doc.check = check
+	}
+	if method != "textDocument/didChange" {
+		s.write(notification{"2.0", "textDocument/publishDiagnostics", publishDiagnosticsParams{uri, check.diagnostics}})
+	}
+}
+
+// Text of a line, without its line break.
+func lineText(text string, line int) string {
+	lines := strings.Split(text, "\n")
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line], "\r")
+}
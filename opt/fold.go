@@ -0,0 +1,343 @@
+package opt
+
+import (
+	"knox/ir"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Evaluate an instruction whose operands are all constants. Operations whose result depends on the
+// backend, like division by zero, are left alone, and so is integer overflow outside of @wrapping code
+// since checked builds trap on it.
+func fold(in *ir.Instr) (*ir.Const, bool) {
+	if len(in.Dst) != 1 {
+		return nil, false
+	}
+	t := in.Dst[0].Typ
+	var args []*ir.Const
+	for _, arg := range in.Args {
+		c, ok := arg.(*ir.Const)
+		if !ok {
+			return nil, false
+		}
+		args = append(args, c)
+	}
+
+	if !in.Wrapping && overflows(in.Op, args, t) {
+		return nil, false
+	}
+
+	switch in.Op {
+	case ir.Copy:
+		return &ir.Const{Typ: t, Value: args[0].Value}, true
+	case ir.Add, ir.Sub, ir.Mul, ir.Div, ir.Rem:
+		return arithmetic(in.Op, args[0], args[1], t)
+	case ir.And, ir.Or, ir.Xor, ir.Shl, ir.Shr:
+		return bitwise(in.Op, args[0], args[1], t)
+	case ir.Eq, ir.Ne, ir.Lt, ir.Le, ir.Gt, ir.Ge:
+		result, ok := compare(in.Op, args[0], args[1])
+		return &ir.Const{Typ: "bool", Value: result}, ok
+	case ir.Concat:
+		var joined strings.Builder
+		for _, arg := range args {
+			s, ok := arg.Value.(string)
+			if !ok {
+				return nil, false
+			}
+			joined.WriteString(s)
+		}
+		return &ir.Const{Typ: "string", Value: joined.String()}, true
+	case ir.Neg:
+		switch v := args[0].Value.(type) {
+		case int64:
+			return &ir.Const{Typ: t, Value: wrap(-v, t)}, true
+		case float64:
+			return &ir.Const{Typ: t, Value: round(-v, t)}, true
+		}
+	case ir.Compl:
+		v, ok := args[0].Value.(int64)
+		return &ir.Const{Typ: t, Value: wrap(^v, t)}, ok
+	case ir.Not:
+		v, ok := args[0].Value.(bool)
+		return &ir.Const{Typ: "bool", Value: !v}, ok
+	case ir.Convert:
+		return convert(args[0], t)
+	}
+	return nil, false
+}
+
+func arithmetic(op ir.Op, a *ir.Const, b *ir.Const, t string) (*ir.Const, bool) {
+	if ir.IsFloat(t) {
+		x, xok := a.Value.(float64)
+		y, yok := b.Value.(float64)
+		if !xok || !yok {
+			return nil, false
+		}
+		var r float64
+		switch op {
+		case ir.Add:
+			r = x + y
+		case ir.Sub:
+			r = x - y
+		case ir.Mul:
+			r = x * y
+		case ir.Div:
+			r = x / y
+		case ir.Rem:
+			r = math.Mod(x, y)
+		}
+		return &ir.Const{Typ: t, Value: round(r, t)}, true
+	}
+
+	x, xok := a.Value.(int64)
+	y, yok := b.Value.(int64)
+	if !xok || !yok {
+		return nil, false
+	}
+	var r int64
+	switch op {
+	case ir.Add:
+		r = x + y
+	case ir.Sub:
+		r = x - y
+	case ir.Mul:
+		r = x * y
+	case ir.Div, ir.Rem:
+		if y == 0 || y == -1 { // Division by zero traps and the minimum value divided by -1 overflows.
+			return nil, false
+		}
+		if ir.IsUnsigned(t) {
+			if op == ir.Div {
+				r = int64(uint64(x) / uint64(y))
+			} else {
+				r = int64(uint64(x) % uint64(y))
+			}
+		} else if op == ir.Div {
+			r = x / y
+		} else {
+			r = x % y
+		}
+	}
+	return &ir.Const{Typ: t, Value: wrap(r, t)}, true
+}
+
+// Bitwise operators and shifts, with the shift count taken modulo the bits of the type like the backends do.
+func bitwise(op ir.Op, a *ir.Const, b *ir.Const, t string) (*ir.Const, bool) {
+	x, xok := a.Value.(int64)
+	y, yok := b.Value.(int64)
+	if !xok || !yok {
+		return nil, false
+	}
+	var r int64
+	shift := uint(y) & uint(ir.Bits(t)-1)
+	switch op {
+	case ir.And:
+		r = x & y
+	case ir.Or:
+		r = x | y
+	case ir.Xor:
+		r = x ^ y
+	case ir.Shl:
+		r = x << shift
+	case ir.Shr:
+		if ir.IsUnsigned(t) {
+			r = int64(uint64(x) >> shift)
+		} else {
+			r = x >> shift
+		}
+	}
+	return &ir.Const{Typ: t, Value: wrap(r, t)}, true
+}
+
+func compare(op ir.Op, a *ir.Const, b *ir.Const) (bool, bool) {
+	var cmp int
+	switch x := a.Value.(type) {
+	case int64:
+		y, ok := b.Value.(int64)
+		if !ok {
+			return false, false
+		}
+		if ir.IsUnsigned(a.Typ) {
+			cmp = order(uint64(x) < uint64(y), uint64(x) > uint64(y))
+		} else {
+			cmp = order(x < y, x > y)
+		}
+	case float64:
+		y, ok := b.Value.(float64)
+		if !ok {
+			return false, false
+		}
+		if math.IsNaN(x) || math.IsNaN(y) {
+			return op == ir.Ne, true
+		}
+		cmp = order(x < y, x > y)
+	case bool:
+		y, ok := b.Value.(bool)
+		if !ok || (op != ir.Eq && op != ir.Ne) {
+			return false, false
+		}
+		return (x == y) == (op == ir.Eq), true
+	case nil:
+		if b.Value != nil || (op != ir.Eq && op != ir.Ne) {
+			return false, false
+		}
+		return op == ir.Eq, true
+	case string:
+		y, ok := b.Value.(string)
+		if !ok {
+			return false, false
+		}
+		cmp = order(x < y, x > y)
+	default:
+		return false, false
+	}
+
+	switch op {
+	case ir.Eq:
+		return cmp == 0, true
+	case ir.Ne:
+		return cmp != 0, true
+	case ir.Lt:
+		return cmp < 0, true
+	case ir.Le:
+		return cmp <= 0, true
+	case ir.Gt:
+		return cmp > 0, true
+	}
+	return cmp >= 0, true
+}
+
+func order(less bool, greater bool) int {
+	if less {
+		return -1
+	} else if greater {
+		return 1
+	}
+	return 0
+}
+
+// Convert a constant following C's rules, like the backends do.
+func convert(c *ir.Const, to string) (*ir.Const, bool) {
+	switch v := c.Value.(type) {
+	case int64:
+		switch {
+		case to == "string":
+			if ir.IsUnsigned(c.Typ) {
+				return &ir.Const{Typ: to, Value: strconv.FormatUint(uint64(v), 10)}, true
+			}
+			return &ir.Const{Typ: to, Value: strconv.FormatInt(v, 10)}, true
+		case to == "bool":
+			return &ir.Const{Typ: to, Value: v != 0}, true
+		case ir.IsInt(to):
+			return &ir.Const{Typ: to, Value: wrap(v, to)}, true
+		case ir.IsFloat(to):
+			if ir.IsUnsigned(c.Typ) {
+				return &ir.Const{Typ: to, Value: round(float64(uint64(v)), to)}, true
+			}
+			return &ir.Const{Typ: to, Value: round(float64(v), to)}, true
+		}
+	case float64:
+		switch {
+		case to == "string":
+			return &ir.Const{Typ: to, Value: strconv.FormatFloat(v, 'g', -1, ir.Bits(c.Typ))}, true
+		case to == "bool":
+			return &ir.Const{Typ: to, Value: v != 0}, true
+		case ir.IsFloat(to):
+			return &ir.Const{Typ: to, Value: round(v, to)}, true
+		case ir.IsInt(to):
+			// Out of range conversions are undefined in C.
+			truncated := math.Trunc(v)
+			if math.IsNaN(v) || truncated < -(1<<63) || truncated >= 1<<63 || wrap(int64(truncated), to) != int64(truncated) {
+				return nil, false
+			}
+			return &ir.Const{Typ: to, Value: int64(truncated)}, true
+		}
+	case bool:
+		n := int64(0)
+		if v {
+			n = 1
+		}
+		switch {
+		case to == "string":
+			return &ir.Const{Typ: to, Value: strconv.FormatBool(v)}, true
+		case to == "bool":
+			return &ir.Const{Typ: to, Value: v}, true
+		case ir.IsInt(to):
+			return &ir.Const{Typ: to, Value: n}, true
+		case ir.IsFloat(to):
+			return &ir.Const{Typ: to, Value: float64(n)}, true
+		}
+	}
+	return nil, false
+}
+
+// Whether integer arithmetic or an integer conversion leaves the range of its result type.
+func overflows(op ir.Op, args []*ir.Const, t string) bool {
+	if !ir.IsInt(t) {
+		return false
+	}
+	var values []*big.Int
+	for _, arg := range args {
+		v, ok := arg.Value.(int64)
+		if !ok {
+			return false
+		}
+		if ir.IsUnsigned(arg.Typ) {
+			values = append(values, new(big.Int).SetUint64(uint64(v)))
+		} else {
+			values = append(values, big.NewInt(v))
+		}
+	}
+
+	r := new(big.Int)
+	switch op {
+	case ir.Add:
+		r.Add(values[0], values[1])
+	case ir.Sub:
+		r.Sub(values[0], values[1])
+	case ir.Mul:
+		r.Mul(values[0], values[1])
+	case ir.Neg:
+		r.Neg(values[0])
+	case ir.Convert:
+		r.Set(values[0])
+	default:
+		return false
+	}
+	bits := uint(ir.Bits(t))
+	min, max := big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), bits)
+	if !ir.IsUnsigned(t) {
+		min.Neg(new(big.Int).Lsh(big.NewInt(1), bits-1))
+		max.Lsh(big.NewInt(1), bits-1)
+	}
+	return r.Cmp(min) < 0 || r.Cmp(max) >= 0
+}
+
+// Wrap an integer to the range of its type.
+func wrap(v int64, t string) int64 {
+	switch t {
+	case "i8":
+		return int64(int8(v))
+	case "i16":
+		return int64(int16(v))
+	case "int", "i32", "rune":
+		return int64(int32(v))
+	case "u8", "byte":
+		return int64(uint8(v))
+	case "u16":
+		return int64(uint16(v))
+	case "u32":
+		return int64(uint32(v))
+	}
+	return v
+}
+
+// Round a float to the precision of its type.
+func round(v float64, t string) float64 {
+	if t == "float" || t == "f32" {
+		return float64(float32(v))
+	}
+	return v
+}
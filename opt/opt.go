@@ -0,0 +1,275 @@
+package opt
+
+import (
+	"knox/ir"
+)
+
+// Optimize simplifies the program in place before code generation and returns the number of
+// simplifications made. Constant expressions are folded and propagated, branches on constant conditions
+// are removed along with unreachable statements, and unused pure instructions are dropped.
+func Optimize(p *ir.Program) int {
+	total := 0
+	for _, f := range p.Funcs {
+		for {
+			o := &optimizer{fn: f, consts: map[*ir.Var]*ir.Const{}}
+			o.countDefs(f.Body)
+			for v, c := range o.copies {
+				if c != nil && o.propagates(v) {
+					o.consts[v] = c
+				}
+			}
+			f.Body = o.block(f.Body)
+			o.removeDeadCode()
+			if o.count == 0 {
+				break
+			}
+			total += o.count
+		}
+	}
+	return total
+}
+
+type optimizer struct {
+	fn     *ir.Func
+	defs   map[*ir.Var]int
+	uses   map[*ir.Var]int
+	copies map[*ir.Var]*ir.Const // Constant a variable is assigned by every definition, nil if they differ.
+	consts map[*ir.Var]*ir.Const // Variables known to hold a constant.
+	count  int
+}
+
+func (o *optimizer) countDefs(stmts []ir.Stmt) {
+	if o.defs == nil {
+		o.defs = map[*ir.Var]int{}
+		o.copies = map[*ir.Var]*ir.Const{}
+		for _, param := range o.fn.Params {
+			o.defs[param]++
+			o.copies[param] = nil // The argument is a definition no constant can stand for.
+		}
+	}
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ir.Instr:
+			for _, dst := range s.Dst {
+				o.defs[dst]++
+				prev, seen := o.copies[dst]
+				if c, ok := o.constCopy(s); ok && (!seen || (prev != nil && prev.Value == c.Value)) {
+					o.copies[dst] = c
+				} else {
+					o.copies[dst] = nil
+				}
+			}
+		case *ir.If:
+			o.countDefs(s.Then)
+			o.countDefs(s.Else)
+		case *ir.Loop:
+			o.countDefs(s.Body)
+			o.countDefs(s.Post)
+		}
+	}
+}
+
+// Simplify a list of statements.
+func (o *optimizer) block(stmts []ir.Stmt) []ir.Stmt {
+	var result []ir.Stmt
+	for i, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ir.Instr:
+			if o.instr(s) {
+				result = append(result, s)
+			}
+		case *ir.If:
+			s.Cond = o.value(s.Cond)
+			if c, ok := s.Cond.(*ir.Const); ok {
+				o.count++
+				if c.Value == true {
+					result = append(result, o.block(s.Then)...)
+				} else {
+					result = append(result, o.block(s.Else)...)
+				}
+			} else {
+				s.Then = o.block(s.Then)
+				s.Else = o.block(s.Else)
+				result = append(result, s)
+			}
+		case *ir.Loop:
+			s.Body = o.block(s.Body)
+			s.Post = o.block(s.Post)
+			if len(s.Body) > 0 {
+				if _, ok := s.Body[0].(*ir.Break); ok {
+					o.count++ // The loop never runs, like while false.
+					continue
+				}
+			}
+			result = append(result, s)
+		case *ir.Return:
+			for j, value := range s.Values {
+				s.Values[j] = o.value(value)
+			}
+			result = append(result, s)
+		default:
+			result = append(result, s)
+		}
+
+		if len(result) > 0 && terminates(result[len(result)-1]) {
+			o.count += len(stmts) - i - 1
+			break
+		}
+	}
+	return result
+}
+
+// Simplify an instruction. Returns false if it should be removed.
+func (o *optimizer) instr(in *ir.Instr) bool {
+	for i, arg := range in.Args {
+		in.Args[i] = o.value(arg)
+	}
+	if in.Op == ir.Copy {
+		if _, ok := in.Args[0].(*ir.Const); ok && !o.propagates(in.Dst[0]) {
+			return true // Already as simple as it gets.
+		}
+	}
+	c, ok := fold(in)
+	if !ok {
+		return true
+	}
+	o.count++
+	if o.propagates(in.Dst[0]) {
+		o.consts[in.Dst[0]] = c
+		return false
+	}
+	in.Op = ir.Copy
+	in.Args = []ir.Value{c}
+	return true
+}
+
+func (o *optimizer) constCopy(in *ir.Instr) (*ir.Const, bool) {
+	if in.Op != ir.Copy {
+		return nil, false
+	}
+	c, ok := in.Args[0].(*ir.Const)
+	return c, ok
+}
+
+// Whether every use of a variable can be replaced by the constant it is assigned. That holds when
+// it is assigned once, or when every assignment copies the same constant.
+func (o *optimizer) propagates(v *ir.Var) bool {
+	if !ir.IsPrimitive(v.Typ) && v.Typ != "string" {
+		return false
+	}
+	if o.defs[v] == 1 {
+		return true
+	}
+	return o.copies[v] != nil
+}
+
+func (o *optimizer) value(v ir.Value) ir.Value {
+	if variable, ok := v.(*ir.Var); ok {
+		if c, ok := o.consts[variable]; ok {
+			return c
+		}
+	}
+	return v
+}
+
+// Remove pure instructions whose results are never used, then the variables that are gone entirely.
+func (o *optimizer) removeDeadCode() {
+	for {
+		o.uses = map[*ir.Var]int{}
+		o.countUses(o.fn.Body)
+		removed := 0
+		o.fn.Body = o.removeUnused(o.fn.Body, &removed)
+		if removed == 0 {
+			break
+		}
+		o.count += removed
+	}
+
+	o.defs = nil
+	o.countDefs(o.fn.Body)
+	var locals []*ir.Var
+	for _, local := range o.fn.Locals {
+		if o.defs[local] > 0 || o.uses[local] > 0 {
+			locals = append(locals, local)
+		}
+	}
+	o.fn.Locals = locals
+}
+
+func (o *optimizer) countUses(stmts []ir.Stmt) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ir.Instr:
+			o.use(s.Args...)
+		case *ir.If:
+			o.use(s.Cond)
+			o.countUses(s.Then)
+			o.countUses(s.Else)
+		case *ir.Loop:
+			o.countUses(s.Body)
+			o.countUses(s.Post)
+		case *ir.Return:
+			o.use(s.Values...)
+		}
+	}
+}
+
+func (o *optimizer) use(values ...ir.Value) {
+	for _, value := range values {
+		if v, ok := value.(*ir.Var); ok {
+			o.uses[v]++
+		}
+	}
+}
+
+func (o *optimizer) removeUnused(stmts []ir.Stmt, removed *int) []ir.Stmt {
+	var result []ir.Stmt
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ir.Instr:
+			if pure(s) && o.uses[s.Dst[0]] == 0 && !o.isParam(s.Dst[0]) {
+				*removed++
+				continue
+			}
+		case *ir.If:
+			s.Then = o.removeUnused(s.Then, removed)
+			s.Else = o.removeUnused(s.Else, removed)
+		case *ir.Loop:
+			s.Body = o.removeUnused(s.Body, removed)
+			s.Post = o.removeUnused(s.Post, removed)
+		}
+		result = append(result, stmt)
+	}
+	return result
+}
+
+func (o *optimizer) isParam(v *ir.Var) bool {
+	for _, param := range o.fn.Params {
+		if param == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an instruction has no effect besides its result and can't fail at runtime.
+func pure(in *ir.Instr) bool {
+	switch in.Op {
+	case ir.Copy, ir.Add, ir.Sub, ir.Mul, ir.And, ir.Or, ir.Xor, ir.Shl, ir.Shr, ir.Eq, ir.Ne, ir.Lt, ir.Le, ir.Gt, ir.Ge,
+		ir.Concat, ir.Neg, ir.Not, ir.Compl, ir.Convert, ir.NewList, ir.NewMap:
+		return true
+	case ir.Div, ir.Rem:
+		c, ok := in.Args[1].(*ir.Const)
+		return ok && c.Value != int64(0) && c.Value != int64(-1)
+	}
+	return false
+}
+
+// Whether control never continues past a statement.
+func terminates(stmt ir.Stmt) bool {
+	switch stmt.(type) {
+	case *ir.Return, *ir.Break, *ir.Continue:
+		return true
+	}
+	return false
+}
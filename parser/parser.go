@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"knox/ast"
 	"knox/lexer"
-
 	"knox/token"
+	"strings"
 )
 
 // Parser object.
@@ -15,6 +15,11 @@ type Parser struct {
 	peekToken token.Token
 	//errors    []string
 	curSymTable *ast.SymTable
+
+	// Doc comments before the current and peek tokens, and the doc comment of the declaration being parsed.
+	curDoc  string
+	peekDoc string
+	doc     string
 }
 
 // New lexer.
@@ -37,8 +42,12 @@ func (p *Parser) abortMsg(msg string) {
 
 // forward token
 func (p *Parser) nextToken() {
-	p.curToken = p.peekToken
-	p.peekToken = p.l.NextToken()
+	p.curToken, p.curDoc = p.peekToken, p.peekDoc
+	p.peekToken, p.peekDoc = p.l.NextToken(), ""
+	for p.peekToken.Type == token.DOC { // Doc comments belong to the token after them.
+		p.peekDoc += p.peekToken.Literal + "\n"
+		p.peekToken = p.l.NextToken()
+	}
 
 	//fmt.Println("Currently at " + string(p.curToken.Literal))
 }
@@ -77,22 +86,69 @@ func (p *Parser) Program() ast.Node {
 	progNode.Symbols = st
 
 	for !p.curTokenIs(token.EOF) {
+		annotations := p.declPrefix()
 		if p.curTokenIs(token.FUNCTION) {
 			progNode.Children = append(progNode.Children, p.funcDecl())
 		} else if p.curTokenIs(token.CLASS) {
 			progNode.Children = append(progNode.Children, p.classDecl())
+		} else if p.curTokenIs(token.CONST) {
+			progNode.Children = append(progNode.Children, p.varDecl())
+			p.consume(token.SEMICOLON)
 		} else {
-			p.abortMsg("Expected function or class.")
+			p.abortMsg("Expected function, class or constant.")
 		}
+		progNode.Children[len(progNode.Children)-1].Annotations = annotations
 
 	}
 	return progNode
 }
 
+// Annotations that can be written before a declaration or statement.
+var knownAnnotations = map[string]bool{
+	"unused":   true, // Silences the warning for an unused declaration.
+	"wrapping": true, // Integer arithmetic wraps around instead of trapping in checked builds.
+	"variadic": true, // The last parameter of a builtin takes any number of arguments.
+	"template": true, // A builtin's format template, with a % for each value of the variadic parameter.
+}
+
+// Annotations of a declaration, keeping its doc comment for the declaration to take. The comment can be
+// written before or after the annotations.
+func (p *Parser) declPrefix() []string {
+	doc := p.curDoc
+	annotations := p.annotations()
+	if len(annotations) > 0 {
+		doc += p.curDoc
+	}
+	p.doc = strings.TrimSuffix(doc, "\n")
+	return annotations
+}
+
+// Doc comment of the declaration being parsed. Nested declarations don't get it.
+func (p *Parser) takeDoc() string {
+	doc := p.doc
+	p.doc = ""
+	return doc
+}
+
+// annotations = {"@" ident}
+func (p *Parser) annotations() []string {
+	var names []string
+	for p.curTokenIs(token.AT) {
+		p.consume(token.AT)
+		if !knownAnnotations[p.curToken.Literal] {
+			p.abortMsg("Unknown annotation @" + p.curToken.Literal + ".")
+		}
+		names = append(names, p.curToken.Literal)
+		p.consume(token.IDENT)
+	}
+	return names
+}
+
 // classDecl = "class" ident classBlock
 func (p *Parser) classDecl() ast.Node {
 	var classNode ast.Node
 	classNode.Type = ast.CLASS
+	classNode.Doc = p.takeDoc()
 	p.consume(token.CLASS)
 
 	var identNode ast.Node
@@ -111,6 +167,7 @@ func (p *Parser) classDecl() ast.Node {
 }
 
 // classBlock = "{" {varDecl | funcDecl} "}"
+// Members declared with let are read-only after the object is created.
 func (p *Parser) classBlock() ast.Node {
 	var blockNode ast.Node
 	blockNode.Type = ast.BLOCK
@@ -122,14 +179,18 @@ func (p *Parser) classBlock() ast.Node {
 
 	p.consume(token.LBRACE)
 	for !p.curTokenIs(token.RBRACE) {
-		if p.curTokenIs(token.VAR) {
+		annotations := p.declPrefix()
+		if p.curTokenIs(token.VAR) || p.curTokenIs(token.LET) {
 			blockNode.Children = append(blockNode.Children, p.varDecl())
 			p.consume(token.SEMICOLON)
 		} else if p.curTokenIs(token.FUNCTION) {
 			blockNode.Children = append(blockNode.Children, p.funcDecl())
+		} else if p.curTokenIs(token.CONST) {
+			p.abortMsg("Constants can't be members. Use let for a read-only member.")
 		} else {
 			p.abortMsg("Unexpected token in class block.")
 		}
+		blockNode.Children[len(blockNode.Children)-1].Annotations = annotations
 
 	}
 	p.consume(token.RBRACE)
@@ -143,6 +204,7 @@ func (p *Parser) classBlock() ast.Node {
 func (p *Parser) funcDecl() ast.Node {
 	var funcNode ast.Node
 	funcNode.Type = ast.FUNCDECL
+	funcNode.Doc = p.takeDoc()
 	p.consume(token.FUNCTION)
 
 	var identNode ast.Node
@@ -181,7 +243,12 @@ func (p *Parser) paramList() ast.Node {
 
 		var varNode ast.Node
 		varNode.Type = ast.VARDECL
+		varNode.Annotations = p.annotations()
 		//varNode.Symbols = p.curSymTable
+		if p.curTokenIs(token.CONST) { // The parameter can't be assigned or changed through.
+			varNode.TokenStart = p.curToken
+			p.consume(token.CONST)
+		}
 
 		var identNode ast.Node
 		identNode.Type = ast.IDENT
@@ -253,9 +320,16 @@ func (p *Parser) block() ast.Node {
 }
 
 func (p *Parser) statement() ast.Node {
+	annotations := p.annotations()
+	statementNode := p.plainStatement()
+	statementNode.Annotations = annotations
+	return statementNode
+}
+
+func (p *Parser) plainStatement() ast.Node {
 	var statementNode ast.Node
 
-	if p.curTokenIs(token.VAR) {
+	if p.curTokenIs(token.VAR) || p.curTokenIs(token.LET) || p.curTokenIs(token.CONST) {
 		statementNode = p.varDecl()
 		p.consume(token.SEMICOLON)
 		//} else if p.curTokenIs(token.IDENT) && p.peekTokenIs(token.LPAREN) {
@@ -279,18 +353,28 @@ func (p *Parser) statement() ast.Node {
 		// If just an expr, then return leftexpr (type checker will expect a funccall somewhere inside), else return assignment.
 		exprNode := p.expr()
 
-		for p.curTokenIs(token.COMMA) {
-			// TODO multiple assignment
+		targets := []ast.Node{exprNode}
+		for p.curTokenIs(token.COMMA) { // Multiple assignment, one target for each return value.
+			p.consume(token.COMMA)
+			targets = append(targets, p.expr())
 		}
-		if p.curTokenIs(token.ASSIGN) { // assignment
+		if p.curTokenIs(token.OPASSIGN) || p.curTokenIs(token.INC) || p.curTokenIs(token.DEC) {
+			if len(targets) > 1 {
+				p.abortMsg("Compound assignment takes a single target")
+			}
+			statementNode = p.compoundAssignment(exprNode)
+		} else if p.curTokenIs(token.ASSIGN) { // assignment
 			var assignNode ast.Node
 			assignNode.Type = ast.VARASSIGN
 			assignNode.Symbols = p.curSymTable
-			assignNode.Children = append(assignNode.Children, exprNode)
+			assignNode.TokenStart = p.curToken
+			assignNode.Children = append(assignNode.Children, targets...)
 
 			p.consume(token.ASSIGN)
 			assignNode.Children = append(assignNode.Children, p.expr())
 			statementNode = assignNode
+		} else if len(targets) > 1 {
+			p.abort(token.ASSIGN)
 		} else { // funccall
 			var leftNode ast.Node
 			leftNode.Type = ast.LEFTEXPR
@@ -314,6 +398,9 @@ func (p *Parser) varDeclPiece() ast.Node {
 		var identNode ast.Node
 		identNode.Type = ast.IDENT
 		identNode.TokenStart = p.curToken
+		if p.curToken.Literal == "_" {
+			p.abortMsg("_ can't be declared.")
+		}
 		success := p.curSymTable.InsertSymbol(p.curToken.Literal, &varNode)
 		if !success {
 			p.abortMsg("Variable already exists.")
@@ -333,18 +420,23 @@ func (p *Parser) varDeclPiece() ast.Node {
 	return varNode
 }
 
-// varDecl = "var" ident ":" type assignOp expr
+// varDecl = ("var" | "let" | "const") ident ":" type assignOp expr
 func (p *Parser) varDecl() ast.Node {
 	var varNode ast.Node
 	varNode.Type = ast.VARDECL
 	varNode.Symbols = p.curSymTable
+	varNode.TokenStart = p.curToken
+	varNode.Doc = p.takeDoc()
 
-	p.consume(token.VAR)
+	p.consume(p.curToken.Type)
 
 	for p.curTokenIs(token.IDENT) {
 		var identNode ast.Node
 		identNode.Type = ast.IDENT
 		identNode.TokenStart = p.curToken
+		if p.curToken.Literal == "_" {
+			p.abortMsg("_ can't be declared.")
+		}
 		success := p.curSymTable.InsertSymbol(p.curToken.Literal, &varNode)
 		if !success {
 			p.abortMsg("Variable already exists.")
@@ -402,8 +494,25 @@ func (p *Parser) argList() []ast.Node {
 	return argNodes
 }
 
-// varType = ident | "[" varType "]" | ident "[" varType {"," varType} "]"
+// varType = (ident | "[" varType "]" | ident "[" varType {"," varType} "]") ["?"]
+// A nullable type is a "?" node around the type that can be nil.
 func (p *Parser) varType() ast.Node {
+	typeNode := p.nonNullType()
+	if p.curTokenIs(token.QUESTION) {
+		var nullableNode ast.Node
+		nullableNode.Type = ast.VARTYPE
+
+		var identNode ast.Node
+		identNode.Type = ast.IDENT
+		identNode.TokenStart = p.curToken
+		nullableNode.Children = append(nullableNode.Children, identNode, typeNode)
+		p.consume(token.QUESTION)
+		return nullableNode
+	}
+	return typeNode
+}
+
+func (p *Parser) nonNullType() ast.Node {
 	var typeNode ast.Node
 	typeNode.Type = ast.VARTYPE
 
@@ -472,6 +581,36 @@ func (p *Parser) varAssignment() ast.Node {
 	return assignNode
 }
 
+// compoundAssignment = expr (assignOp expr | "++" | "--")
+// x += y is parsed as x = x + y with += as the token, and the target as the left operand, so that it's checked
+// like the operator and the lowering can evaluate the target once. x++ adds 1 the same way.
+func (p *Parser) compoundAssignment(target ast.Node) ast.Node {
+	var assignNode ast.Node
+	assignNode.Type = ast.VARASSIGN
+	assignNode.Symbols = p.curSymTable
+	assignNode.TokenStart = p.curToken
+
+	op := p.curToken.Literal[:len(p.curToken.Literal)-1]
+	var right ast.Node
+	if p.curTokenIs(token.INC) || p.curTokenIs(token.DEC) {
+		op = p.curToken.Literal[:1]
+		right.Type = ast.INT
+		right.TokenStart = token.Token{Type: token.INT, Literal: "1", Line: p.curToken.Line}
+		p.nextToken()
+	} else {
+		p.nextToken()
+		right = p.expr()
+	}
+
+	var binaryNode ast.Node
+	binaryNode.Type = ast.BINARYOP
+	binaryNode.TokenStart = token.Token{Type: token.TokenType(op), Literal: op, Line: assignNode.TokenStart.Line}
+	binaryNode.Children = append(binaryNode.Children, target.Children[0], right)
+
+	assignNode.Children = append(assignNode.Children, target, binaryNode)
+	return assignNode
+}
+
 // ifStatement = "if" expr block
 func (p *Parser) ifStatement() ast.Node {
 	var statementNode ast.Node
@@ -619,7 +758,7 @@ func (p *Parser) comparison() ast.Node {
 
 func (p *Parser) addition() ast.Node {
 	var node = p.multiplication()
-	for p.curTokenIs(token.PLUS) || p.curTokenIs(token.MINUS) {
+	for p.curTokenIs(token.PLUS) || p.curTokenIs(token.MINUS) || p.curTokenIs(token.PIPE) || p.curTokenIs(token.CARET) {
 		var binaryNode ast.Node
 		binaryNode.Type = ast.BINARYOP
 		binaryNode.TokenStart = p.curToken
@@ -634,7 +773,8 @@ func (p *Parser) addition() ast.Node {
 
 func (p *Parser) multiplication() ast.Node {
 	var node = p.unary()
-	for p.curTokenIs(token.ASTERISK) || p.curTokenIs(token.SLASH) || p.curTokenIs(token.PERCENT) {
+	for p.curTokenIs(token.ASTERISK) || p.curTokenIs(token.SLASH) || p.curTokenIs(token.PERCENT) ||
+		p.curTokenIs(token.AMPERSAND) || p.curTokenIs(token.LSHIFT) || p.curTokenIs(token.RSHIFT) {
 		var binaryNode ast.Node
 		binaryNode.Type = ast.BINARYOP
 		binaryNode.TokenStart = p.curToken
@@ -649,7 +789,7 @@ func (p *Parser) multiplication() ast.Node {
 }
 
 func (p *Parser) unary() ast.Node {
-	if p.curTokenIs(token.BANG) || p.curTokenIs(token.PLUS) || p.curTokenIs(token.MINUS) {
+	if p.curTokenIs(token.BANG) || p.curTokenIs(token.PLUS) || p.curTokenIs(token.MINUS) || p.curTokenIs(token.TILDE) {
 		var unaryNode ast.Node
 		unaryNode.Type = ast.UNARYOP
 		unaryNode.TokenStart = p.curToken
@@ -672,6 +812,7 @@ func (p *Parser) postfix() ast.Node {
 			var postNode ast.Node
 			postNode.Children = append(postNode.Children, node)
 			postNode.Type = ast.FUNCCALL
+			postNode.TokenStart = p.curToken
 			postNode.Symbols = p.curSymTable
 
 			var nodes = p.argList()
@@ -682,6 +823,7 @@ func (p *Parser) postfix() ast.Node {
 			var postNode ast.Node
 			postNode.Children = append(postNode.Children, node)
 			postNode.Type = ast.INDEXOP
+			postNode.TokenStart = p.curToken
 
 			p.nextToken()
 			postNode.Children = append(postNode.Children, p.expr())
@@ -781,7 +923,31 @@ func (p *Parser) listLiteral() ast.Node {
 	return listNode
 }
 
-// primary = varRef | INT | FLOAT | STRING | "false" | "true" | "nil" | "(" expr ")" | listLiteral
+// interpolation = INTERPSTART expr {INTERPMID expr} INTERPEND
+func (p *Parser) interpolation() ast.Node {
+	var interpNode ast.Node
+	interpNode.Type = ast.INTERPOLATION
+	interpNode.TokenStart = p.curToken
+
+	for {
+		segment := p.curToken
+		segment.Type = token.STRING
+		interpNode.Children = append(interpNode.Children, ast.Node{Type: ast.STRING, TokenStart: segment})
+		if p.curTokenIs(token.INTERPEND) {
+			break
+		}
+		p.nextToken()
+		interpNode.Children = append(interpNode.Children, p.expr())
+		if !p.curTokenIs(token.INTERPMID) && !p.curTokenIs(token.INTERPEND) {
+			p.abortMsg("Expected } to close the expression in the string")
+		}
+	}
+	p.nextToken()
+
+	return interpNode
+}
+
+// primary = varRef | INT | FLOAT | STRING | CHAR | interpolation | "false" | "true" | "nil" | "(" expr ")" | listLiteral
 func (p *Parser) primary() ast.Node {
 	var primaryNode ast.Node
 	primaryNode.TokenStart = p.curToken
@@ -793,6 +959,8 @@ func (p *Parser) primary() ast.Node {
 		primaryNode.Type = ast.FLOAT
 	case token.STRING:
 		primaryNode.Type = ast.STRING
+	case token.CHAR:
+		primaryNode.Type = ast.CHAR
 	case token.TRUE, token.FALSE:
 		primaryNode.Type = ast.BOOL
 	case token.NIL:
@@ -808,6 +976,10 @@ func (p *Parser) primary() ast.Node {
 		primaryNode.Children = append(primaryNode.Children, identNode)
 	case token.LBRACKET:
 		return p.listLiteral()
+	case token.INTERPSTART:
+		return p.interpolation()
+	case token.EOF: // Lists and argument lists would wait for their closing bracket forever.
+		p.abortMsg("Unexpected end of file")
 	}
 
 	p.nextToken()
@@ -1,2 +1,25 @@
 ./knox -time -ast -go -out="output" examples/builtin.knox
-./output/out
\ No newline at end of file
+./output/out
+./knox -backend=wasm examples/fizzbuzz.knox # Validates the module and runs it with the Go hosted interpreter.
+./knox -out="output" -name=folding examples/folding.knox && ./output/folding | grep -qx "105 15 7" # A constant assigned to a parameter isn't folded over the argument.
+./knox -Werror examples/fib.knox # Fails on the warning for the uncalled fib function.
+./knox -checked -out="output" examples/casts.knox # Casts between int and float build with the runtime checks.
+./knox -checked -out="output" -name=trap examples/traps/overflow.knox && ! ./output/trap 2> output/trap.txt && grep -q "Runtime error: integer overflow in +" output/trap.txt # Adding past the largest int stops with an error.
+./knox -checked -out="output" -name=trap examples/traps/zero.knox && ! ./output/trap 2> output/trap.txt && grep -q "Runtime error: division by zero" output/trap.txt # Dividing by zero stops with an error.
+./knox -checked -out="output" -name=trap examples/traps/minimum.knox && ! ./output/trap 2> output/trap.txt && grep -q "Runtime error: integer overflow in /" output/trap.txt # Dividing the smallest int by -1 stops with an error.
+./knox -checked -out="output" -name=trap examples/traps/narrowing.knox && ! ./output/trap 2> output/trap.txt && grep -q "Runtime error: integer overflow in conversion to i8" output/trap.txt # Casting 300 to i8 stops with an error.
+./knox -debug -out="output" examples/classes.knox # Nullable locals narrowed by assignment build with the nil checks.
+./knox -debug -out="output" -name=trap examples/traps/nil.knox && ! ./output/trap 2> output/trap.txt && grep -q "Runtime error: nil Node dereferenced" output/trap.txt # Reading a member of a nil object stops with an error.
+./knox -out="output" examples/constants.knox # let, const and const parameters.
+./knox -out="output" examples/text.knox # String escapes, rune indexing and the string methods.
+./knox -out="output" examples/interpolation.knox # Holes like {p.x} in string literals, escaped with \{.
+./knox -out="output" examples/printing.knox # println, eprint and format with objects that have toString.
+./knox -out="output" examples/characters.knox # Rune literals and conversions between runes, bytes and integers.
+./knox -out="output" examples/literals.knox # Hex, binary and octal literals, exponents and type suffixes.
+./knox -out="output" examples/bits.knox # Bitwise operators and shifts on integers.
+./knox -out="output" examples/assignment.knox # Compound assignments like += and ++ evaluate their target once.
+./knox -out="output" examples/comments.knox # Nested block comments and /// doc comments on declarations.
+./knox doc -out="output/doc" examples/comments.knox # Markdown and HTML pages for the classes, functions and constants, with their doc comments.
+ls examples/*.knox | grep -v -e basic -e future | xargs ./knox fmt > /dev/null # Every example formats to code that parses back to the same program.
+./knox fmt examples/formatting.knox | diff examples/formatting.knox - # Formatted code stays as it is, with its literal escapes and the comments in empty blocks and after annotations.
+./knox lsp < examples/lsp.jsonrpc # A scripted editor session: diagnostics, hover, definition, completion and symbols.
@@ -29,6 +29,11 @@ const (
 	SLASH     = "/"
 	PERCENT   = "%"
 	CARET     = "^"
+	AMPERSAND = "&"
+	PIPE      = "|"
+	TILDE     = "~"
+	LSHIFT    = "<<"
+	RSHIFT    = ">>"
 	LT        = "<"
 	LTEQ      = "<="
 	GT        = ">"
@@ -43,6 +48,8 @@ const (
 	CLASS     = "CLASS"
 	FUNCTION  = "FUNCTION"
 	VAR       = "VAR"
+	LET       = "LET"
+	CONST     = "CONST"
 	TRUE      = "TRUE"
 	FALSE     = "FALSE"
 	IF        = "IF"
@@ -57,12 +64,29 @@ const (
 	EQ        = "=="
 	NOTEQ     = "!="
 	STRING    = "STRING"
+	CHAR      = "CHAR"
 	LBRACKET  = "["
 	RBRACKET  = "]"
 	COLON     = ":"
 	DOT       = "."
 	SELF      = "SELF"
 	NIL       = "NIL"
+	AT        = "@"
+	QUESTION  = "?"
+	INC       = "++"
+	DEC       = "--"
+
+	// An operator followed by =, like += or <<=. The literal is the whole operator.
+	OPASSIGN = "OPASSIGN"
+
+	// A /// comment documenting the declaration after it. The literal is the text after the slashes.
+	DOC = "DOC"
+
+	// An interpolated string is split at its holes into a start, middle segments and an end, with the
+	// tokens of each hole's expression in between.
+	INTERPSTART = "INTERPSTART"
+	INTERPMID   = "INTERPMID"
+	INTERPEND   = "INTERPEND"
 )
 
 // reversed keywords
@@ -84,6 +108,8 @@ var keywords = map[string]TokenType{
 	"new":      NEW,
 	"self":     SELF,
 	"nil":      NIL,
+	"let":      LET,
+	"const":    CONST,
 }
 
 // LookupIdentifier used to determinate whether identifier is keyword nor not
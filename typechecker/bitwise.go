@@ -0,0 +1,70 @@
+package typechecker
+
+import (
+	"knox/ast"
+	"math/big"
+)
+
+var bitwiseOps = map[string]bool{"&": true, "|": true, "^": true, "<<": true, ">>": true}
+
+// Bitwise operators and shifts only work on integers. Both sides have the same type like other operators, and a
+// shift count is taken modulo the number of bits at runtime.
+func checkBitwise(node *ast.Node, left *typeObj, right *typeObj) *typeObj {
+	if !isInteger(left) || !isInteger(right) {
+		t := left
+		if isInteger(left) {
+			t = right
+		}
+		abortMsgf(node, "%s only works on integers, not %s", node.TokenStart.Literal, literalText(t))
+	}
+	op := node.TokenStart.Literal
+	if (op == "<<" || op == ">>") && right.value != nil && right.value.Sign() < 0 {
+		abortMsgf(node, "Shift count %s can't be negative", literalText(right))
+	}
+	if !left.isLiteral || !right.isLiteral {
+		if left.isLiteral {
+			return right
+		}
+		return left
+	}
+
+	t := *left
+	t.value = nil
+	if left.value == nil || right.value == nil {
+		return &t
+	}
+	x, y := left.value.Num(), right.value.Num()
+	v := new(big.Int)
+	switch op {
+	case "&":
+		v.And(x, y)
+	case "|":
+		v.Or(x, y)
+	case "^":
+		v.Xor(x, y)
+	case "<<", ">>":
+		if y.Cmp(big.NewInt(64)) >= 0 {
+			abortMsgf(node, "Shift count %s is too large", literalText(right))
+		}
+		if op == "<<" {
+			v.Lsh(x, uint(y.Int64()))
+		} else {
+			v.Rsh(x, uint(y.Int64()))
+		}
+	}
+	t.value = new(big.Rat).SetInt(v)
+	return &t
+}
+
+// ~ flips the bits of an integer. On a literal it gives -x-1, like it does for any signed type.
+func checkComplement(node *ast.Node, t *typeObj) *typeObj {
+	if !isInteger(t) {
+		abortMsgf(node, "~ only works on integers, not %s", literalText(t))
+	}
+	if t.value == nil {
+		return t
+	}
+	c := *t
+	c.value = new(big.Rat).SetInt(new(big.Int).Not(t.value.Num()))
+	return &c
+}
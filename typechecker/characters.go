@@ -0,0 +1,23 @@
+package typechecker
+
+import (
+	"knox/ast"
+)
+
+// Runes are Unicode code points and bytes are 8 bits. Neither is a number, so they are compared and converted
+// with as but have no arithmetic.
+func isCharacter(t *typeObj) bool {
+	return t.fullName == "rune" || t.fullName == "byte"
+}
+
+// Runes and bytes convert to and from integers and each other. A rune converts to a string of its character.
+func checkCharacterCast(node *ast.Node, from *typeObj, to *typeObj) {
+	if !isCharacter(from) && !isCharacter(to) {
+		return
+	}
+	ok := isCharacter(from) && (isCharacter(to) || isInteger(to) || compareTypes(to, prim.typeSTRING)) ||
+		isCharacter(to) && isInteger(from)
+	if !ok {
+		abortMsgf(node, "Can't convert %s to %s. Runes and bytes only convert to integers, each other and string", from.fullName, to.fullName)
+	}
+}
@@ -0,0 +1,47 @@
+package typechecker
+
+import (
+	"knox/ast"
+)
+
+// Check that values of a type can be compared with == and !=. Primitives and strings compare by value, lists
+// compare their items, and objects are identical unless their class declares equals(other : T) bool.
+func checkEquality(node *ast.Node, left *typeObj, right *typeObj) {
+	t := left
+	if t.fullName == "nil" {
+		t = right
+	}
+	switch {
+	case t.isMap:
+		abortMsgf(node, "Maps can't be compared with %s", node.TokenStart.Literal)
+	case t.isList:
+		checkEquality(node, &t.inner[0], &t.inner[0])
+	case t.isClass:
+		if method := classMethod(t.name, "equals"); method != nil {
+			params := method.Children[1].Children
+			results := declType(method)
+			if len(params) != 1 || declType(&params[0]).fullName != t.name || len(results.inner) != 1 || !compareTypes(&results.inner[0], prim.typeBOOL) {
+				abortMsgf(&method.Children[0], "%s.equals must take a %s and return bool", t.name, t.name)
+			}
+		}
+	}
+}
+
+// Method declared by a class, or nil.
+func classMethod(class string, name string) *ast.Node {
+	decl := program.Symbols.LookupSymbol(class)
+	if decl == nil || decl.Type != ast.CLASS {
+		return nil
+	}
+	if method := decl.Children[1].Symbols.Entries[name]; method != nil && method.Type == ast.FUNCDECL {
+		return method
+	}
+	return nil
+}
+
+// Only numbers, strings, runes and bytes have an order.
+func checkOrdering(node *ast.Node, left *typeObj, right *typeObj) {
+	if !(left.isNumber && right.isNumber) && !compareTypes(left, prim.typeSTRING) && !isCharacter(left) {
+		abortMsgf(node, "Only numbers, strings, runes and bytes can be compared with %s, not %s", node.TokenStart.Literal, left.fullName)
+	}
+}
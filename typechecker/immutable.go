@@ -0,0 +1,149 @@
+package typechecker
+
+import (
+	"knox/ast"
+	"knox/token"
+)
+
+// TODO: Allow constants in type constraints and array sizes once Knox has them.
+
+// List and map methods that don't change their receiver.
+var readMethods = map[string]bool{"length": true, "contains": true}
+
+// Read-only form of a reference type, for values reached through a const parameter.
+func readOnly(t *typeObj) *typeObj {
+	r := *t
+	r.isMutable = false
+	return &r
+}
+
+func isReference(t *typeObj) bool {
+	return t.isClass || t.isContainer
+}
+
+// Whether a declaration is a const parameter.
+func isConstParam(decl *ast.Node) bool {
+	return decl.Type == ast.VARDECL && decl.TokenStart.Type == token.CONST && len(decl.Children) == 2
+}
+
+// Whether a declaration is a compile-time constant.
+func isConstant(decl *ast.Node) bool {
+	return decl.Type == ast.VARDECL && decl.TokenStart.Type == token.CONST && len(decl.Children) == 3
+}
+
+// Abort when a read-only reference would be stored where it could be changed.
+func checkMutable(node *ast.Node, target *typeObj, value *typeObj) {
+	if isReference(value) && !value.isMutable && target.isMutable {
+		abortMsgf(located(node), "%s is const, so it can only be passed to const parameters", describe(node))
+	}
+}
+
+// First node of an expression that has a line, since operators and wrappers don't have their own token.
+func located(node *ast.Node) *ast.Node {
+	for node.TokenStart.Line == 0 && len(node.Children) > 0 {
+		node = &node.Children[0]
+	}
+	return node
+}
+
+// Abort on an assignment to a let or const declaration, a read-only member, a string's rune, or through a const
+// parameter.
+func checkWritable(target *ast.Node) {
+	target = unwrap(target)
+	switch target.Type {
+	case ast.VARREF:
+		name := target.Children[0].TokenStart.Literal
+		decl := target.Symbols.LookupSymbol(name)
+		if decl == nil || decl.Type != ast.VARDECL {
+			return
+		}
+		if isConstParam(decl) {
+			abortMsgf(target, "Parameter %s is const and can't be assigned", name)
+		} else if isConstant(decl) {
+			abortMsgf(target, "Constant %s can't be assigned", name)
+		} else if decl.TokenStart.Type == token.LET && currentClass != nil && currentClass.Children[1].Symbols.Entries[name] == decl {
+			abortMsgf(target, "Member %s is read-only", name)
+		} else if decl.TokenStart.Type == token.LET {
+			abortMsgf(target, "%s is declared with let and can't be assigned", name)
+		}
+	case ast.DOTOP:
+		left := getType(&target.Children[0])
+		if !left.isMutable {
+			abortMsgf(located(target), "%s is const and can't be changed", describe(&target.Children[0]))
+		}
+		if class := target.Symbols.LookupSymbol(left.name); class != nil && class.Type == ast.CLASS {
+			member := target.Children[1].TokenStart.Literal
+			if decl := class.Children[1].Symbols.Entries[member]; decl != nil && decl.TokenStart.Type == token.LET {
+				abortMsgf(&target.Children[1], "Member %s.%s is read-only", left.name, member)
+			}
+		}
+	case ast.INDEXOP:
+		left := getType(&target.Children[0])
+		if compareTypes(left, prim.typeSTRING) {
+			abortMsg(located(target), "Strings can't be changed. Build a new one with slice or +")
+		}
+		if !left.isMutable {
+			abortMsgf(located(target), "%s is const and can't be changed", describe(&target.Children[0]))
+		}
+	}
+}
+
+// Abort on a method call that could change a read-only receiver. Only the list and map methods that read
+// are allowed, since any method of a class could assign its members.
+func checkReceiver(call *ast.Node) {
+	callee := &call.Children[0]
+	if callee.Type != ast.DOTOP {
+		return
+	}
+	receiver := getType(&callee.Children[0])
+	method := callee.Children[1].TokenStart.Literal
+	if !receiver.isMutable && isReference(receiver) && !((receiver.isList || receiver.isMap) && readMethods[method]) {
+		abortMsgf(call, "%s is const, and %s could change it", describe(&callee.Children[0]), method)
+	}
+}
+
+// Constants must be numbers, bools, runes, bytes or strings that are computed from literals and other constants.
+func checkConstant(node *ast.Node, t *typeObj) {
+	name := node.Children[0].TokenStart.Literal
+	if len(node.Children) != 3 {
+		abortMsg(node, "Constants must be declared one at a time")
+	}
+	if !t.isPrimitive || t.isNullable {
+		abortMsgf(node, "Constant %s must be a number, bool, rune, byte or string, not %s", name, t.fullName)
+	}
+	if !constantExpr(&node.Children[2], map[*ast.Node]bool{node.Symbols.Entries[name]: true}) {
+		abortMsgf(node, "Constant %s must be computed from literals and other constants", name)
+	}
+}
+
+func constantExpr(node *ast.Node, visiting map[*ast.Node]bool) bool {
+	switch node.Type {
+	case ast.INT, ast.FLOAT, ast.STRING, ast.CHAR, ast.BOOL:
+		return true
+	case ast.EXPRESSION, ast.CAST:
+		return constantExpr(&node.Children[0], visiting)
+	case ast.UNARYOP, ast.BINARYOP:
+		if node.TokenStart.Type == token.NEW {
+			return false
+		}
+		for i := range node.Children {
+			if !constantExpr(&node.Children[i], visiting) {
+				return false
+			}
+		}
+		return true
+	case ast.VARREF:
+		name := node.Children[0].TokenStart.Literal
+		decl := node.Symbols.LookupSymbol(name)
+		if decl == nil || !isConstant(decl) {
+			return false
+		}
+		if visiting[decl] {
+			abortMsgf(node, "Constant %s depends on itself", name)
+		}
+		visiting[decl] = true
+		defer delete(visiting, decl)
+		return constantExpr(&decl.Children[2], visiting)
+	}
+	return false
+}
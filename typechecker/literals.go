@@ -0,0 +1,171 @@
+package typechecker
+
+import (
+	"knox/ast"
+	"knox/lexer"
+	"math"
+	"math/big"
+)
+
+// Ranges of the integer types.
+var intRanges = map[string][2]*big.Rat{
+	"i8":  {big.NewRat(math.MinInt8, 1), big.NewRat(math.MaxInt8, 1)},
+	"i16": {big.NewRat(math.MinInt16, 1), big.NewRat(math.MaxInt16, 1)},
+	"i32": {big.NewRat(math.MinInt32, 1), big.NewRat(math.MaxInt32, 1)},
+	"int": {big.NewRat(math.MinInt32, 1), big.NewRat(math.MaxInt32, 1)},
+	"i64": {big.NewRat(math.MinInt64, 1), big.NewRat(math.MaxInt64, 1)},
+	"u8":  {big.NewRat(0, 1), big.NewRat(math.MaxUint8, 1)},
+	"u16": {big.NewRat(0, 1), big.NewRat(math.MaxUint16, 1)},
+	"u32": {big.NewRat(0, 1), big.NewRat(math.MaxUint32, 1)},
+	"u64": {big.NewRat(0, 1), new(big.Rat).SetInt(new(big.Int).SetUint64(math.MaxUint64))},
+}
+
+// Ranges of the code points and bytes, for casts of literals.
+var characterRanges = map[string][2]*big.Rat{
+	"rune": {big.NewRat(0, 1), big.NewRat(0x10FFFF, 1)},
+	"byte": {big.NewRat(0, 1), big.NewRat(math.MaxUint8, 1)},
+}
+
+func isInteger(t *typeObj) bool {
+	_, ok := intRanges[t.fullName]
+	return ok || t.fullName == "INT_LITERAL"
+}
+
+// Type of a number literal, which carries its value for range checks. A literal with a suffix like 255u8 has
+// that type.
+func literalType(node *ast.Node) *typeObj {
+	t := *prim.typeINTLITERAL
+	if node.Type == ast.FLOAT {
+		t = *prim.typeFLOATLITERAL
+	}
+	digits, suffix := lexer.NumberSuffix(node.TokenStart.Literal)
+	value, ok := lexer.NumberValue(digits)
+	if !ok {
+		abortMsgf(node, "Invalid number literal %s", node.TokenStart.Literal)
+	}
+	t.value = value
+	if suffix == "" {
+		return &t
+	}
+	if node == negatedLiteral {
+		t.value = new(big.Rat).Neg(value)
+	}
+	typed := stringToType(suffix)
+	if !literalFits(&t, typed) { // The lexer only allows f32 and f64 after a float.
+		abortMsgf(node, "Literal %s is out of range for %s", literalText(&t), suffix)
+	}
+	return typed
+}
+
+// Literal being negated by a unary minus, so that a suffixed literal like -128i8 is range checked as a whole.
+var negatedLiteral *ast.Node
+
+// Evaluate an operator on literals so that expressions like -128 are range checked as a whole.
+// Integer division truncates like it does at runtime.
+func foldLiterals(node *ast.Node, left *typeObj, right *typeObj) *typeObj {
+	t := *left
+	if right.fullName == "FLOAT_LITERAL" {
+		t = *right
+	}
+	t.value = nil
+	if left.value == nil || right.value == nil {
+		return &t
+	}
+
+	v := new(big.Rat)
+	switch node.TokenStart.Literal {
+	case "+":
+		v.Add(left.value, right.value)
+	case "-":
+		v.Sub(left.value, right.value)
+	case "*":
+		v.Mul(left.value, right.value)
+	case "/", "%":
+		if right.value.Sign() == 0 {
+			abortMsg(node, "Division by zero in a constant expression")
+		}
+		if t.fullName == "FLOAT_LITERAL" {
+			if node.TokenStart.Literal == "%" {
+				return &t
+			}
+			v.Quo(left.value, right.value)
+		} else {
+			q, r := new(big.Int).QuoRem(left.value.Num(), right.value.Num(), new(big.Int))
+			if node.TokenStart.Literal == "/" {
+				v.SetInt(q)
+			} else {
+				v.SetInt(r)
+			}
+		}
+	default:
+		return &t
+	}
+	t.value = v
+	return &t
+}
+
+// Whether a literal can be used as the target type. Float literals can't become integers, and values must
+// be in the target's range.
+func literalFits(lit *typeObj, target *typeObj) bool {
+	if !lit.isLiteral || !lit.isNumber || target.isLiteral || !target.isNumber {
+		return true
+	}
+	if lit.fullName == "FLOAT_LITERAL" && isInteger(target) {
+		return false
+	}
+	if lit.value == nil {
+		return true
+	}
+	if r, ok := intRanges[target.fullName]; ok {
+		return lit.value.Cmp(r[0]) >= 0 && lit.value.Cmp(r[1]) <= 0
+	}
+	if target.fullName == "float" || target.fullName == "f32" {
+		f, _ := lit.value.Float64()
+		return math.Abs(f) <= math.MaxFloat32
+	}
+	return true
+}
+
+// An integer literal cast with as becomes a constant of the target type, so it must be in its range.
+func checkLiteralCast(node *ast.Node, lit *typeObj, to string) {
+	if lit.value == nil || !lit.value.IsInt() {
+		return
+	}
+	r, ok := intRanges[to]
+	if !ok {
+		r, ok = characterRanges[to]
+	}
+	if ok && (lit.value.Cmp(r[0]) < 0 || lit.value.Cmp(r[1]) > 0) {
+		abortMsgf(node, "Literal %s is out of range for %s", literalText(lit), to)
+	}
+}
+
+// Value of a literal for error messages. Floats are shortened like 1e+300, even when they're whole numbers or
+// too large for f64.
+func literalText(lit *typeObj) string {
+	if lit.value == nil {
+		return lit.fullName
+	}
+	if lit.value.IsInt() && lit.fullName != "FLOAT_LITERAL" {
+		return lit.value.RatString()
+	}
+	return new(big.Float).SetPrec(53).SetRat(lit.value).Text('g', -1)
+}
+
+// Abort with an error naming both types, explaining why a literal or nil doesn't fit.
+func mismatch(node *ast.Node, a *typeObj, b *typeObj) {
+	for _, pair := range [][2]*typeObj{{a, b}, {b, a}} {
+		lit, target := pair[0], pair[1]
+		if lit.fullName == "nil" && (target.isClass || target.isContainer) && !target.isNullable {
+			abortMsgf(node, "%s can't be nil. Declare it as %s? to allow nil", target.fullName, target.fullName)
+		}
+		if literalFits(lit, target) {
+			continue
+		}
+		if lit.fullName == "FLOAT_LITERAL" && isInteger(target) {
+			abortMsgf(node, "Float literal %s can't be used as %s", literalText(lit), target.fullName)
+		}
+		abortMsgf(node, "Literal %s is out of range for %s", literalText(lit), target.fullName)
+	}
+	abortMsgf(node, "Mismatched types: %s and %s", a.fullName, b.fullName)
+}
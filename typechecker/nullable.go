@@ -0,0 +1,327 @@
+package typechecker
+
+import (
+	"fmt"
+	"knox/ast"
+	"strings"
+)
+
+// Paths like x or self.next that are known not to be nil at the current point of the function. The set is
+// replaced rather than changed so that a saved copy stays valid.
+var narrowed = map[string]bool{}
+
+// Non-nullable form of a type.
+func nonNull(t *typeObj) *typeObj {
+	n := *t
+	n.isNullable = false
+	n.fullName = strings.TrimSuffix(t.fullName, "?")
+	return &n
+}
+
+// Path of a variable or member access that can be narrowed, or "" for other expressions. Variables are
+// identified by their declaration so that shadowing doesn't carry a narrowing over.
+func path(node *ast.Node) string {
+	node = unwrap(node)
+	switch node.Type {
+	case ast.VARREF:
+		if len(node.Children) == 1 && node.Symbols != nil {
+			if entry := node.Symbols.LookupSymbol(node.Children[0].TokenStart.Literal); entry != nil {
+				return fmt.Sprintf("%p", entry)
+			}
+		}
+	case ast.SELF:
+		return "self"
+	case ast.DOTOP:
+		if left := path(&node.Children[0]); left != "" {
+			return left + "." + node.Children[1].TokenStart.Literal
+		}
+	}
+	return ""
+}
+
+// Source text of an expression for error messages.
+func describe(node *ast.Node) string {
+	node = unwrap(node)
+	switch node.Type {
+	case ast.VARREF:
+		return node.Children[0].TokenStart.Literal
+	case ast.SELF:
+		return "self"
+	case ast.DOTOP:
+		return describe(&node.Children[0]) + "." + node.Children[1].TokenStart.Literal
+	}
+	return "Value"
+}
+
+// Type of a variable or member, which can't be nil where its path is narrowed.
+func narrowedType(node *ast.Node, t *typeObj) *typeObj {
+	if t.isNullable && narrowed[path(node)] {
+		return nonNull(t)
+	}
+	return t
+}
+
+// Type of an operand of == or !=. A value compared with nil has its declared type even where it's narrowed, so
+// that code can check it again.
+func operandType(node *ast.Node, i int) *typeObj {
+	op := node.TokenStart.Literal
+	operand := &node.Children[i]
+	if p := path(operand); p != "" && narrowed[p] && (op == "==" || op == "!=") && unwrap(&node.Children[1-i]).Type == ast.NIL {
+		saved := narrowed
+		narrowed = without(narrowed, p)
+		t := getType(operand)
+		narrowed = saved
+		return t
+	}
+	return getType(operand)
+}
+
+// Abort when an expression that can be nil is dereferenced.
+func checkNotNil(node *ast.Node, t *typeObj) {
+	if t.isNullable {
+		abortMsgf(node, "%s may be nil. Check it with != nil before using it", describe(node))
+	}
+}
+
+func with(set map[string]bool, paths []string) map[string]bool {
+	result := map[string]bool{}
+	for p := range set {
+		result[p] = true
+	}
+	for _, p := range paths {
+		result[p] = true
+	}
+	return result
+}
+
+// Only variables stay narrowed, since a call can change the members of any object it can reach.
+func locals(set map[string]bool) map[string]bool {
+	result := map[string]bool{}
+	for p := range set {
+		if !strings.Contains(p, ".") {
+			result[p] = true
+		}
+	}
+	return result
+}
+
+// Remove the paths through a member. Any reference to an object of the class could be the one assigned, so a
+// member is forgotten whatever path it's reached by.
+func withoutMember(set map[string]bool, member string) map[string]bool {
+	result := map[string]bool{}
+	for p := range set {
+		if !strings.Contains(p+".", "."+member+".") {
+			result[p] = true
+		}
+	}
+	return result
+}
+
+// Remove a path and the members reached through it.
+func without(set map[string]bool, p string) map[string]bool {
+	result := map[string]bool{}
+	for q := range set {
+		if q != p && !strings.HasPrefix(q, p+".") {
+			result[q] = true
+		}
+	}
+	return result
+}
+
+func intersect(sets []map[string]bool) map[string]bool {
+	result := map[string]bool{}
+	for p := range sets[0] {
+		result[p] = true
+		for _, set := range sets[1:] {
+			if !set[p] {
+				delete(result, p)
+			}
+		}
+	}
+	return result
+}
+
+// Paths that are not nil when a condition is true and when it is false.
+func narrowing(cond *ast.Node) ([]string, []string) {
+	cond = unwrap(cond)
+	switch cond.Type {
+	case ast.BINARYOP:
+		switch cond.TokenStart.Literal {
+		case "==", "!=":
+			p := path(&cond.Children[0])
+			if unwrap(&cond.Children[0]).Type == ast.NIL {
+				p = path(&cond.Children[1])
+			} else if unwrap(&cond.Children[1]).Type != ast.NIL {
+				return nil, nil
+			}
+			if p == "" {
+				return nil, nil
+			} else if cond.TokenStart.Literal == "!=" {
+				return []string{p}, nil
+			}
+			return nil, []string{p}
+		case "&&":
+			leftTrue, _ := narrowing(&cond.Children[0])
+			rightTrue, _ := narrowing(&cond.Children[1])
+			return append(afterCalls(&cond.Children[1], leftTrue), rightTrue...), nil
+		case "||":
+			_, leftFalse := narrowing(&cond.Children[0])
+			_, rightFalse := narrowing(&cond.Children[1])
+			return nil, append(afterCalls(&cond.Children[1], leftFalse), rightFalse...)
+		}
+	case ast.UNARYOP:
+		if cond.TokenStart.Literal == "!" {
+			whenTrue, whenFalse := narrowing(&cond.Children[0])
+			return whenFalse, whenTrue
+		}
+	}
+	return nil, nil
+}
+
+// Paths of a left operand that still hold after the right one, which drops the members if it calls anything.
+func afterCalls(right *ast.Node, paths []string) []string {
+	if !calls(right) {
+		return paths
+	}
+	var kept []string
+	for _, p := range paths {
+		if !strings.Contains(p, ".") {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// Whether an expression contains a call.
+func calls(node *ast.Node) bool {
+	if node.Type == ast.FUNCCALL {
+		return true
+	}
+	for i := range node.Children {
+		if calls(&node.Children[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// The right operand of && only runs when the left one is true, and the right operand of || when it's false.
+// Returns the paths to restore afterwards.
+func narrowRight(node *ast.Node) map[string]bool {
+	saved := narrowed
+	whenTrue, whenFalse := narrowing(&node.Children[0])
+	switch node.TokenStart.Literal {
+	case "&&":
+		narrowed = with(saved, whenTrue)
+	case "||":
+		narrowed = with(saved, whenFalse)
+	}
+	return saved
+}
+
+// Record an assignment to a path. Assigning a value that can't be nil narrows it.
+func assignPath(target *ast.Node, value *typeObj) {
+	if left := unwrap(target); left.Type == ast.DOTOP {
+		narrowed = withoutMember(narrowed, left.Children[1].TokenStart.Literal)
+	}
+	p := path(target)
+	if p == "" {
+		return
+	}
+	narrowed = without(narrowed, p)
+	if value.fullName != "nil" && !value.isNullable {
+		narrowed = with(narrowed, []string{p})
+	}
+}
+
+func checkCondition(node *ast.Node, cond *ast.Node) {
+	if !compareTypes(getType(cond), prim.typeBOOL) {
+		abortMsg(node, "Conditionals require boolean expressions.")
+	}
+}
+
+// Check each branch with what its conditions tell about nil. After the statement, a path stays narrowed
+// if every branch that doesn't jump away leaves it narrowed.
+func checkIf(node *ast.Node) {
+	var ends []map[string]bool
+	falses := narrowed
+	for i := 0; i+1 < len(node.Children); i += 2 {
+		narrowed = falses
+		checkCondition(node, &node.Children[i])
+		falses = narrowed // Less what calls in the condition could change.
+		whenTrue, whenFalse := narrowing(&node.Children[i])
+		narrowed = with(falses, whenTrue)
+		typecheck(&node.Children[i+1])
+		if !jumps(&node.Children[i+1]) {
+			ends = append(ends, narrowed)
+		}
+		falses = with(falses, whenFalse)
+	}
+	if len(node.Children)%2 == 1 { // Else block.
+		narrowed = falses
+		typecheck(&node.Children[len(node.Children)-1])
+		if !jumps(&node.Children[len(node.Children)-1]) {
+			ends = append(ends, narrowed)
+		}
+	} else {
+		ends = append(ends, falses)
+	}
+	if len(ends) == 0 { // Every branch jumps away, so nothing after is reachable.
+		ends = append(ends, falses)
+	}
+	narrowed = intersect(ends)
+}
+
+// Loops can run again after an assignment, so paths assigned in the body aren't narrowed at its start unless
+// the condition narrows them.
+func checkWhile(node *ast.Node) {
+	body := &node.Children[1]
+	forgetAssigned(body)
+	checkCondition(node, &node.Children[0])
+	whenTrue, whenFalse := narrowing(&node.Children[0])
+	before := narrowed
+	narrowed = with(before, whenTrue)
+	typecheck(body)
+	narrowed = before
+	if !breaks(body) {
+		narrowed = with(before, whenFalse)
+	}
+}
+
+// Forget what a loop body could change before it runs again: the paths and members it assigns, and every member
+// if it calls anything.
+func forgetAssigned(node *ast.Node) {
+	if node.Type == ast.VARASSIGN {
+		for i := 0; i+1 < len(node.Children); i++ {
+			if left := unwrap(&node.Children[i]); left.Type == ast.DOTOP {
+				narrowed = withoutMember(narrowed, left.Children[1].TokenStart.Literal)
+			}
+			if p := path(&node.Children[i]); p != "" {
+				narrowed = without(narrowed, p)
+			}
+		}
+	} else if node.Type == ast.FUNCCALL {
+		narrowed = locals(narrowed)
+	}
+	for i := range node.Children {
+		forgetAssigned(&node.Children[i])
+	}
+}
+
+// Whether a block always ends with return, break or continue.
+func jumps(block *ast.Node) bool {
+	return len(block.Children) > 0 && block.Children[len(block.Children)-1].Type == ast.JUMPSTATEMENT
+}
+
+// Whether a loop body contains a break for the loop.
+func breaks(node *ast.Node) bool {
+	for i := range node.Children {
+		child := &node.Children[i]
+		if child.Type == ast.JUMPSTATEMENT && child.TokenStart.Literal == "break" {
+			return true
+		} else if child.Type != ast.WHILESTATEMENT && child.Type != ast.FORSTATEMENT && breaks(child) {
+			return true
+		}
+	}
+	return false
+}
@@ -18,6 +18,8 @@ type primitives struct {
 	typeF32          *typeObj
 	typeF64          *typeObj
 	typeSTRING       *typeObj
+	typeRUNE         *typeObj
+	typeBYTE         *typeObj
 	typeNIL          *typeObj
 	typeLIST         *typeObj
 	typeMAP          *typeObj
@@ -42,11 +44,13 @@ func (p *primitives) Init() {
 	p.typeF32 = createTypeObj("f32", false, true, false, true, false, false, false, false, false, false, false)
 	p.typeF64 = createTypeObj("f64", false, true, false, true, false, false, false, false, false, false, false)
 	p.typeSTRING = createTypeObj("string", false, false, false, true, false, false, false, false, false, false, false)
+	p.typeRUNE = createTypeObj("rune", false, false, false, true, false, false, false, false, false, false, false)
+	p.typeBYTE = createTypeObj("byte", false, false, false, true, false, false, false, false, false, false, false)
 	p.typeNIL = createTypeObj("nil", true, false, false, true, false, false, false, false, false, false, false)
 }
 
 func (p *primitives) IsPrimitiveType(text string) bool {
-	return text == "bool" || text == "string" || text == "int" || text == "float" || text == "i8" || text == "i16" || text == "i32" || text == "i64" || text == "u8" || text == "u16" || text == "u32" || text == "u64" || text == "f32" || text == "f64"
+	return text == "bool" || text == "string" || text == "int" || text == "float" || text == "i8" || text == "i16" || text == "i32" || text == "i64" || text == "u8" || text == "u16" || text == "u32" || text == "u64" || text == "f32" || text == "f64" || text == "rune" || text == "byte"
 }
 
 func (p *primitives) IsNumberType(text string) bool {
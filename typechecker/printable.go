@@ -0,0 +1,57 @@
+package typechecker
+
+import (
+	"knox/ast"
+)
+
+// Parameter type of the builtins that print, which take primitives, lists and maps of printable values, and
+// objects whose class declares toString() string. Lowering to IR turns the value into a string at each
+// call, so only builtins can declare printable, @variadic and @template parameters.
+const printable = "printable"
+
+// Whether the declarations being checked are from builtin/*.knox.
+var inBuiltin bool
+
+func checkPrintable(node *ast.Node, t *typeObj) {
+	switch {
+	case t.fullName == "nil" || t.fullName == "void":
+		abortMsgf(located(node), "Can't print %s", t.fullName)
+	case t.isPrimitive:
+	case t.isList:
+		checkPrintable(node, &t.inner[0])
+	case t.isMap:
+		checkPrintable(node, &t.inner[0])
+		checkPrintable(node, &t.inner[1])
+	case t.isClass:
+		method := classMethod(t.name, "toString")
+		if method == nil {
+			abortMsgf(located(node), "%s can't be printed. Give it a toString() string method", t.name)
+		}
+		results := declType(method)
+		if len(method.Children[1].Children) != 0 || len(results.inner) != 1 || !compareTypes(&results.inner[0], prim.typeSTRING) {
+			abortMsgf(&method.Children[0], "%s.toString must take no arguments and return string", t.name)
+		}
+	default:
+		abortMsgf(located(node), "Can't print %s", t.fullName)
+	}
+}
+
+// A template is a string literal with a % for each value, and %% for a percent sign.
+func checkTemplate(node *ast.Node, values int) {
+	template := unwrap(node)
+	if template.Type != ast.STRING {
+		abortMsg(located(node), "The template must be a string literal")
+	}
+	if holes := len(ast.SplitTemplate(template.TokenStart.Literal)) - 1; holes != values {
+		abortMsgf(template, "The template has %d placeholders but %d values", holes, values)
+	}
+}
+
+func checkBuiltinParams(decl *ast.Node) {
+	for i := range decl.Children[1].Children {
+		param := &decl.Children[1].Children[i]
+		if getName(&param.Children[1]) == printable || param.HasAnnotation("variadic") || param.HasAnnotation("template") {
+			abortMsg(&param.Children[0], "Only builtins can declare printable, @variadic and @template parameters")
+		}
+	}
+}
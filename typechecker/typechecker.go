@@ -5,16 +5,25 @@ import (
 	"knox/ast"
 	"knox/lexer"
 	"knox/token"
+	"math/big"
+	"strings"
 )
 
 var prim primitives // Object holding the primitive types.
 
 var currentFunc *ast.Node  // Keep track of current function to compare return type.
 var currentClass *ast.Node // Keep track of current class to check self type.
+var multiValue *ast.Node   // Call whose results are all assigned by a multiple assignment or declaration.
+var program *ast.Node      // Root of the AST, for looking up classes from nodes without a symbol table.
 
 // Analyze performs type checking on the entire AST.
+// The state of an earlier run is cleared, since a language server runs it again after it aborts.
 func Analyze(node *ast.Node) {
 	prim.Init()
+	program = node
+	currentFunc, currentClass, multiValue, negatedLiteral = nil, nil, nil, nil
+	narrowed = map[string]bool{}
+	inBuiltin = false
 	typecheck(node)
 }
 
@@ -23,32 +32,33 @@ func Analyze(node *ast.Node) {
 func typecheck(node *ast.Node) {
 	for _, child := range node.Children {
 		if child.Type == ast.EXPRESSION {
+			if node.Type == ast.VARDECL && len(node.Children) > 3 {
+				if node.TokenStart.Type == token.CONST {
+					abortMsg(node, "Constants must be declared one at a time")
+				}
+				checkMultiDecl(node)
+				continue
+			}
 			exprType := getType(&child.Children[0])
 			// TODO: Handle for, return
 			if node.Type == ast.VARDECL {
-				// TODO: Handle multiple assignment.
-
 				leftType := declType(node)
 
 				//fmt.Println("Left: " + leftType.fullName)
 				//fmt.Println("Right: " + exprType.fullName)
 
 				if !compareTypes(leftType, exprType) { // Do the types match?
-					abortMsgf(node, "Mismatched types: %s and %s", leftType.fullName, exprType.fullName)
+					mismatch(node, leftType, exprType)
+				}
+				checkMutable(&child.Children[0], leftType, exprType)
+				if node.TokenStart.Type == token.CONST {
+					checkConstant(node, leftType)
 				}
 				if leftType.isClass && !child.Symbols.IsDeclared(leftType.name) {
 					abortMsgf(node, "Undeclared type: %s", leftType.name)
 				}
-			} else if node.Type == ast.VARASSIGN {
-				// TODO: Fix member access bug.
-				//decl := child.Symbols.LookupSymbol(node.Children[0].Children[0].TokenStart.Literal)
-				//if decl == nil {
-				//	abortMsgf("Referencing undeclared variable: %s", node.Children[0].Children[0].TokenStart.Literal)
-				//}
-				//leftType := declType(decl)
-				leftType := getType(&node.Children[0])
-				if !compareTypes(leftType, exprType) { // Do the types match?
-					abortMsgf(node, "Mismatched types: %s and %s", leftType.fullName, exprType.fullName)
+				if exprType.fullName != "nil" && !exprType.isNullable {
+					narrowed = with(narrowed, []string{fmt.Sprintf("%p", node.Symbols.Entries[node.Children[0].TokenStart.Literal])})
 				}
 			} else if node.Type == ast.IFSTATEMENT || node.Type == ast.WHILESTATEMENT {
 				if !compareTypes(exprType, prim.typeBOOL) {
@@ -68,37 +78,57 @@ func typecheck(node *ast.Node) {
 			// 	}
 		} else if child.Type == ast.JUMPSTATEMENT {
 			if child.TokenStart.Literal == "return" {
-				// TODO: Support multiple return types.
-				returnType := buildTypeList(&child)
-				funcReturnType := buildReturnList(&currentFunc.Children[2])
-				if compareTypes(funcReturnType, prim.typeVOID) && returnType.fullName == "" { // Check for return; and void type.
-				} else if !compareTypes(&returnType.inner[0], &funcReturnType.inner[0]) {
-					// TODO: Comparing the inner[0] is correct for single return types, but won't work for multiple. Need to expand compareType to handle this. buildTypeList and buildReturnList should probably not use inner for single return types, which would solve literals and simple types, then set isMulti to true and expand compareTypes to handle recursively comparing inner for multi.
-					abortMsgf(node, "Incorrect return type: %v when expecting %v.", returnType.inner[0].fullName, funcReturnType.inner[0].fullName)
-				}
+				checkReturn(&child)
 			}
-		} else if node.Type == ast.FORSTATEMENT {
-			// TODO: Right should be a list. Left type should be right inner type.
-			// TODO: Is this working?
-			left := declType(&node.Children[0])
-			right := getType(&node.Children[1])
-			fmt.Println("Debugging...", right.fullName, right.isList, right.isClass, right.isPrimitive)
+		} else if child.Type == ast.FORSTATEMENT {
+			left := declType(&child.Children[0])
+			right := getType(&child.Children[1])
 			if !right.isList && !right.isMap {
-				abortMsg(node, "For loop requires a list or map")
+				abortMsg(&child, "For loop requires a list or map")
 			}
+			checkNotNil(&child.Children[1], right)
 			if !compareTypes(left, &right.inner[0]) {
-				abortMsg(node, "For loop element is incorrect type")
+				abortMsg(&child, "For loop element is incorrect type")
 			}
-
+			if !right.isMutable {
+				checkMutable(&child.Children[1], left, readOnly(&right.inner[0]))
+			}
+			forgetAssigned(&child.Children[2])
+			before := narrowed
+			typecheck(&child.Children[2])
+			narrowed = before
+		} else if child.Type == ast.IFSTATEMENT {
+			checkIf(&child)
+		} else if child.Type == ast.WHILESTATEMENT {
+			checkWhile(&child)
 		} else if child.Type == ast.FUNCDECL {
 			currentFunc = &child
+			narrowed = map[string]bool{}
+			if !inBuiltin {
+				checkBuiltinParams(&child)
+			}
 			typecheck(&child)
 		} else if child.Type == ast.CLASS {
 			currentClass = &child
 			typecheck(&child)
+		} else if child.Type == ast.PROGRAM { // Declarations from builtin/*.knox.
+			inBuiltin = true
+			typecheck(&child)
+			inBuiltin = false
+		} else if child.Type == ast.VARASSIGN {
+			checkAssign(&child)
 		} else if child.Type == ast.LEFTEXPR {
+			call := unwrap(&child.Children[0])
+			if call.Type == ast.FUNCCALL {
+				multiValue = call
+			}
 			only := getType(&child.Children[0])
-			if !compareTypes(only, prim.typeVOID) {
+			if call.Type == ast.FUNCCALL {
+				results := callResults(call)
+				if !compareTypes(&results.inner[0], prim.typeVOID) {
+					abortMsgf(call, "Unused results of %s: %s. Assign them to _ to throw them away", funcName(call), results.fullName)
+				}
+			} else if !compareTypes(only, prim.typeVOID) {
 				abortMsg(node, "Expression must be of void type, not "+only.fullName)
 			}
 		} else {
@@ -107,6 +137,124 @@ func typecheck(node *ast.Node) {
 	}
 }
 
+// Check an assignment. Multiple targets take the results of a call, and assigning to _ throws a value away.
+func checkAssign(node *ast.Node) {
+	targets := node.Children[:len(node.Children)-1]
+	value := &node.Children[len(node.Children)-1]
+	if ast.IsCompound(node) && ast.IsDiscard(&targets[0]) {
+		abortMsgf(node, "Can't use %s on _", node.TokenStart.Literal)
+	}
+
+	// A single target is evaluated before its value, and several targets after the call that gives their values.
+	before := narrowed
+	var types []typeObj
+	if len(targets) > 1 {
+		types = multiResults(value, len(targets))
+		before = narrowed
+	} else {
+		if ast.IsDiscard(&targets[0]) && unwrap(value).Type == ast.FUNCCALL {
+			multiValue = unwrap(value) // _ = f(); throws away every result.
+		}
+		only := getType(value)
+		if ast.IsDiscard(&targets[0]) && compareTypes(only, prim.typeVOID) {
+			abortMsg(unwrap(value), "Nothing to throw away, the value is void")
+		}
+		types = append(types, *only)
+	}
+
+	after := narrowed
+	for i := range targets {
+		if ast.IsDiscard(&targets[i]) {
+			continue
+		}
+		narrowed = before
+		checkWritable(&targets[i])
+		leftType := getType(&targets[i])
+		if narrowed[path(&targets[i])] { // The target can be assigned anything its declaration allows.
+			narrowed = without(narrowed, path(&targets[i]))
+			leftType = getType(&targets[i])
+		}
+		narrowed = after
+		if !compareTypes(leftType, &types[i]) { // Do the types match?
+			mismatch(node, leftType, &types[i])
+		}
+		checkMutable(value, leftType, &types[i])
+		assignPath(&targets[i], &types[i])
+		before, after = narrowed, narrowed
+	}
+}
+
+// Check that a return gives a value of the declared type for each result of the function, and none for void.
+func checkReturn(node *ast.Node) {
+	returnType := buildTypeList(node)
+	funcReturnType := buildReturnList(&currentFunc.Children[2])
+	name := currentFunc.Children[0].TokenStart.Literal
+	if compareTypes(funcReturnType, prim.typeVOID) && returnType.fullName == "" { // Check for return; and void type.
+		return
+	} else if len(returnType.inner) == 0 {
+		abortMsgf(node, "Missing return value: %s returns %s", name, funcReturnType.fullName)
+	} else if len(returnType.inner) != len(funcReturnType.inner) {
+		abortMsgf(node, "Wrong number of return values for %s: %d given, %s expected", name, len(returnType.inner), funcReturnType.fullName)
+	}
+	for i := range returnType.inner {
+		if !literalFits(&returnType.inner[i], &funcReturnType.inner[i]) {
+			mismatch(node, &funcReturnType.inner[i], &returnType.inner[i])
+		} else if !compareTypes(&funcReturnType.inner[i], &returnType.inner[i]) {
+			abortMsgf(node, "Incorrect return type: %v when expecting %v.", returnType.inner[i].fullName, funcReturnType.inner[i].fullName)
+		}
+		checkMutable(&node.Children[i], &funcReturnType.inner[i], &returnType.inner[i])
+	}
+}
+
+// Check a declaration of several variables from the results of a call.
+func checkMultiDecl(node *ast.Node) {
+	names := (len(node.Children) - 1) / 2
+	types := multiResults(&node.Children[len(node.Children)-1], names)
+	for i := 0; i < names; i++ {
+		leftType := buildTypeObj(&node.Children[2*i+1])
+		if !compareTypes(leftType, &types[i]) {
+			mismatch(node, leftType, &types[i])
+		}
+	}
+}
+
+// Result types of a call whose n results are all assigned.
+func multiResults(value *ast.Node, n int) []typeObj {
+	call := unwrap(value)
+	if call.Type != ast.FUNCCALL {
+		abortMsg(call, "Multiple assignment requires a function call")
+	}
+	multiValue = call
+	getType(value)
+	results := callResults(call)
+	if len(results.inner) != n {
+		abortMsgf(call, "Assigning %d results of %s to %d variables", len(results.inner), funcName(call), n)
+	}
+	return results.inner
+}
+
+// Return types of a call.
+func callResults(call *ast.Node) *typeObj {
+	return declType(lookUpDecl(call.Children[0]))
+}
+
+// Name of the function or method a call refers to.
+func funcName(call *ast.Node) string {
+	name := call.Children[0].TokenStart.Literal
+	if name == "" {
+		name = call.Children[0].Children[1].TokenStart.Literal
+	}
+	return name
+}
+
+// Skip over EXPRESSION wrappers.
+func unwrap(node *ast.Node) *ast.Node {
+	for node.Type == ast.EXPRESSION {
+		node = &node.Children[0]
+	}
+	return node
+}
+
 func abortMsg(node *ast.Node, msg string) {
 	fmt.Printf("Type error: %v. Line %v.\n", msg, node.TokenStart.Line)
 	panic("Aborted.\n")
@@ -123,15 +271,16 @@ func compareTypes(a *typeObj, b *typeObj) bool {
 	if a.isLiteral || b.isLiteral {
 		// Type inference for number literals.
 		if a.isNumber && b.isNumber {
-			// TODO: Range check the literal.
-			return true
+			return literalFits(a, b) && literalFits(b, a)
 		}
 	}
 
-	// TODO: Consider adding nil as a subtype of all reference types.
-	// Special case for comparing reference types to nil.
-	if (a.isClass || a.isContainer) && b.fullName == "nil" {
-		return true
+	// nil only fits nullable types, and any value fits the nullable form of its type.
+	if b.fullName == "nil" {
+		return a.isNullable || a.fullName == "nil"
+	}
+	if a.isNullable != b.isNullable {
+		return a.isNullable && compareTypes(nonNull(a), b)
 	}
 
 	// Recursively check container type.
@@ -140,8 +289,8 @@ func compareTypes(a *typeObj, b *typeObj) bool {
 			return false
 		}
 
-		for i := range a.inner {
-			if compareTypes(&a.inner[i], &b.inner[i]) == false {
+		for i := range a.inner { // Containers can be changed through either type, so nullability must match.
+			if compareTypes(&a.inner[i], &b.inner[i]) == false || a.inner[i].isNullable != b.inner[i].isNullable {
 				return false
 			}
 		}
@@ -159,6 +308,7 @@ func stringToType(s string) *typeObj {
 	primitive.name = s
 	primitive.isPrimitive = prim.IsPrimitiveType(s)
 	primitive.isNumber = prim.IsNumberType(s)
+	primitive.isMutable = true
 	return primitive
 }
 
@@ -179,19 +329,41 @@ func declType(node *ast.Node) *typeObj {
 	return nil
 }
 
+// Get the type of one name from a declaration, which can declare several variables.
+func nameType(node *ast.Node, name string) *typeObj {
+	if node.Type == ast.VARDECL {
+		for i := 0; i+1 < len(node.Children); i += 2 {
+			if node.Children[i].TokenStart.Literal == name {
+				return buildTypeObj(&node.Children[i+1])
+			}
+		}
+	}
+	return declType(node)
+}
+
 // Builds up a type obj recursively given a varType AST node.
 func buildTypeObj(node *ast.Node) *typeObj {
 	obj := &typeObj{}
 
-	if isSimple(node) {
+	if getName(node) == "?" {
+		obj = buildTypeObj(&node.Children[1])
+		if !obj.isClass && !obj.isContainer {
+			abortMsgf(&node.Children[0], "Only class and container types can be nil, not %s", obj.fullName)
+		}
+		obj.isNullable = true
+		obj.fullName += "?"
+		return obj
+	} else if isSimple(node) {
 		obj.isPrimitive = prim.IsPrimitiveType(getName(node))
 		obj.isNumber = prim.IsNumberType(getName(node))
 		obj.isClass = !obj.isPrimitive
+		obj.isMutable = true
 		obj.fullName = getName(node)
 		obj.name = obj.fullName
 		return obj
 	} else if isList(node) {
 		obj.isContainer = true
+		obj.isMutable = true
 		obj.isList = true
 		obj.inner = append(obj.inner, *buildTypeObj(&node.Children[1]))
 		obj.name = "["
@@ -199,7 +371,9 @@ func buildTypeObj(node *ast.Node) *typeObj {
 		return obj
 	} else { // Complex type
 		obj.isContainer = true
+		obj.isMutable = true
 		obj.name = getName(node)
+		obj.isMap = obj.name == "map"
 		obj.fullName = obj.name + "["
 		for i := 1; i < len(node.Children); i++ {
 			obj.inner = append(obj.inner, *buildTypeObj(&node.Children[i]))
@@ -258,27 +432,54 @@ func getName(node *ast.Node) string {
 }
 
 func checkFuncCall(node *ast.Node, declNode *ast.Node) {
-	name := node.Children[0].TokenStart.Literal
-	if name == "" {
-		name = node.Children[0].Children[1].TokenStart.Literal
-	}
+	name := funcName(node)
 
 	//declNode := node.Symbols.LookupSymbol(name)
 	if declNode == nil {
 		abortMsgf(node, "Calling undeclared function: %s", name)
 	}
 
-	// Check number of args to number of params.
-	if len(node.Children)-1 != len(declNode.Children[1].Children) {
+	// Check number of args to number of params. A @variadic parameter takes the rest of the arguments.
+	params := declNode.Children[1].Children
+	variadic := len(params) > 0 && params[len(params)-1].HasAnnotation("variadic")
+	if args := len(node.Children) - 1; variadic && args < len(params)-1 || !variadic && args != len(params) {
 		abortMsg(node, "Incorrect number of arguments.")
 	}
+	// The builtin list methods declare their element parameter x as int, so use the list's element type.
+	var elemType *typeObj
+	if callee := &node.Children[0]; callee.Type == ast.DOTOP {
+		if receiver := getType(&callee.Children[0]); receiver.isList {
+			elemType = &receiver.inner[0]
+		}
+	}
+
 	// Check types of args to types of params.
 	for i := 1; i < len(node.Children); i++ {
 		argType := getType(&node.Children[i])
-		expectedType := declType(&declNode.Children[1].Children[i-1])
-		if !compareTypes(argType, expectedType) {
-			abortMsgf(node, "Mismatched type in function argument.")
+		param := &params[len(params)-1]
+		if i <= len(params) {
+			param = &params[i-1]
 		}
+		if getName(&param.Children[1]) == printable {
+			checkPrintable(&node.Children[i], argType)
+			continue
+		} else if param.HasAnnotation("template") {
+			checkTemplate(&node.Children[i], len(node.Children)-len(params))
+		}
+		expectedType := declType(param)
+		if elemType != nil && param.Children[0].TokenStart.Literal == "x" {
+			expectedType = elemType
+		}
+		if isConstParam(param) {
+			expectedType = readOnly(expectedType)
+		}
+		if !compareTypes(expectedType, argType) {
+			if !literalFits(argType, expectedType) {
+				mismatch(node, expectedType, argType)
+			}
+			abortMsgf(node, "Mismatched type in function argument")
+		}
+		checkMutable(&node.Children[i], expectedType, argType)
 	}
 }
 
@@ -296,6 +497,7 @@ func lookUpDecl(node ast.Node) *ast.Node {
 	} else if node.Type == ast.DOTOP {
 		// TODO: Handle chain of dotops
 		left := getType(&node.Children[0])
+		checkNotNil(&node.Children[0], left)
 		var name string
 		if left.name == "[" { // Special case for builtin list functions
 			name = "list"
@@ -316,37 +518,63 @@ func lookUpDecl(node ast.Node) *ast.Node {
 	return nil // Can't happen?
 }
 
-// Get type from expression node.
+// Get type from expression node and record it in the AST for the code generators, which represent nullable
+// types like the types they wrap.
 func getType(node *ast.Node) *typeObj {
+	t := resolveType(node)
+	if t != nil {
+		node.ValueType = strings.ReplaceAll(t.fullName, "?", "")
+		node.TypeName = t.fullName
+	}
+	return t
+}
+
+func resolveType(node *ast.Node) *typeObj {
 	switch node.Type {
 	case ast.BINARYOP:
-		left := getType(&node.Children[0])
-		right := getType(&node.Children[1])
+		left := operandType(node, 0)
+		saved := narrowRight(node)
+		right := operandType(node, 1)
+		narrowed = saved
+		if calls(&node.Children[1]) {
+			narrowed = locals(narrowed)
+		}
 
-		if !compareTypes(left, right) { // All ops require left and right types be same.
-			abortMsgf(node, "Mismatched types: %s and %s", left.fullName, right.fullName)
+		// All ops require left and right types be same. Numbers of different types, like i32 and u64 or
+		// int and f64, must be cast explicitly. A literal takes the type of the other side if it fits.
+		if !compareTypes(left, right) && !compareTypes(right, left) {
+			if left.isNumber && right.isNumber && !left.isLiteral && !right.isLiteral {
+				abortMsgf(node, "Mismatched number types: %s and %s. Use as to convert one side", left.fullName, right.fullName)
+			}
+			mismatch(node, left, right)
 		}
-		if lexer.IsOperator([]rune(node.TokenStart.Literal)[0]) {
+		if bitwiseOps[node.TokenStart.Literal] {
+			return checkBitwise(node, left, right)
+		} else if lexer.IsOperator([]rune(node.TokenStart.Literal)[0]) {
 			//if compareTypes(left, prim.typeINT) || compareTypes(left, prim.typeFLOAT) { // Math ops work on numbers.
 			if left.isNumber && right.isNumber {
-				// TODO: Will this coerce a INTLITERAL to an INT? x + 1 is not the same as 1 + x here.
+				if left.isLiteral && right.isLiteral {
+					return foldLiterals(node, left, right)
+				}
+				if left.isLiteral { // 1 + x has the type of x.
+					return right
+				}
 				return left
 			} else if node.TokenStart.Type == token.PLUS && compareTypes(left, prim.typeSTRING) {
 				// + works on strings.
 				// TODO: Need to properly augment the AST with concat info.
 				node.TokenStart.Literal = "concat"
 				return left
+			} else if isCharacter(left) {
+				abortMsgf(node, "Can't do arithmetic on %s. Convert it to an integer with as", left.fullName)
 			} else {
 				abortMsg(node, "Invalid operation.") // TODO: Improve this error message.
 			}
-		} else if node.TokenStart.Literal == ">=" || node.TokenStart.Literal == ">" || node.TokenStart.Literal == "<=" || node.TokenStart.Literal == "<" { // Comparison ops work on numbers, but return a bool.
-			if left.isNumber && right.isNumber {
-				//if compareTypes(left, prim.typeINT) || compareTypes(left, prim.typeFLOAT) {
-				return prim.typeBOOL
-			} else {
-				abortMsg(node, "Invalid operation.") // TODO: Improve this error message.
-			}
-		} else if node.TokenStart.Literal == "==" {
+		} else if node.TokenStart.Literal == ">=" || node.TokenStart.Literal == ">" || node.TokenStart.Literal == "<=" || node.TokenStart.Literal == "<" { // Comparison ops work on numbers and strings, but return a bool.
+			checkOrdering(node, left, right)
+			return prim.typeBOOL
+		} else if node.TokenStart.Literal == "==" || node.TokenStart.Literal == "!=" {
+			checkEquality(node, left, right)
 			return prim.typeBOOL
 		} else if node.TokenStart.Literal == "&&" || node.TokenStart.Literal == "||" {
 			if !compareTypes(left, prim.typeBOOL) {
@@ -357,8 +585,14 @@ func getType(node *ast.Node) *typeObj {
 		return left // Will this ever be reached?
 
 	case ast.UNARYOP:
+		if node.TokenStart.Type == token.MINUS {
+			negatedLiteral = unwrap(&node.Children[0])
+		}
 		single := getType(&node.Children[0])
-		if node.TokenStart.Type == token.BANG {
+		negatedLiteral = nil
+		if node.TokenStart.Type == token.TILDE {
+			return checkComplement(node, single)
+		} else if node.TokenStart.Type == token.BANG {
 			if !compareTypes(single, prim.typeBOOL) {
 				abortMsg(node, "Invalid operation.") // TODO: Improve this error message.
 			}
@@ -367,6 +601,11 @@ func getType(node *ast.Node) *typeObj {
 			if !single.isNumber {
 				abortMsg(node, "Invalid operation.") // TODO: Improve this error message.
 			}
+			if single.value != nil && node.TokenStart.Type == token.MINUS {
+				negated := *single
+				negated.value = new(big.Rat).Neg(single.value)
+				return &negated
+			}
 		} else if node.TokenStart.Type == token.NEW {
 			//if !compareTypes(single, typeBOOL) {
 			//	abortMsg("Invalid operation.")
@@ -380,14 +619,29 @@ func getType(node *ast.Node) *typeObj {
 		// If map, then right should be first inner type of left. Return second inner type of right.
 		left := getType(&node.Children[0])
 		right := getType(&node.Children[1])
+		checkNotNil(&node.Children[0], left)
 
 		if left.isList {
 			if !compareTypes(right, prim.typeINT) {
 				abortMsg(node, "List index must be int.")
 			}
+			if !left.isMutable {
+				return readOnly(&left.inner[0])
+			}
 			return &left.inner[0]
 		} else if left.isMap {
-			// TODO
+			if !compareTypes(&left.inner[0], right) {
+				abortMsgf(node, "Map key must be %s", left.inner[0].fullName)
+			}
+			if !left.isMutable {
+				return readOnly(&left.inner[1])
+			}
+			return &left.inner[1]
+		} else if compareTypes(left, prim.typeSTRING) { // The rune at an index, as a string.
+			if !compareTypes(right, prim.typeINT) {
+				abortMsg(node, "String index must be int.")
+			}
+			return prim.typeSTRING
 		} else {
 			abortMsg(node, "Invalid operation.") // TODO: Improve this error message.
 		}
@@ -396,6 +650,7 @@ func getType(node *ast.Node) *typeObj {
 	case ast.DOTOP:
 		// TODO: Handle chain of dotops
 		left := getType(&node.Children[0])
+		checkNotNil(&node.Children[0], left)
 		var name string
 		if left.name == "[" { // Special case for builtin list functions
 			name = "list"
@@ -412,15 +667,25 @@ func getType(node *ast.Node) *typeObj {
 		if memberDecl == nil {
 			abortMsgf(node, "Referencing undeclared member: %s", node.Children[1].TokenStart.Literal)
 		}
-		return declType(memberDecl)
+		member := narrowedType(node, nameType(memberDecl, node.Children[1].TokenStart.Literal))
+		if !left.isMutable && memberDecl.Type == ast.VARDECL {
+			return readOnly(member)
+		}
+		return member
 
 	case ast.VARREF:
 		name := node.Children[0].TokenStart.Literal
+		if name == "_" {
+			abortMsg(node, "_ can only be assigned to")
+		}
 		declNode := node.Symbols.LookupSymbol(name)
 		if declNode == nil {
 			abortMsgf(node, "Referencing undeclared variable: %s", name)
 		}
-		return declType(declNode)
+		if isConstParam(declNode) {
+			return readOnly(narrowedType(node, nameType(declNode, name)))
+		}
+		return narrowedType(node, nameType(declNode, name))
 
 	case ast.FUNCCALL:
 		//name := node.Children[0].TokenStart.Literal // TODO: Handle dot op.
@@ -428,8 +693,19 @@ func getType(node *ast.Node) *typeObj {
 		declNode := lookUpDecl(node.Children[0])
 
 		checkFuncCall(node, declNode)
-
-		return &declType(declNode).inner[0] // TODO: This will not work for multiple return...
+		checkReceiver(node)
+		narrowed = locals(narrowed)
+
+		// Only a multiple assignment or declaration can take every result.
+		results := declType(declNode)
+		if len(results.inner) > 1 && node != multiValue {
+			var dropped []string
+			for _, t := range results.inner[1:] {
+				dropped = append(dropped, t.fullName)
+			}
+			abortMsgf(node, "Only the first result of %s is used, dropping %s", funcName(node), strings.Join(dropped, ","))
+		}
+		return &results.inner[0]
 
 	case ast.CAST:
 		// Check that left and right are both primitive.
@@ -441,25 +717,35 @@ func getType(node *ast.Node) *typeObj {
 		if !left.isPrimitive || !isRightPrimitive {
 			abortMsgf(node, "Illegal cast from %s to %s.", node.Children[0].TokenStart.Literal, node.Children[1].TokenStart.Literal)
 		}
+		checkCharacterCast(node, left, stringToType(typeLiteral))
+		checkLiteralCast(node, left, typeLiteral)
 
 		return stringToType(typeLiteral)
 
 	case ast.NEW:
-		return buildTypeObj(&node.Children[0])
+		t := buildTypeObj(&node.Children[0])
+		if t.isNullable {
+			abortMsg(&node.Children[0].Children[0], "New objects can't be nil, so new takes a type without ?")
+		}
+		return t
 
 	case ast.LIST:
 		obj := &typeObj{}
 		obj.isContainer = true
 		obj.isList = true
+		obj.isMutable = true
 		obj.name = "["
 		obj.fullName = "["
 		itemType := ""
 		for i, item := range node.Children {
-			obj.inner = append(obj.inner, *getType(&item))
-			if obj.inner[i].fullName != itemType && itemType != "" { // Check if all items are same type.
+			t := getType(&item)
+			if t.fullName != itemType && itemType != "" { // Check if all items are same type.
 				abortMsg(node, "Mismatched types in list literal.")
 			}
-			itemType = obj.inner[i].fullName
+			if i == 0 {
+				obj.inner = append(obj.inner, *t)
+			}
+			itemType = t.fullName
 		}
 		// TODO: Handle if no items.
 		obj.fullName += itemType + "]"
@@ -467,12 +753,17 @@ func getType(node *ast.Node) *typeObj {
 
 	case ast.SELF:
 		return declType(currentClass)
-	case ast.INT:
-		return prim.typeINTLITERAL
-	case ast.FLOAT:
-		return prim.typeFLOATLITERAL
+	case ast.INT, ast.FLOAT:
+		return literalType(node)
 	case ast.STRING:
 		return prim.typeSTRING
+	case ast.CHAR:
+		return prim.typeRUNE
+	case ast.INTERPOLATION:
+		for i := 1; i < len(node.Children); i += 2 {
+			checkPrintable(&node.Children[i], getType(&node.Children[i]))
+		}
+		return prim.typeSTRING
 	case ast.BOOL:
 		return prim.typeBOOL
 	case ast.NIL:
@@ -1,10 +1,14 @@
 package typechecker
 
+import (
+	"math/big"
+)
+
 // Internal representation of a type.
 type typeObj struct {
 	fullName    string    // Name of this type (and all inner types)
 	name        string    // Name of this outer type
-	isMutable   bool      // Is this mutable or immutable TODO: Unused right now.
+	isMutable   bool      // Can a reference type be changed through this value, false when reached through a const parameter
 	isReference bool      // Is this a reference type (should be opposite of isPrimitive?)
 	isLiteral   bool      // Is is this a literal value
 	isNumber    bool      // Is this a number type (i32, f64, etc.)
@@ -17,7 +21,9 @@ type typeObj struct {
 	isClass     bool      // Is this a user-defined class
 	isEnum      bool      // Is this an enum
 	isTypedef   bool      // Is this a typedef
+	isNullable  bool      // Can this reference type be nil
 	inner       []typeObj // Inner types. TODO: Make this a slice of pointers of typeObj.
+	value       *big.Rat  // Value of a constant number literal expression, nil if unknown.
 }
 
 func createTypeObj(name string, literal bool, number bool, function bool, primitive bool, container bool, listt bool, mapt bool, multi bool, classt bool, enumt bool, typedeft bool) *typeObj {
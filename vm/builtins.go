@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"fmt"
+	"knox/bytecode"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Native implementation of a builtin function or method. Methods receive the receiver as args[0].
+type nativeFunc func(vm *VM, args []Value) ([]Value, error)
+
+// Natively implemented functions from builtin/stl.knox.
+var builtins = map[string]nativeFunc{
+	"stl.print": func(vm *VM, args []Value) ([]Value, error) {
+		fmt.Fprint(vm.out, Format(args[0]))
+		return nil, nil
+	},
+	"stl.println": func(vm *VM, args []Value) ([]Value, error) {
+		fmt.Fprintln(vm.out, Format(args[0]))
+		return nil, nil
+	},
+	"stl.eprint": func(vm *VM, args []Value) ([]Value, error) {
+		fmt.Fprint(os.Stderr, Format(args[0]))
+		return nil, nil
+	},
+	"rune.toString": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{string(rune(args[0].(int64)))}, nil
+	},
+	"stl.range": func(vm *VM, args []Value) ([]Value, error) {
+		start, end, step := args[0].(int64), args[1].(int64), args[2].(int64)
+		if step == 0 {
+			return nil, fmt.Errorf("range step must not be zero")
+		}
+		list := &List{}
+		for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+			list.Items = append(list.Items, i)
+		}
+		return []Value{list}, nil
+	},
+	"stl.random": func(vm *VM, args []Value) ([]Value, error) {
+		min, max := args[0].(int64), args[1].(int64)
+		if max < min {
+			return nil, fmt.Errorf("random range is empty")
+		}
+		return []Value{min + rand.Int63n(max-min+1)}, nil
+	},
+}
+
+// Natively implemented methods from builtin/list.knox.
+var listMethods = map[string]nativeFunc{
+	"append": func(vm *VM, args []Value) ([]Value, error) {
+		list := args[0].(*List)
+		list.Items = append(list.Items, args[1])
+		return nil, nil
+	},
+	"insert": func(vm *VM, args []Value) ([]Value, error) {
+		list := args[0].(*List)
+		i, ok := args[1].(int64)
+		if !ok || i < 0 || i > int64(len(list.Items)) {
+			return nil, fmt.Errorf("insert index %s out of range for list of length %d", Format(args[1]), len(list.Items))
+		}
+		list.Items = append(list.Items, nil)
+		copy(list.Items[i+1:], list.Items[i:])
+		list.Items[i] = args[2]
+		return nil, nil
+	},
+	"length": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{int64(len(args[0].(*List).Items))}, nil
+	},
+	"sort": func(vm *VM, args []Value) ([]Value, error) {
+		list := args[0].(*List)
+		var err error
+		sort.SliceStable(list.Items, func(i, j int) bool {
+			less, cerr := compare(bytecode.LT, list.Items[i], list.Items[j], "")
+			if cerr != nil {
+				err = cerr
+			}
+			return less
+		})
+		return nil, err
+	},
+	"reverse": func(vm *VM, args []Value) ([]Value, error) {
+		items := args[0].(*List).Items
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+		return nil, nil
+	},
+	"remove": func(vm *VM, args []Value) ([]Value, error) {
+		list := args[0].(*List)
+		i, ok := args[1].(int64)
+		if !ok || i < 0 || i >= int64(len(list.Items)) {
+			return []Value{false}, nil
+		}
+		list.Items = append(list.Items[:i], list.Items[i+1:]...)
+		return []Value{true}, nil
+	},
+	"contains": func(vm *VM, args []Value) ([]Value, error) {
+		for _, item := range args[0].(*List).Items {
+			if equal(item, args[1]) {
+				return []Value{true}, nil
+			}
+		}
+		return []Value{false}, nil
+	},
+	"range": func(vm *VM, args []Value) ([]Value, error) {
+		list := args[0].(*List)
+		pos, posOk := args[1].(int64)
+		length, lenOk := args[2].(int64)
+		if !posOk || !lenOk || pos < 0 || length < 0 || pos+length > int64(len(list.Items)) {
+			return nil, fmt.Errorf("range %s:%s out of range for list of length %d", Format(args[1]), Format(args[2]), len(list.Items))
+		}
+		return []Value{&List{Items: append([]Value(nil), list.Items[pos:pos+length]...)}}, nil
+	},
+}
+
+// Natively implemented map methods.
+var mapMethods = map[string]nativeFunc{
+	"length": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{int64(len(args[0].(*Map).Keys))}, nil
+	},
+	"contains": func(vm *VM, args []Value) ([]Value, error) {
+		_, ok := args[0].(*Map).Items[args[1]]
+		return []Value{ok}, nil
+	},
+	"remove": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{args[0].(*Map).Delete(args[1])}, nil
+	},
+}
+
+// Natively implemented methods from builtin/string.knox, plus at for indexing. Positions count runes.
+var stringMethods = map[string]nativeFunc{
+	"length": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{int64(utf8.RuneCountInString(args[0].(string)))}, nil
+	},
+	"at": func(vm *VM, args []Value) ([]Value, error) {
+		runes := []rune(args[0].(string))
+		i := args[1].(int64)
+		if i < 0 || i >= int64(len(runes)) {
+			return nil, fmt.Errorf("index %d out of range for string of length %d", i, len(runes))
+		}
+		return []Value{string(runes[i])}, nil
+	},
+	"slice": func(vm *VM, args []Value) ([]Value, error) {
+		runes := []rune(args[0].(string))
+		start, end := args[1].(int64), args[2].(int64)
+		if start < 0 || start > end || end > int64(len(runes)) {
+			return nil, fmt.Errorf("slice %d:%d out of range for string of length %d", start, end, len(runes))
+		}
+		return []Value{string(runes[start:end])}, nil
+	},
+	"find": func(vm *VM, args []Value) ([]Value, error) {
+		s := args[0].(string)
+		i := strings.Index(s, args[1].(string))
+		if i < 0 {
+			return []Value{int64(-1)}, nil
+		}
+		return []Value{int64(utf8.RuneCountInString(s[:i]))}, nil
+	},
+	"split": func(vm *VM, args []Value) ([]Value, error) {
+		list := &List{}
+		for _, part := range strings.Split(args[0].(string), args[1].(string)) {
+			list.Items = append(list.Items, part)
+		}
+		return []Value{list}, nil
+	},
+	"join": func(vm *VM, args []Value) ([]Value, error) {
+		var parts []string
+		for _, part := range args[1].(*List).Items {
+			parts = append(parts, part.(string))
+		}
+		return []Value{strings.Join(parts, args[0].(string))}, nil
+	},
+	"trim": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{strings.Trim(args[0].(string), " \t\n\r")}, nil
+	},
+	"replace": func(vm *VM, args []Value) ([]Value, error) {
+		s, old := args[0].(string), args[1].(string)
+		if old == "" {
+			return []Value{s}, nil
+		}
+		return []Value{strings.ReplaceAll(s, old, args[2].(string))}, nil
+	},
+	"toUpper": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{mapASCII(args[0].(string), 'a', 'z', 'A'-'a')}, nil
+	},
+	"toLower": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{mapASCII(args[0].(string), 'A', 'Z', 'a'-'A')}, nil
+	},
+	"quote": func(vm *VM, args []Value) ([]Value, error) {
+		return []Value{quoteString(args[0].(string))}, nil
+	},
+}
+
+// Shift the ASCII letters from first to last, leaving other characters alone.
+func mapASCII(s string, first byte, last byte, shift int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= first && c <= last {
+			b[i] = byte(int(c) + shift)
+		}
+	}
+	return string(b)
+}
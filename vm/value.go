@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"fmt"
+	"knox/bytecode"
+	"strconv"
+	"strings"
+)
+
+// Value is an int64, float64, bool, string, nil, *Object, *List or *Map.
+type Value interface{}
+
+// Object is an instance of a Knox class.
+type Object struct {
+	Class  *bytecode.Class
+	Fields []Value
+}
+
+// List is a growable Knox list. Lists are reference types.
+type List struct {
+	Items []Value
+}
+
+// Map is a Knox map that remembers insertion order.
+type Map struct {
+	Items map[Value]Value
+	Keys  []Value
+}
+
+// NewMap creates an empty map.
+func NewMap() *Map {
+	return &Map{Items: make(map[Value]Value)}
+}
+
+// Set adds or replaces a key.
+func (m *Map) Set(key Value, value Value) {
+	if _, ok := m.Items[key]; !ok {
+		m.Keys = append(m.Keys, key)
+	}
+	m.Items[key] = value
+}
+
+// Delete removes a key and reports whether it existed.
+func (m *Map) Delete(key Value) bool {
+	if _, ok := m.Items[key]; !ok {
+		return false
+	}
+	delete(m.Items, key)
+	for i, k := range m.Keys {
+		if k == key {
+			m.Keys = append(m.Keys[:i], m.Keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Format returns the printed form of a value.
+func Format(v Value) string {
+	switch value := v.(type) {
+	case nil:
+		return "nil"
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case string:
+		return value
+	case *Object:
+		return value.Class.Name
+	case *List:
+		items := make([]string, len(value.Items))
+		for i, item := range value.Items {
+			items[i] = quote(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case *Map:
+		items := make([]string, len(value.Keys))
+		for i, key := range value.Keys {
+			items[i] = quote(key) + ": " + quote(value.Items[key])
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return "?"
+}
+
+// Strings inside containers are quoted.
+func quote(v Value) string {
+	if s, ok := v.(string); ok {
+		return quoteString(s)
+	}
+	return Format(v)
+}
+
+// A string as a Knox literal. Braces are escaped so that they don't start an interpolation.
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\', '{', '}':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case 0:
+			sb.WriteString(`\0`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&sb, "\\u{%x}", r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func typeName(v Value) string {
+	switch value := v.(type) {
+	case nil:
+		return "nil"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case *Object:
+		return value.Class.Name
+	case *List:
+		return "list"
+	case *Map:
+		return "map"
+	}
+	return "unknown"
+}
@@ -0,0 +1,598 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"knox/bytecode"
+	"math"
+	"runtime"
+)
+
+const maxFrames = 10000
+
+// RuntimeError is an error raised while executing a program, located by Knox source line.
+type RuntimeError struct {
+	Message  string
+	Function string
+	Line     int
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("Runtime error: %s in %s. Line %d.", e.Message, e.Function, e.Line)
+}
+
+type frame struct {
+	fn   *bytecode.Function
+	ip   int
+	base int // Stack index of the first local.
+}
+
+// VM is a stack machine that executes a bytecode program.
+type VM struct {
+	prog   *bytecode.Program
+	stack  []Value
+	frames []frame
+	out    io.Writer
+}
+
+// New creates a VM that writes program output to out.
+func New(prog *bytecode.Program, out io.Writer) *VM {
+	return &VM{prog: prog, out: out}
+}
+
+// Run executes main until it returns or a runtime error occurs. Decode doesn't check the stack or the values
+// passed to builtins, so when a corrupt program makes the VM itself fail, that's reported as an error too.
+func (vm *VM) Run() (err error) {
+	vm.stack = vm.stack[:0]
+	vm.frames = vm.frames[:0]
+	fn, start := &vm.prog.Functions[vm.prog.Main], 0
+	defer func() {
+		if r := recover(); r != nil {
+			failure, ok := r.(runtime.Error)
+			if !ok {
+				panic(r)
+			}
+			err = &RuntimeError{Message: "invalid bytecode: " + failure.Error(), Function: fn.Name, Line: fn.LineAt(start)}
+		}
+	}()
+	vm.call(fn)
+
+	for len(vm.frames) > 0 {
+		f := &vm.frames[len(vm.frames)-1]
+		code := f.fn.Code
+		fn, start = f.fn, f.ip
+		op := bytecode.Opcode(code[f.ip])
+		var a, b int
+		switch bytecode.Width(op) {
+		case 5:
+			b = bytecode.ReadOperand(code, f.ip+3)
+			fallthrough
+		case 3:
+			a = bytecode.ReadOperand(code, f.ip+1)
+		}
+		f.ip += bytecode.Width(op)
+
+		if err := vm.step(op, a, b); err != nil {
+			return &RuntimeError{Message: err.Error(), Function: f.fn.Name, Line: f.fn.LineAt(start)}
+		}
+	}
+	return nil
+}
+
+func (vm *VM) step(op bytecode.Opcode, a int, b int) error {
+	f := &vm.frames[len(vm.frames)-1]
+	switch op {
+	case bytecode.CONST:
+		vm.push(vm.prog.Constants[a])
+	case bytecode.NIL:
+		vm.push(nil)
+	case bytecode.TRUE:
+		vm.push(true)
+	case bytecode.FALSE:
+		vm.push(false)
+	case bytecode.POP:
+		vm.pop()
+	case bytecode.LOAD:
+		vm.push(vm.stack[f.base+a])
+	case bytecode.STORE:
+		vm.stack[f.base+a] = vm.pop()
+
+	case bytecode.GETFIELD:
+		obj, index, err := vm.field(vm.pop(), a)
+		if err != nil {
+			return err
+		}
+		vm.push(obj.Fields[index])
+	case bytecode.SETFIELD:
+		value := vm.pop()
+		obj, index, err := vm.field(vm.pop(), a)
+		if err != nil {
+			return err
+		}
+		obj.Fields[index] = value
+
+	case bytecode.INDEX:
+		index := vm.pop()
+		value, err := getIndex(vm.pop(), index)
+		if err != nil {
+			return err
+		}
+		vm.push(value)
+	case bytecode.SETINDEX:
+		value := vm.pop()
+		index := vm.pop()
+		return setIndex(vm.pop(), index, value)
+
+	case bytecode.ADD, bytecode.SUB, bytecode.MUL, bytecode.DIV, bytecode.MOD:
+		right := vm.pop()
+		result, err := arithmetic(op, vm.pop(), right, vm.prog.Constants[a].(string))
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+	case bytecode.AND, bytecode.OR, bytecode.XOR, bytecode.SHL, bytecode.SHR:
+		right := vm.pop()
+		var t string
+		if op == bytecode.SHL || op == bytecode.SHR {
+			t = vm.prog.Constants[a].(string)
+		}
+		result, err := bitwise(op, vm.pop(), right, t)
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+	case bytecode.COMPL:
+		value, ok := vm.pop().(int64)
+		if !ok {
+			return fmt.Errorf("operand of ~ must be an integer")
+		}
+		result, err := cast(^value, vm.prog.Constants[a].(string))
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+	case bytecode.NEG:
+		switch value := vm.pop().(type) {
+		case int64:
+			result, err := wrap(-value, vm.prog.Constants[a].(string))
+			if err != nil {
+				return err
+			}
+			vm.push(result)
+		case float64:
+			vm.push(-value)
+		default:
+			return fmt.Errorf("cannot negate %s", typeName(value))
+		}
+	case bytecode.NOT:
+		value, ok := vm.pop().(bool)
+		if !ok {
+			return fmt.Errorf("operand of ! must be bool")
+		}
+		vm.push(!value)
+	case bytecode.CONCAT:
+		right := vm.pop()
+		left := vm.pop()
+		vm.push(Format(left) + Format(right))
+	case bytecode.EQ:
+		right := vm.pop()
+		vm.push(equal(vm.pop(), right))
+	case bytecode.NOTEQ:
+		right := vm.pop()
+		vm.push(!equal(vm.pop(), right))
+	case bytecode.LT, bytecode.LTEQ, bytecode.GT, bytecode.GTEQ:
+		right := vm.pop()
+		result, err := compare(op, vm.pop(), right, vm.prog.Constants[a].(string))
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+
+	case bytecode.JUMP:
+		f.ip = a
+	case bytecode.JUMPIFFALSE:
+		if cond, ok := vm.pop().(bool); ok && !cond {
+			f.ip = a
+		}
+
+	case bytecode.CALL:
+		return vm.call(&vm.prog.Functions[a])
+	case bytecode.INVOKE:
+		return vm.invoke(vm.prog.Constants[a].(string), b)
+	case bytecode.BUILTIN:
+		name := vm.prog.Constants[a].(string)
+		fn, ok := builtins[name]
+		if !ok {
+			return fmt.Errorf("unknown builtin %s", name)
+		}
+		return vm.native(fn, b)
+	case bytecode.RETURN:
+		results := append([]Value(nil), vm.stack[len(vm.stack)-a:]...)
+		vm.stack = append(vm.stack[:f.base], results...)
+		vm.frames = vm.frames[:len(vm.frames)-1]
+
+	case bytecode.NEW:
+		class := &vm.prog.Classes[a]
+		vm.push(&Object{Class: class, Fields: make([]Value, len(class.Fields))})
+	case bytecode.LIST:
+		items := append([]Value(nil), vm.stack[len(vm.stack)-a:]...)
+		vm.stack = vm.stack[:len(vm.stack)-a]
+		vm.push(&List{Items: items})
+	case bytecode.MAP:
+		vm.push(NewMap())
+	case bytecode.CAST:
+		value, err := cast(vm.pop(), vm.prog.Constants[a].(string))
+		if err != nil {
+			return err
+		}
+		vm.push(value)
+	case bytecode.ITER:
+		switch container := vm.pop().(type) {
+		case *List:
+			vm.push(&List{Items: append([]Value(nil), container.Items...)})
+		case *Map:
+			vm.push(&List{Items: append([]Value(nil), container.Keys...)})
+		case nil:
+			return fmt.Errorf("nil dereference in for loop")
+		default:
+			return fmt.Errorf("cannot iterate over %s", typeName(container))
+		}
+	default:
+		return fmt.Errorf("invalid opcode %d", op)
+	}
+	return nil
+}
+
+func (vm *VM) push(v Value) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *VM) pop() Value {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+// Enter a function whose arguments are on top of the stack.
+func (vm *VM) call(fn *bytecode.Function) error {
+	if len(vm.frames) == maxFrames {
+		return fmt.Errorf("stack overflow")
+	}
+	base := len(vm.stack) - fn.Params
+	for i := fn.Params; i < fn.Locals; i++ {
+		vm.push(nil)
+	}
+	vm.frames = append(vm.frames, frame{fn: fn, base: base})
+	return nil
+}
+
+func (vm *VM) invoke(name string, argc int) error {
+	receiver := vm.stack[len(vm.stack)-1-argc]
+	switch value := receiver.(type) {
+	case *Object:
+		index, ok := value.Class.Methods[name]
+		if !ok {
+			return fmt.Errorf("%s has no method %s", value.Class.Name, name)
+		}
+		return vm.call(&vm.prog.Functions[index])
+	case *List:
+		if fn, ok := listMethods[name]; ok {
+			return vm.native(fn, argc+1)
+		}
+	case *Map:
+		if fn, ok := mapMethods[name]; ok {
+			return vm.native(fn, argc+1)
+		}
+	case string:
+		if fn, ok := stringMethods[name]; ok {
+			return vm.native(fn, argc+1)
+		}
+	case nil:
+		return fmt.Errorf("nil dereference calling %s", name)
+	}
+	return fmt.Errorf("%s has no method %s", typeName(receiver), name)
+}
+
+// Call a native function on the top n stack values, which include the receiver for methods.
+func (vm *VM) native(fn nativeFunc, n int) error {
+	args := append([]Value(nil), vm.stack[len(vm.stack)-n:]...)
+	vm.stack = vm.stack[:len(vm.stack)-n]
+	results, err := fn(vm, args)
+	if err != nil {
+		return err
+	}
+	vm.stack = append(vm.stack, results...)
+	return nil
+}
+
+func (vm *VM) field(v Value, name int) (*Object, int, error) {
+	member := vm.prog.Constants[name].(string)
+	obj, ok := v.(*Object)
+	if !ok {
+		if v == nil {
+			return nil, 0, fmt.Errorf("nil dereference accessing %s", member)
+		}
+		return nil, 0, fmt.Errorf("%s has no member %s", typeName(v), member)
+	}
+	index := obj.Class.FieldIndex(member)
+	if index == -1 {
+		return nil, 0, fmt.Errorf("%s has no member %s", obj.Class.Name, member)
+	}
+	return obj, index, nil
+}
+
+func getIndex(container Value, index Value) (Value, error) {
+	switch c := container.(type) {
+	case *List:
+		i, err := listIndex(c, index)
+		if err != nil {
+			return nil, err
+		}
+		return c.Items[i], nil
+	case *Map:
+		value, ok := c.Items[index]
+		if !ok {
+			return nil, fmt.Errorf("key %s not found", quote(index))
+		}
+		return value, nil
+	case nil:
+		return nil, fmt.Errorf("nil dereference indexing")
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(container))
+}
+
+func setIndex(container Value, index Value, value Value) error {
+	switch c := container.(type) {
+	case *List:
+		i, err := listIndex(c, index)
+		if err != nil {
+			return err
+		}
+		c.Items[i] = value
+		return nil
+	case *Map:
+		c.Set(index, value)
+		return nil
+	case nil:
+		return fmt.Errorf("nil dereference indexing")
+	}
+	return fmt.Errorf("cannot index %s", typeName(container))
+}
+
+func listIndex(list *List, index Value) (int, error) {
+	i, ok := index.(int64)
+	if !ok {
+		return 0, fmt.Errorf("list index must be int")
+	}
+	if i < 0 || i >= int64(len(list.Items)) {
+		return 0, fmt.Errorf("index %d out of range for list of length %d", i, len(list.Items))
+	}
+	return int(i), nil
+}
+
+// Arithmetic in type t. Integers wrap to t like cast does, and unsigned ones divide as unsigned.
+func arithmetic(op bytecode.Opcode, left Value, right Value, t string) (Value, error) {
+	l, lok := left.(int64)
+	r, rok := right.(int64)
+	if lok && rok {
+		switch op {
+		case bytecode.ADD:
+			return wrap(l+r, t)
+		case bytecode.SUB:
+			return wrap(l-r, t)
+		case bytecode.MUL:
+			return wrap(l*r, t)
+		case bytecode.DIV:
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			} else if unsigned(t) {
+				return wrap(int64(uint64(l)/uint64(r)), t)
+			}
+			return wrap(l/r, t)
+		case bytecode.MOD:
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			} else if unsigned(t) {
+				return wrap(int64(uint64(l)%uint64(r)), t)
+			}
+			return wrap(l%r, t)
+		}
+	}
+
+	lf, lok := toFloat(left)
+	rf, rok := toFloat(right)
+	if !lok || !rok {
+		if ls, ok := left.(string); ok && op == bytecode.ADD {
+			if rs, ok := right.(string); ok {
+				return ls + rs, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid operands %s and %s for %s", typeName(left), typeName(right), op)
+	}
+	switch op {
+	case bytecode.ADD:
+		return lf + rf, nil
+	case bytecode.SUB:
+		return lf - rf, nil
+	case bytecode.MUL:
+		return lf * rf, nil
+	case bytecode.DIV:
+		return lf / rf, nil
+	case bytecode.MOD:
+		return math.Mod(lf, rf), nil
+	}
+	return nil, fmt.Errorf("invalid arithmetic")
+}
+
+// Bits of the integer types, since a shift count is taken modulo the width of its type.
+var intBits = map[string]uint{
+	"i8": 8, "u8": 8, "byte": 8, "i16": 16, "u16": 16,
+	"int": 32, "i32": 32, "u32": 32, "rune": 32, "i64": 64, "u64": 64,
+}
+
+// Narrow an integer result to its type. Values of other types, like strings added together, are left alone.
+func wrap(i int64, t string) (Value, error) {
+	if _, ok := intBits[t]; !ok {
+		return i, nil
+	}
+	return cast(i, t)
+}
+
+func unsigned(t string) bool {
+	_, ok := intBits[t]
+	return ok && (t[0] == 'u' || t == "byte")
+}
+
+// Bitwise operators and shifts. Shifts wrap to their type t like cast does, and shift unsigned values right
+// without keeping the sign.
+func bitwise(op bytecode.Opcode, left Value, right Value, t string) (Value, error) {
+	l, lok := left.(int64)
+	r, rok := right.(int64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("invalid operands %s and %s for %s", typeName(left), typeName(right), op)
+	}
+	switch op {
+	case bytecode.AND:
+		return l & r, nil
+	case bytecode.OR:
+		return l | r, nil
+	case bytecode.XOR:
+		return l ^ r, nil
+	}
+	bits, ok := intBits[t]
+	if !ok {
+		return nil, fmt.Errorf("cannot shift %s", t)
+	}
+	shift := uint64(r) & uint64(bits-1)
+	if op == bytecode.SHL {
+		return cast(l<<shift, t)
+	} else if unsigned(t) {
+		return int64(uint64(l) >> shift), nil
+	}
+	return l >> shift, nil
+}
+
+func toFloat(v Value) (float64, bool) {
+	switch value := v.(type) {
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+func equal(left Value, right Value) bool {
+	if l, ok := left.(int64); ok {
+		if r, ok := right.(float64); ok {
+			return float64(l) == r
+		}
+	} else if l, ok := left.(float64); ok {
+		if r, ok := right.(int64); ok {
+			return l == float64(r)
+		}
+	}
+	return left == right
+}
+
+// Compare values of type t, which decides if integers compare as unsigned.
+func compare(op bytecode.Opcode, left Value, right Value, t string) (bool, error) {
+	var cmp int
+	if l, ok := left.(int64); ok {
+		if r, ok := right.(int64); ok {
+			if unsigned(t) {
+				l, r = l^math.MinInt64, r^math.MinInt64 // Flipping the sign bits orders them like uint64.
+			}
+			cmp = compareInts(l, r)
+			return ordered(op, cmp), nil
+		}
+	}
+	if ls, ok := left.(string); ok {
+		if rs, ok := right.(string); ok {
+			if ls < rs {
+				cmp = -1
+			} else if ls > rs {
+				cmp = 1
+			}
+			return ordered(op, cmp), nil
+		}
+	}
+	lf, lok := toFloat(left)
+	rf, rok := toFloat(right)
+	if !lok || !rok {
+		return false, fmt.Errorf("cannot compare %s and %s", typeName(left), typeName(right))
+	}
+	if lf < rf {
+		cmp = -1
+	} else if lf > rf {
+		cmp = 1
+	} else if lf != rf { // NaN
+		return false, nil
+	}
+	return ordered(op, cmp), nil
+}
+
+func compareInts(l int64, r int64) int {
+	if l < r {
+		return -1
+	} else if l > r {
+		return 1
+	}
+	return 0
+}
+
+func ordered(op bytecode.Opcode, cmp int) bool {
+	switch op {
+	case bytecode.LT:
+		return cmp < 0
+	case bytecode.LTEQ:
+		return cmp <= 0
+	case bytecode.GT:
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// Convert between primitive types following C's rules for the emitted code.
+func cast(v Value, to string) (Value, error) {
+	var i int64
+	var f float64
+	switch value := v.(type) {
+	case int64:
+		i, f = value, float64(value)
+	case float64:
+		i, f = int64(value), value
+	case bool:
+		if value {
+			i, f = 1, 1
+		}
+	default:
+		return nil, fmt.Errorf("cannot cast %s to %s", typeName(v), to)
+	}
+
+	switch to {
+	case "int", "i32", "rune":
+		return int64(int32(i)), nil
+	case "i8":
+		return int64(int8(i)), nil
+	case "i16":
+		return int64(int16(i)), nil
+	case "i64", "u64":
+		return i, nil
+	case "u8", "byte":
+		return int64(uint8(i)), nil
+	case "u16":
+		return int64(uint16(i)), nil
+	case "u32":
+		return int64(uint32(i)), nil
+	case "float", "f32":
+		return float64(float32(f)), nil
+	case "f64":
+		return f, nil
+	case "bool":
+		return f != 0, nil
+	case "string":
+		return Format(v), nil
+	}
+	return nil, fmt.Errorf("cannot cast %s to %s", typeName(v), to)
+}
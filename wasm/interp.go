@@ -0,0 +1,711 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	pageSize  = 65536
+	maxPages  = 16384 // 1GB.
+	maxFrames = 10000
+)
+
+// Trap is a runtime error raised by the program, like a failed bounds check or an integer divide by zero.
+type Trap struct {
+	Message string
+}
+
+func (t *Trap) Error() string {
+	return "Runtime error: " + t.Message + "."
+}
+
+type label struct {
+	pc     int // Position of the loop, or of the end of a block.
+	height int
+	arity  int
+	loop   bool
+}
+
+type machine struct {
+	m       *Module
+	memory  []byte
+	globals []uint64
+	stack   []uint64
+	depth   int
+	out     io.Writer
+}
+
+// Run instantiates a validated module and calls main, with the Knox host functions writing to out.
+func Run(m *Module, out io.Writer) error {
+	vm := &machine{m: m, memory: make([]byte, m.MemoryPages*pageSize), out: out}
+	for _, g := range m.Globals {
+		vm.globals = append(vm.globals, g.Init)
+	}
+	for _, d := range m.Data {
+		copy(vm.memory[d.Offset:], d.Bytes)
+	}
+	_, err := vm.call(m.Exports["main"], nil)
+	return err
+}
+
+func trap(format string, args ...interface{}) error {
+	return &Trap{Message: fmt.Sprintf(format, args...)}
+}
+
+func (vm *machine) call(index int, args []uint64) ([]uint64, error) {
+	f := vm.m.Funcs[index]
+	if f.Import != "" {
+		return vm.host(f, args)
+	}
+	vm.depth++
+	defer func() { vm.depth-- }()
+	if vm.depth > maxFrames {
+		return nil, trap("call stack exhausted")
+	}
+
+	locals := make([]uint64, len(f.Params)+len(f.Locals))
+	copy(locals, args)
+	base := len(vm.stack)
+	var labels []label
+
+	for pc := 0; pc < len(f.Code); pc++ {
+		in := &f.Code[pc]
+		switch in.Op {
+		case "block":
+			labels = append(labels, label{pc: in.End, height: len(vm.stack), arity: len(in.Block)})
+		case "loop":
+			labels = append(labels, label{pc: pc, height: len(vm.stack), loop: true})
+		case "if":
+			cond := vm.pop()
+			labels = append(labels, label{pc: in.End, height: len(vm.stack), arity: len(in.Block)})
+			if uint32(cond) == 0 {
+				if in.Else != -1 {
+					pc = in.Else
+				} else {
+					pc = in.End
+					labels = labels[:len(labels)-1]
+				}
+			}
+		case "else": // The end of the then branch.
+			pc = labels[len(labels)-1].pc
+			labels = labels[:len(labels)-1]
+		case "end":
+			labels = labels[:len(labels)-1]
+		case "br", "br_if":
+			if in.Op == "br_if" && uint32(vm.pop()) == 0 {
+				continue
+			}
+			if in.Index == len(labels) { // Branch out of the function.
+				return vm.results(f, base), nil
+			}
+			target := labels[len(labels)-1-in.Index]
+			arity := target.arity
+			if target.loop {
+				arity = 0
+			}
+			copy(vm.stack[target.height:], vm.stack[len(vm.stack)-arity:])
+			vm.stack = vm.stack[:target.height+arity]
+			labels = labels[:len(labels)-1-in.Index]
+			if target.loop {
+				pc = target.pc - 1 // Run the loop instruction again.
+			} else {
+				pc = target.pc
+			}
+		case "return":
+			return vm.results(f, base), nil
+		case "unreachable":
+			return nil, trap("unreachable executed in %s", f.Name)
+		case "call":
+			callee := vm.m.Funcs[in.Index]
+			n := len(callee.Params)
+			args := append([]uint64(nil), vm.stack[len(vm.stack)-n:]...)
+			vm.stack = vm.stack[:len(vm.stack)-n]
+			results, err := vm.call(in.Index, args)
+			if err != nil {
+				return nil, err
+			}
+			vm.stack = append(vm.stack, results...)
+		case "drop":
+			vm.pop()
+		case "select":
+			cond := vm.pop()
+			b, a := vm.pop(), vm.pop()
+			if uint32(cond) != 0 {
+				vm.push(a)
+			} else {
+				vm.push(b)
+			}
+		case "local.get":
+			vm.push(locals[in.Index])
+		case "local.set":
+			locals[in.Index] = vm.pop()
+		case "local.tee":
+			locals[in.Index] = vm.stack[len(vm.stack)-1]
+		case "global.get":
+			vm.push(vm.globals[in.Index])
+		case "global.set":
+			vm.globals[in.Index] = vm.pop()
+		default:
+			if err := vm.numeric(in); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vm.results(f, base), nil
+}
+
+// Pop the results of a function, discarding anything else it left on the stack.
+func (vm *machine) results(f *Func, base int) []uint64 {
+	n := len(f.Results)
+	results := append([]uint64(nil), vm.stack[len(vm.stack)-n:]...)
+	vm.stack = vm.stack[:base]
+	return results
+}
+
+func (vm *machine) push(v uint64) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *machine) pop() uint64 {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+// Host functions imported by generated modules.
+func (vm *machine) host(f *Func, args []uint64) ([]uint64, error) {
+	switch f.Import {
+	case "env.print":
+		s, err := vm.read(uint32(args[0]))
+		if err != nil {
+			return nil, err
+		}
+		_, werr := vm.out.Write(s)
+		return nil, werr
+	case "env.eprint":
+		s, err := vm.read(uint32(args[0]))
+		if err != nil {
+			return nil, err
+		}
+		_, werr := os.Stderr.Write(s)
+		return nil, werr
+	case "env.random":
+		min, max := int32(args[0]), int32(args[1])
+		if max < min {
+			return nil, trap("random range is empty")
+		}
+		return []uint64{uint64(uint32(min + int32(rand.Int63n(int64(max)-int64(min)+1))))}, nil
+	case "env.index_error":
+		return nil, trap("index %d out of range for list of length %d. Line %d", int32(args[0]), int32(args[1]), int32(args[2]))
+	case "env.format_float": // Writes at most 32 bytes.
+		s := strconv.FormatFloat(f64(args[0]), 'g', -1, int(args[1]))
+		buffer, err := vm.bytes(uint32(args[2]), 0, uint32(len(s)))
+		if err != nil {
+			return nil, err
+		}
+		return []uint64{uint64(copy(buffer, s))}, nil
+	case "env.string_index_error":
+		return nil, trap("index %d out of range for string of length %d. Line %d", int32(args[0]), int32(args[1]), int32(args[2]))
+	case "env.slice_error":
+		return nil, trap("slice %d:%d out of range for string of length %d. Line %d", int32(args[0]), int32(args[1]), int32(args[2]), int32(args[3]))
+	}
+	return nil, trap("unknown import %s", f.Import)
+}
+
+// Read a length prefixed string from memory.
+func (vm *machine) read(addr uint32) ([]byte, error) {
+	header, err := vm.bytes(addr, 0, 4)
+	if err != nil {
+		return nil, err
+	}
+	return vm.bytes(addr, 4, binary.LittleEndian.Uint32(header))
+}
+
+// Bounds checked slice of memory.
+func (vm *machine) bytes(addr uint32, offset uint32, size uint32) ([]byte, error) {
+	start := uint64(addr) + uint64(offset)
+	if start+uint64(size) > uint64(len(vm.memory)) {
+		return nil, trap("memory access out of bounds")
+	}
+	return vm.memory[start : start+uint64(size)], nil
+}
+
+func f32(v uint64) float32 {
+	return math.Float32frombits(uint32(v))
+}
+
+func f64(v uint64) float64 {
+	return math.Float64frombits(v)
+}
+
+func fromF32(f float32) uint64 {
+	return uint64(math.Float32bits(f))
+}
+
+func fromF64(f float64) uint64 {
+	return math.Float64bits(f)
+}
+
+func fromBool(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Saturating float to integer conversion.
+func truncSat(f float64, min float64, max float64) float64 {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f < min:
+		return min
+	case f > max:
+		return max
+	}
+	return math.Trunc(f)
+}
+
+func (vm *machine) numeric(in *Instr) error {
+	switch in.Op {
+	case "i32.const", "i64.const", "f32.const", "f64.const":
+		vm.push(in.Value)
+		return nil
+	case "memory.size":
+		vm.push(uint64(len(vm.memory) / pageSize))
+		return nil
+	case "memory.grow":
+		delta := uint32(vm.pop())
+		old := len(vm.memory) / pageSize
+		if uint64(old)+uint64(delta) > maxPages {
+			vm.push(uint64(math.MaxUint32))
+			return nil
+		}
+		vm.memory = append(vm.memory, make([]byte, int(delta)*pageSize)...)
+		vm.push(uint64(old))
+		return nil
+	case "memory.copy", "memory.fill":
+		n, src, dst := uint32(vm.pop()), uint32(vm.pop()), uint32(vm.pop())
+		to, err := vm.bytes(dst, 0, n)
+		if err != nil {
+			return err
+		}
+		if in.Op == "memory.fill" {
+			for i := range to {
+				to[i] = byte(src)
+			}
+			return nil
+		}
+		from, err := vm.bytes(src, 0, n)
+		if err != nil {
+			return err
+		}
+		copy(to, from)
+		return nil
+	case "nop":
+		return nil
+	}
+
+	if _, ok := memorySizes[in.Op]; ok {
+		return vm.memoryOp(in)
+	}
+
+	if len(opTypes[in.Op].params) == 2 {
+		b := vm.pop()
+		a := vm.pop()
+		result, err := binop(in.Op, a, b)
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+		return nil
+	}
+	result, err := unop(in.Op, vm.pop())
+	if err != nil {
+		return err
+	}
+	vm.push(result)
+	return nil
+}
+
+var memorySizes = map[string]uint32{
+	"i32.load": 4, "i64.load": 8, "f32.load": 4, "f64.load": 8,
+	"i32.load8_s": 1, "i32.load8_u": 1, "i32.load16_s": 2, "i32.load16_u": 2,
+	"i64.load8_s": 1, "i64.load8_u": 1, "i64.load16_s": 2, "i64.load16_u": 2, "i64.load32_s": 4, "i64.load32_u": 4,
+	"i32.store": 4, "i64.store": 8, "f32.store": 4, "f64.store": 8,
+	"i32.store8": 1, "i32.store16": 2, "i64.store8": 1, "i64.store16": 2, "i64.store32": 4,
+}
+
+func (vm *machine) memoryOp(in *Instr) error {
+	size := memorySizes[in.Op]
+	var value uint64
+	store := len(opTypes[in.Op].results) == 0
+	if store {
+		value = vm.pop()
+	}
+	addr := uint32(vm.pop())
+	b, err := vm.bytes(addr, in.Offset, size)
+	if err != nil {
+		return err
+	}
+	if store {
+		for i := range b {
+			b[i] = byte(value >> (8 * i))
+		}
+		return nil
+	}
+	for i := int(size) - 1; i >= 0; i-- {
+		value = value<<8 | uint64(b[i])
+	}
+	switch in.Op {
+	case "i32.load8_s":
+		value = uint64(uint32(int32(int8(value))))
+	case "i32.load16_s":
+		value = uint64(uint32(int32(int16(value))))
+	case "i64.load8_s":
+		value = uint64(int64(int8(value)))
+	case "i64.load16_s":
+		value = uint64(int64(int16(value)))
+	case "i64.load32_s":
+		value = uint64(int64(int32(value)))
+	}
+	vm.push(value)
+	return nil
+}
+
+func binop(op string, a uint64, b uint64) (uint64, error) {
+	x, y := uint32(a), uint32(b)
+	switch op {
+	case "i32.add":
+		return uint64(x + y), nil
+	case "i32.sub":
+		return uint64(x - y), nil
+	case "i32.mul":
+		return uint64(x * y), nil
+	case "i32.div_s", "i32.rem_s":
+		if y == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == "i32.rem_s" {
+			if int32(y) == -1 {
+				return 0, nil
+			}
+			return uint64(uint32(int32(x) % int32(y))), nil
+		}
+		if int32(x) == math.MinInt32 && int32(y) == -1 {
+			return 0, trap("integer overflow")
+		}
+		return uint64(uint32(int32(x) / int32(y))), nil
+	case "i32.div_u", "i32.rem_u":
+		if y == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == "i32.rem_u" {
+			return uint64(x % y), nil
+		}
+		return uint64(x / y), nil
+	case "i32.and":
+		return uint64(x & y), nil
+	case "i32.or":
+		return uint64(x | y), nil
+	case "i32.xor":
+		return uint64(x ^ y), nil
+	case "i32.shl":
+		return uint64(x << (y & 31)), nil
+	case "i32.shr_s":
+		return uint64(uint32(int32(x) >> (y & 31))), nil
+	case "i32.shr_u":
+		return uint64(x >> (y & 31)), nil
+	case "i32.rotl":
+		return uint64(bits.RotateLeft32(x, int(y&31))), nil
+	case "i32.rotr":
+		return uint64(bits.RotateLeft32(x, -int(y&31))), nil
+	case "i32.eq":
+		return fromBool(x == y), nil
+	case "i32.ne":
+		return fromBool(x != y), nil
+	case "i32.lt_s":
+		return fromBool(int32(x) < int32(y)), nil
+	case "i32.lt_u":
+		return fromBool(x < y), nil
+	case "i32.gt_s":
+		return fromBool(int32(x) > int32(y)), nil
+	case "i32.gt_u":
+		return fromBool(x > y), nil
+	case "i32.le_s":
+		return fromBool(int32(x) <= int32(y)), nil
+	case "i32.le_u":
+		return fromBool(x <= y), nil
+	case "i32.ge_s":
+		return fromBool(int32(x) >= int32(y)), nil
+	case "i32.ge_u":
+		return fromBool(x >= y), nil
+
+	case "i64.add":
+		return a + b, nil
+	case "i64.sub":
+		return a - b, nil
+	case "i64.mul":
+		return a * b, nil
+	case "i64.div_s", "i64.rem_s":
+		if b == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == "i64.rem_s" {
+			if int64(b) == -1 {
+				return 0, nil
+			}
+			return uint64(int64(a) % int64(b)), nil
+		}
+		if int64(a) == math.MinInt64 && int64(b) == -1 {
+			return 0, trap("integer overflow")
+		}
+		return uint64(int64(a) / int64(b)), nil
+	case "i64.div_u", "i64.rem_u":
+		if b == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == "i64.rem_u" {
+			return a % b, nil
+		}
+		return a / b, nil
+	case "i64.and":
+		return a & b, nil
+	case "i64.or":
+		return a | b, nil
+	case "i64.xor":
+		return a ^ b, nil
+	case "i64.shl":
+		return a << (b & 63), nil
+	case "i64.shr_s":
+		return uint64(int64(a) >> (b & 63)), nil
+	case "i64.shr_u":
+		return a >> (b & 63), nil
+	case "i64.rotl":
+		return bits.RotateLeft64(a, int(b&63)), nil
+	case "i64.rotr":
+		return bits.RotateLeft64(a, -int(b&63)), nil
+	case "i64.eq":
+		return fromBool(a == b), nil
+	case "i64.ne":
+		return fromBool(a != b), nil
+	case "i64.lt_s":
+		return fromBool(int64(a) < int64(b)), nil
+	case "i64.lt_u":
+		return fromBool(a < b), nil
+	case "i64.gt_s":
+		return fromBool(int64(a) > int64(b)), nil
+	case "i64.gt_u":
+		return fromBool(a > b), nil
+	case "i64.le_s":
+		return fromBool(int64(a) <= int64(b)), nil
+	case "i64.le_u":
+		return fromBool(a <= b), nil
+	case "i64.ge_s":
+		return fromBool(int64(a) >= int64(b)), nil
+	case "i64.ge_u":
+		return fromBool(a >= b), nil
+
+	case "f32.add":
+		return fromF32(f32(a) + f32(b)), nil
+	case "f32.sub":
+		return fromF32(f32(a) - f32(b)), nil
+	case "f32.mul":
+		return fromF32(f32(a) * f32(b)), nil
+	case "f32.div":
+		return fromF32(f32(a) / f32(b)), nil
+	case "f32.min":
+		return fromF32(float32(math.Min(float64(f32(a)), float64(f32(b))))), nil
+	case "f32.max":
+		return fromF32(float32(math.Max(float64(f32(a)), float64(f32(b))))), nil
+	case "f32.copysign":
+		return fromF32(float32(math.Copysign(float64(f32(a)), float64(f32(b))))), nil
+	case "f32.eq":
+		return fromBool(f32(a) == f32(b)), nil
+	case "f32.ne":
+		return fromBool(f32(a) != f32(b)), nil
+	case "f32.lt":
+		return fromBool(f32(a) < f32(b)), nil
+	case "f32.gt":
+		return fromBool(f32(a) > f32(b)), nil
+	case "f32.le":
+		return fromBool(f32(a) <= f32(b)), nil
+	case "f32.ge":
+		return fromBool(f32(a) >= f32(b)), nil
+
+	case "f64.add":
+		return fromF64(f64(a) + f64(b)), nil
+	case "f64.sub":
+		return fromF64(f64(a) - f64(b)), nil
+	case "f64.mul":
+		return fromF64(f64(a) * f64(b)), nil
+	case "f64.div":
+		return fromF64(f64(a) / f64(b)), nil
+	case "f64.min":
+		return fromF64(math.Min(f64(a), f64(b))), nil
+	case "f64.max":
+		return fromF64(math.Max(f64(a), f64(b))), nil
+	case "f64.copysign":
+		return fromF64(math.Copysign(f64(a), f64(b))), nil
+	case "f64.eq":
+		return fromBool(f64(a) == f64(b)), nil
+	case "f64.ne":
+		return fromBool(f64(a) != f64(b)), nil
+	case "f64.lt":
+		return fromBool(f64(a) < f64(b)), nil
+	case "f64.gt":
+		return fromBool(f64(a) > f64(b)), nil
+	case "f64.le":
+		return fromBool(f64(a) <= f64(b)), nil
+	case "f64.ge":
+		return fromBool(f64(a) >= f64(b)), nil
+	}
+	return 0, trap("unsupported instruction %s", op)
+}
+
+func unop(op string, a uint64) (uint64, error) {
+	x := uint32(a)
+	switch op {
+	case "i32.eqz":
+		return fromBool(x == 0), nil
+	case "i64.eqz":
+		return fromBool(a == 0), nil
+	case "i32.clz":
+		return uint64(bits.LeadingZeros32(x)), nil
+	case "i32.ctz":
+		return uint64(bits.TrailingZeros32(x)), nil
+	case "i32.popcnt":
+		return uint64(bits.OnesCount32(x)), nil
+	case "i64.clz":
+		return uint64(bits.LeadingZeros64(a)), nil
+	case "i64.ctz":
+		return uint64(bits.TrailingZeros64(a)), nil
+	case "i64.popcnt":
+		return uint64(bits.OnesCount64(a)), nil
+	case "i32.extend8_s":
+		return uint64(uint32(int32(int8(x)))), nil
+	case "i32.extend16_s":
+		return uint64(uint32(int32(int16(x)))), nil
+	case "i64.extend8_s":
+		return uint64(int64(int8(a))), nil
+	case "i64.extend16_s":
+		return uint64(int64(int16(a))), nil
+	case "i64.extend32_s", "i64.extend_i32_s":
+		return uint64(int64(int32(a))), nil
+	case "i64.extend_i32_u":
+		return uint64(x), nil
+	case "i32.wrap_i64":
+		return uint64(x), nil
+
+	case "f32.neg":
+		return fromF32(-f32(a)), nil
+	case "f64.neg":
+		return fromF64(-f64(a)), nil
+	case "f32.abs":
+		return fromF32(float32(math.Abs(float64(f32(a))))), nil
+	case "f64.abs":
+		return fromF64(math.Abs(f64(a))), nil
+	case "f32.sqrt":
+		return fromF32(float32(math.Sqrt(float64(f32(a))))), nil
+	case "f64.sqrt":
+		return fromF64(math.Sqrt(f64(a))), nil
+	case "f32.ceil":
+		return fromF32(float32(math.Ceil(float64(f32(a))))), nil
+	case "f64.ceil":
+		return fromF64(math.Ceil(f64(a))), nil
+	case "f32.floor":
+		return fromF32(float32(math.Floor(float64(f32(a))))), nil
+	case "f64.floor":
+		return fromF64(math.Floor(f64(a))), nil
+	case "f32.trunc":
+		return fromF32(float32(math.Trunc(float64(f32(a))))), nil
+	case "f64.trunc":
+		return fromF64(math.Trunc(f64(a))), nil
+	case "f32.nearest":
+		return fromF32(float32(math.RoundToEven(float64(f32(a))))), nil
+	case "f64.nearest":
+		return fromF64(math.RoundToEven(f64(a))), nil
+
+	case "f32.demote_f64":
+		return fromF32(float32(f64(a))), nil
+	case "f64.promote_f32":
+		return fromF64(float64(f32(a))), nil
+	case "i32.reinterpret_f32", "f32.reinterpret_i32":
+		return uint64(x), nil
+	case "i64.reinterpret_f64", "f64.reinterpret_i64":
+		return a, nil
+	case "f32.convert_i32_s":
+		return fromF32(float32(int32(x))), nil
+	case "f32.convert_i32_u":
+		return fromF32(float32(x)), nil
+	case "f32.convert_i64_s":
+		return fromF32(float32(int64(a))), nil
+	case "f32.convert_i64_u":
+		return fromF32(float32(a)), nil
+	case "f64.convert_i32_s":
+		return fromF64(float64(int32(x))), nil
+	case "f64.convert_i32_u":
+		return fromF64(float64(x)), nil
+	case "f64.convert_i64_s":
+		return fromF64(float64(int64(a))), nil
+	case "f64.convert_i64_u":
+		return fromF64(float64(a)), nil
+	}
+	return truncate(op, a)
+}
+
+// Float to integer conversions, like i32.trunc_f64_s. The trapping forms fail on NaN and out of range values.
+func truncate(op string, a uint64) (uint64, error) {
+	limits := map[string][2]float64{
+		"i32_s": {math.MinInt32, math.MaxInt32},
+		"i32_u": {0, math.MaxUint32},
+		"i64_s": {math.MinInt64, math.MaxInt64},
+		"i64_u": {0, math.MaxUint64},
+	}
+	parts := strings.SplitN(op, ".", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "trunc_") || len(parts[1]) < 11 {
+		return 0, trap("unsupported instruction %s", op)
+	}
+	saturate := strings.HasPrefix(parts[1], "trunc_sat_")
+	suffix := parts[1][len(parts[1])-5:] // Like f32_s.
+	limit, ok := limits[parts[0]+suffix[3:]]
+	if !ok {
+		return 0, trap("unsupported instruction %s", op)
+	}
+
+	f := f64(a)
+	if suffix[:3] == "f32" {
+		f = float64(f32(a))
+	}
+	if saturate {
+		f = truncSat(f, limit[0], limit[1])
+	} else if math.IsNaN(f) || math.Trunc(f) < limit[0] || math.Trunc(f) > limit[1] {
+		return 0, trap("integer overflow")
+	} else {
+		f = math.Trunc(f)
+	}
+
+	switch parts[0] + suffix[3:] {
+	case "i32_s":
+		return uint64(uint32(int32(f))), nil
+	case "i32_u":
+		return uint64(uint32(f)), nil
+	case "i64_s":
+		if f >= math.MaxInt64 { // The limit rounds up to 2^63.
+			return math.MaxInt64, nil
+		}
+		return uint64(int64(f)), nil
+	}
+	if f >= math.MaxUint64 {
+		return math.MaxUint64, nil
+	}
+	return uint64(f), nil
+}
@@ -0,0 +1,556 @@
+package wasm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Module is a parsed WAT module. Only the subset of the text format that Generate emits is supported:
+// flat instructions, function imports, one memory, data segments, globals and exports.
+type Module struct {
+	Funcs       []*Func // Imports come first, as in the wasm index space.
+	Globals     []Global
+	MemoryPages int
+	Data        []Data
+	Exports     map[string]int // Exported function indices.
+}
+
+// Func is a function of the module. Imported functions have no code.
+type Func struct {
+	Name    string
+	Import  string // "module.name" for imported functions.
+	Params  []string
+	Results []string
+	Locals  []string // Declared locals, following the params.
+	Code    []Instr
+}
+
+// Instr is a single instruction with its immediates resolved.
+type Instr struct {
+	Op     string
+	Index  int      // Local, global or function index, or label depth.
+	Offset uint32   // Memory offset.
+	Value  uint64   // Bits of a constant.
+	Block  []string // Result types of a block.
+	Else   int      // Position of the matching else, or -1.
+	End    int      // Position of the matching end.
+}
+
+// Global is a global variable with a constant initializer.
+type Global struct {
+	Name    string
+	Type    string
+	Mutable bool
+	Init    uint64
+}
+
+// Data is a segment copied into memory when the module is instantiated.
+type Data struct {
+	Offset uint32
+	Bytes  []byte
+}
+
+type sexpr struct {
+	atom   string
+	quoted bool // The atom is a string literal.
+	list   []*sexpr
+	isList bool
+}
+
+func (s *sexpr) String() string {
+	if !s.isList {
+		return s.atom
+	}
+	var parts []string
+	for _, item := range s.list {
+		parts = append(parts, item.String())
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// Split WAT into atoms, strings and parentheses, skipping comments.
+func tokenize(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], ";;"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "(;"):
+			end := strings.Index(src[i:], ";)")
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated block comment")
+			}
+			i += end + 2
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, src[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\n\r()\";", rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func parseSexpr(tokens []string, pos *int) (*sexpr, error) {
+	if *pos >= len(tokens) {
+		return nil, fmt.Errorf("unexpected end of input")
+	}
+	token := tokens[*pos]
+	*pos++
+	switch {
+	case token == ")":
+		return nil, fmt.Errorf("unexpected )")
+	case token == "(":
+		s := &sexpr{isList: true}
+		for *pos < len(tokens) && tokens[*pos] != ")" {
+			item, err := parseSexpr(tokens, pos)
+			if err != nil {
+				return nil, err
+			}
+			s.list = append(s.list, item)
+		}
+		if *pos >= len(tokens) {
+			return nil, fmt.Errorf("missing )")
+		}
+		*pos++
+		return s, nil
+	case token[0] == '"':
+		value, err := unquote(token[1 : len(token)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &sexpr{atom: value, quoted: true}, nil
+	}
+	return &sexpr{atom: token}, nil
+}
+
+// Decode the escapes of a WAT string.
+func unquote(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", fmt.Errorf("invalid escape in string")
+		}
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case '\\', '"', '\'':
+			sb.WriteByte(s[i])
+		default:
+			if i+1 >= len(s) {
+				return "", fmt.Errorf("invalid escape in string")
+			}
+			b, err := strconv.ParseUint(s[i:i+2], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in string")
+			}
+			sb.WriteByte(byte(b))
+			i++
+		}
+	}
+	return sb.String(), nil
+}
+
+// Parse reads a WAT module.
+func Parse(src string) (*Module, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	root, err := parseSexpr(tokens, &pos)
+	if err != nil {
+		return nil, err
+	}
+	if pos != len(tokens) {
+		return nil, fmt.Errorf("unexpected tokens after module")
+	}
+	if !root.isList || len(root.list) == 0 || root.list[0].atom != "module" {
+		return nil, fmt.Errorf("expected module")
+	}
+
+	m := &Module{Exports: make(map[string]int)}
+	funcs := make(map[string]int)
+	globals := make(map[string]int)
+	var bodies []*sexpr
+
+	// Imports have to be numbered before the other functions.
+	for _, field := range root.list[1:] {
+		if head(field) == "import" {
+			if len(field.list) != 4 || head(field.list[3]) != "func" {
+				return nil, fmt.Errorf("only function imports are supported: %s", field)
+			}
+			f, _, err := signature(field.list[3])
+			if err != nil {
+				return nil, err
+			}
+			f.Import = field.list[1].atom + "." + field.list[2].atom
+			funcs[f.Name] = len(m.Funcs)
+			m.Funcs = append(m.Funcs, f)
+		}
+	}
+	for _, field := range root.list[1:] {
+		switch head(field) {
+		case "import":
+		case "func":
+			f, _, err := signature(field)
+			if err != nil {
+				return nil, err
+			}
+			funcs[f.Name] = len(m.Funcs)
+			m.Funcs = append(m.Funcs, f)
+			bodies = append(bodies, field)
+		case "memory":
+			if len(field.list) != 2 {
+				return nil, fmt.Errorf("unsupported memory: %s", field)
+			}
+			pages, err := strconv.Atoi(field.list[1].atom)
+			if err != nil {
+				return nil, fmt.Errorf("invalid memory size: %s", field)
+			}
+			m.MemoryPages = pages
+		case "global":
+			g, err := global(field)
+			if err != nil {
+				return nil, err
+			}
+			globals[g.Name] = len(m.Globals)
+			m.Globals = append(m.Globals, g)
+		case "data":
+			if len(field.list) < 2 || head(field.list[1]) != "i32.const" || len(field.list[1].list) != 2 {
+				return nil, fmt.Errorf("unsupported data segment: %s", field)
+			}
+			offset, err := constant("i32", field.list[1].list[1].atom)
+			if err != nil {
+				return nil, err
+			}
+			d := Data{Offset: uint32(offset)}
+			for _, s := range field.list[2:] {
+				if !s.quoted {
+					return nil, fmt.Errorf("expected string in data segment: %s", field)
+				}
+				d.Bytes = append(d.Bytes, s.atom...)
+			}
+			m.Data = append(m.Data, d)
+		case "export":
+			if len(field.list) != 3 || !field.list[1].quoted || !field.list[2].isList || len(field.list[2].list) != 2 {
+				return nil, fmt.Errorf("unsupported export: %s", field)
+			}
+			kind, name := head(field.list[2]), field.list[2].list[1].atom
+			if kind == "func" {
+				index, ok := resolve(funcs, name)
+				if !ok {
+					return nil, fmt.Errorf("exporting unknown function %s", name)
+				}
+				m.Exports[field.list[1].atom] = index
+			} else if kind != "memory" {
+				return nil, fmt.Errorf("unsupported export: %s", field)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported module field: %s", field)
+		}
+	}
+
+	// Bodies are parsed last so that calls can refer to any function.
+	i := 0
+	for _, f := range m.Funcs {
+		if f.Import != "" {
+			continue
+		}
+		if err := f.parseBody(bodies[i], funcs, globals); err != nil {
+			return nil, fmt.Errorf("in function %s: %v", f.Name, err)
+		}
+		i++
+	}
+	return m, nil
+}
+
+func head(s *sexpr) string {
+	if !s.isList || len(s.list) == 0 {
+		return ""
+	}
+	return s.list[0].atom
+}
+
+// Look up a $name or a numeric index.
+func resolve(names map[string]int, ref string) (int, bool) {
+	if strings.HasPrefix(ref, "$") {
+		index, ok := names[ref]
+		return index, ok
+	}
+	index, err := strconv.Atoi(ref)
+	return index, err == nil
+}
+
+func isValType(t string) bool {
+	return t == "i32" || t == "i64" || t == "f32" || t == "f64"
+}
+
+// Parse the name, params, results and locals of a func, returning the remaining body.
+func signature(s *sexpr) (*Func, []*sexpr, error) {
+	f := &Func{}
+	rest := s.list[1:]
+	if len(rest) > 0 && strings.HasPrefix(rest[0].atom, "$") {
+		f.Name = rest[0].atom
+		rest = rest[1:]
+	}
+	for len(rest) > 0 && rest[0].isList {
+		kind := head(rest[0])
+		if kind != "param" && kind != "result" && kind != "local" {
+			break
+		}
+		items := rest[0].list[1:]
+		if kind != "result" && len(items) == 2 && strings.HasPrefix(items[0].atom, "$") {
+			items = items[1:] // Names are only used to look up locals, which parseBody does from the source.
+		}
+		for _, item := range items {
+			if !isValType(item.atom) {
+				return nil, nil, fmt.Errorf("invalid %s type %s", kind, item)
+			}
+			switch kind {
+			case "param":
+				f.Params = append(f.Params, item.atom)
+			case "result":
+				f.Results = append(f.Results, item.atom)
+			case "local":
+				f.Locals = append(f.Locals, item.atom)
+			}
+		}
+		rest = rest[1:]
+	}
+	return f, rest, nil
+}
+
+// Names of the params and locals of a func in index order.
+func localNames(s []*sexpr) map[string]int {
+	names := make(map[string]int)
+	index := 0
+	for _, item := range s {
+		kind := head(item)
+		if kind != "param" && kind != "local" {
+			continue
+		}
+		if len(item.list) == 3 && strings.HasPrefix(item.list[1].atom, "$") {
+			names[item.list[1].atom] = index
+			index++
+		} else {
+			index += len(item.list) - 1
+		}
+	}
+	return names
+}
+
+func global(s *sexpr) (Global, error) {
+	g := Global{}
+	rest := s.list[1:]
+	if len(rest) > 0 && strings.HasPrefix(rest[0].atom, "$") {
+		g.Name = rest[0].atom
+		rest = rest[1:]
+	}
+	if len(rest) != 2 {
+		return g, fmt.Errorf("unsupported global: %s", s)
+	}
+	if head(rest[0]) == "mut" && len(rest[0].list) == 2 {
+		g.Mutable = true
+		g.Type = rest[0].list[1].atom
+	} else {
+		g.Type = rest[0].atom
+	}
+	if !isValType(g.Type) || head(rest[1]) != g.Type+".const" || len(rest[1].list) != 2 {
+		return g, fmt.Errorf("unsupported global: %s", s)
+	}
+	value, err := constant(g.Type, rest[1].list[1].atom)
+	g.Init = value
+	return g, err
+}
+
+// Parse a constant into the bits of its type.
+func constant(t string, literal string) (uint64, error) {
+	clean := strings.ReplaceAll(literal, "_", "")
+	switch t {
+	case "i32", "i64":
+		bits := 32
+		if t == "i64" {
+			bits = 64
+		}
+		if v, err := strconv.ParseInt(clean, 0, bits); err == nil {
+			if bits == 32 {
+				return uint64(uint32(v)), nil
+			}
+			return uint64(v), nil
+		}
+		v, err := strconv.ParseUint(clean, 0, bits)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s constant %s", t, literal)
+		}
+		return v, nil
+	case "f32", "f64":
+		v, err := strconv.ParseFloat(strings.Replace(clean, "inf", "Inf", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s constant %s", t, literal)
+		}
+		if t == "f32" {
+			return uint64(math.Float32bits(float32(v))), nil
+		}
+		return math.Float64bits(v), nil
+	}
+	return 0, fmt.Errorf("invalid constant type %s", t)
+}
+
+// Parse flat instructions, resolving names and matching blocks with their ends.
+func (f *Func) parseBody(s *sexpr, funcs map[string]int, globals map[string]int) error {
+	_, body, _ := signature(s)
+	locals := localNames(s.list)
+	var labels []string
+	var open []int
+	for i := 0; i < len(body); i++ {
+		if body[i].isList {
+			return fmt.Errorf("folded instructions aren't supported: %s", body[i])
+		}
+		in := Instr{Op: body[i].atom, Else: -1}
+		next := func() (string, bool) {
+			if i+1 < len(body) && !body[i+1].isList {
+				return body[i+1].atom, true
+			}
+			return "", false
+		}
+		switch op := in.Op; {
+		case op == "block" || op == "loop" || op == "if":
+			label := ""
+			if ref, ok := next(); ok && strings.HasPrefix(ref, "$") {
+				label = ref
+				i++
+			}
+			if i+1 < len(body) && head(body[i+1]) == "result" {
+				for _, t := range body[i+1].list[1:] {
+					if !isValType(t.atom) {
+						return fmt.Errorf("invalid result type %s", t)
+					}
+					in.Block = append(in.Block, t.atom)
+				}
+				i++
+			}
+			labels = append(labels, label)
+			open = append(open, len(f.Code))
+		case op == "else" || op == "end":
+			if ref, ok := next(); ok && strings.HasPrefix(ref, "$") {
+				i++
+			}
+			if len(open) == 0 {
+				return fmt.Errorf("%s without block", op)
+			}
+			start := &f.Code[open[len(open)-1]]
+			if op == "else" {
+				if start.Op != "if" || start.Else != -1 {
+					return fmt.Errorf("else without if")
+				}
+				start.Else = len(f.Code)
+			} else {
+				start.End = len(f.Code)
+				labels = labels[:len(labels)-1]
+				open = open[:len(open)-1]
+			}
+		case op == "br" || op == "br_if":
+			ref, ok := next()
+			if !ok {
+				return fmt.Errorf("%s requires a label", op)
+			}
+			i++
+			in.Index = -1
+			for depth := 0; depth < len(labels) && in.Index == -1; depth++ {
+				if labels[len(labels)-1-depth] == ref {
+					in.Index = depth
+				}
+			}
+			if in.Index == -1 {
+				depth, err := strconv.Atoi(ref)
+				if err != nil || depth < 0 || depth > len(labels) {
+					return fmt.Errorf("unknown label %s", ref)
+				}
+				in.Index = depth
+			}
+		case op == "call" || strings.HasPrefix(op, "local.") || strings.HasPrefix(op, "global."):
+			ref, ok := next()
+			if !ok {
+				return fmt.Errorf("%s requires an index", op)
+			}
+			i++
+			names := locals
+			if op == "call" {
+				names = funcs
+			} else if strings.HasPrefix(op, "global.") {
+				names = globals
+			}
+			index, ok := resolve(names, ref)
+			if !ok {
+				return fmt.Errorf("unknown reference %s", ref)
+			}
+			in.Index = index
+		case strings.HasSuffix(op, ".const"):
+			ref, ok := next()
+			if !ok {
+				return fmt.Errorf("%s requires a value", op)
+			}
+			i++
+			value, err := constant(strings.TrimSuffix(op, ".const"), ref)
+			if err != nil {
+				return err
+			}
+			in.Value = value
+		case strings.Contains(op, ".load") || strings.Contains(op, ".store"):
+			for {
+				ref, ok := next()
+				if !ok || !(strings.HasPrefix(ref, "offset=") || strings.HasPrefix(ref, "align=")) {
+					break
+				}
+				i++
+				if strings.HasPrefix(ref, "offset=") {
+					offset, err := strconv.ParseUint(strings.TrimPrefix(ref, "offset="), 0, 32)
+					if err != nil {
+						return fmt.Errorf("invalid offset %s", ref)
+					}
+					in.Offset = uint32(offset)
+				}
+			}
+		}
+		f.Code = append(f.Code, in)
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("block without end")
+	}
+	return nil
+}
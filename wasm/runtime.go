@@ -0,0 +1,1334 @@
+package wasm
+
+// Host functions, provided by Run or by whatever embeds the module.
+const imports = `  (import "env" "print" (func $print (param i32)))
+  (import "env" "eprint" (func $eprint (param i32)))
+  (import "env" "random" (func $random (param i32 i32) (result i32)))
+  (import "env" "index_error" (func $index_error (param i32 i32 i32)))
+  (import "env" "string_index_error" (func $string_index_error (param i32 i32 i32)))
+  (import "env" "slice_error" (func $slice_error (param i32 i32 i32 i32)))
+  (import "env" "format_float" (func $format_float (param f64 i32 i32) (result i32)))
+`
+
+// Runtime support written in WAT. Strings are a 32-bit length followed by the bytes.
+// Lists are a header of length, capacity and items, with items stored in 64-bit slots.
+// Memory is never freed.
+const runtime = `  (func $alloc (param $size i32) (result i32) (local $ptr i32)
+    global.get $heap
+    local.set $ptr
+    global.get $heap
+    local.get $size
+    i32.add
+    i32.const 7
+    i32.add
+    i32.const -8
+    i32.and
+    global.set $heap
+    block $done
+      loop $grow
+        global.get $heap
+        memory.size
+        i32.const 16
+        i32.shl
+        i32.le_u
+        br_if $done
+        i32.const 1
+        memory.grow
+        i32.const -1
+        i32.eq
+        if
+          unreachable
+        end
+        br $grow
+      end
+    end
+    local.get $ptr
+  )
+  (func $concat (param $a i32) (param $b i32) (result i32) (local $la i32) (local $lb i32) (local $r i32)
+    local.get $a
+    i32.load
+    local.set $la
+    local.get $b
+    i32.load
+    local.set $lb
+    local.get $la
+    local.get $lb
+    i32.add
+    i32.const 4
+    i32.add
+    call $alloc
+    local.set $r
+    local.get $r
+    local.get $la
+    local.get $lb
+    i32.add
+    i32.store
+    local.get $r
+    i32.const 4
+    i32.add
+    local.get $a
+    i32.const 4
+    i32.add
+    local.get $la
+    memory.copy
+    local.get $r
+    i32.const 4
+    i32.add
+    local.get $la
+    i32.add
+    local.get $b
+    i32.const 4
+    i32.add
+    local.get $lb
+    memory.copy
+    local.get $r
+  )
+  (func $string_compare (param $a i32) (param $b i32) (result i32) (local $la i32) (local $lb i32) (local $n i32) (local $i i32) (local $x i32) (local $y i32)
+    local.get $a
+    i32.load
+    local.set $la
+    local.get $b
+    i32.load
+    local.set $lb
+    local.get $la
+    local.get $lb
+    local.get $la
+    local.get $lb
+    i32.lt_u
+    select
+    local.set $n
+    block $done
+      loop $next
+        local.get $i
+        local.get $n
+        i32.ge_u
+        br_if $done
+        local.get $a
+        i32.const 4
+        i32.add
+        local.get $i
+        i32.add
+        i32.load8_u
+        local.set $x
+        local.get $b
+        i32.const 4
+        i32.add
+        local.get $i
+        i32.add
+        i32.load8_u
+        local.set $y
+        local.get $x
+        local.get $y
+        i32.ne
+        if
+          local.get $x
+          local.get $y
+          i32.sub
+          return
+        end
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $la
+    local.get $lb
+    i32.sub
+  )
+  (func $int_to_string (param $n i64) (result i32) (local $pos i32) (local $neg i32) (local $u i64) (local $end i32)
+    i32.const 28
+    call $alloc
+    i32.const 28
+    i32.add
+    local.tee $pos
+    local.set $end
+    local.get $n
+    local.set $u
+    local.get $n
+    i64.const 0
+    i64.lt_s
+    local.tee $neg
+    if
+      i64.const 0
+      local.get $n
+      i64.sub
+      local.set $u
+    end
+    loop $digit
+      local.get $pos
+      i32.const 1
+      i32.sub
+      local.tee $pos
+      local.get $u
+      i64.const 10
+      i64.rem_u
+      i32.wrap_i64
+      i32.const 48
+      i32.add
+      i32.store8
+      local.get $u
+      i64.const 10
+      i64.div_u
+      local.tee $u
+      i64.const 0
+      i64.ne
+      br_if $digit
+    end
+    local.get $neg
+    if
+      local.get $pos
+      i32.const 1
+      i32.sub
+      local.tee $pos
+      i32.const 45
+      i32.store8
+    end
+    local.get $pos
+    i32.const 4
+    i32.sub
+    local.get $end
+    local.get $pos
+    i32.sub
+    i32.store
+    local.get $pos
+    i32.const 4
+    i32.sub
+  )
+  (func $float_to_string (param $f f64) (param $bits i32) (result i32) (local $s i32)
+    i32.const 36
+    call $alloc
+    local.tee $s
+    local.get $f
+    local.get $bits
+    local.get $s
+    i32.const 4
+    i32.add
+    call $format_float
+    i32.store
+    local.get $s
+  )
+  (func $list_new (result i32)
+    i32.const 12
+    call $alloc
+  )
+  (func $list_append (param $list i32) (param $item i64) (local $len i32) (local $cap i32) (local $items i32)
+    local.get $list
+    i32.load
+    local.set $len
+    local.get $list
+    i32.load offset=4
+    local.set $cap
+    local.get $len
+    local.get $cap
+    i32.eq
+    if
+      local.get $cap
+      i32.eqz
+      if (result i32)
+        i32.const 8
+      else
+        local.get $cap
+        i32.const 2
+        i32.mul
+      end
+      local.set $cap
+      local.get $cap
+      i32.const 8
+      i32.mul
+      call $alloc
+      local.tee $items
+      local.get $list
+      i32.load offset=8
+      local.get $len
+      i32.const 8
+      i32.mul
+      memory.copy
+      local.get $list
+      local.get $cap
+      i32.store offset=4
+      local.get $list
+      local.get $items
+      i32.store offset=8
+    end
+    local.get $list
+    i32.load offset=8
+    local.get $len
+    i32.const 8
+    i32.mul
+    i32.add
+    local.get $item
+    i64.store
+    local.get $list
+    local.get $len
+    i32.const 1
+    i32.add
+    i32.store
+  )
+  (func $list_copy (param $list i32) (result i32) (local $copy i32) (local $size i32)
+    call $list_new
+    local.set $copy
+    local.get $list
+    i32.load
+    i32.const 8
+    i32.mul
+    local.set $size
+    local.get $copy
+    local.get $list
+    i32.load
+    i32.store
+    local.get $copy
+    local.get $list
+    i32.load
+    i32.store offset=4
+    local.get $copy
+    local.get $size
+    call $alloc
+    i32.store offset=8
+    local.get $copy
+    i32.load offset=8
+    local.get $list
+    i32.load offset=8
+    local.get $size
+    memory.copy
+    local.get $copy
+  )
+  (func $list_check (param $list i32) (param $index i32) (param $line i32)
+    local.get $index
+    local.get $list
+    i32.load
+    i32.ge_u
+    if
+      local.get $index
+      local.get $list
+      i32.load
+      local.get $line
+      call $index_error
+      unreachable
+    end
+  )
+  (func $list_get (param $list i32) (param $index i32) (param $line i32) (result i64)
+    local.get $list
+    local.get $index
+    local.get $line
+    call $list_check
+    local.get $list
+    i32.load offset=8
+    local.get $index
+    i32.const 8
+    i32.mul
+    i32.add
+    i64.load
+  )
+  (func $list_set (param $list i32) (param $index i32) (param $item i64) (param $line i32)
+    local.get $list
+    local.get $index
+    local.get $line
+    call $list_check
+    local.get $list
+    i32.load offset=8
+    local.get $index
+    i32.const 8
+    i32.mul
+    i32.add
+    local.get $item
+    i64.store
+  )
+  (func $range (param $start i32) (param $end i32) (param $step i32) (result i32) (local $list i32)
+    call $list_new
+    local.set $list
+    block $done
+      loop $next
+        local.get $step
+        i32.const 0
+        i32.gt_s
+        if (result i32)
+          local.get $start
+          local.get $end
+          i32.lt_s
+        else
+          local.get $step
+          i32.const 0
+          i32.lt_s
+          local.get $start
+          local.get $end
+          i32.gt_s
+          i32.and
+        end
+        i32.eqz
+        br_if $done
+        local.get $list
+        local.get $start
+        i64.extend_i32_s
+        call $list_append
+        local.get $start
+        local.get $step
+        i32.add
+        local.set $start
+        br $next
+      end
+    end
+    local.get $list
+  )
+`
+
+// String methods. Strings are indexed by rune, so offsets count the bytes that start a UTF-8 sequence.
+const stringRuntime = `  (func $string_new (param $src i32) (param $len i32) (result i32) (local $s i32)
+    local.get $len
+    i32.const 4
+    i32.add
+    call $alloc
+    local.tee $s
+    local.get $len
+    i32.store
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $src
+    local.get $len
+    memory.copy
+    local.get $s
+  )
+  (func $rune_start (param $b i32) (result i32)
+    local.get $b
+    i32.const 192
+    i32.and
+    i32.const 128
+    i32.ne
+  )
+  (func $runes (param $ptr i32) (param $n i32) (result i32) (local $i i32) (local $count i32)
+    block $done
+      loop $next
+        local.get $i
+        local.get $n
+        i32.ge_u
+        br_if $done
+        local.get $ptr
+        local.get $i
+        i32.add
+        i32.load8_u
+        call $rune_start
+        local.get $count
+        i32.add
+        local.set $count
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $count
+  )
+  (func $string_length (param $s i32) (result i32)
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $s
+    i32.load
+    call $runes
+  )
+  (func $string_offset (param $s i32) (param $index i32) (result i32) (local $i i32) (local $count i32)
+    local.get $index
+    i32.const 0
+    i32.lt_s
+    if
+      i32.const -1
+      return
+    end
+    block $done
+      loop $next
+        local.get $i
+        local.get $s
+        i32.load
+        i32.ge_u
+        br_if $done
+        local.get $s
+        local.get $i
+        i32.add
+        i32.load8_u offset=4
+        call $rune_start
+        if
+          local.get $count
+          local.get $index
+          i32.eq
+          if
+            local.get $i
+            return
+          end
+          local.get $count
+          i32.const 1
+          i32.add
+          local.set $count
+        end
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $count
+    local.get $index
+    i32.eq
+    if (result i32)
+      local.get $i
+    else
+      i32.const -1
+    end
+  )
+  (func $rune_end (param $s i32) (param $start i32) (result i32) (local $end i32)
+    local.get $start
+    i32.const 1
+    i32.add
+    local.set $end
+    block $done
+      loop $next
+        local.get $end
+        local.get $s
+        i32.load
+        i32.ge_u
+        br_if $done
+        local.get $s
+        local.get $end
+        i32.add
+        i32.load8_u offset=4
+        call $rune_start
+        br_if $done
+        local.get $end
+        i32.const 1
+        i32.add
+        local.set $end
+        br $next
+      end
+    end
+    local.get $end
+  )
+  (func $string_at (param $s i32) (param $index i32) (param $line i32) (result i32) (local $start i32)
+    local.get $s
+    local.get $index
+    call $string_offset
+    local.tee $start
+    i32.const 0
+    i32.lt_s
+    local.get $start
+    local.get $s
+    i32.load
+    i32.eq
+    i32.or
+    if
+      local.get $index
+      local.get $s
+      call $string_length
+      local.get $line
+      call $string_index_error
+      unreachable
+    end
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $start
+    i32.add
+    local.get $s
+    local.get $start
+    call $rune_end
+    local.get $start
+    i32.sub
+    call $string_new
+  )
+  (func $string_slice (param $s i32) (param $start i32) (param $end i32) (param $line i32) (result i32) (local $from i32) (local $to i32)
+    local.get $s
+    local.get $start
+    call $string_offset
+    local.set $from
+    local.get $s
+    local.get $end
+    call $string_offset
+    local.set $to
+    local.get $from
+    i32.const 0
+    i32.lt_s
+    local.get $to
+    i32.const 0
+    i32.lt_s
+    i32.or
+    local.get $start
+    local.get $end
+    i32.gt_s
+    i32.or
+    if
+      local.get $start
+      local.get $end
+      local.get $s
+      call $string_length
+      local.get $line
+      call $slice_error
+      unreachable
+    end
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $from
+    i32.add
+    local.get $to
+    local.get $from
+    i32.sub
+    call $string_new
+  )
+  (func $string_build (param $parts i32) (result i32) (local $length i32) (local $i i32) (local $s i32) (local $end i32) (local $part i32)
+    block $done
+      loop $next
+        local.get $i
+        local.get $parts
+        i32.load
+        i32.ge_u
+        br_if $done
+        local.get $parts
+        i32.load offset=8
+        local.get $i
+        i32.const 8
+        i32.mul
+        i32.add
+        i64.load
+        i32.wrap_i64
+        i32.load
+        local.get $length
+        i32.add
+        local.set $length
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $length
+    i32.const 4
+    i32.add
+    call $alloc
+    local.tee $s
+    local.get $length
+    i32.store
+    local.get $s
+    i32.const 4
+    i32.add
+    local.set $end
+    i32.const 0
+    local.set $i
+    block $done
+      loop $next
+        local.get $i
+        local.get $parts
+        i32.load
+        i32.ge_u
+        br_if $done
+        local.get $parts
+        i32.load offset=8
+        local.get $i
+        i32.const 8
+        i32.mul
+        i32.add
+        i64.load
+        i32.wrap_i64
+        local.set $part
+        local.get $end
+        local.get $part
+        i32.const 4
+        i32.add
+        local.get $part
+        i32.load
+        memory.copy
+        local.get $end
+        local.get $part
+        i32.load
+        i32.add
+        local.set $end
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $s
+  )
+  (func $bytes_equal (param $a i32) (param $b i32) (param $n i32) (result i32) (local $i i32)
+    block $done
+      loop $next
+        local.get $i
+        local.get $n
+        i32.ge_u
+        br_if $done
+        local.get $a
+        local.get $i
+        i32.add
+        i32.load8_u
+        local.get $b
+        local.get $i
+        i32.add
+        i32.load8_u
+        i32.ne
+        if
+          i32.const 0
+          return
+        end
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    i32.const 1
+  )
+  (func $string_search (param $s i32) (param $sub i32) (param $from i32) (result i32) (local $i i32)
+    local.get $from
+    local.set $i
+    block $done
+      loop $next
+        local.get $i
+        local.get $sub
+        i32.load
+        i32.add
+        local.get $s
+        i32.load
+        i32.gt_u
+        br_if $done
+        local.get $s
+        i32.const 4
+        i32.add
+        local.get $i
+        i32.add
+        local.get $sub
+        i32.const 4
+        i32.add
+        local.get $sub
+        i32.load
+        call $bytes_equal
+        if
+          local.get $i
+          return
+        end
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    i32.const -1
+  )
+  (func $string_find (param $s i32) (param $sub i32) (result i32) (local $i i32)
+    local.get $s
+    local.get $sub
+    i32.const 0
+    call $string_search
+    local.tee $i
+    i32.const 0
+    i32.lt_s
+    if
+      i32.const -1
+      return
+    end
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $i
+    call $runes
+  )
+  (func $string_split (param $s i32) (param $sep i32) (result i32) (local $parts i32) (local $start i32) (local $i i32)
+    call $list_new
+    local.set $parts
+    local.get $sep
+    i32.load
+    i32.eqz
+    if
+      block $done
+        loop $next
+          local.get $start
+          local.get $s
+          i32.load
+          i32.ge_u
+          br_if $done
+          local.get $s
+          local.get $start
+          call $rune_end
+          local.set $i
+          local.get $parts
+          local.get $s
+          i32.const 4
+          i32.add
+          local.get $start
+          i32.add
+          local.get $i
+          local.get $start
+          i32.sub
+          call $string_new
+          i64.extend_i32_u
+          call $list_append
+          local.get $i
+          local.set $start
+          br $next
+        end
+      end
+      local.get $parts
+      return
+    end
+    block $done
+      loop $next
+        local.get $s
+        local.get $sep
+        local.get $start
+        call $string_search
+        local.tee $i
+        i32.const 0
+        i32.lt_s
+        br_if $done
+        local.get $parts
+        local.get $s
+        i32.const 4
+        i32.add
+        local.get $start
+        i32.add
+        local.get $i
+        local.get $start
+        i32.sub
+        call $string_new
+        i64.extend_i32_u
+        call $list_append
+        local.get $i
+        local.get $sep
+        i32.load
+        i32.add
+        local.set $start
+        br $next
+      end
+    end
+    local.get $parts
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $start
+    i32.add
+    local.get $s
+    i32.load
+    local.get $start
+    i32.sub
+    call $string_new
+    i64.extend_i32_u
+    call $list_append
+    local.get $parts
+  )
+  (func $string_join (param $sep i32) (param $parts i32) (result i32) (local $result i32) (local $i i32)
+    i32.const 0
+    i32.const 0
+    call $string_new
+    local.set $result
+    block $done
+      loop $next
+        local.get $i
+        local.get $parts
+        i32.load
+        i32.ge_u
+        br_if $done
+        local.get $i
+        if
+          local.get $result
+          local.get $sep
+          call $concat
+          local.set $result
+        end
+        local.get $result
+        local.get $parts
+        i32.load offset=8
+        local.get $i
+        i32.const 8
+        i32.mul
+        i32.add
+        i64.load
+        i32.wrap_i64
+        call $concat
+        local.set $result
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $result
+  )
+  (func $is_space (param $b i32) (result i32)
+    local.get $b
+    i32.const 32
+    i32.eq
+    local.get $b
+    i32.const 9
+    i32.eq
+    i32.or
+    local.get $b
+    i32.const 10
+    i32.eq
+    i32.or
+    local.get $b
+    i32.const 13
+    i32.eq
+    i32.or
+  )
+  (func $string_trim (param $s i32) (result i32) (local $start i32) (local $end i32)
+    local.get $s
+    i32.load
+    local.set $end
+    block $done
+      loop $next
+        local.get $start
+        local.get $end
+        i32.ge_u
+        br_if $done
+        local.get $s
+        local.get $start
+        i32.add
+        i32.load8_u offset=4
+        call $is_space
+        i32.eqz
+        br_if $done
+        local.get $start
+        i32.const 1
+        i32.add
+        local.set $start
+        br $next
+      end
+    end
+    block $done
+      loop $next
+        local.get $end
+        local.get $start
+        i32.le_u
+        br_if $done
+        local.get $s
+        local.get $end
+        i32.add
+        i32.load8_u offset=3
+        call $is_space
+        i32.eqz
+        br_if $done
+        local.get $end
+        i32.const 1
+        i32.sub
+        local.set $end
+        br $next
+      end
+    end
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $start
+    i32.add
+    local.get $end
+    local.get $start
+    i32.sub
+    call $string_new
+  )
+  (func $string_replace (param $s i32) (param $old i32) (param $new i32) (result i32) (local $result i32) (local $start i32) (local $i i32)
+    local.get $old
+    i32.load
+    i32.eqz
+    if
+      local.get $s
+      return
+    end
+    i32.const 0
+    i32.const 0
+    call $string_new
+    local.set $result
+    block $done
+      loop $next
+        local.get $s
+        local.get $old
+        local.get $start
+        call $string_search
+        local.tee $i
+        i32.const 0
+        i32.lt_s
+        br_if $done
+        local.get $result
+        local.get $s
+        i32.const 4
+        i32.add
+        local.get $start
+        i32.add
+        local.get $i
+        local.get $start
+        i32.sub
+        call $string_new
+        call $concat
+        local.get $new
+        call $concat
+        local.set $result
+        local.get $i
+        local.get $old
+        i32.load
+        i32.add
+        local.set $start
+        br $next
+      end
+    end
+    local.get $result
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $start
+    i32.add
+    local.get $s
+    i32.load
+    local.get $start
+    i32.sub
+    call $string_new
+    call $concat
+  )
+  (func $map_ascii (param $s i32) (param $first i32) (param $last i32) (param $shift i32) (result i32) (local $r i32) (local $i i32) (local $b i32)
+    local.get $s
+    i32.const 4
+    i32.add
+    local.get $s
+    i32.load
+    call $string_new
+    local.set $r
+    block $done
+      loop $next
+        local.get $i
+        local.get $r
+        i32.load
+        i32.ge_u
+        br_if $done
+        local.get $r
+        local.get $i
+        i32.add
+        i32.load8_u offset=4
+        local.tee $b
+        local.get $first
+        i32.ge_u
+        local.get $b
+        local.get $last
+        i32.le_u
+        i32.and
+        if
+          local.get $r
+          local.get $i
+          i32.add
+          local.get $b
+          local.get $shift
+          i32.add
+          i32.store8 offset=4
+        end
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $r
+  )
+  (func $string_toUpper (param $s i32) (result i32)
+    local.get $s
+    i32.const 97
+    i32.const 122
+    i32.const -32
+    call $map_ascii
+  )
+  (func $string_toLower (param $s i32) (result i32)
+    local.get $s
+    i32.const 65
+    i32.const 90
+    i32.const 32
+    call $map_ascii
+  )
+  ;; UTF-8 encoding of a code point. Invalid code points become U+FFFD, like in Go.
+  (func $rune_to_string (param $r i32) (result i32) (local $s i32) (local $n i32)
+    local.get $r
+    i32.const 0x10ffff
+    i32.gt_u
+    local.get $r
+    i32.const 0xfffff800
+    i32.and
+    i32.const 0xd800
+    i32.eq
+    i32.or
+    if
+      i32.const 0xfffd
+      local.set $r
+    end
+    i32.const 8
+    call $alloc
+    local.set $s
+    local.get $r
+    i32.const 0x80
+    i32.lt_u
+    if
+      local.get $s
+      local.get $r
+      i32.store8 offset=4
+      i32.const 1
+      local.set $n
+    else
+      local.get $r
+      i32.const 0x800
+      i32.lt_u
+      if
+        local.get $s
+        local.get $r
+        i32.const 6
+        i32.shr_u
+        i32.const 0xc0
+        i32.or
+        i32.store8 offset=4
+        local.get $s
+        local.get $r
+        i32.const 0x3f
+        i32.and
+        i32.const 0x80
+        i32.or
+        i32.store8 offset=5
+        i32.const 2
+        local.set $n
+      else
+        local.get $r
+        i32.const 0x10000
+        i32.lt_u
+        if
+          local.get $s
+          local.get $r
+          i32.const 12
+          i32.shr_u
+          i32.const 0xe0
+          i32.or
+          i32.store8 offset=4
+          local.get $s
+          local.get $r
+          i32.const 6
+          i32.shr_u
+          i32.const 0x3f
+          i32.and
+          i32.const 0x80
+          i32.or
+          i32.store8 offset=5
+          local.get $s
+          local.get $r
+          i32.const 0x3f
+          i32.and
+          i32.const 0x80
+          i32.or
+          i32.store8 offset=6
+          i32.const 3
+          local.set $n
+        else
+          local.get $s
+          local.get $r
+          i32.const 18
+          i32.shr_u
+          i32.const 0xf0
+          i32.or
+          i32.store8 offset=4
+          local.get $s
+          local.get $r
+          i32.const 12
+          i32.shr_u
+          i32.const 0x3f
+          i32.and
+          i32.const 0x80
+          i32.or
+          i32.store8 offset=5
+          local.get $s
+          local.get $r
+          i32.const 6
+          i32.shr_u
+          i32.const 0x3f
+          i32.and
+          i32.const 0x80
+          i32.or
+          i32.store8 offset=6
+          local.get $s
+          local.get $r
+          i32.const 0x3f
+          i32.and
+          i32.const 0x80
+          i32.or
+          i32.store8 offset=7
+          i32.const 4
+          local.set $n
+        end
+      end
+    end
+    local.get $s
+    local.get $n
+    i32.store
+    local.get $s
+  )
+  (func $put (param $p i32) (param $b i32) (result i32)
+    local.get $p
+    local.get $b
+    i32.store8
+    local.get $p
+    i32.const 1
+    i32.add
+  )
+  (func $hex_digit (param $d i32) (result i32)
+    local.get $d
+    i32.const 48
+    i32.add
+    local.get $d
+    i32.const 87
+    i32.add
+    local.get $d
+    i32.const 10
+    i32.lt_u
+    select
+  )
+  ;; The string as a Knox literal. Braces are escaped so that they don't start an interpolation.
+  (func $string_quote (param $s i32) (result i32) (local $r i32) (local $p i32) (local $i i32) (local $b i32) (local $e i32)
+    local.get $s
+    i32.load
+    i32.const 6 ;; Control characters take at most 6 bytes, as \u{1f}.
+    i32.mul
+    i32.const 6
+    i32.add
+    call $alloc
+    local.tee $r
+    i32.const 4
+    i32.add
+    i32.const 34
+    call $put
+    local.set $p
+    block $done
+      loop $next
+        local.get $i
+        local.get $s
+        i32.load
+        i32.ge_u
+        br_if $done
+        local.get $s
+        local.get $i
+        i32.add
+        i32.load8_u offset=4
+        local.tee $b
+        local.set $e
+        local.get $b
+        i32.const 10
+        i32.eq
+        if
+          i32.const 110
+          local.set $e
+        end
+        local.get $b
+        i32.const 9
+        i32.eq
+        if
+          i32.const 116
+          local.set $e
+        end
+        local.get $b
+        i32.const 13
+        i32.eq
+        if
+          i32.const 114
+          local.set $e
+        end
+        local.get $b
+        i32.const 0
+        i32.eq
+        if
+          i32.const 48
+          local.set $e
+        end
+        local.get $e
+        local.get $b
+        i32.ne
+        local.get $b
+        i32.const 34
+        i32.eq
+        local.get $b
+        i32.const 92
+        i32.eq
+        i32.or
+        local.get $b
+        i32.const 123
+        i32.eq
+        i32.or
+        local.get $b
+        i32.const 125
+        i32.eq
+        i32.or
+        i32.or
+        if
+          local.get $p
+          i32.const 92
+          call $put
+          local.get $e
+          call $put
+          local.set $p
+        else
+          local.get $b
+          i32.const 32
+          i32.lt_u
+          local.get $b
+          i32.const 127
+          i32.eq
+          i32.or
+          if
+            local.get $p
+            i32.const 92
+            call $put
+            i32.const 117
+            call $put
+            i32.const 123
+            call $put
+            local.set $p
+            local.get $b
+            i32.const 16
+            i32.ge_u
+            if
+              local.get $p
+              local.get $b
+              i32.const 4
+              i32.shr_u
+              call $hex_digit
+              call $put
+              local.set $p
+            end
+            local.get $p
+            local.get $b
+            i32.const 15
+            i32.and
+            call $hex_digit
+            call $put
+            i32.const 125
+            call $put
+            local.set $p
+          else
+            local.get $p
+            local.get $b
+            call $put
+            local.set $p
+          end
+        end
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $next
+      end
+    end
+    local.get $r
+    local.get $p
+    i32.const 34
+    call $put
+    local.get $r
+    i32.sub
+    i32.const 4
+    i32.sub
+    i32.store
+    local.get $r
+  )
+`
@@ -0,0 +1,61 @@
+package wasm
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Wasm value type for a Knox type. Strings, objects and lists are i32 addresses into linear memory.
+func valType(t string) string {
+	switch t {
+	case "i64", "u64":
+		return "i64"
+	case "float", "f32":
+		return "f32"
+	case "f64", "FLOAT_LITERAL":
+		return "f64"
+	}
+	return "i32"
+}
+
+func resultTypes(types []string) string {
+	if len(types) == 0 {
+		return ""
+	}
+	var vals []string
+	for _, t := range types {
+		vals = append(vals, valType(t))
+	}
+	return " (result " + strings.Join(vals, " ") + ")"
+}
+
+// Float constants use Go's shortest representation, which is valid WAT.
+func floatConstant(value float64, val string) string {
+	switch {
+	case math.IsNaN(value):
+		return "nan"
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case val == "f32":
+		return strconv.FormatFloat(value, 'g', -1, 32)
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Quote a string as WAT data, escaping everything outside printable ASCII.
+func quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, b := range []byte(s) {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			sb.WriteString("\\" + strconv.FormatInt(int64(b)>>4, 16) + strconv.FormatInt(int64(b)&15, 16))
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,336 @@
+package wasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stack effect of a plain instruction.
+type opType struct {
+	params  []string
+	results []string
+}
+
+var opTypes = map[string]opType{}
+
+func init() {
+	sig := func(op string, params string, results string) {
+		opTypes[op] = opType{strings.Fields(params), strings.Fields(results)}
+	}
+	for _, t := range []string{"i32", "i64"} {
+		for _, op := range []string{"add", "sub", "mul", "div_s", "div_u", "rem_s", "rem_u", "and", "or", "xor", "shl", "shr_s", "shr_u", "rotl", "rotr"} {
+			sig(t+"."+op, t+" "+t, t)
+		}
+		for _, op := range []string{"eq", "ne", "lt_s", "lt_u", "gt_s", "gt_u", "le_s", "le_u", "ge_s", "ge_u"} {
+			sig(t+"."+op, t+" "+t, "i32")
+		}
+		for _, op := range []string{"clz", "ctz", "popcnt", "extend8_s", "extend16_s"} {
+			sig(t+"."+op, t, t)
+		}
+		sig(t+".eqz", t, "i32")
+		for _, f := range []string{"f32", "f64"} {
+			for _, op := range []string{"trunc", "trunc_sat"} {
+				sig(t+"."+op+"_"+f+"_s", f, t)
+				sig(t+"."+op+"_"+f+"_u", f, t)
+			}
+			sig(f+".convert_"+t+"_s", t, f)
+			sig(f+".convert_"+t+"_u", t, f)
+		}
+	}
+	for _, t := range []string{"f32", "f64"} {
+		for _, op := range []string{"add", "sub", "mul", "div", "min", "max", "copysign"} {
+			sig(t+"."+op, t+" "+t, t)
+		}
+		for _, op := range []string{"eq", "ne", "lt", "gt", "le", "ge"} {
+			sig(t+"."+op, t+" "+t, "i32")
+		}
+		for _, op := range []string{"neg", "abs", "sqrt", "ceil", "floor", "trunc", "nearest"} {
+			sig(t+"."+op, t, t)
+		}
+	}
+	sig("i64.extend32_s", "i64", "i64")
+	sig("i32.wrap_i64", "i64", "i32")
+	sig("i64.extend_i32_s", "i32", "i64")
+	sig("i64.extend_i32_u", "i32", "i64")
+	sig("f32.demote_f64", "f64", "f32")
+	sig("f64.promote_f32", "f32", "f64")
+	sig("i32.reinterpret_f32", "f32", "i32")
+	sig("i64.reinterpret_f64", "f64", "i64")
+	sig("f32.reinterpret_i32", "i32", "f32")
+	sig("f64.reinterpret_i64", "i64", "f64")
+
+	for _, t := range []string{"i32", "i64", "f32", "f64"} {
+		sig(t+".const", "", t)
+		sig(t+".load", "i32", t)
+		sig(t+".store", "i32 "+t, "")
+	}
+	for _, size := range []string{"8", "16"} {
+		sig("i32.load"+size+"_s", "i32", "i32")
+		sig("i32.load"+size+"_u", "i32", "i32")
+		sig("i32.store"+size, "i32 i32", "")
+	}
+	for _, size := range []string{"8", "16", "32"} {
+		sig("i64.load"+size+"_s", "i32", "i64")
+		sig("i64.load"+size+"_u", "i32", "i64")
+		sig("i64.store"+size, "i32 i64", "")
+	}
+	sig("memory.size", "", "i32")
+	sig("memory.grow", "i32", "i32")
+	sig("memory.copy", "i32 i32 i32", "")
+	sig("memory.fill", "i32 i32 i32", "")
+	sig("nop", "", "")
+}
+
+// A block being validated.
+type ctrlFrame struct {
+	op          string
+	labelTypes  []string // Types a branch to the block carries.
+	results     []string
+	height      int
+	unreachable bool
+}
+
+// The type checking algorithm from the appendix of the WebAssembly specification.
+type validator struct {
+	m     *Module
+	f     *Func
+	vals  []string // "" is an unknown type in unreachable code.
+	ctrls []ctrlFrame
+}
+
+// Validate parses a WAT module and checks that it is well typed.
+func Validate(src string) (*Module, error) {
+	m, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range m.Data {
+		if uint64(d.Offset)+uint64(len(d.Bytes)) > uint64(m.MemoryPages)*pageSize {
+			return nil, fmt.Errorf("data segment at %d doesn't fit in memory", d.Offset)
+		}
+	}
+	for i, f := range m.Funcs {
+		if f.Import != "" {
+			continue
+		}
+		v := &validator{m: m, f: f}
+		if err := v.function(); err != nil {
+			name := f.Name
+			if name == "" {
+				name = fmt.Sprint(i)
+			}
+			return nil, fmt.Errorf("in function %s: %v", name, err)
+		}
+	}
+	if _, ok := m.Exports["main"]; !ok {
+		return nil, fmt.Errorf("missing main export")
+	}
+	return m, nil
+}
+
+func (v *validator) push(t string) {
+	v.vals = append(v.vals, t)
+}
+
+func (v *validator) pop(expect string) (string, error) {
+	frame := &v.ctrls[len(v.ctrls)-1]
+	if len(v.vals) == frame.height {
+		if frame.unreachable {
+			return expect, nil
+		}
+		if expect == "" {
+			return "", fmt.Errorf("stack underflow")
+		}
+		return "", fmt.Errorf("stack underflow, expected %s", expect)
+	}
+	actual := v.vals[len(v.vals)-1]
+	v.vals = v.vals[:len(v.vals)-1]
+	if actual != "" && expect != "" && actual != expect {
+		return "", fmt.Errorf("type mismatch, expected %s but got %s", expect, actual)
+	}
+	if actual == "" {
+		return expect, nil
+	}
+	return actual, nil
+}
+
+func (v *validator) pushAll(types []string) {
+	for _, t := range types {
+		v.push(t)
+	}
+}
+
+func (v *validator) popAll(types []string) error {
+	for i := len(types) - 1; i >= 0; i-- {
+		if _, err := v.pop(types[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *validator) pushCtrl(op string, results []string) {
+	labels := results
+	if op == "loop" {
+		labels = nil
+	}
+	v.ctrls = append(v.ctrls, ctrlFrame{op: op, labelTypes: labels, results: results, height: len(v.vals)})
+}
+
+func (v *validator) popCtrl() (ctrlFrame, error) {
+	if len(v.ctrls) == 0 {
+		return ctrlFrame{}, fmt.Errorf("unbalanced end")
+	}
+	frame := v.ctrls[len(v.ctrls)-1]
+	if err := v.popAll(frame.results); err != nil {
+		return frame, err
+	}
+	if len(v.vals) != frame.height {
+		return frame, fmt.Errorf("%d values left on the stack at the end of %s", len(v.vals)-frame.height, frame.op)
+	}
+	v.ctrls = v.ctrls[:len(v.ctrls)-1]
+	return frame, nil
+}
+
+func (v *validator) setUnreachable() {
+	frame := &v.ctrls[len(v.ctrls)-1]
+	v.vals = v.vals[:frame.height]
+	frame.unreachable = true
+}
+
+func (v *validator) localType(index int) (string, error) {
+	if index < len(v.f.Params) {
+		return v.f.Params[index], nil
+	}
+	if index-len(v.f.Params) < len(v.f.Locals) {
+		return v.f.Locals[index-len(v.f.Params)], nil
+	}
+	return "", fmt.Errorf("unknown local %d", index)
+}
+
+func (v *validator) function() error {
+	v.pushCtrl("func", v.f.Results)
+	for pc, in := range v.f.Code {
+		if err := v.instr(in); err != nil {
+			return fmt.Errorf("%s at instruction %d: %v", in.Op, pc, err)
+		}
+	}
+	if _, err := v.popCtrl(); err != nil {
+		return err
+	}
+	if len(v.ctrls) != 0 {
+		return fmt.Errorf("block without end")
+	}
+	return nil
+}
+
+func (v *validator) instr(in Instr) error {
+	switch in.Op {
+	case "block", "loop":
+		v.pushCtrl(in.Op, in.Block)
+	case "if":
+		if _, err := v.pop("i32"); err != nil {
+			return err
+		}
+		v.pushCtrl(in.Op, in.Block)
+	case "else":
+		frame, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		v.pushCtrl("else", frame.results)
+	case "end":
+		frame, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		if frame.op == "if" && len(frame.results) > 0 {
+			return fmt.Errorf("if with results requires an else")
+		}
+		v.pushAll(frame.results)
+	case "br", "br_if":
+		if in.Index >= len(v.ctrls) {
+			return fmt.Errorf("label depth %d out of range", in.Index)
+		}
+		if in.Op == "br_if" {
+			if _, err := v.pop("i32"); err != nil {
+				return err
+			}
+		}
+		labels := v.ctrls[len(v.ctrls)-1-in.Index].labelTypes
+		if err := v.popAll(labels); err != nil {
+			return err
+		}
+		if in.Op == "br" {
+			v.setUnreachable()
+		} else {
+			v.pushAll(labels)
+		}
+	case "return":
+		if err := v.popAll(v.f.Results); err != nil {
+			return err
+		}
+		v.setUnreachable()
+	case "unreachable":
+		v.setUnreachable()
+	case "drop":
+		_, err := v.pop("")
+		return err
+	case "select":
+		if _, err := v.pop("i32"); err != nil {
+			return err
+		}
+		t, err := v.pop("")
+		if err != nil {
+			return err
+		}
+		if _, err := v.pop(t); err != nil {
+			return err
+		}
+		v.push(t)
+	case "call":
+		if in.Index >= len(v.m.Funcs) {
+			return fmt.Errorf("unknown function %d", in.Index)
+		}
+		callee := v.m.Funcs[in.Index]
+		if err := v.popAll(callee.Params); err != nil {
+			return err
+		}
+		v.pushAll(callee.Results)
+	case "local.get", "local.set", "local.tee":
+		t, err := v.localType(in.Index)
+		if err != nil {
+			return err
+		}
+		if in.Op != "local.get" {
+			if _, err := v.pop(t); err != nil {
+				return err
+			}
+		}
+		if in.Op != "local.set" {
+			v.push(t)
+		}
+	case "global.get", "global.set":
+		if in.Index >= len(v.m.Globals) {
+			return fmt.Errorf("unknown global %d", in.Index)
+		}
+		g := v.m.Globals[in.Index]
+		if in.Op == "global.get" {
+			v.push(g.Type)
+		} else if !g.Mutable {
+			return fmt.Errorf("global %s is immutable", g.Name)
+		} else if _, err := v.pop(g.Type); err != nil {
+			return err
+		}
+	default:
+		op, ok := opTypes[in.Op]
+		if !ok {
+			return fmt.Errorf("unknown instruction")
+		}
+		if err := v.popAll(op.params); err != nil {
+			return err
+		}
+		v.pushAll(op.results)
+	}
+	return nil
+}
@@ -0,0 +1,536 @@
+package wasm
+
+import (
+	"fmt"
+	"knox/ir"
+	"strings"
+)
+
+type loop struct {
+	continueLabel string
+	breakLabel    string
+}
+
+type generator struct {
+	main    *ir.Func
+	data    strings.Builder
+	dataEnd int // Next free address after the string literals.
+	strings map[string]int
+	code    strings.Builder
+
+	// State of the function being generated.
+	body   strings.Builder
+	labels int
+	depth  int
+	loops  []loop
+}
+
+// Generate outputs a WAT module for a program in IR form.
+func Generate(p *ir.Program) string {
+	g := &generator{
+		main:    p.Main,
+		strings: make(map[string]int),
+		dataEnd: 8, // Address 0 is nil.
+	}
+	for _, f := range p.Funcs {
+		g.function(f)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(";; Generated by the Knox compiler.\n(module\n")
+	sb.WriteString(imports)
+	sb.WriteString("  (memory 1)\n")
+	sb.WriteString(g.data.String())
+	fmt.Fprintf(&sb, "  (global $heap (mut i32) (i32.const %d))\n", (g.dataEnd+7)&^7)
+	sb.WriteString(runtime)
+	sb.WriteString(stringRuntime)
+	sb.WriteString(g.code.String())
+	fmt.Fprintf(&sb, "  (export \"memory\" (memory 0))\n  (export \"main\" (func $%s))\n)\n", p.Main.Name)
+	return sb.String()
+}
+
+func abortMsg(line int, msg string) {
+	fmt.Printf("Wasm error: %v. Line %v.\n", msg, line)
+	panic("Aborted.\n")
+}
+
+////
+// Functions.
+////
+
+func (g *generator) function(f *ir.Func) {
+	g.body.Reset()
+	g.labels = 0
+	g.depth = 2
+	g.loops = nil
+
+	g.stmts(f.Body)
+	if f == g.main { // Like C, main returns zero when it falls off the end.
+		for _, t := range f.Results {
+			g.emit("%s.const 0", valType(t))
+		}
+	} else if len(f.Results) > 0 { // Falling off the end of a function with results.
+		g.emit("unreachable")
+	}
+
+	g.code.WriteString("  (func $" + f.Name)
+	for _, param := range f.Params {
+		fmt.Fprintf(&g.code, " (param $%s %s)", param.Name, valType(param.Typ))
+	}
+	g.code.WriteString(resultTypes(f.Results))
+	for _, local := range f.Locals {
+		fmt.Fprintf(&g.code, " (local $%s %s)", local.Name, valType(local.Typ))
+	}
+	g.code.WriteString("\n" + g.body.String() + "  )\n")
+}
+
+////
+// Statements.
+////
+
+func (g *generator) stmts(stmts []ir.Stmt) {
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *ir.Instr:
+			g.instr(s)
+		case *ir.If:
+			g.push(s.Cond)
+			g.open("if")
+			g.stmts(s.Then)
+			if len(s.Else) > 0 {
+				g.reopen("else")
+				g.stmts(s.Else)
+			}
+			g.close()
+		case *ir.Loop:
+			// Continue branches out of an inner block so that the post statements still run.
+			g.labels++
+			l := loop{continueLabel: fmt.Sprintf("$continue.%d", g.labels), breakLabel: fmt.Sprintf("$break.%d", g.labels)}
+			top := fmt.Sprintf("$top.%d", g.labels)
+			g.open("block " + l.breakLabel)
+			g.open("loop " + top)
+			g.open("block " + l.continueLabel)
+			g.loops = append(g.loops, l)
+			g.stmts(s.Body)
+			g.loops = g.loops[:len(g.loops)-1]
+			g.close()
+			g.stmts(s.Post)
+			g.emit("br %s", top)
+			g.close()
+			g.close()
+		case *ir.Break:
+			g.emit("br %s", g.loops[len(g.loops)-1].breakLabel)
+		case *ir.Continue:
+			g.emit("br %s", g.loops[len(g.loops)-1].continueLabel)
+		case *ir.Return:
+			g.push(s.Values...)
+			g.emit("return")
+		}
+	}
+}
+
+////
+// Instructions. Operands are pushed, the operation leaves its results on the stack and they're stored in reverse.
+////
+
+func (g *generator) instr(in *ir.Instr) {
+	switch in.Op {
+	case ir.Copy:
+		g.push(in.Args...)
+	case ir.Add, ir.Sub, ir.Mul, ir.Div, ir.Rem, ir.Eq, ir.Ne, ir.Lt, ir.Le, ir.Gt, ir.Ge:
+		g.push(in.Args...)
+		g.binaryOp(in)
+	case ir.And, ir.Or, ir.Xor, ir.Shl, ir.Shr:
+		g.push(in.Args...)
+		g.bitwise(in)
+	case ir.Concat:
+		if len(in.Args) == 2 {
+			g.push(in.Args...)
+			g.emit("call $concat")
+			break
+		}
+		// Collect the parts in a list, kept in the result until the string is built.
+		parts := in.Dst[0].Name
+		g.emit("call $list_new")
+		g.emit("local.set $%s", parts)
+		for _, part := range in.Args {
+			g.emit("local.get $%s", parts)
+			g.push(part)
+			g.toSlot("string")
+			g.emit("call $list_append")
+		}
+		g.emit("local.get $%s", parts)
+		g.emit("call $string_build")
+	case ir.Neg:
+		t := in.Dst[0].Typ
+		g.push(in.Args...)
+		if ir.IsFloat(t) {
+			g.emit("%s.neg", valType(t))
+		} else {
+			g.emit("%s.const -1", valType(t))
+			g.emit("%s.mul", valType(t))
+			g.narrow(t)
+		}
+	case ir.Not:
+		g.push(in.Args...)
+		g.emit("i32.eqz")
+	case ir.Compl:
+		t := in.Dst[0].Typ
+		g.push(in.Args...)
+		g.emit("%s.const -1", valType(t))
+		g.emit("%s.xor", valType(t))
+		g.narrow(t)
+	case ir.Convert:
+		g.push(in.Args...)
+		g.convert(in.Line, in.Args[0].Type(), in.Dst[0].Typ)
+	case ir.Call:
+		g.push(in.Args...)
+		g.emit("call $%s", in.Func.Name)
+	case ir.Builtin:
+		g.builtin(in)
+	case ir.New:
+		size := 8 * len(in.Class.Fields)
+		if size == 0 { // Every object needs its own address.
+			size = 8
+		}
+		g.emit("i32.const %d", size)
+		g.emit("call $alloc")
+	case ir.GetField:
+		g.push(in.Args...)
+		g.emit("%s.load offset=%d", valType(in.Dst[0].Typ), 8*in.Field)
+	case ir.SetField:
+		g.push(in.Args...)
+		g.emit("%s.store offset=%d", valType(in.Class.Fields[in.Field].Typ), 8*in.Field)
+	case ir.NewList:
+		list := in.Dst[0].Name
+		g.emit("call $list_new")
+		g.emit("local.set $%s", list)
+		for _, item := range in.Args {
+			g.emit("local.get $%s", list)
+			g.push(item)
+			g.toSlot(item.Type())
+			g.emit("call $list_append")
+		}
+		return
+	case ir.Index:
+		g.list(in)
+		g.index(in)
+		g.emit("i32.const %d", in.Line)
+		g.emit("call $list_get")
+		g.fromSlot(in.Dst[0].Typ)
+	case ir.SetIndex:
+		g.list(in)
+		g.index(in)
+		g.push(in.Args[2])
+		g.toSlot(in.Args[2].Type())
+		g.emit("i32.const %d", in.Line)
+		g.emit("call $list_set")
+	case ir.Iter:
+		g.list(in)
+		g.emit("call $list_copy")
+	default:
+		abortMsg(in.Line, "The WebAssembly backend doesn't support "+in.Op.String())
+	}
+	for i := len(in.Dst) - 1; i >= 0; i-- {
+		g.emit("local.set $%s", in.Dst[i].Name)
+	}
+}
+
+// Push the list operand of an instruction. Maps aren't supported yet.
+func (g *generator) list(in *ir.Instr) {
+	if !ir.IsList(in.Args[0].Type()) {
+		abortMsg(in.Line, "Only lists are supported by the WebAssembly backend")
+	}
+	g.push(in.Args[0])
+}
+
+// Push a list index as an i32.
+func (g *generator) index(in *ir.Instr) {
+	g.push(in.Args[1])
+	g.convert(in.Line, in.Args[1].Type(), "int")
+}
+
+var (
+	arithmetic  = map[ir.Op]string{ir.Add: "add", ir.Sub: "sub", ir.Mul: "mul", ir.Div: "div", ir.Rem: "rem"}
+	comparisons = map[ir.Op]string{ir.Eq: "eq", ir.Ne: "ne", ir.Lt: "lt", ir.Le: "le", ir.Gt: "gt", ir.Ge: "ge"}
+)
+
+func (g *generator) binaryOp(in *ir.Instr) {
+	operand := in.Args[0].Type()
+	if operand == "nil" {
+		operand = in.Args[1].Type()
+	}
+	v := valType(operand)
+	inst, ok := arithmetic[in.Op]
+	if !ok {
+		inst = comparisons[in.Op]
+	}
+	if operand == "string" { // Strings compare by value.
+		g.emit("call $string_compare")
+		g.emit("i32.const 0")
+		if in.Op != ir.Eq && in.Op != ir.Ne {
+			inst += "_s"
+		}
+		g.emit("i32.%s", inst)
+		return
+	}
+	if ir.IsFloat(operand) {
+		if in.Op == ir.Rem {
+			abortMsg(in.Line, "The WebAssembly backend doesn't support % on "+operand)
+		}
+		g.emit("%s.%s", v, inst)
+		return
+	}
+	if in.Op != ir.Add && in.Op != ir.Sub && in.Op != ir.Mul && in.Op != ir.Eq && in.Op != ir.Ne {
+		if ir.IsUnsigned(operand) {
+			inst += "_u"
+		} else {
+			inst += "_s"
+		}
+	}
+	g.emit("%s.%s", v, inst)
+	// Narrow integers are calculated in an i32, so the result is narrowed like bitwise does. Unsigned quotients
+	// and remainders already fit, but signed ones don't, like -128 / -1.
+	if _, ok := arithmetic[in.Op]; ok && !(ir.IsUnsigned(operand) && (in.Op == ir.Div || in.Op == ir.Rem)) {
+		g.narrow(operand)
+	}
+}
+
+var bitwiseOps = map[ir.Op]string{ir.And: "and", ir.Or: "or", ir.Xor: "xor", ir.Shl: "shl", ir.Shr: "shr"}
+
+// Narrow integers are shifted in an i32, so their count is masked to their own width and the result narrowed.
+func (g *generator) bitwise(in *ir.Instr) {
+	t := in.Dst[0].Typ
+	v := valType(t)
+	inst := bitwiseOps[in.Op]
+	if in.Op == ir.Shl || in.Op == ir.Shr {
+		if bits := ir.Bits(t); bits < 32 {
+			g.emit("i32.const %d", bits-1)
+			g.emit("i32.and")
+		}
+	}
+	if in.Op == ir.Shr && ir.IsUnsigned(t) {
+		inst += "_u"
+	} else if in.Op == ir.Shr {
+		inst += "_s"
+	}
+	g.emit("%s.%s", v, inst)
+	if in.Op == ir.Shl {
+		g.narrow(t)
+	}
+}
+
+// Convert the value on the stack between Knox primitive types using C's rules.
+func (g *generator) convert(line int, from string, to string) {
+	if from == to {
+		return
+	}
+	if to == "string" {
+		switch {
+		case ir.IsInt(from):
+			g.widen(from)
+			g.emit("call $int_to_string")
+		case ir.IsFloat(from):
+			if valType(from) == "f32" {
+				g.emit("f64.promote_f32")
+			}
+			g.emit("i32.const %d", ir.Bits(from))
+			g.emit("call $float_to_string")
+		case from == "bool":
+			g.open("if (result i32)")
+			g.emit("i32.const %d", g.stringConstant("true"))
+			g.reopen("else")
+			g.emit("i32.const %d", g.stringConstant("false"))
+			g.close()
+		default:
+			abortMsg(line, "The WebAssembly backend can't cast "+from+" to string")
+		}
+		return
+	}
+	if from == "string" || !(ir.IsNumber(from) || from == "bool") || !(ir.IsNumber(to) || to == "bool") {
+		abortMsg(line, "The WebAssembly backend can't cast "+from+" to "+to)
+	}
+
+	fv, tv := valType(from), valType(to)
+	sign := "_s"
+	if ir.IsUnsigned(from) || from == "bool" {
+		sign = "_u"
+	}
+	switch {
+	case to == "bool":
+		if ir.IsFloat(from) {
+			g.emit("%s.const 0", fv)
+			g.emit("%s.ne", fv)
+		} else {
+			g.emit("%s.eqz", fv)
+			g.emit("i32.eqz")
+		}
+		return
+	case ir.IsFloat(from) && ir.IsFloat(to):
+		if fv == "f32" && tv == "f64" {
+			g.emit("f64.promote_f32")
+		} else if fv == "f64" && tv == "f32" {
+			g.emit("f32.demote_f64")
+		}
+	case ir.IsFloat(from):
+		if ir.IsUnsigned(to) {
+			g.emit("%s.trunc_sat_%s_u", tv, fv)
+		} else {
+			g.emit("%s.trunc_sat_%s_s", tv, fv)
+		}
+	case ir.IsFloat(to):
+		g.emit("%s.convert_%s%s", tv, fv, sign)
+	case fv == "i64" && tv == "i32":
+		g.emit("i32.wrap_i64")
+	case fv == "i32" && tv == "i64":
+		g.emit("i64.extend_i32%s", sign)
+	}
+
+	g.narrow(to)
+}
+
+// Narrow integers keep the value range of their type.
+func (g *generator) narrow(t string) {
+	switch t {
+	case "i8":
+		g.emit("i32.extend8_s")
+	case "i16":
+		g.emit("i32.extend16_s")
+	case "u8", "byte":
+		g.emit("i32.const 255")
+		g.emit("i32.and")
+	case "u16":
+		g.emit("i32.const 65535")
+		g.emit("i32.and")
+	}
+}
+
+// Widen an integer on the stack to i64.
+func (g *generator) widen(t string) {
+	if valType(t) == "i32" {
+		if ir.IsUnsigned(t) {
+			g.emit("i64.extend_i32_u")
+		} else {
+			g.emit("i64.extend_i32_s")
+		}
+	}
+}
+
+// List items are stored in 64-bit slots.
+func (g *generator) toSlot(t string) {
+	switch valType(t) {
+	case "i32":
+		g.emit("i64.extend_i32_u")
+	case "f32":
+		g.emit("f64.promote_f32")
+		g.emit("i64.reinterpret_f64")
+	case "f64":
+		g.emit("i64.reinterpret_f64")
+	}
+}
+
+func (g *generator) fromSlot(t string) {
+	switch valType(t) {
+	case "i32":
+		g.emit("i32.wrap_i64")
+	case "f32":
+		g.emit("f64.reinterpret_i64")
+		g.emit("f32.demote_f64")
+	case "f64":
+		g.emit("f64.reinterpret_i64")
+	}
+}
+
+func (g *generator) builtin(in *ir.Instr) {
+	g.push(in.Args...)
+	switch in.Name {
+	case "stl.print", "stl.eprint":
+		g.emit("call $%s", in.Name[4:])
+	case "rune.toString":
+		g.emit("call $rune_to_string")
+	case "stl.println":
+		g.emit("call $print")
+		g.emit("i32.const %d", g.stringConstant("\n"))
+		g.emit("call $print")
+	case "stl.range", "stl.random":
+		g.emit("call $%s", in.Name[4:])
+	case "list.append":
+		g.toSlot(in.Args[1].Type())
+		g.emit("call $list_append")
+	case "list.length":
+		g.emit("i32.load")
+	case "string.at", "string.slice":
+		g.emit("i32.const %d", in.Line)
+		g.emit("call $%s", strings.Replace(in.Name, ".", "_", 1))
+	case "string.length", "string.find", "string.split", "string.join", "string.trim", "string.replace",
+		"string.toUpper", "string.toLower", "string.quote":
+		g.emit("call $%s", strings.Replace(in.Name, ".", "_", 1))
+	default:
+		abortMsg(in.Line, "The WebAssembly backend doesn't support "+in.Name)
+	}
+}
+
+////
+// Helpers.
+////
+
+// Push operands onto the stack.
+func (g *generator) push(values ...ir.Value) {
+	for _, v := range values {
+		switch v := v.(type) {
+		case *ir.Var:
+			g.emit("local.get $%s", v.Name)
+		case *ir.Const:
+			switch value := v.Value.(type) {
+			case int64:
+				g.emit("%s.const %d", valType(v.Typ), value)
+			case float64:
+				g.emit("%s.const %s", valType(v.Typ), floatConstant(value, valType(v.Typ)))
+			case string:
+				g.emit("i32.const %d", g.stringConstant(value))
+			case bool:
+				if value {
+					g.emit("i32.const 1")
+				} else {
+					g.emit("i32.const 0")
+				}
+			default:
+				g.emit("i32.const 0")
+			}
+		}
+	}
+}
+
+// Lay out a string literal in the data segment, returning its address.
+func (g *generator) stringConstant(value string) int {
+	if addr, ok := g.strings[value]; ok {
+		return addr
+	}
+	addr := g.dataEnd
+	g.strings[value] = addr
+	length := []byte{byte(len(value)), byte(len(value) >> 8), byte(len(value) >> 16), byte(len(value) >> 24)}
+	fmt.Fprintf(&g.data, "  (data (i32.const %d) %s)\n", addr, quote(string(length)+value))
+	g.dataEnd = (addr + 4 + len(value) + 3) &^ 3
+	return addr
+}
+
+func (g *generator) emit(format string, args ...interface{}) {
+	g.body.WriteString(strings.Repeat("  ", g.depth) + fmt.Sprintf(format, args...) + "\n")
+}
+
+// Structured control flow indents its body.
+func (g *generator) open(inst string) {
+	g.emit("%s", inst)
+	g.depth++
+}
+
+func (g *generator) reopen(inst string) {
+	g.depth--
+	g.emit("%s", inst)
+	g.depth++
+}
+
+func (g *generator) close() {
+	g.depth--
+	g.emit("end")
+}